@@ -0,0 +1,481 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/logging"
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// carriageControl is how the first character of each line of a printed file
+// is interpreted.
+type carriageControl int
+
+const (
+	ccAuto carriageControl = iota
+	ccNone
+	ccASA
+	ccMachine
+)
+
+func (c carriageControl) String() string {
+	switch c {
+	case ccNone:
+		return "none"
+	case ccASA:
+		return "asa"
+	case ccMachine:
+		return "machine"
+	}
+	return "auto"
+}
+
+func parseCarriageControl(s string) (carriageControl, error) {
+	switch strings.ToLower(s) {
+	case "", "auto":
+		return ccAuto, nil
+	case "none", "plain":
+		return ccNone, nil
+	case "asa":
+		return ccASA, nil
+	case "machine":
+		return ccMachine, nil
+	}
+	return ccAuto, fmt.Errorf("unknown carriage control `%s`; must be "+
+		"auto, none, asa or machine", s)
+}
+
+// ccExtensions are the file extensions that tell us the carriage control of
+// a file without looking at its contents. The FBA/VBA and FBM/VBM names
+// follow the MVS record formats of ASA and machine control datasets.
+var ccExtensions = map[string]carriageControl{
+	".txt": ccNone,
+	".asa": ccASA,
+	".fba": ccASA,
+	".vba": ccASA,
+	".mcc": ccMachine,
+	".fbm": ccMachine,
+	".vbm": ccMachine,
+}
+
+// sniffLen is how much of a file we look at to guess its carriage control.
+const sniffLen = 8192
+
+// detectCarriageControl guesses the carriage control of a file from its
+// extension or, failing that, from the first bytes of its contents.
+func detectCarriageControl(filename string, data []byte) carriageControl {
+	if cc, ok := ccExtensions[strings.ToLower(filepath.Ext(filename))]; ok {
+		return cc
+	}
+
+	lines := bytes.Split(data, []byte{'\n'})
+	if len(lines) > 1 {
+		// The last line is either empty or may have been cut off.
+		lines = lines[:len(lines)-1]
+	}
+
+	// A file is only machine or ASA controlled if every line starts with a
+	// control code. Since a space (ASA) and a tab (machine "write, space 1")
+	// are common at the start of ordinary text, we also require at least one
+	// line with a more distinctive code: a skip to a channel for ASA. Digits
+	// are common at the start of text too, so an ASA file must also have
+	// lines that are simply single spaced.
+	machine, machineSeen := true, false
+	asa, asaSeen, asaSpace := true, false, false
+	n := 0
+	for _, line := range lines {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(line) == 0 {
+			continue
+		}
+		n++
+		if !scanner.IsMachineControl(line[0]) {
+			machine = false
+		} else if line[0] != '\t' {
+			machineSeen = true
+		}
+		switch {
+		case !scanner.IsASAControl(line[0]):
+			asa = false
+		case line[0] == ' ':
+			asaSpace = true
+		case line[0] != '0' && line[0] != '-' && line[0] != '+':
+			asaSeen = true
+		}
+	}
+
+	switch {
+	case n > 0 && machine && machineSeen:
+		return ccMachine
+	case n > 0 && asa && asaSeen && asaSpace:
+		return ccASA
+	}
+	return ccNone
+}
+
+// jobNameRegex matches the characters that aren't allowed in job info.
+var jobNameRegex = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// jobNameForFile makes job info from a filename. The job name character set
+// is pretty restricted, so we change any non-allowed character to _ and
+// limit it to 25 characters.
+func jobNameForFile(filename string) string {
+	jobname := jobNameRegex.ReplaceAllString(filepath.Base(filename), "_")
+	if len(jobname) > 25 {
+		jobname = jobname[:25]
+	}
+	return jobname
+}
+
+// expandPrintFiles turns the -printfile arguments, each of which is a file,
+// a glob pattern or a directory, into the list of files to print.
+// Directories are searched recursively, skipping hidden files and
+// directories. "-" is stdin.
+func expandPrintFiles(args []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			seen[path] = true
+			files = append(files, path)
+		}
+	}
+
+	for _, arg := range args {
+		if arg == "-" {
+			add(arg)
+			continue
+		}
+
+		paths := []string{arg}
+		if strings.ContainsAny(arg, "*?[") {
+			matches, err := filepath.Glob(arg)
+			if err != nil {
+				return nil, fmt.Errorf("bad pattern `%s`: %v", arg, err)
+			}
+			if len(matches) == 0 {
+				return nil, fmt.Errorf("no files match `%s`", arg)
+			}
+			paths = matches
+		}
+
+		for _, path := range paths {
+			info, err := os.Stat(path)
+			if err != nil {
+				return nil, err
+			}
+			if !info.IsDir() {
+				add(path)
+				continue
+			}
+			err = filepath.WalkDir(path, func(p string, d fs.DirEntry,
+				err error) error {
+
+				if err != nil {
+					return err
+				}
+				if p != path && strings.HasPrefix(d.Name(), ".") {
+					if d.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if d.Type().IsRegular() {
+					add(p)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return files, nil
+}
+
+// printedFile is what we remember about a file that we have printed, so we
+// can skip it if it hasn't changed.
+type printedFile struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	Printed time.Time `json:"printed"`
+}
+
+// batchState is the -statefile, which records the files that were
+// successfully printed by earlier runs.
+type batchState struct {
+	path  string
+	Files map[string]printedFile `json:"files"`
+}
+
+func loadBatchState(path string) (*batchState, error) {
+	s := &batchState{path: path, Files: make(map[string]printedFile)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, fmt.Errorf("couldn't read state file `%s`: %v", path,
+			err)
+	}
+	if s.Files == nil {
+		s.Files = make(map[string]printedFile)
+	}
+	return s, nil
+}
+
+// unchanged returns true if the file at path has the same contents as when
+// we last printed it. If only the modification time changed, we compare the
+// file's hash.
+func (s *batchState) unchanged(path string, info fs.FileInfo) bool {
+	prev, ok := s.Files[path]
+	if !ok || prev.Size != info.Size() {
+		return false
+	}
+	if prev.ModTime.Equal(info.ModTime()) {
+		return true
+	}
+	sum, err := hashFile(path)
+	return err == nil && sum == prev.SHA256
+}
+
+// record remembers that the file at path was printed, and saves the state
+// file so that the progress isn't lost if the agent is interrupted.
+func (s *batchState) record(path string, info fs.FileInfo,
+	sum string) error {
+
+	s.Files[path] = printedFile{
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		SHA256:  sum,
+		Printed: time.Now(),
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// sameFile returns true if paths a and b name the same existing file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ai, bi)
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileReaderInput is the input name used for the status of -printfile jobs.
+const fileReaderInput = "fileReader"
+
+// fileResult is the outcome of printing one file in a batch.
+type fileResult int
+
+const (
+	filePrinted fileResult = iota
+	fileSkipped
+	filePrintFailed
+)
+
+// runFilePrinter prints local files, or stdin, to an output. Each file is a
+// separate job with the filename as its job info. If stateFile isn't empty,
+// files that were printed by an earlier run and haven't changed since are
+// skipped. It returns the number of files that couldn't be printed.
+func runFilePrinter(output OutputConfig, outputName string, args []string,
+	cc carriageControl, stateFile string) int {
+
+	files, err := expandPrintFiles(args)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	var state *batchState
+	if stateFile != "" {
+		if state, err = loadBatchState(stateFile); err != nil {
+			logger.Errorf("%v", err)
+			return 1
+		}
+	}
+
+	handler, err := newOutputHandler(fileReaderInput, outputName, output)
+	if err != nil {
+		logger.Errorf("%v", err)
+		return 1
+	}
+
+	failures, skipped := 0, 0
+	for _, file := range files {
+		if state != nil && sameFile(file, stateFile) {
+			// Don't print our own state file if it's in a printed directory.
+			continue
+		}
+		switch printOneFile(file, handler, cc, state) {
+		case fileSkipped:
+			skipped++
+		case filePrintFailed:
+			failures++
+		}
+	}
+	if len(files) > 1 {
+		logger.Infof("printed %d files, skipped %d unchanged, %d failed",
+			len(files)-skipped-failures, skipped, failures)
+	}
+	return failures
+}
+
+// jobDiscarder is implemented by output handlers that can throw away a
+// partly received job.
+type jobDiscarder interface {
+	discardJob()
+}
+
+// printOneFile prints one file as a job.
+func printOneFile(filename string, handler scanner.PrinterHandler,
+	cc carriageControl, state *batchState) fileResult {
+
+	log := logger.With("file", filename)
+
+	var r io.Reader
+	var info fs.FileInfo
+	var path string
+	var h hash.Hash
+	jobname := "stdin"
+	if filename == "-" {
+		r = os.Stdin
+	} else {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Errorf("Couldn't open file: %v", err)
+			return filePrintFailed
+		}
+		defer f.Close()
+		if info, err = f.Stat(); err != nil {
+			log.Errorf("Couldn't open file: %v", err)
+			return filePrintFailed
+		}
+		if path, err = filepath.Abs(filename); err != nil {
+			path = filename
+		}
+		if state != nil && state.unchanged(path, info) {
+			log.Infof("skipping unchanged file")
+			return fileSkipped
+		}
+
+		// We hash the file as we print it, for the state file.
+		h = sha256.New()
+		r = io.TeeReader(f, h)
+		jobname = jobNameForFile(filename)
+	}
+
+	log = log.With("job", jobname)
+	failedBefore := failedJobCount(fileReaderInput)
+	if err := scanFile(r, filename, jobname, cc, handler, log); err != nil {
+		log.Errorf("couldn't read file: %v", err)
+		return filePrintFailed
+	}
+	if failedJobCount(fileReaderInput) != failedBefore {
+		// The output handler has already logged why.
+		return filePrintFailed
+	}
+
+	if state != nil && info != nil {
+		sum := hex.EncodeToString(h.Sum(nil))
+		if err := state.record(path, info, sum); err != nil {
+			log.Errorf("couldn't save state file: %v", err)
+		}
+	}
+	return filePrinted
+}
+
+// scanFile prints the contents of r, read from filename, as one job. If cc
+// is ccAuto, the carriage control is detected from the filename and
+// contents. If reading fails, the part of the job we read is thrown away so
+// it doesn't end up at the start of the next file's job.
+func scanFile(r io.Reader, filename, jobname string, cc carriageControl,
+	handler scanner.PrinterHandler, log *logging.Logger) error {
+
+	err := scanFileJob(r, filename, jobname, cc, handler, log)
+	if d, ok := handler.(jobDiscarder); ok && err != nil {
+		d.discardJob()
+	}
+	return err
+}
+
+func scanFileJob(r io.Reader, filename, jobname string, cc carriageControl,
+	handler scanner.PrinterHandler, log *logging.Logger) error {
+
+	b := bufio.NewReaderSize(r, sniffLen)
+	if cc == ccAuto {
+		data, _ := b.Peek(sniffLen)
+		cc = detectCarriageControl(filename, data)
+	}
+	log.Infof("printing file with %s carriage control", cc)
+
+	switch cc {
+	case ccASA:
+		return scanner.ScanASAUTF8Single(b, jobname, handler)
+	case ccMachine:
+		return scanner.ScanMachineUTF8Single(b, jobname, handler)
+	}
+	return scanner.ScanUTF8SingleWithLogTag(b, jobname, handler, filename)
+}
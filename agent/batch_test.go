@@ -0,0 +1,130 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestDetectCarriageControl(t *testing.T) {
+	tests := []struct {
+		filename string
+		data     string
+		want     carriageControl
+	}{
+		{"listing.txt", "1HELLO\n line\n", ccNone},
+		{"LISTING.FBA", "hello\n", ccASA},
+		{"out.vbm", "hello\n", ccMachine},
+		{"listing", "1PAGE ONE\n line\n0line\n1PAGE TWO\n+over", ccASA},
+		{"listing", "\x09line\r\n\x89eject\r\n\x09next\r\n", ccMachine},
+		{"listing", " HEADING\n line\n2TOTALS\n line\n", ccASA},
+		{"listing", "CA\nB\n", ccNone},
+		{"code.c", "\tint x;\n\tint y;\n", ccNone},
+		{"notes", " indented\n - bullet\n", ccNone},
+		{"notes", "1. first\n2. second\n", ccNone},
+		{"empty", "", ccNone},
+	}
+
+	for _, test := range tests {
+		got := detectCarriageControl(test.filename, []byte(test.data))
+		if got != test.want {
+			t.Errorf("%s %q: got %s, want %s", test.filename, test.data,
+				got, test.want)
+		}
+	}
+}
+
+func TestJobNameForFile(t *testing.T) {
+	got := jobNameForFile("listings/IBMUSER.JOB00123 (1).lst")
+	if want := "IBMUSER_JOB00123__1__lst"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	got = jobNameForFile("a-very-long-listing-file-name.txt")
+	if want := "a_very_long_listing_file_"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestExpandPrintFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.lst", "sub/c.txt",
+		".hidden/d.txt", ".e.txt"} {
+
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("x\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := expandPrintFiles([]string{
+		filepath.Join(dir, "*.txt"),
+		dir,
+		"-",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join(dir, ".e.txt"),
+		filepath.Join(dir, "a.txt"),
+		filepath.Join(dir, "b.lst"),
+		filepath.Join(dir, "sub/c.txt"),
+		"-",
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %v, want %v", files, want)
+	}
+
+	if _, err := expandPrintFiles([]string{
+		filepath.Join(dir, "*.pdf")}); err == nil {
+
+		t.Errorf("expected an error for a pattern with no matches")
+	}
+}
+
+func TestScanFileFailure(t *testing.T) {
+	handler, err := newOutputHandler(fileReaderInput, "pdf",
+		OutputConfig{Mode: "local", OutputDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	printer := handler.(*pdfOutputHandler).printer
+	r := io.MultiReader(strings.NewReader("HELLO\nWORLD\n"),
+		iotest.ErrReader(errors.New("disk on fire")))
+	if err := scanFile(r, "hello.txt", "hello", ccAuto, handler,
+		logger); err == nil {
+
+		t.Fatal("expected an error from a failed read")
+	}
+
+	if handler.(*pdfOutputHandler).printer == printer {
+		t.Errorf("the failed file was left in the job")
+	}
+}
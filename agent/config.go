@@ -21,28 +21,53 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
 	"os"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/racingmars/virtual1403/vprinter"
 )
 
 type OutputConfig struct {
-	Mode           string `yaml:"mode"`
-	ServiceAddress string `yaml:"service_address"`
-	APIKey         string `yaml:"access_key"`
-	OutputDir      string `yaml:"output_directory"`
-	FontFile       string `yaml:"font_file"`
-	Profile        string `yaml:"profile"`
+	Mode           string                 `yaml:"mode"`
+	ServiceAddress string                 `yaml:"service_address"`
+	APIKey         string                 `yaml:"access_key"`
+	Protocol       int                    `yaml:"protocol"`
+	DownloadDir    string                 `yaml:"download_directory"`
+	OutputDir      string                 `yaml:"output_directory"`
+	FontFile       string                 `yaml:"font_file"`
+	Profile        string                 `yaml:"profile"`
+	ProfileRules   []vprinter.ProfileRule `yaml:"profile_rules"`
+	SeparatorPages string                 `yaml:"separator_pages"`
+	Hooks          []HookConfig           `yaml:"hooks"`
 	font           []byte
 }
 
 type InputConfig struct {
-	HerculesAddress string `yaml:"hercules_address"`
-	Output          string `yaml:"output"`
+	InputType        string   `yaml:"input_type"`
+	HerculesAddress  string   `yaml:"hercules_address"`
+	ListenAddress    string   `yaml:"listen_address"`
+	Network          string   `yaml:"network"`
+	AllowedAddresses []string `yaml:"allowed_addresses"`
+	InputFile        string   `yaml:"input_file"`
+	WatchDirectory   string   `yaml:"watch_directory"`
+	StableSeconds    int      `yaml:"stable_seconds"`
+	CarriageControl  string   `yaml:"carriage_control"`
+	Output           string   `yaml:"output"`
+}
+
+// AgentConfig holds the settings for the agent as a whole rather than a
+// particular input or output.
+type AgentConfig struct {
+	// StatusAddress is the host:port for the optional status and metrics
+	// HTTP server. If empty, the server isn't started.
+	StatusAddress string `yaml:"status_address"`
 }
 
 type Configuration struct {
+	AgentConfig  `yaml:",inline"`
 	InputConfig  `yaml:",inline"`
 	OutputConfig `yaml:",inline"`
 	Inputs       []struct {
@@ -56,18 +81,18 @@ type Configuration struct {
 }
 
 func loadConfig(path string) (map[string]InputConfig, map[string]OutputConfig,
-	error) {
+	AgentConfig, error) {
 
 	var c Configuration
 	f, err := os.Open(path)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, AgentConfig{}, err
 	}
 	defer f.Close()
 
 	decoder := yaml.NewDecoder(f)
 	if err := decoder.Decode(&c); err != nil {
-		return nil, nil, err
+		return nil, nil, AgentConfig{}, err
 	}
 
 	inputs := make(map[string]InputConfig)
@@ -75,7 +100,7 @@ func loadConfig(path string) (map[string]InputConfig, map[string]OutputConfig,
 	inputs["default"] = c.InputConfig
 	for _, i := range c.Inputs {
 		if strings.TrimSpace(i.Name) == "" {
-			return nil, nil, errors.New(
+			return nil, nil, AgentConfig{}, errors.New(
 				"all inputs require a value in the \"name\" field")
 		}
 		inputs[i.Name] = i.InputConfig
@@ -85,13 +110,45 @@ func loadConfig(path string) (map[string]InputConfig, map[string]OutputConfig,
 	outputs["default"] = c.OutputConfig
 	for _, o := range c.Outputs {
 		if strings.TrimSpace(o.Name) == "" {
-			return nil, nil, errors.New(
+			return nil, nil, AgentConfig{}, errors.New(
 				"all outputs require a value in the \"name\" field")
 		}
 		outputs[o.Name] = o.OutputConfig
 	}
 
-	return inputs, outputs, nil
+	return inputs, outputs, c.AgentConfig, nil
+}
+
+// readConfig loads, validates, and prepares the outputs of the
+// configuration in path. Individual validation errors are logged.
+func readConfig(path string) (map[string]InputConfig,
+	map[string]OutputConfig, AgentConfig, error) {
+
+	inputs, outputs, agent, err := loadConfig(path)
+	if err != nil {
+		return nil, nil, agent, fmt.Errorf("unable to read config `%s`: %v",
+			path, err)
+	}
+
+	errs := validateConfig(inputs, outputs)
+	if agent.StatusAddress != "" {
+		if _, _, err := net.SplitHostPort(agent.StatusAddress); err != nil {
+			errs = append(errs, fmt.Errorf("'status_address' must be a "+
+				"host:port address: %v", err))
+		}
+	}
+	if errs != nil {
+		for _, err := range errs {
+			logger.Errorf("%s", err.Error())
+		}
+		return nil, nil, agent, errors.New("invalid configuration")
+	}
+
+	if err := setupOutputs(outputs); err != nil {
+		return nil, nil, agent, err
+	}
+
+	return inputs, outputs, agent, nil
 }
 
 func validateConfig(inputs map[string]InputConfig,
@@ -100,11 +157,74 @@ func validateConfig(inputs map[string]InputConfig,
 	var errs []error
 
 	for name, config := range inputs {
-		if config.HerculesAddress == "" {
+		switch config.InputType {
+		case "", "connect":
+			if config.HerculesAddress == "" {
+				errs = append(errs,
+					fmt.Errorf(
+						"input [%s] must set 'hercules_address'",
+						name))
+			}
+			if !(config.Network == "" || config.Network == "tcp" ||
+				config.Network == "unix") {
+				errs = append(errs,
+					fmt.Errorf("input [%s] 'network' must be either 'tcp' "+
+						"or 'unix'", name))
+			}
+		case "listen":
+			if config.ListenAddress == "" {
+				errs = append(errs,
+					fmt.Errorf(
+						"input [%s] must set 'listen_address'",
+						name))
+			}
+			if !(config.Network == "" || config.Network == "tcp" ||
+				config.Network == "unix") {
+				errs = append(errs,
+					fmt.Errorf("input [%s] 'network' must be either 'tcp' "+
+						"or 'unix'", name))
+			}
+			if config.Network == "unix" && len(config.AllowedAddresses) > 0 {
+				errs = append(errs,
+					fmt.Errorf("input [%s] 'allowed_addresses' may not be "+
+						"used with a unix socket", name))
+			}
+			if _, err := parseAllowList(config.AllowedAddresses); err != nil {
+				errs = append(errs,
+					fmt.Errorf("input [%s] 'allowed_addresses': %v", name,
+						err))
+			}
+		case "fifo", "follow":
+			if config.InputFile == "" {
+				errs = append(errs,
+					fmt.Errorf(
+						"input [%s] must set 'input_file'",
+						name))
+			}
+		case "watch":
+			if config.WatchDirectory == "" {
+				errs = append(errs,
+					fmt.Errorf(
+						"input [%s] must set 'watch_directory'",
+						name))
+			}
+			if config.StableSeconds < 0 {
+				errs = append(errs,
+					fmt.Errorf(
+						"input [%s] 'stable_seconds' may not be negative",
+						name))
+			}
+			if _, err := parseCarriageControl(
+				config.CarriageControl); err != nil {
+				errs = append(errs,
+					fmt.Errorf("input [%s] 'carriage_control': %v", name,
+						err))
+			}
+		default:
 			errs = append(errs,
 				fmt.Errorf(
-					"input [%s] must set 'hercules_address'",
-					name))
+					"input [%s] 'input_type' must be one of 'connect', "+
+						"'listen', 'fifo', 'follow', or 'watch'", name))
 		}
 
 		if config.Output == "" {
@@ -122,15 +242,36 @@ func validateConfig(inputs map[string]InputConfig,
 		}
 
 		// Don't allow multiple inputs to connect to the same Hercules socket
-		// device.
+		// device, to listen on the same address, or to read the same file.
 		for othername, otherconfig := range inputs {
-			if othername != name &&
+			if othername != name && config.HerculesAddress != "" &&
 				otherconfig.HerculesAddress == config.HerculesAddress {
 				errs = append(errs,
 					fmt.Errorf("input [%s] and input [%s] have the same "+
 						"'hercules_address'; this is not allowed",
 						name, othername))
 			}
+			if othername != name && config.ListenAddress != "" &&
+				otherconfig.ListenAddress == config.ListenAddress {
+				errs = append(errs,
+					fmt.Errorf("input [%s] and input [%s] have the same "+
+						"'listen_address'; this is not allowed",
+						name, othername))
+			}
+			if othername != name && config.InputFile != "" &&
+				otherconfig.InputFile == config.InputFile {
+				errs = append(errs,
+					fmt.Errorf("input [%s] and input [%s] have the same "+
+						"'input_file'; this is not allowed",
+						name, othername))
+			}
+			if othername != name && config.WatchDirectory != "" &&
+				otherconfig.WatchDirectory == config.WatchDirectory {
+				errs = append(errs,
+					fmt.Errorf("input [%s] and input [%s] have the same "+
+						"'watch_directory'; this is not allowed",
+						name, othername))
+			}
 		}
 	}
 
@@ -148,6 +289,11 @@ func validateConfig(inputs map[string]InputConfig,
 					fmt.Errorf("output [%s] must set 'output_directory'",
 						name))
 			}
+			if config.DownloadDir != "" {
+				errs = append(errs,
+					fmt.Errorf("output [%s] 'download_directory' is only "+
+						"for online outputs", name))
+			}
 		}
 
 		if config.Mode == "online" {
@@ -159,7 +305,35 @@ func validateConfig(inputs map[string]InputConfig,
 				errs = append(errs,
 					fmt.Errorf("output [%s] must set 'api_key'", name))
 			}
+			if config.Protocol < 0 || config.Protocol > protocolVersion {
+				errs = append(errs,
+					fmt.Errorf("output [%s] 'protocol' must be 1 or %d",
+						name, protocolVersion))
+			}
 		}
+
+		for i, rule := range config.ProfileRules {
+			if err := rule.Validate(); err != nil {
+				errs = append(errs,
+					fmt.Errorf("output [%s] profile_rules entry %d: %v",
+						name, i+1, err))
+			}
+		}
+
+		mode, err := vprinter.ParseSeparatorMode(config.SeparatorPages)
+		if err != nil {
+			errs = append(errs,
+				fmt.Errorf("output [%s] 'separator_pages' must be one of "+
+					"keep, drop, header, trailer or banner", name))
+		}
+		if mode == vprinter.SeparatorBanner && config.Mode == "online" {
+			errs = append(errs,
+				fmt.Errorf("output [%s] 'separator_pages' can't be banner "+
+					"for online outputs; choose banner separator pages in "+
+					"your print service account settings instead", name))
+		}
+
+		errs = append(errs, validateHooks(name, config.Hooks)...)
 	}
 
 	return errs
@@ -0,0 +1,227 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// defaultHookTimeout is used for hooks that don't configure a timeout.
+const defaultHookTimeout = 30
+
+// HookConfig is one action to run after an output has finished a job.
+// Exactly one of Command or Webhook must be set.
+type HookConfig struct {
+	// Command is the program and its arguments. The arguments may refer to
+	// the V1403_* job environment variables, e.g. "$V1403_PDF".
+	Command []string `yaml:"command"`
+
+	// Webhook is a URL to which we will POST the job metadata as JSON.
+	Webhook string `yaml:"webhook"`
+
+	// Timeout is the number of seconds the hook is allowed to run.
+	Timeout int `yaml:"timeout"`
+}
+
+// jobResult is the metadata about a completed job that we provide to hooks.
+type jobResult struct {
+	Input     string          `json:"input"`
+	Output    string          `json:"output"`
+	Mode      string          `json:"mode"`
+	Profile   string          `json:"profile"`
+	JobInfo   string          `json:"job_info"`
+	Job       scanner.JobInfo `json:"job"`
+	Pages     int             `json:"pages"`
+	PDFFile   string          `json:"pdf_file,omitempty"`
+	Truncated bool            `json:"truncated"`
+	Time      time.Time       `json:"time"`
+}
+
+// env returns the job metadata as the environment variables we provide to
+// command hooks.
+func (r jobResult) env() map[string]string {
+	truncated := "0"
+	if r.Truncated {
+		truncated = "1"
+	}
+	return map[string]string{
+		"V1403_INPUT":     r.Input,
+		"V1403_OUTPUT":    r.Output,
+		"V1403_MODE":      r.Mode,
+		"V1403_PROFILE":   r.Profile,
+		"V1403_JOBINFO":   r.JobInfo,
+		"V1403_JOBNAME":   r.Job.Name,
+		"V1403_JOBNUMBER": r.Job.Number,
+		"V1403_CLASS":     r.Job.Class,
+		"V1403_USER":      r.Job.User,
+		"V1403_PAGES":     strconv.Itoa(r.Pages),
+		"V1403_PDF":       r.PDFFile,
+		"V1403_TRUNCATED": truncated,
+		"V1403_TIME":      r.Time.UTC().Format(time.RFC3339),
+	}
+}
+
+// pendingHooks tracks the hooks that are currently running in the
+// background.
+var pendingHooks sync.WaitGroup
+
+// runHooks starts the hooks for a completed job in the background. The hooks
+// for one job run in the order they are configured; a failing hook is logged
+// and does not prevent the following hooks from running.
+func runHooks(hooks []HookConfig, result jobResult) {
+	if len(hooks) == 0 {
+		return
+	}
+
+	log := logger.With("input", result.Input, "output", result.Output)
+	pendingHooks.Add(1)
+	go func() {
+		defer pendingHooks.Done()
+		for i, hook := range hooks {
+			var err error
+			if len(hook.Command) > 0 {
+				err = runCommandHook(hook, result)
+			} else {
+				err = runWebhook(hook, result)
+			}
+			if err != nil {
+				log.Errorf("hook %d failed: %v", i+1, err)
+				continue
+			}
+			log.Infof("hook %d completed", i+1)
+		}
+	}()
+}
+
+func hookTimeout(hook HookConfig) time.Duration {
+	if hook.Timeout <= 0 {
+		return defaultHookTimeout * time.Second
+	}
+	return time.Duration(hook.Timeout) * time.Second
+}
+
+// runCommandHook runs an external command with the job metadata in its
+// environment. Output from the command is only logged if it fails.
+func runCommandHook(hook HookConfig, result jobResult) error {
+	ctx, cancel := context.WithTimeout(context.Background(),
+		hookTimeout(hook))
+	defer cancel()
+
+	vars := result.env()
+	expand := func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return os.Getenv(name)
+	}
+	args := make([]string, len(hook.Command))
+	for i := range hook.Command {
+		args[i] = os.Expand(hook.Command[i], expand)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = os.Environ()
+	for k, v := range vars {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("command `%s` timed out after %s", args[0],
+			hookTimeout(hook))
+	}
+	if err != nil {
+		return fmt.Errorf("command `%s`: %v: %s", args[0], err,
+			strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// runWebhook POSTs the job metadata as JSON to the hook's URL. Any non-2xx
+// response is an error.
+func runWebhook(hook HookConfig, result jobResult) error {
+	body, err := json.Marshal(&result)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		hookTimeout(hook))
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.Webhook,
+		bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Drain a little of the body so the keep-alive connection can be reused
+	// when able, without reading whatever an endpoint cares to send.
+	defer io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook `%s` response status: %s", hook.Webhook,
+			resp.Status)
+	}
+	return nil
+}
+
+// validateHooks checks the hook configuration for output name.
+func validateHooks(name string, hooks []HookConfig) []error {
+	var errs []error
+	for i, hook := range hooks {
+		if len(hook.Command) > 0 && hook.Webhook != "" {
+			errs = append(errs, fmt.Errorf("output [%s] hook %d must set "+
+				"only one of 'command' or 'webhook'", name, i+1))
+		}
+		if len(hook.Command) == 0 && hook.Webhook == "" {
+			errs = append(errs, fmt.Errorf("output [%s] hook %d must set "+
+				"'command' or 'webhook'", name, i+1))
+		}
+		if hook.Webhook != "" && !(strings.HasPrefix(hook.Webhook,
+			"http://") || strings.HasPrefix(hook.Webhook, "https://")) {
+			errs = append(errs, fmt.Errorf("output [%s] hook %d 'webhook' "+
+				"must be an http:// or https:// URL", name, i+1))
+		}
+		if hook.Timeout < 0 {
+			errs = append(errs, fmt.Errorf("output [%s] hook %d 'timeout' "+
+				"may not be negative", name, i+1))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,178 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+var testResult = jobResult{
+	Input:   "default",
+	Output:  "local",
+	Mode:    "local",
+	Profile: "default-green",
+	JobInfo: "J17_IBMUSERA",
+	Pages:   3,
+	PDFFile: "pdfs/v1403-J17_IBMUSERA-20220101T010203.pdf",
+	Time:    time.Date(2022, 1, 1, 1, 2, 3, 0, time.UTC),
+}
+
+func TestWebhook(t *testing.T) {
+	var got jobResult
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				t.Errorf("webhook used method %s", r.Method)
+			}
+			if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+				t.Errorf("couldn't decode webhook body: %v", err)
+			}
+		}))
+	defer srv.Close()
+
+	if err := runWebhook(HookConfig{Webhook: srv.URL}, testResult); err != nil {
+		t.Fatalf("webhook failed: %v", err)
+	}
+	if got != testResult {
+		t.Errorf("webhook got %+v, expected %+v", got, testResult)
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "paper jam", http.StatusInternalServerError)
+		}))
+	defer srv.Close()
+
+	if err := runWebhook(HookConfig{Webhook: srv.URL}, testResult); err == nil {
+		t.Error("webhook with 500 response did not fail")
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan bool)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+		}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	err := runWebhook(HookConfig{Webhook: srv.URL, Timeout: 1}, testResult)
+	if err == nil {
+		t.Error("slow webhook did not time out")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("webhook timeout was not enforced")
+	}
+}
+
+// TestHelperProcess isn't a real test; it's the command run by
+// TestCommandHook. It checks that it received the job metadata.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("V1403_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	if os.Getenv("V1403_HELPER_SLEEP") == "1" {
+		time.Sleep(time.Minute)
+	}
+	if os.Getenv("V1403_JOBINFO") != testResult.JobInfo ||
+		os.Getenv("V1403_PAGES") != "3" ||
+		os.Args[len(os.Args)-1] != testResult.PDFFile {
+		fmt.Println("missing job metadata")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestCommandHook(t *testing.T) {
+	os.Setenv("V1403_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("V1403_WANT_HELPER_PROCESS")
+
+	hook := HookConfig{Command: []string{os.Args[0],
+		"-test.run=TestHelperProcess", "--", "$V1403_PDF"}}
+	if err := runCommandHook(hook, testResult); err != nil {
+		t.Errorf("command hook failed: %v", err)
+	}
+
+	badResult := testResult
+	badResult.JobInfo = "wrong"
+	if err := runCommandHook(hook, badResult); err == nil {
+		t.Error("failing command hook did not return an error")
+	}
+}
+
+func TestCommandHookTimeout(t *testing.T) {
+	os.Setenv("V1403_WANT_HELPER_PROCESS", "1")
+	os.Setenv("V1403_HELPER_SLEEP", "1")
+	defer os.Unsetenv("V1403_WANT_HELPER_PROCESS")
+	defer os.Unsetenv("V1403_HELPER_SLEEP")
+
+	hook := HookConfig{Command: []string{os.Args[0],
+		"-test.run=TestHelperProcess", "--", "$V1403_PDF"}, Timeout: 1}
+	start := time.Now()
+	if err := runCommandHook(hook, testResult); err == nil {
+		t.Error("slow command hook did not time out")
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("command hook timeout was not enforced")
+	}
+}
+
+func TestRunHooks(t *testing.T) {
+	os.Setenv("V1403_WANT_HELPER_PROCESS", "1")
+	defer os.Unsetenv("V1403_WANT_HELPER_PROCESS")
+
+	calls := make(chan jobResult, 2)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var got jobResult
+			json.NewDecoder(r.Body).Decode(&got)
+			calls <- got
+		}))
+	defer srv.Close()
+
+	// A failing hook doesn't stop the ones after it.
+	runHooks([]HookConfig{
+		{Command: []string{os.Args[0], "-test.run=TestHelperProcess",
+			"--", "$V1403_PDF"}},
+		{Webhook: srv.URL + "/first"},
+		{Command: []string{os.Args[0], "-test.run=TestHelperProcess",
+			"--", "wrong-pdf"}},
+		{Webhook: srv.URL + "/second"},
+	}, testResult)
+	pendingHooks.Wait()
+
+	if len(calls) != 2 {
+		t.Fatalf("got %d webhook calls, expected 2", len(calls))
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-calls; got != testResult {
+			t.Errorf("webhook got %+v, expected %+v", got, testResult)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// followPollInterval is how often we check a followed file for new data. It
+// needs to be comfortably shorter than the scanner's end-of-job timeout.
+const followPollInterval = 100 * time.Millisecond
+
+// handleFIFO reads printer output from a named pipe, such as one that
+// Hercules is configured to write the printer output to. Opening the pipe
+// waits for Hercules to open the other end, and we return when Hercules
+// closes it. If ctx is cancelled while we're waiting for Hercules to open
+// the pipe, the open can't be interrupted; the wait is abandoned and any
+// later data is ignored.
+func handleFIFO(ctx context.Context, path string,
+	handler scanner.PrinterHandler, inputName string) {
+
+	log := logger.With("input", inputName)
+	log.Infof("Waiting for Hercules to open %s...", path)
+	setState(inputName, stateWaiting)
+	type openResult struct {
+		f   *os.File
+		err error
+	}
+	opened := make(chan openResult, 1)
+	go func() {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		opened <- openResult{f, err}
+	}()
+
+	var f *os.File
+	select {
+	case <-ctx.Done():
+		go func() {
+			if result := <-opened; result.f != nil {
+				result.f.Close()
+			}
+		}()
+		return
+	case result := <-opened:
+		if result.err != nil {
+			log.Errorf("Couldn't open named pipe: %v", result.err)
+			setState(inputName, stateDisconnected)
+			setError(inputName, result.err)
+			return
+		}
+		f = result.f
+	}
+	defer f.Close()
+	log.Infof("Named pipe opened.")
+	setState(inputName, stateConnected)
+	defer setState(inputName, stateDisconnected)
+
+	// On most platforms, pipes support read deadlines directly. If not,
+	// we'll emulate them.
+	var in scanner.Input = f
+	if err := f.SetReadDeadline(time.Time{}); err != nil {
+		in = scanner.NewDeadlineReader(f)
+	}
+
+	err := scanner.ScanContext(ctx, newCountingInput(in, inputName), handler,
+		inputName)
+	if ctx.Err() != nil {
+		return
+	}
+	if err == io.EOF {
+		log.Warnf("Hercules closed the named pipe.")
+		return
+	}
+	if err != nil {
+		log.Errorf("error reading from named pipe: %s", err)
+		setError(inputName, err)
+		return
+	}
+}
+
+// handleFollow reads printer output that Hercules appends to a file, like
+// "tail -f". We start at the current end of the file so we don't re-print
+// old output.
+func handleFollow(ctx context.Context, path string,
+	handler scanner.PrinterHandler, inputName string) {
+
+	log := logger.With("input", inputName)
+	r, err := openFollowReader(path)
+	if err != nil {
+		log.Errorf("Couldn't open file to follow: %v", err)
+		setState(inputName, stateDisconnected)
+		setError(inputName, err)
+		return
+	}
+	defer r.Close()
+	log.Infof("Following printer output in %s", path)
+	setState(inputName, stateConnected)
+	defer setState(inputName, stateDisconnected)
+
+	err = scanner.ScanContext(ctx, newCountingInput(r, inputName), handler,
+		inputName)
+	if err != nil && ctx.Err() == nil {
+		log.Errorf("error reading from %s: %s", path, err)
+		setError(inputName, err)
+	}
+}
+
+// followReader is a scanner.Input that reads a file which is still being
+// written to. At the end of the file, reads wait for more data to be
+// written instead of returning io.EOF. If the file is truncated we start
+// again from the beginning, and if it is replaced by a new file (e.g. log
+// rotation) we switch to reading the new file.
+type followReader struct {
+	path     string
+	f        *os.File
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func openFollowReader(path string) (*followReader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &followReader{path: path, f: f}, nil
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 {
+			return n, nil
+		}
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+
+		// We're at the end of the file; wait for more data.
+		if err := r.checkReplaced(); err != nil {
+			return 0, err
+		}
+		r.mu.Lock()
+		deadline := r.deadline
+		r.mu.Unlock()
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		time.Sleep(followPollInterval)
+	}
+}
+
+// checkReplaced handles the followed file being truncated or replaced.
+func (r *followReader) checkReplaced() error {
+	pathStat, err := os.Stat(r.path)
+	if os.IsNotExist(err) {
+		// File was moved away and the new one hasn't been created yet.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	curStat, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	if !os.SameFile(pathStat, curStat) {
+		f, err := os.Open(r.path)
+		if err != nil {
+			return err
+		}
+		r.f.Close()
+		r.f = f
+		return nil
+	}
+
+	pos, err := r.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if curStat.Size() < pos {
+		_, err = r.f.Seek(0, io.SeekStart)
+		return err
+	}
+
+	return nil
+}
+
+func (r *followReader) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	r.deadline = t
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *followReader) Close() error {
+	return r.f.Close()
+}
@@ -0,0 +1,160 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// listenHercules listens on the input's listen address for Hercules to
+// connect to us. Since all data from an input goes to the same output
+// handler, we only handle one printer connection at a time; additional
+// connections wait in the listen backlog until the current one disconnects.
+// This function returns when ctx is cancelled or if we are unable to listen
+// or accept connections.
+func listenHercules(ctx context.Context, input InputConfig,
+	handler scanner.PrinterHandler, inputName string) {
+
+	log := logger.With("input", inputName)
+	network := input.Network
+	if network == "" {
+		network = "tcp"
+	}
+
+	// The allow-list was already checked during config validation.
+	allowed, _ := parseAllowList(input.AllowedAddresses)
+
+	// A unix socket left behind by a previous run would prevent us from
+	// listening, so we'll clean it up if we find one.
+	if network == "unix" {
+		if stat, err := os.Lstat(input.ListenAddress); err == nil &&
+			stat.Mode()&os.ModeSocket != 0 {
+			os.Remove(input.ListenAddress)
+		}
+	}
+
+	l, err := net.Listen(network, input.ListenAddress)
+	if err != nil {
+		log.Errorf("Couldn't listen: %v", err)
+		setState(inputName, stateDisconnected)
+		setError(inputName, err)
+		return
+	}
+	defer l.Close()
+	defer closeOnCancel(ctx, l)()
+	log.Infof("Listening for Hercules on %s %s...", network,
+		input.ListenAddress)
+
+	for {
+		setState(inputName, stateListening)
+		conn, err := l.Accept()
+		if ctx.Err() != nil {
+			if err == nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			log.Errorf("Couldn't accept connection: %v", err)
+			setState(inputName, stateDisconnected)
+			setError(inputName, err)
+			return
+		}
+
+		if !addressAllowed(conn.RemoteAddr(), allowed) {
+			log.Warnf("Rejected connection from %s", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+
+		log.Infof("Accepted connection from %s", conn.RemoteAddr())
+		setState(inputName, stateConnected)
+		err = scanner.ScanContext(ctx, newCountingInput(conn, inputName),
+			handler, inputName)
+		conn.Close()
+		if ctx.Err() != nil {
+			return
+		}
+		if err == io.EOF {
+			log.Warnf("Hercules disconnected.")
+		} else if err != nil {
+			log.Errorf("error reading from Hercules: %s", err)
+			setError(inputName, err)
+		}
+	}
+}
+
+// parseAllowList converts a list of IP addresses and CIDR networks into a
+// list of networks. A plain IP address is treated as a network containing
+// only that address.
+func parseAllowList(addresses []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, address := range addresses {
+		address = strings.TrimSpace(address)
+		if strings.Contains(address, "/") {
+			_, ipnet, err := net.ParseCIDR(address)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipnet)
+			continue
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("`%s` is not an IP address or network",
+				address)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+// addressAllowed returns true if addr is in one of the allowed networks. An
+// empty allow-list allows every address, and we don't restrict connections
+// on unix sockets.
+func addressAllowed(addr net.Addr, allowed []*net.IPNet) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+
+	for _, ipnet := range allowed {
+		if ipnet.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// discardHandler is a printer handler that ignores everything.
+type discardHandler struct{}
+
+func (discardHandler) AddLine(string, bool)     {}
+func (discardHandler) PageBreak()               {}
+func (discardHandler) EndOfJob(scanner.JobInfo) {}
+
+func TestParseAllowList(t *testing.T) {
+	tests := []struct {
+		addresses []string
+		want      []string
+		wantErr   bool
+	}{
+		{nil, nil, false},
+		{[]string{"192.168.1.0/24"}, []string{"192.168.1.0/24"}, false},
+		{[]string{" 10.1.2.3 "}, []string{"10.1.2.3/32"}, false},
+		{[]string{"::1"}, []string{"::1/128"}, false},
+		{[]string{"10.0.0.0/8", "fd00::/8"},
+			[]string{"10.0.0.0/8", "fd00::/8"}, false},
+		{[]string{"10.0.0.0/33"}, nil, true},
+		{[]string{"hercules.example.com"}, nil, true},
+	}
+
+	for _, test := range tests {
+		nets, err := parseAllowList(test.addresses)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%v: got error %v", test.addresses, err)
+			continue
+		}
+		var got []string
+		for _, ipnet := range nets {
+			got = append(got, ipnet.String())
+		}
+		if len(got) != len(test.want) {
+			t.Errorf("%v: got %v, want %v", test.addresses, got, test.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.want[i] {
+				t.Errorf("%v: got %v, want %v", test.addresses, got,
+					test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestAddressAllowed(t *testing.T) {
+	allowed, err := parseAllowList([]string{"192.168.1.0/24", "10.1.2.3",
+		"fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr    net.Addr
+		allowed []*net.IPNet
+		want    bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.20")}, allowed, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.2.20")}, allowed, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.3")}, allowed, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.1.2.4")}, allowed, false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:10.1.2.3")}, allowed, true},
+		{&net.TCPAddr{IP: net.ParseIP("fd12::1")}, allowed, true},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, allowed, false},
+		{&net.TCPAddr{IP: net.ParseIP("::1")}, nil, true},
+		{&net.UnixAddr{Name: "@", Net: "unix"}, allowed, true},
+	}
+
+	for _, test := range tests {
+		got := addressAllowed(test.addr, test.allowed)
+		if got != test.want {
+			t.Errorf("%s with %v: got %v, want %v", test.addr,
+				test.allowed, got, test.want)
+		}
+	}
+}
+
+// startListener runs listenHercules for input until the test ends, and
+// waits for it to start listening.
+func startListener(t *testing.T, name string, input InputConfig) {
+	t.Helper()
+	agentStatus.register(name, input)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		listenHercules(ctx, input, discardHandler{}, name)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		agentStatus.remove(name)
+	})
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(
+		deadline); time.Sleep(10 * time.Millisecond) {
+
+		if inputState(name) == stateListening {
+			return
+		}
+	}
+	t.Fatalf("%s isn't listening", name)
+}
+
+// inputState returns the current state of the named input.
+func inputState(name string) string {
+	for _, pair := range agentStatus.snapshot() {
+		if pair.Input == name {
+			return pair.State
+		}
+	}
+	return ""
+}
+
+// freeAddress returns a local TCP address that nothing is listening on.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestListenRejectsAddress(t *testing.T) {
+	rejecting := InputConfig{ListenAddress: freeAddress(t),
+		AllowedAddresses: []string{"10.0.0.0/8"}}
+	startListener(t, "rejecting", rejecting)
+
+	conn, err := net.Dial("tcp", rejecting.ListenAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if !hungUp(conn) {
+		t.Errorf("connection from a rejected address wasn't closed")
+	}
+	if state := inputState("rejecting"); state != stateListening {
+		t.Errorf("got state %s after rejecting a connection", state)
+	}
+
+	accepting := InputConfig{ListenAddress: freeAddress(t),
+		AllowedAddresses: []string{"127.0.0.1"}}
+	startListener(t, "accepting", accepting)
+
+	conn, err = net.Dial("tcp", accepting.ListenAddress)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if hungUp(conn) {
+		t.Errorf("connection from an allowed address was closed")
+	}
+	if state := inputState("accepting"); state != stateConnected {
+		t.Errorf("got state %s for an allowed connection", state)
+	}
+}
+
+func TestListenRemovesStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "printer.sock")
+
+	// Leave a socket file behind, as a crashed agent would.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path,
+		Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	startListener(t, "unix", InputConfig{ListenAddress: path,
+		Network: "unix"})
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Anything else at the path is left alone.
+	regular := filepath.Join(dir, "listing.txt")
+	if err := os.WriteFile(regular, []byte("x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	agentStatus.register("regular", InputConfig{})
+	defer agentStatus.remove("regular")
+	listenHercules(context.Background(), InputConfig{ListenAddress: regular,
+		Network: "unix"}, discardHandler{}, "regular")
+	if _, err := os.Stat(regular); err != nil {
+		t.Errorf("regular file was removed: %v", err)
+	}
+}
@@ -19,17 +19,18 @@ package main
 // along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
-	"log"
 	"net"
 	"os"
-	"path/filepath"
-	"regexp"
-	"sync"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/racingmars/virtual1403/logging"
 	"github.com/racingmars/virtual1403/scanner"
 	"github.com/racingmars/virtual1403/vprinter"
 )
@@ -39,13 +40,28 @@ var version string = "unknown"
 
 var configFile = flag.String("config", "config.yaml", "name of config file")
 var output = flag.String("output", "default", "profile to use for -printfile")
-var printFile = flag.String("printfile", "",
-	"print a single UTF-8 text file. Use filename \"-\" for stdin")
+var printFile = flag.String("printfile", "", "print UTF-8 text files: "+
+	"a file, glob or directory; any further arguments are more files. Use "+
+	"filename \"-\" for stdin")
 var useASA = flag.Bool("asa", false, "When using -printfile, file has ASA "+
-	"carriage control characters in first position of each line")
-var trace = flag.Bool("trace", false, "enable trace logging")
+	"carriage control characters in first position of each line "+
+	"(same as -cc asa)")
+var carriageCtl = flag.String("cc", "auto", "When using -printfile, "+
+	"carriage control in first position of each line: auto, none, asa or "+
+	"machine")
+var stateFile = flag.String("statefile", "", "When using -printfile, "+
+	"remember printed files in this file and skip them if unchanged")
+var trace = flag.Bool("trace", false,
+	"enable scanner trace logging (same as -loglevel scanner=trace)")
+var logLevel = flag.String("loglevel", "info", "minimum log level, "+
+	"optionally per component, e.g. \"info,scanner=debug\"")
+var logFormat = flag.String("logformat", "text", "log format: text or json")
+var shutdownTimeout = flag.Duration("shutdowntimeout", 30*time.Second,
+	"how long to wait for in-flight jobs to be delivered when shutting down")
 var displayVersion = flag.Bool("version", false, "display version and quit")
 
+var logger = logging.New("agent")
+
 func main() {
 	flag.Parse()
 
@@ -54,126 +70,123 @@ func main() {
 		return
 	}
 
-	startupMessage()
-
+	format, err := logging.ParseFormat(*logFormat)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	logging.SetFormat(format)
+	if err := logging.Configure(*logLevel); err != nil {
+		logger.Fatalf("invalid -loglevel: %v", err)
+	}
 	if *trace {
-		log.Printf("TRACE: trace logging enabled")
+		logging.SetComponentLevel("scanner", logging.LevelTrace)
 	}
 
-	if *useASA && *printFile == "" {
-		log.Fatalf("FATAL: the -asa flag is only used with the -printFile " +
-			"parameter.")
-	}
+	startupMessage()
 
-	// Load configuration file
-	inputs, outputs, err := loadConfig(*configFile)
+	cc, err := parseCarriageControl(*carriageCtl)
 	if err != nil {
-		log.Fatalf("FATAL: Unable to read config `%s`: %v", *configFile, err)
+		logger.Fatalf("%v", err)
 	}
-
-	errs := validateConfig(inputs, outputs)
-	if errs != nil {
-		for _, err := range errs {
-			log.Printf("ERROR: %s", err.Error())
+	if *useASA {
+		if cc != ccAuto && cc != ccASA {
+			logger.Fatalf("the -asa and -cc %s flags conflict", cc)
 		}
-		log.Fatalf("FATAL: invalid configuration")
+		cc = ccASA
 	}
-
-	// Set up outputs
-	for name, conf := range outputs {
-		if conf.Mode == "local" {
-			// setup for local mode
-
-			// Make sure the output directory exists
-			if err = verifyOrCreateDir(conf.OutputDir); err != nil {
-				log.Fatalf("FATAL: [%s] %v", name, err.Error())
-			}
-
-			// Verify we have a font we can use. If the user doesn't provide a
-			// font, we will use our embedded copy of IBM Plex Mono. If the
-			// user does provide a font, we will make sure we can read the
-			// file, use it in a PDF, and that it is a fixed-width font.
-			//
-			// Note that the user's custom font is only used for the
-			// "default-" profiles; the retro- and modern- profiles will use
-			// one of our embedded fonts.
-			var font []byte
-			if conf.FontFile == "" {
-				// easy... just use default font by setting font to null
-				log.Printf("INFO:  [%s] Using default font", name)
-			} else {
-				log.Printf("INFO:  [%s] Attempting to load font %s", name,
-					conf.FontFile)
-				font, err = vprinter.LoadFont(conf.FontFile)
-				if err != nil {
-					log.Fatalf("FATAL: [%s] couldn't load requested font: %v",
-						name, err)
-				}
-				log.Printf("INFO:  [%s] Successfully loaded font %s", name,
-					conf.FontFile)
-			}
-			o := outputs[name]
-			o.font = font
-			outputs[name] = o
+	if *printFile == "" {
+		if *useASA || cc != ccAuto || *stateFile != "" {
+			logger.Fatalf("the -asa, -cc and -statefile flags are only " +
+				"used with the -printFile parameter.")
+		}
+		if flag.NArg() > 0 {
+			logger.Fatalf("unexpected arguments: %s",
+				strings.Join(flag.Args(), " "))
 		}
 	}
 
+	// Load configuration file
+	inputs, outputs, agent, err := readConfig(*configFile)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
 	// If user requested that we print a single file, we will do so then quit.
 	if *printFile != "" {
 		// Does the requested output config exist?
 		o, ok := outputs[*output]
 		if !ok {
-			log.Fatalf("FATAL: Output configuration [%s] doesn't exist",
+			logger.Fatalf("Output configuration [%s] doesn't exist",
 				*output)
 		}
 
-		runFilePrinter(o, *printFile)
+		files := append([]string{*printFile}, flag.Args()...)
+		failures := runFilePrinter(o, *output, files, cc, *stateFile)
+
+		// Don't quit until any post-job hooks have finished.
+		pendingHooks.Wait()
 
+		if failures > 0 {
+			os.Exit(1)
+		}
 		return
 	}
 
 	// Otherwise...
-	// Start a thread for each input and run until they all stop...which will
-	// usually be never; typically user will Ctrl-C out of the agent. We'll
-	// wait 250ms between startups so the initial log messages from each don't
-	// intermingle.
-	var wg sync.WaitGroup
-	for input := range inputs {
-		wg.Add(1)
-		// the output for the input is guaranteed to exist because of the
-		// earlier config validation.
-		go runPrinter(input, inputs[input].Output, inputs[input],
-			outputs[inputs[input].Output], &wg)
-		time.Sleep(250 * time.Millisecond)
+	// Start a thread for each input and run until the user Ctrl-C's out of
+	// the agent. On SIGHUP, we re-read the configuration file and apply any
+	// changes to the running inputs and outputs. On SIGINT or SIGTERM, we
+	// stop reading from the inputs, finish any jobs in progress, and wait
+	// for them to be delivered before we exit.
+	if agent.StatusAddress != "" {
+		go serveStatus(agent.StatusAddress)
 	}
-	wg.Wait()
-}
 
-func runPrinter(inputName, outputName string, input InputConfig,
-	output OutputConfig, wg *sync.WaitGroup) {
-
-	defer wg.Done()
-	var handler scanner.PrinterHandler
-	var err error
+	sup := newSupervisor()
+	if err := sup.apply(inputs, outputs); err != nil {
+		logger.Fatalf("%v", err)
+	}
 
-	log.Printf("INFO:  starting input/output pair [%s]/[%s]",
-		inputName, outputName)
-	if output.Mode == "local" {
-		log.Printf("INFO:  [%s] Will create PDFs in directory `%s`",
-			inputName, output.OutputDir)
-		// Set up our output handler
-		handler, err = newPDFOutputHandler(output.OutputDir, output.Profile,
-			output.font, inputName)
-		if err != nil {
-			log.Printf("ERROR: [%s] %v", inputName, err)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case <-hup:
+			logger.Infof("Received SIGHUP; reloading configuration `%s`",
+				*configFile)
+			inputs, outputs, newAgent, err := readConfig(*configFile)
+			if err == nil {
+				err = sup.apply(inputs, outputs)
+			}
+			if err != nil {
+				logger.Errorf("%v", err)
+				logger.Errorf("configuration not reloaded; continuing " +
+					"with the previous configuration")
+				continue
+			}
+			if newAgent.StatusAddress != agent.StatusAddress {
+				logger.Warnf("the agent must be restarted for the " +
+					"change to 'status_address' to take effect")
+			}
+			logger.Infof("Configuration reloaded")
+		case sig := <-stop:
+			logger.Infof("Received %v; shutting down", sig)
+			// A second signal skips waiting for the shutdown to finish.
+			signal.Reset(os.Interrupt, syscall.SIGTERM)
+			if status := sup.stop(*shutdownTimeout); status != 0 {
+				os.Exit(status)
+			}
 			return
 		}
-	} else {
-		log.Printf("INFO:  [%s] will use online print API at `%s`",
-			inputName, output.ServiceAddress)
-		handler = newOnlineOutputHandler(output.ServiceAddress, output.APIKey,
-			output.Profile, inputName)
 	}
+}
+
+func runPrinter(ctx context.Context, inputName string, input InputConfig,
+	handler scanner.PrinterHandler) {
+
+	log := logger.With("input", inputName)
 
 	// Hercules sometimes closes connections on the printer socket device even
 	// when everything is still up and running -- seems to happen, at least,
@@ -183,95 +196,179 @@ func runPrinter(inputName, outputName string, input InputConfig,
 	// Hercules, we want the agent to automatically re-connect. So, we just
 	// loop forever with a 10 second pause between connection failures or
 	// disconnects.
+	//
+	// When we are the listening side, we likewise restart the listener if it
+	// ever fails.
+	//
+	// The same goes for named pipes and followed files, which we re-open if
+	// Hercules closes them or they can't be read, and watched folders.
+	//
+	// We only stop when ctx is cancelled, which happens if the input is
+	// removed or changed when the configuration is reloaded.
 	for {
-		handleHercules(input.HerculesAddress, handler, inputName)
-		log.Printf("INFO:  [%s] Re-trying Hercules connection in 10 seconds...",
-			inputName)
-		time.Sleep(10 * time.Second)
-	}
-}
-
-func runFilePrinter(output OutputConfig, filename string) {
-	var r io.ReadCloser
-	var jobname string
-	if *printFile == "-" {
-		r = os.Stdin
-		jobname = "stdin"
-	} else {
-		f, err := os.Open(*printFile)
-		if err != nil {
-			log.Fatalf("FATAL: Couldn't open file [%s]: %v",
-				*printFile, err)
+		var retry string
+		switch input.InputType {
+		case "listen":
+			listenHercules(ctx, input, handler, inputName)
+			retry = "Re-trying listener"
+		case "fifo":
+			handleFIFO(ctx, input.InputFile, handler, inputName)
+			retry = "Re-opening named pipe"
+		case "follow":
+			handleFollow(ctx, input.InputFile, handler, inputName)
+			retry = "Re-opening file"
+		case "watch":
+			handleWatch(ctx, input, handler, inputName)
+			retry = "Re-starting folder watch"
+		default:
+			handleHercules(ctx, input.Network, input.HerculesAddress,
+				handler, inputName)
+			retry = "Re-trying Hercules connection"
 		}
-		r = f
-		jobname = filepath.Base(filename)
-	}
-	defer r.Close()
-
-	// job name character set is pretty restricted, we'll change any
-	// non-allowed character to _
-	jobRegex := regexp.MustCompile(`[^a-zA-Z0-9_]`)
-	jobname = jobRegex.ReplaceAllString(jobname, "_")
-	// and limit to 25 characters if needed
-	if len(jobname) > 25 {
-		jobname = jobname[:25]
-	}
-
-	var handler scanner.PrinterHandler
-	var err error
 
-	if output.Mode == "local" {
-		log.Printf("INFO:  Will create PDF in directory `%s`",
-			output.OutputDir)
-		// Set up our output handler
-		handler, err = newPDFOutputHandler(output.OutputDir, output.Profile,
-			output.font, "fileReader")
-		if err != nil {
-			log.Printf("ERROR: %v", err)
+		if ctx.Err() != nil {
+			log.Infof("Input stopped.")
+			setState(inputName, stateStopped)
 			return
 		}
-	} else {
-		log.Printf("INFO:  will use online print API at `%s`",
-			output.ServiceAddress)
-		handler = newOnlineOutputHandler(output.ServiceAddress, output.APIKey,
-			output.Profile, "fileReader")
-	}
-
-	if *useASA {
-		err = scanner.ScanASAUTF8Single(r, jobname, handler, *trace)
-	} else {
-		err = scanner.ScanUTF8Single(r, jobname, handler, *trace)
-	}
-	if err != nil {
-		log.Fatalf("FATAL: %v", err)
+		log.Infof("%s in 10 seconds...", retry)
+		select {
+		case <-ctx.Done():
+			log.Infof("Input stopped.")
+			setState(inputName, stateStopped)
+			return
+		case <-time.After(10 * time.Second):
+		}
 	}
 }
 
-func handleHercules(address string, handler scanner.PrinterHandler,
-	inputName string) {
-	log.Printf("INFO:  [%s] Connecting to Hercules on %s...", inputName,
-		address)
-	conn, err := net.Dial("tcp", address)
+func handleHercules(ctx context.Context, network, address string,
+	handler scanner.PrinterHandler, inputName string) {
+	if network == "" {
+		network = "tcp"
+	}
+	log := logger.With("input", inputName)
+	log.Infof("Connecting to Hercules on %s %s...", network, address)
+	setState(inputName, stateConnecting)
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
 	if err != nil {
-		log.Printf("ERROR: [%s] Couldn't connect: %v", inputName, err)
+		log.Errorf("Couldn't connect: %v", err)
+		setState(inputName, stateDisconnected)
+		setError(inputName, err)
 		return
 	}
 	defer conn.Close()
-	log.Printf("INFO:  [%s] Connection successful.", inputName)
-
-	err = scanner.ScanWithLogTag(conn, handler, *trace, inputName)
+	log.Infof("Connection successful.")
+	setState(inputName, stateConnected)
+	defer setState(inputName, stateDisconnected)
+
+	err = scanner.ScanContext(ctx, newCountingInput(conn, inputName), handler,
+		inputName)
+	if ctx.Err() != nil {
+		// we were asked to stop
+		return
+	}
 	if err == io.EOF {
 		// we're done!
-		log.Printf("WARN:  [%s] Hercules disconnected.", inputName)
+		log.Warnf("Hercules disconnected.")
 		return
 	}
 	if err != nil {
-		log.Printf("ERROR: [%s] error reading from Hercules: %s", inputName,
-			err)
+		log.Errorf("error reading from Hercules: %s", err)
+		setError(inputName, err)
 		return
 	}
 }
 
+// setupOutputs prepares the outputs for use: for local mode outputs, we make
+// sure the output directory exists and load the font. For online outputs, we
+// make sure the download directory exists, if there is one.
+func setupOutputs(outputs map[string]OutputConfig) error {
+	for name, conf := range outputs {
+		log := logger.With("output", name)
+		if conf.Mode == "local" {
+			// setup for local mode
+
+			// Make sure the output directory exists
+			if err := verifyOrCreateDir(conf.OutputDir); err != nil {
+				return fmt.Errorf("[%s] %v", name, err)
+			}
+
+			// Verify we have a font we can use. If the user doesn't provide a
+			// font, we will use our embedded copy of IBM Plex Mono. If the
+			// user does provide a font, we will make sure we can read the
+			// file, use it in a PDF, and that it is a fixed-width font.
+			//
+			// Note that the user's custom font is only used for the
+			// "default-" profiles; the retro- and modern- profiles will use
+			// one of our embedded fonts.
+			var font []byte
+			var err error
+			if conf.FontFile == "" {
+				// easy... just use default font by setting font to null
+				log.Infof("Using default font")
+			} else {
+				log.Infof("Attempting to load font %s", conf.FontFile)
+				font, err = vprinter.LoadFont(conf.FontFile)
+				if err != nil {
+					return fmt.Errorf("[%s] couldn't load requested font: %v",
+						name, err)
+				}
+				log.Infof("Successfully loaded font %s", conf.FontFile)
+			}
+			o := outputs[name]
+			o.font = font
+			outputs[name] = o
+		} else if conf.DownloadDir != "" {
+			// Online outputs may download copies of their PDFs
+			if err := verifyOrCreateDir(conf.DownloadDir); err != nil {
+				return fmt.Errorf("[%s] %v", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// newOutputHandler creates the printer handler for an output.
+func newOutputHandler(inputName, outputName string,
+	output OutputConfig) (scanner.PrinterHandler, error) {
+
+	log := logger.With("input", inputName)
+	// The separator page mode was validated with the configuration.
+	separators, _ := vprinter.ParseSeparatorMode(output.SeparatorPages)
+	if output.Mode == "local" {
+		log.Infof("Will create PDFs in directory `%s`", output.OutputDir)
+		return newPDFOutputHandler(output.OutputDir, output.Profile,
+			output.ProfileRules, output.font, separators, inputName,
+			outputName, output.Hooks)
+	}
+
+	log.Infof("will use online print API at `%s`", output.ServiceAddress)
+	return newOnlineOutputHandler(output.ServiceAddress, output.APIKey,
+		output.Protocol, output.DownloadDir, output.Profile,
+		output.ProfileRules, separators,
+		inputName, outputName, output.Hooks), nil
+}
+
+// closeOnCancel closes c if ctx is cancelled, which unblocks any reads or
+// accepts in progress on c. The returned function must be called when the
+// caller is done with c.
+func closeOnCancel(ctx context.Context, c io.Closer) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.Close()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+	}
+}
+
 // verifyOrCreateDir will check if path exists and is a directory. If so, the
 // returned error will be nil. If path doesn't exist, we will try to create
 // the directory, and if successful, returned error will be nil. In other
@@ -291,7 +388,7 @@ func verifyOrCreateDir(path string) error {
 	}
 
 	// Try to create the directory
-	log.Printf("INFO:  creating directory `%s`", path)
+	logger.Infof("creating directory `%s`", path)
 	if err = os.MkdirAll(path, 0755); err != nil {
 		return err
 	}
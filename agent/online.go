@@ -21,35 +21,72 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
-	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/klauspost/compress/zstd"
+	"github.com/racingmars/virtual1403/logging"
 	"github.com/racingmars/virtual1403/scanner"
+	"github.com/racingmars/virtual1403/vprinter"
 )
 
 type onlineOutputHandler struct {
-	buf       bytes.Buffer
-	enc       *zstd.Encoder
-	w         *bufio.Writer
-	api       string
-	key       string
-	profile   string
-	inputName string
+	buf        bytes.Buffer
+	enc        *zstd.Encoder
+	w          *bufio.Writer
+	api        string
+	key        string
+	protocol   int
+	downloads  string
+	profile    string
+	rules      []vprinter.ProfileRule
+	separators vprinter.SeparatorMode
+	job        vprinter.Job
+	inputName  string
+	outputName string
+	hooks      []HookConfig
+	truncated  bool
+	pages      int
+	log        *logging.Logger
+
+	// Large jobs are sent in chunks as they're printed, in an upload
+	// session. If uploading fails, uploadErr is the reason the job can't be
+	// delivered. Jobs are sent in one request if the server doesn't support
+	// uploads (noUploads), or we couldn't start a session for this job
+	// (oneShot).
+	upload    *jobUpload
+	uploadErr error
+	noUploads bool
+	oneShot   bool
 }
 
-func newOnlineOutputHandler(api, key, profile,
-	inputName string) scanner.PrinterHandler {
+func newOnlineOutputHandler(api, key string, protocol int,
+	downloads, profile string, rules []vprinter.ProfileRule,
+	separators vprinter.SeparatorMode,
+	inputName, outputName string, hooks []HookConfig) scanner.PrinterHandler {
 
 	o := &onlineOutputHandler{
-		api:       api,
-		key:       key,
-		profile:   profile,
-		inputName: inputName,
+		api:        api,
+		key:        key,
+		protocol:   protocol,
+		downloads:  downloads,
+		profile:    profile,
+		rules:      rules,
+		separators: separators,
+		inputName:  inputName,
+		outputName: outputName,
+		hooks:      hooks,
+		log:        logger.With("input", inputName, "output", outputName),
 	}
-	o.enc, _ = zstd.NewWriter(&o.buf)
-	o.w = bufio.NewWriter(o.enc)
+	if o.protocol == 0 {
+		o.protocol = protocolVersion
+	}
+	o.startJob()
 	if o.profile == "" {
 		o.profile = "default"
 	}
@@ -57,67 +94,253 @@ func newOnlineOutputHandler(api, key, profile,
 	return o
 }
 
-func (o *onlineOutputHandler) AddLine(line string, linefeed bool) {
-	command := "L:"
-	if !linefeed {
-		command = "O:"
+// startJob starts the print directives for a new job.
+func (o *onlineOutputHandler) startJob() {
+	o.enc, _ = zstd.NewWriter(&o.buf)
+	o.w = bufio.NewWriter(o.enc)
+	o.job = vprinter.NewSeparatorFilter(directiveJob{o}, o.separators,
+		scanner.IsSeparatorLine)
+	if o.protocol >= 2 {
+		writeHeaderDirective(o.w)
 	}
-	o.w.WriteString(command + line + "\n")
+}
+
+func (o *onlineOutputHandler) AddLine(line string, linefeed bool) {
+	o.job.AddLine(line, linefeed)
+	o.sendChunk()
 }
 
 func (o *onlineOutputHandler) PageBreak() {
-	o.w.WriteString("P:\n")
+	o.job.NewPage()
+	o.sendChunk()
+}
+
+func (o *onlineOutputHandler) SkipToChannel(channel int) {
+	vprinter.SkipToChannel(o.job, channel)
+	o.sendChunk()
 }
 
-func (o *onlineOutputHandler) EndOfJob(jobinfo string) {
+// sendChunk sends the compressed job data collected so far to the server
+// once there's enough of it, starting an upload session for the job if
+// there isn't one yet.
+func (o *onlineOutputHandler) sendChunk() {
+	if o.buf.Len() < uploadChunkSize || o.noUploads || o.oneShot {
+		return
+	}
+	if o.uploadErr != nil {
+		// The job can't be delivered, so there's no point keeping it.
+		o.buf.Reset()
+		return
+	}
+
+	if o.upload == nil {
+		upload, err := beginUpload(o.api, o.key)
+		if err == errUploadsUnsupported {
+			o.log.Infof("%v; sending jobs in one request", err)
+			o.noUploads = true
+			return
+		} else if err != nil {
+			o.log.Warnf("unable to begin upload, sending job in one "+
+				"request: %v", err)
+			o.oneShot = true
+			return
+		}
+		o.log.Debugf("began upload session %s", upload.url)
+		o.upload = upload
+	}
+
+	if err := o.upload.send(o.buf.Bytes(), o.log); err != nil {
+		o.log.Errorf("unable to upload print job: %v", err)
+		o.uploadErr = err
+		o.upload.abort()
+		o.upload = nil
+	}
+	o.buf.Reset()
+}
+
+func (o *onlineOutputHandler) JobTruncated() {
+	o.truncated = true
+	o.AddLine("", true)
+	o.AddLine(truncatedJobMessage, true)
+}
+
+func (o *onlineOutputHandler) EndOfJob(job scanner.JobInfo) {
+	jobinfo := job.String()
+	log := o.log.With("job", jobinfo)
+	// This writes out any pages the separator page filter was holding on
+	// to.
+	o.job.EndJob(io.Discard)
+	if o.protocol >= 2 {
+		writeMetadataDirectives(o.w, job)
+	}
 	o.w.WriteString("J:" + jobinfo + "\n")
+	truncated := o.truncated
+	pages := o.pages + 1
+	profile := chooseProfile(o.rules, job, o.profile, log)
 
 	// No matter what happens, we always want to reset our state to a fresh
 	// new job.
-	defer func() {
-		// We could use Buffer.Reset(), but if this was a particularly large
-		// job, there's no reason for us to hold on to that much allocated
-		// memory indefinitely. All things considered, this is a low-volume
-		// application to paying for the allocation of a new buffer slice
-		// isn't going to have a noticable performance penalty.
-		o.buf = bytes.Buffer{}
-		o.enc, _ = zstd.NewWriter(&o.buf)
-		o.w = bufio.NewWriter(o.enc)
-	}()
+	defer o.reset()
 
 	o.w.Flush()
 	o.enc.Close()
 
-	// We now have a complete zstd-compressed job stream in o.buf.
-
-	req, err := http.NewRequest(http.MethodPost,
-		o.api+"?profile="+o.profile, &o.buf)
+	// We now have the rest of the zstd-compressed job stream in o.buf. If
+	// the job was big enough to start uploading it, we send the rest and
+	// commit the upload, otherwise we send the whole job now.
+	var req *http.Request
+	var err error
+	if o.upload != nil || o.uploadErr != nil {
+		req, err = o.commitRequest()
+	} else {
+		req, err = http.NewRequest(http.MethodPost, o.api, &o.buf)
+		if err == nil {
+			req.Header.Set("Content-Encoding", "zstd")
+			req.Header.Set("Content-Type", "text/x-print-job")
+		}
+	}
 	if err != nil {
-		log.Printf("ERROR: [%s] unable to create HTTP request: %v",
-			o.inputName, err)
+		log.Errorf("unable to send print job: %v", err)
+		jobNotDelivered(o.inputName, err)
 		return
 	}
 
-	req.Header.Set("Content-Encoding", "zstd")
-	req.Header.Set("Content-Type", "text/x-print-job")
+	req.URL.RawQuery = "profile=" + url.QueryEscape(profile)
 	req.Header.Set("Authorization", "Bearer "+o.key)
+	if o.protocol < 2 {
+		// Version 2 sends the job details as metadata directives instead.
+		if details, err := json.Marshal(&job); err == nil {
+			req.Header.Set("X-Print-Job-Info", string(details))
+		}
+	}
 
-	log.Printf("INFO:  [%s] Sending print job to online print API...",
-		o.inputName)
+	log.Infof("Sending print job to online print API...")
 	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		log.Printf("ERROR: [%s] unable to execute HTTP request: %v",
-			o.inputName, err)
+		log.Errorf("unable to execute HTTP request: %v", err)
+		jobNotDelivered(o.inputName, err)
 		return
 	}
 	defer resp.Body.Close()
-	defer io.ReadAll(resp.Body) // ensure keep-alive client reuse when able
+	// Reading the whole response also ensures keep-alive client reuse when
+	// able.
+	result := readPrintResult(resp)
 
 	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
-		log.Printf("INFO:  [%s] Print API response status: %s", o.inputName,
-			resp.Status)
+		log.Infof("Print API response status: %s; %v", resp.Status, result)
+		// The server knows best how many pages it printed, once it has
+		// printed them.
+		if result.valid && result.finished() {
+			pages = result.Pages
+		}
+
+		// If the user wants a copy of the PDF, fetch it from the link the
+		// server gave us.
+		var pdfFile string
+		if o.downloads != "" && result.PDFURL != "" {
+			pdfFile, err = downloadPDF(result.PDFURL, o.downloads, jobinfo)
+			if err != nil {
+				log.Warnf("unable to download PDF: %v", err)
+			} else {
+				log.Infof("downloaded PDF to %s", pdfFile)
+			}
+		}
+
+		jobDelivered(o.inputName, pages)
+		runHooks(o.hooks, jobResult{
+			Input:     o.inputName,
+			Output:    o.outputName,
+			Mode:      "online",
+			Profile:   profile,
+			JobInfo:   jobinfo,
+			Job:       job,
+			Pages:     pages,
+			PDFFile:   pdfFile,
+			Truncated: truncated,
+			Time:      time.Now(),
+		})
 	} else {
-		log.Printf("ERROR: [%s] Print API response status: %s", o.inputName,
-			resp.Status)
+		err := fmt.Errorf("print API response status: %s", resp.Status)
+		if result.Error != "" {
+			err = fmt.Errorf("%v: %s", err, result.Error)
+		}
+		log.Errorf("%v", err)
+		jobNotDelivered(o.inputName, err)
 	}
 }
+
+// reset starts a fresh new job.
+func (o *onlineOutputHandler) reset() {
+	// We could use Buffer.Reset(), but if this was a particularly large job,
+	// there's no reason for us to hold on to that much allocated memory
+	// indefinitely. All things considered, this is a low-volume application
+	// to paying for the allocation of a new buffer slice isn't going to have
+	// a noticable performance penalty.
+	o.truncated = false
+	o.pages = 0
+	o.buf = bytes.Buffer{}
+	o.upload = nil
+	o.uploadErr = nil
+	o.oneShot = false
+	o.startJob()
+}
+
+// discardJob throws away the job in progress, abandoning its upload session
+// if it has one.
+func (o *onlineOutputHandler) discardJob() {
+	if o.upload != nil {
+		o.upload.abort()
+	}
+	o.reset()
+}
+
+// commitRequest sends the end of an uploaded job, and returns the request
+// that prints it.
+func (o *onlineOutputHandler) commitRequest() (*http.Request, error) {
+	if o.uploadErr != nil {
+		return nil, o.uploadErr
+	}
+	if err := o.upload.send(o.buf.Bytes(), o.log); err != nil {
+		o.upload.abort()
+		return nil, err
+	}
+	o.log.Debugf("committing %d byte upload", o.upload.offset)
+	return o.upload.commitRequest()
+}
+
+// directiveJob is a vprinter.Job that writes the lines and pages of the job
+// as print API directives, so the online output can use the same separator
+// page filter as local outputs.
+type directiveJob struct {
+	o *onlineOutputHandler
+}
+
+func (d directiveJob) AddLine(line string, linefeed bool) int {
+	command := "L:"
+	if !linefeed {
+		command = "O:"
+	}
+	d.o.w.WriteString(command + line + "\n")
+	return d.o.pages + 1
+}
+
+func (d directiveJob) NewPage() int {
+	d.o.pages++
+	d.o.w.WriteString("P:\n")
+	return d.o.pages + 1
+}
+
+// SkipToChannel writes a channel skip directive, or a blank line for
+// servers that only understand version 1 of the protocol.
+func (d directiveJob) SkipToChannel(channel int) int {
+	if d.o.protocol < 2 {
+		return d.AddLine("", true)
+	}
+	d.o.w.WriteString("C:" + strconv.Itoa(channel) + "\n")
+	return d.o.pages + 1
+}
+
+// EndJob doesn't write anything; the caller sends the job.
+func (d directiveJob) EndJob(w io.Writer) (int, error) {
+	return d.o.pages + 1, nil
+}
@@ -20,85 +20,243 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"time"
 
+	"github.com/racingmars/virtual1403/logging"
 	"github.com/racingmars/virtual1403/scanner"
 	"github.com/racingmars/virtual1403/vprinter"
 )
 
 type pdfOutputHandler struct {
-	job       vprinter.Job
-	outputDir string
-	font      []byte
-	inputName string
-	profile   string
+	// If the output has profile rules, we don't know which profile to print
+	// a job with until we've seen all of it, so the job is recorded until
+	// then. Otherwise it is printed as it arrives.
+	printer  vprinter.Job
+	recorded *recordedJob
+
+	outputDir  string
+	font       []byte
+	inputName  string
+	outputName string
+	profile    string
+	rules      []vprinter.ProfileRule
+	separators vprinter.SeparatorMode
+	hooks      []HookConfig
+	truncated  bool
+	log        *logging.Logger
 }
 
-func newPDFOutputHandler(outputDir, profile string, fontOverride []byte,
-	inputName string) (scanner.PrinterHandler, error) {
+func newPDFOutputHandler(outputDir, profile string,
+	rules []vprinter.ProfileRule, fontOverride []byte,
+	separators vprinter.SeparatorMode, inputName, outputName string,
+	hooks []HookConfig) (scanner.PrinterHandler, error) {
 
-	o := &pdfOutputHandler{
-		outputDir: outputDir,
-		font:      fontOverride,
-		inputName: inputName,
-		profile:   profile,
+	// Make sure the font works with every profile we might print with now,
+	// rather than finding out when each job is printed.
+	profiles := []string{profile}
+	for _, rule := range rules {
+		profiles = append(profiles, rule.Profile)
+	}
+	for _, p := range profiles {
+		if _, err := vprinter.NewProfile(p, fontOverride, 11.4); err != nil {
+			return nil, fmt.Errorf("couldn't initialize virtual 1403 with "+
+				"profile %s: %v", p, err)
+		}
 	}
-	var err error
 
-	o.job, err = vprinter.NewProfile(profile, fontOverride, 11.4)
-	if err != nil {
-		return nil, err
+	o := &pdfOutputHandler{
+		outputDir:  outputDir,
+		font:       fontOverride,
+		inputName:  inputName,
+		outputName: outputName,
+		profile:    profile,
+		rules:      rules,
+		separators: separators,
+		hooks:      hooks,
+		log:        logger.With("input", inputName, "output", outputName),
 	}
+	o.reset()
 	return o, nil
 }
 
 func (o *pdfOutputHandler) AddLine(line string, linefeed bool) {
-	o.job.AddLine(line, linefeed)
+	if o.recorded != nil {
+		o.recorded.addLine(line, linefeed)
+		return
+	}
+	o.printer.AddLine(line, linefeed)
 }
 
 func (o *pdfOutputHandler) PageBreak() {
-	o.job.NewPage()
+	if o.recorded != nil {
+		o.recorded.newPage()
+		return
+	}
+	o.printer.NewPage()
+}
+
+func (o *pdfOutputHandler) SkipToChannel(channel int) {
+	if o.recorded != nil {
+		o.recorded.skipToChannel(channel)
+		return
+	}
+	vprinter.SkipToChannel(o.printer, channel)
+}
+
+func (o *pdfOutputHandler) JobTruncated() {
+	o.truncated = true
+	o.AddLine("", true)
+	o.AddLine(truncatedJobMessage, true)
 }
 
-func (o *pdfOutputHandler) EndOfJob(jobinfo string) {
+func (o *pdfOutputHandler) EndOfJob(job scanner.JobInfo) {
+	jobinfo := job.String()
+	log := o.log.With("job", jobinfo)
+	truncated := o.truncated
+	pdfjob, recorded := o.printer, o.recorded
+
 	// No matter what happens, we always want to reset our state to a fresh
 	// new job.
-	defer func() {
-		var err error
-		o.job, err = vprinter.NewProfile(o.profile, o.font, 11.4)
-		if err != nil {
-			log.Printf("ERROR: [%s] couldn't re-initialize virtual 1403: %v",
-				o.inputName, err)
-			log.Printf(
-				"ERROR: [%s] application is probably in a bad state, "+
-					"please restart.", o.inputName)
-		}
-	}()
+	defer o.reset()
 
-	if jobinfo != "" {
-		jobinfo = jobinfo + "-"
+	// Now that we've seen the whole job, we know its class and forms and
+	// can choose the paper to print it on.
+	profile := o.profile
+	if recorded != nil {
+		profile = chooseProfile(o.rules, job, o.profile, log)
+		pdfjob = o.newPrinter(profile)
+		recorded.replay(pdfjob)
 	}
-	jobfilename := fmt.Sprintf("v1403-%s%s.pdf", jobinfo,
-		time.Now().UTC().Format("20060102T030405"))
-	filename := filepath.Join(o.outputDir, jobfilename)
+
+	now := time.Now()
+	filename := filepath.Join(o.outputDir, pdfFileName(jobinfo, now))
 
 	f, err := os.Create(filename)
 	if err != nil {
-		log.Printf("ERROR: [%s] couldn't create output file: %v",
-			o.inputName, err)
+		log.Errorf("couldn't create output file: %v", err)
+		jobNotDelivered(o.inputName, err)
 		return
 	}
 	defer f.Close()
-	n, err := o.job.EndJob(f)
+	n, err := pdfjob.EndJob(f)
 	if err != nil {
-		log.Printf("ERROR: [%s] couldn't write PDF output: %v", o.inputName,
-			err)
+		log.Errorf("couldn't write PDF output: %v", err)
+		jobNotDelivered(o.inputName, err)
 		return
 	}
 
-	log.Printf("INFO:  [%s] wrote %d page PDF to %s", o.inputName, n,
-		filename)
+	log.Infof("wrote %d page PDF to %s", n, filename)
+	jobDelivered(o.inputName, n)
+
+	runHooks(o.hooks, jobResult{
+		Input:     o.inputName,
+		Output:    o.outputName,
+		Mode:      "local",
+		Profile:   profile,
+		JobInfo:   jobinfo,
+		Job:       job,
+		Pages:     n,
+		PDFFile:   filename,
+		Truncated: truncated,
+		Time:      now,
+	})
+}
+
+// reset starts a fresh new job.
+func (o *pdfOutputHandler) reset() {
+	o.truncated = false
+	if len(o.rules) > 0 {
+		o.recorded = newRecordedJob()
+		return
+	}
+	o.printer = o.newPrinter(o.profile)
+}
+
+// newPrinter returns a virtual printer for a job printed with profile.
+func (o *pdfOutputHandler) newPrinter(profile string) vprinter.Job {
+	// We checked that the profiles work with our font when the handler was
+	// created.
+	printer, _ := vprinter.NewProfile(profile, o.font, 11.4)
+	return vprinter.NewSeparatorFilter(printer, o.separators,
+		scanner.IsSeparatorLine)
+}
+
+// discardJob throws away the job in progress.
+func (o *pdfOutputHandler) discardJob() {
+	o.reset()
+}
+
+// chooseProfile returns the profile for job from the profile rules of an
+// output, or fallback if none of them match.
+func chooseProfile(rules []vprinter.ProfileRule, job scanner.JobInfo,
+	fallback string, log *logging.Logger) string {
+
+	profile := vprinter.ChooseProfile(rules, job.Class, job.Forms, job.Name,
+		fallback)
+	if profile != fallback {
+		log.With("class", job.Class, "forms", job.Forms).Debugf(
+			"profile rules chose profile %s", profile)
+	}
+	return profile
+}
+
+// recordedLine is one line of a recordedJob, or a skip to a channel if
+// channel isn't 0.
+type recordedLine struct {
+	text     string
+	linefeed bool
+	channel  int
+}
+
+// recordedJob keeps the lines and pages of a job until we know which
+// profile to print it with. For jobs from the mainframe, we don't know that
+// until we've seen the whole job.
+type recordedJob struct {
+	pages [][]recordedLine
+}
+
+func newRecordedJob() *recordedJob {
+	return &recordedJob{pages: make([][]recordedLine, 1)}
+}
+
+func (r *recordedJob) addLine(text string, linefeed bool) {
+	page := &r.pages[len(r.pages)-1]
+	*page = append(*page, recordedLine{text: text, linefeed: linefeed})
+}
+
+func (r *recordedJob) skipToChannel(channel int) {
+	page := &r.pages[len(r.pages)-1]
+	*page = append(*page, recordedLine{channel: channel})
+}
+
+func (r *recordedJob) newPage() {
+	r.pages = append(r.pages, nil)
+}
+
+// replay prints the recorded job to job.
+func (r *recordedJob) replay(job vprinter.Job) {
+	for i, page := range r.pages {
+		if i > 0 {
+			job.NewPage()
+		}
+		for _, line := range page {
+			if line.channel != 0 {
+				vprinter.SkipToChannel(job, line.channel)
+			} else {
+				job.AddLine(line.text, line.linefeed)
+			}
+		}
+	}
+}
+
+// pdfFileName returns the name for the PDF of the job jobinfo printed at t.
+func pdfFileName(jobinfo string, t time.Time) string {
+	jobtag := jobinfo
+	if jobtag != "" {
+		jobtag = jobtag + "-"
+	}
+	return fmt.Sprintf("v1403-%s%s.pdf", jobtag,
+		t.UTC().Format("20060102T030405"))
 }
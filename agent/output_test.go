@@ -0,0 +1,44 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"testing"
+
+	"github.com/racingmars/virtual1403/vprinter"
+)
+
+func TestPDFOutputHandlerFont(t *testing.T) {
+	badFont := []byte("not a font")
+	rules := []vprinter.ProfileRule{{Class: "A", Profile: "default-blue"}}
+
+	// The modern and retro profiles don't use the configured font.
+	if _, err := newPDFOutputHandler(t.TempDir(), "modern-green", nil,
+		badFont, vprinter.SeparatorKeep, "in", "out", nil); err != nil {
+
+		t.Errorf("got error for a profile that doesn't use the font: %v",
+			err)
+	}
+	if _, err := newPDFOutputHandler(t.TempDir(), "modern-green", rules,
+		badFont, vprinter.SeparatorKeep, "in", "out", nil); err == nil {
+
+		t.Errorf("expected an error for a rule profile that can't use " +
+			"the font")
+	}
+}
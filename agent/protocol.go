@@ -0,0 +1,66 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// protocolVersion is the version of the print API wire protocol that online
+// outputs use unless they're configured for an older one. Version 1 is the
+// original L:, O:, P: and J: directives. Version 2 starts with a V: header
+// directive, and adds M: metadata and C: channel skip directives.
+const protocolVersion = 2
+
+// writeHeaderDirective writes the version 2 header directive, which must be
+// the first directive of the job: the protocol version followed by
+// name=value fields describing the agent and the printer.
+func writeHeaderDirective(w *bufio.Writer) {
+	agent := strings.Join(strings.Fields("virtual1403-agent/"+version), "_")
+	w.WriteString("V:2 agent=" + agent +
+		" printer=1403 width=132 codepage=UTF-8\n")
+}
+
+// writeMetadataDirectives writes a version 2 metadata directive for each
+// detail we know about job.
+func writeMetadataDirectives(w *bufio.Writer, job scanner.JobInfo) {
+	for _, m := range []struct{ name, value string }{
+		{"type", job.Type},
+		{"number", job.Number},
+		{"name", job.Name},
+		{"class", job.Class},
+		{"forms", job.Forms},
+		{"programmer", job.Programmer},
+		{"room", job.Room},
+		{"user", job.User},
+		{"printer", job.Printer},
+		{"system", job.System},
+	} {
+		if value := strings.TrimSpace(m.value); value != "" {
+			w.WriteString("M:" + m.name + "=" + value + "\n")
+		}
+	}
+	if job.Printed != nil {
+		w.WriteString("M:printed=" + job.Printed.Format(time.RFC3339) + "\n")
+	}
+}
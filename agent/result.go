@@ -0,0 +1,147 @@
+package main
+
+// Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// printResult is the print API's JSON response to a job. Older servers
+// don't send one, in which case it's empty.
+type printResult struct {
+	JobID    uint64 `json:"job_id"`
+	Job      string `json:"job"`
+	Pages    int    `json:"pages"`
+	Nuisance bool   `json:"nuisance"`
+	State    string `json:"state"`
+	Delivery string `json:"delivery"`
+	Quota    *struct {
+		Jobs        *int `json:"jobs"`
+		Pages       *int `json:"pages"`
+		PeriodHours int  `json:"period_hours"`
+	} `json:"quota"`
+	PDFURL string `json:"pdf_url"`
+
+	// Error is the server's explanation of an unsuccessful response, or of
+	// a failed delivery that it will retry.
+	Error string `json:"error"`
+
+	// valid is true if the server sent us a result.
+	valid bool
+}
+
+// readPrintResult reads the print API response body, which is a printResult
+// if the server sent JSON.
+func readPrintResult(resp *http.Response) printResult {
+	var result printResult
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return result
+	}
+	mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediatype != "application/json" {
+		result.Error = strings.TrimSpace(string(body))
+		return result
+	}
+	if err := json.Unmarshal(body, &result); err == nil {
+		result.valid = true
+	}
+	return result
+}
+
+// finished is true if the server has finished with the job. Servers without
+// a print queue don't send a state; they always finish the job first.
+func (r printResult) finished() bool {
+	return r.State == "" || r.State == "done" || r.State == "failed"
+}
+
+// String describes the result for the log.
+func (r printResult) String() string {
+	if !r.valid {
+		return "no details from server"
+	}
+	var b strings.Builder
+	if r.JobID != 0 {
+		fmt.Fprintf(&b, "job ID %d, ", r.JobID)
+	}
+	switch {
+	case r.Nuisance:
+		b.WriteString("ignored as a nuisance job")
+	case r.finished():
+		fmt.Fprintf(&b, "%d pages, delivery %s", r.Pages, r.Delivery)
+	default:
+		fmt.Fprintf(&b, "%s in the print queue", r.State)
+		if r.Error != "" {
+			fmt.Fprintf(&b, " (%s)", r.Error)
+		}
+	}
+	if r.Quota != nil {
+		var left []string
+		if r.Quota.Jobs != nil {
+			left = append(left, fmt.Sprintf("%d jobs", *r.Quota.Jobs))
+		}
+		if r.Quota.Pages != nil {
+			left = append(left, fmt.Sprintf("%d pages", *r.Quota.Pages))
+		}
+		if len(left) > 0 {
+			fmt.Fprintf(&b, ", quota remaining %s in %d hours",
+				strings.Join(left, " and "), r.Quota.PeriodHours)
+		}
+	}
+	return b.String()
+}
+
+// downloadClient fetches PDFs from the print server. A server that stops
+// responding mustn't hold up the output forever.
+var downloadClient = &http.Client{Timeout: 5 * time.Minute}
+
+// downloadPDF saves the PDF at pdfURL to dir, named the same way as local
+// outputs name their PDFs. It returns the name of the file.
+func downloadPDF(pdfURL, dir, jobinfo string) (string, error) {
+	resp, err := downloadClient.Get(pdfURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("PDF download response status: %s",
+			resp.Status)
+	}
+
+	filename := filepath.Join(dir, pdfFileName(jobinfo, time.Now()))
+	f, err := os.Create(filename)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return "", err
+	}
+	return filename, f.Close()
+}
@@ -0,0 +1,121 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadPrintResult(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		valid       bool
+		finished    bool
+		want        string
+	}{
+		{"application/json", `{"job_id":12,"job":"J12_IBMUSERA",` +
+			`"pages":3,"state":"done","delivery":"emailed",` +
+			`"quota":{"jobs":4,"pages":null,"period_hours":24}}`,
+			true, true, "job ID 12, 3 pages, delivery emailed, quota " +
+				"remaining 4 jobs in 24 hours"},
+		{"application/json; charset=utf-8", `{"job_id":13,` +
+			`"state":"delivering","error":"mail server down"}`,
+			true, false, "job ID 13, delivering in the print queue " +
+				"(mail server down)"},
+		{"application/json", `{"nuisance":true,"state":"done"}`,
+			true, true, "ignored as a nuisance job"},
+		{"text/plain", "Quota exceeded\n", false, true,
+			"no details from server"},
+		{"application/json", "not json", false, true,
+			"no details from server"},
+	}
+
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", test.contentType)
+		rec.WriteString(test.body)
+		result := readPrintResult(rec.Result())
+		if result.valid != test.valid || result.finished() != test.finished ||
+			result.String() != test.want {
+			t.Errorf("%s: got %+v, %q", test.body, result, result.String())
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	rec.Header().Set("Content-Type", "text/plain")
+	rec.WriteString("Quota exceeded\n")
+	if result := readPrintResult(rec.Result()); result.Error !=
+		"Quota exceeded" {
+		t.Errorf("got error %q from a text response", result.Error)
+	}
+}
+
+func TestDownloadPDF(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/pdf/12":
+				w.Write([]byte("%PDF-1.3"))
+			case "/pdf/stalled":
+				w.Write([]byte("%PDF"))
+				w.(http.Flusher).Flush()
+				<-unblock
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	defer server.Close()
+	defer close(unblock)
+
+	dir := t.TempDir()
+	filename, err := downloadPDF(server.URL+"/pdf/12", dir, "J12_IBMUSERA")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(filepath.Base(filename), "v1403-J12_IBMUSERA-") {
+		t.Errorf("got file name %s", filename)
+	}
+	if data, _ := os.ReadFile(filename); string(data) != "%PDF-1.3" {
+		t.Errorf("got PDF contents %q", data)
+	}
+
+	if _, err := downloadPDF(server.URL+"/pdf/13", dir, "J13"); err == nil {
+		t.Errorf("expected an error for a missing PDF")
+	}
+
+	defer func(client *http.Client) { downloadClient = client }(
+		downloadClient)
+	downloadClient = &http.Client{Timeout: 100 * time.Millisecond}
+	if _, err := downloadPDF(server.URL+"/pdf/stalled", dir,
+		"J14"); err == nil {
+		t.Errorf("expected an error for a stalled download")
+	}
+
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("got %d files, want only the downloaded PDF", len(files))
+	}
+}
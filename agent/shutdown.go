@@ -0,0 +1,93 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// exitUndelivered is the exit status when the agent shut down without
+// delivering every job it received.
+const exitUndelivered = 2
+
+// truncatedJobMessage is printed at the end of a job that was cut short
+// because the agent was shutting down.
+const truncatedJobMessage = "*** VIRTUAL1403: JOB TRUNCATED, AGENT WAS " +
+	"SHUT DOWN BEFORE THE END OF THE JOB ***"
+
+// undeliveredJobs counts the jobs that we couldn't write or upload.
+var undeliveredJobs int64
+
+// stop shuts down the supervisor, and returns the agent's exit status:
+// exitUndelivered if any jobs weren't delivered, otherwise 0.
+func (s *supervisor) stop(timeout time.Duration) int {
+	undelivered := s.shutdown(timeout)
+	if undelivered > 0 {
+		logger.Errorf("%d job(s) were not delivered", undelivered)
+		return exitUndelivered
+	}
+	logger.Infof("Shutdown complete")
+	return 0
+}
+
+// shutdown stops all of the inputs, which ends any jobs in progress, and
+// waits up to timeout for the final jobs to be written or uploaded and for
+// post-job hooks to finish. It returns the number of jobs which were not
+// delivered during the shutdown.
+func (s *supervisor) shutdown(timeout time.Duration) int {
+	failedBefore := atomic.LoadInt64(&undeliveredJobs)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	for name, r := range s.running {
+		logger.With("input", name).Infof("stopping input")
+		r.cancel()
+	}
+
+	// Any input that hasn't stopped by the deadline is still busy writing
+	// or uploading its last job.
+	pending := 0
+	for name, r := range s.running {
+		select {
+		case <-r.done:
+		case <-ctx.Done():
+			logger.With("input", name).Errorf(
+				"job still in progress at shutdown deadline")
+			pending++
+			continue
+		}
+		delete(s.running, name)
+	}
+
+	hooksDone := make(chan struct{})
+	go func() {
+		pendingHooks.Wait()
+		close(hooksDone)
+	}()
+	select {
+	case <-hooksDone:
+	case <-ctx.Done():
+		logger.Warnf("post-job hooks still running at shutdown deadline")
+	}
+
+	failed := atomic.LoadInt64(&undeliveredJobs) - failedBefore
+	return pending + int(failed)
+}
@@ -0,0 +1,94 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sendSlowly keeps a job going on conn by sending a line every 100ms, until
+// the input hangs up.
+func sendSlowly(conn net.Conn) {
+	for {
+		if _, err := io.WriteString(conn, "LINE\r\n"); err != nil {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestShutdownTruncatesJobs(t *testing.T) {
+	results := make(chan jobResult, 10)
+	srv := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			var result jobResult
+			json.NewDecoder(r.Body).Decode(&result)
+			results <- result
+		}))
+	defer srv.Close()
+
+	deliveredDir := t.TempDir()
+	outputs := map[string]OutputConfig{
+		"pdf": {Mode: "local", OutputDir: deliveredDir,
+			Hooks: []HookConfig{{Webhook: srv.URL}}},
+		"missing": {Mode: "local",
+			OutputDir: filepath.Join(t.TempDir(), "missing")},
+	}
+	herc, otherHerc := newFakeHercules(t), newFakeHercules(t)
+	inputs := map[string]InputConfig{
+		"delivered": {HerculesAddress: herc.addr(), Output: "pdf"},
+		"lost":      {HerculesAddress: otherHerc.addr(), Output: "missing"},
+	}
+
+	sup := newSupervisor()
+	if err := sup.apply(inputs, outputs); err != nil {
+		t.Fatal(err)
+	}
+	go sendSlowly(herc.accept(t))
+	go sendSlowly(otherHerc.accept(t))
+	time.Sleep(300 * time.Millisecond)
+
+	// Both jobs are cut short. One is written, but the other output's
+	// directory doesn't exist, so the agent exits with an error.
+	if status := sup.stop(5 * time.Second); status != exitUndelivered {
+		t.Errorf("got exit status %d, expected %d", status,
+			exitUndelivered)
+	}
+	if len(sup.running) != 0 {
+		t.Errorf("%d inputs still running", len(sup.running))
+	}
+
+	waitForPDF(t, deliveredDir)
+	select {
+	case result := <-results:
+		if !result.Truncated || result.Input != "delivered" ||
+			result.Pages != 1 {
+			t.Errorf("got job result %+v", result)
+		}
+	default:
+		t.Errorf("hook didn't run before shutdown finished")
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// Input connection states reported by the status endpoint.
+const (
+	stateStarting     = "starting"
+	stateConnecting   = "connecting"
+	stateListening    = "listening"
+	stateWaiting      = "waiting"
+	stateConnected    = "connected"
+	stateWatching     = "watching"
+	stateDisconnected = "disconnected"
+	stateStopped      = "stopped"
+)
+
+// pairStatus is what we know about one input/output pair.
+type pairStatus struct {
+	Input         string     `json:"input"`
+	Output        string     `json:"output"`
+	InputType     string     `json:"input_type"`
+	State         string     `json:"state"`
+	StateSince    time.Time  `json:"state_since"`
+	Connections   int        `json:"connections"`
+	Reconnects    int        `json:"reconnects"`
+	BytesReceived int64      `json:"bytes_received"`
+	Jobs          int        `json:"jobs"`
+	Pages         int        `json:"pages"`
+	FailedJobs    int        `json:"failed_jobs"`
+	LastJob       *time.Time `json:"last_job,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+	// SpoolDepth is the number of jobs that have been received but are not
+	// yet written or uploaded.
+	SpoolDepth int `json:"spool_depth"`
+
+	// received is counted by the input without taking the registry lock,
+	// and copied to BytesReceived in snapshots.
+	received *int64
+}
+
+// statusRegistry holds the status of every input/output pair.
+type statusRegistry struct {
+	mu      sync.Mutex
+	started time.Time
+	pairs   map[string]*pairStatus
+}
+
+var agentStatus = &statusRegistry{
+	started: time.Now(),
+	pairs:   make(map[string]*pairStatus),
+}
+
+// update calls f with the status of inputName, creating it if needed, while
+// holding the registry lock.
+func (r *statusRegistry) update(inputName string, f func(*pairStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.pairs[inputName]
+	if !ok {
+		s = &pairStatus{
+			Input:      inputName,
+			State:      stateStarting,
+			StateSince: time.Now(),
+			received:   new(int64),
+		}
+		r.pairs[inputName] = s
+	}
+	f(s)
+}
+
+// register records the configuration of a running input.
+func (r *statusRegistry) register(inputName string, input InputConfig) {
+	r.update(inputName, func(s *pairStatus) {
+		s.Output = input.Output
+		s.InputType = input.InputType
+		if s.InputType == "" {
+			s.InputType = "connect"
+		}
+	})
+}
+
+// remove forgets an input that is no longer configured.
+func (r *statusRegistry) remove(inputName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.pairs, inputName)
+}
+
+// snapshot returns a copy of all of the pair statuses, sorted by input name.
+func (r *statusRegistry) snapshot() []pairStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var pairs []pairStatus
+	for _, s := range r.pairs {
+		pair := *s
+		pair.BytesReceived = atomic.LoadInt64(s.received)
+		pairs = append(pairs, pair)
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Input < pairs[j].Input
+	})
+	return pairs
+}
+
+// setState records the connection state of an input. Each time an input
+// becomes connected counts as a connection.
+func setState(inputName, state string) {
+	agentStatus.update(inputName, func(s *pairStatus) {
+		if state == stateConnected {
+			s.Connections++
+			if s.Connections > 1 {
+				s.Reconnects++
+			}
+		}
+		if s.State != state {
+			s.State = state
+			s.StateSince = time.Now()
+		}
+	})
+}
+
+// setError records the most recent error for an input.
+func setError(inputName string, err error) {
+	now := time.Now()
+	agentStatus.update(inputName, func(s *pairStatus) {
+		s.LastError = err.Error()
+		s.LastErrorTime = &now
+	})
+}
+
+// jobDelivered records that an output handler wrote or uploaded a job.
+func jobDelivered(inputName string, pages int) {
+	now := time.Now()
+	agentStatus.update(inputName, func(s *pairStatus) {
+		s.Jobs++
+		s.Pages += pages
+		s.LastJob = &now
+	})
+}
+
+// jobNotDelivered records that an output handler failed to deliver a job.
+func jobNotDelivered(inputName string, err error) {
+	atomic.AddInt64(&undeliveredJobs, 1)
+	agentStatus.update(inputName, func(s *pairStatus) {
+		s.FailedJobs++
+	})
+	setError(inputName, err)
+}
+
+// failedJobCount returns the number of jobs from inputName that couldn't be
+// delivered.
+func failedJobCount(inputName string) int {
+	var n int
+	agentStatus.update(inputName, func(s *pairStatus) {
+		n = s.FailedJobs
+	})
+	return n
+}
+
+// countingInput counts the bytes read from an input. The scanner reads a
+// byte at a time, so we count into the input's counter directly instead of
+// going through the registry.
+type countingInput struct {
+	scanner.Input
+	received *int64
+}
+
+func newCountingInput(in scanner.Input, inputName string) countingInput {
+	var received *int64
+	agentStatus.update(inputName, func(s *pairStatus) {
+		received = s.received
+	})
+	return countingInput{in, received}
+}
+
+func (c countingInput) Read(p []byte) (int, error) {
+	n, err := c.Input.Read(p)
+	if n > 0 {
+		atomic.AddInt64(c.received, int64(n))
+	}
+	return n, err
+}
+
+// serveStatus runs the status HTTP server. It only returns if the server
+// fails.
+func serveStatus(address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/metrics", metricsHandler)
+
+	logger.Infof("Serving agent status on http://%s/status and "+
+		"http://%s/metrics", address, address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		logger.Errorf("status server failed: %v", err)
+	}
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	status := struct {
+		Version string       `json:"version"`
+		Started time.Time    `json:"started"`
+		Pairs   []pairStatus `json:"pairs"`
+	}{
+		Version: version,
+		Started: agentStatus.started,
+		Pairs:   agentStatus.snapshot(),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(&status)
+}
+
+// metricsHandler serves the status in the Prometheus text exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	pairs := agentStatus.snapshot()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	metric := func(name, kind, help string, value func(pairStatus) float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for _, p := range pairs {
+			fmt.Fprintf(w, "%s{input=\"%s\",output=\"%s\"} %s\n", name,
+				escapeLabel(p.Input), escapeLabel(p.Output),
+				strconv.FormatFloat(value(p), 'f', -1, 64))
+		}
+	}
+
+	metric("virtual1403_input_connected", "gauge",
+		"Whether the input is currently connected to Hercules.",
+		func(p pairStatus) float64 {
+			return boolMetric(p.State == stateConnected)
+		})
+	metric("virtual1403_input_reconnects_total", "counter",
+		"Number of times the input has reconnected to Hercules.",
+		func(p pairStatus) float64 { return float64(p.Reconnects) })
+	metric("virtual1403_input_bytes_received_total", "counter",
+		"Bytes of printer data received from Hercules.",
+		func(p pairStatus) float64 { return float64(p.BytesReceived) })
+	metric("virtual1403_jobs_total", "counter",
+		"Print jobs delivered to the output.",
+		func(p pairStatus) float64 { return float64(p.Jobs) })
+	metric("virtual1403_pages_total", "counter",
+		"Pages in the print jobs delivered to the output.",
+		func(p pairStatus) float64 { return float64(p.Pages) })
+	metric("virtual1403_jobs_failed_total", "counter",
+		"Print jobs that could not be delivered to the output.",
+		func(p pairStatus) float64 { return float64(p.FailedJobs) })
+	metric("virtual1403_last_job_timestamp_seconds", "gauge",
+		"Unix time of the last delivered print job.",
+		func(p pairStatus) float64 {
+			if p.LastJob == nil {
+				return 0
+			}
+			return float64(p.LastJob.Unix())
+		})
+	metric("virtual1403_spool_depth", "gauge",
+		"Print jobs received but not yet delivered to the output.",
+		func(p pairStatus) float64 { return float64(p.SpoolDepth) })
+}
+
+func boolMetric(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,60 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	agentStatus.register("test\"input", InputConfig{Output: "out"})
+	defer agentStatus.remove("test\"input")
+	setState("test\"input", stateConnected)
+	jobDelivered("test\"input", 3)
+	jobNotDelivered("test\"input", errors.New("paper jam"))
+	hercules, in := net.Pipe()
+	go func() {
+		io.WriteString(hercules, "HELLO\r\n")
+		hercules.Close()
+	}()
+	io.ReadAll(newCountingInput(in, "test\"input"))
+
+	rec := httptest.NewRecorder()
+	metricsHandler(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, want := range []string{
+		"# TYPE virtual1403_jobs_total counter\n",
+		`virtual1403_input_connected{input="test\"input",output="out"} 1`,
+		`virtual1403_jobs_total{input="test\"input",output="out"} 1`,
+		`virtual1403_pages_total{input="test\"input",output="out"} 3`,
+		`virtual1403_jobs_failed_total{input="test\"input",output="out"} 1`,
+		`virtual1403_input_bytes_received_total{input="test\"input",` +
+			`output="out"} 7`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// supervisor keeps track of the running inputs so that a new configuration
+// can be applied without restarting the agent. Inputs whose configuration
+// didn't change keep running, so their connections to Hercules aren't
+// dropped.
+type supervisor struct {
+	running map[string]*runningInput
+}
+
+type runningInput struct {
+	input   InputConfig
+	output  OutputConfig
+	handler *reloadableHandler
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func newSupervisor() *supervisor {
+	return &supervisor{running: make(map[string]*runningInput)}
+}
+
+// apply makes the running inputs match the configuration. Inputs that were
+// removed, or whose input settings changed, are stopped; inputs whose output
+// changed get the new output starting with their next job; and new inputs
+// are started. If any of the new output handlers can't be created, nothing is
+// changed and an error is returned.
+func (s *supervisor) apply(inputs map[string]InputConfig,
+	outputs map[string]OutputConfig) error {
+
+	// Create all of the handlers we need before changing anything.
+	handlers := make(map[string]scanner.PrinterHandler)
+	for name, input := range inputs {
+		// the output for the input is guaranteed to exist because of the
+		// earlier config validation.
+		output := outputs[input.Output]
+		if r, ok := s.running[name]; ok && sameSource(r.input, input) &&
+			r.input.Output == input.Output &&
+			reflect.DeepEqual(r.output, output) {
+			continue
+		}
+		handler, err := newOutputHandler(name, input.Output, output)
+		if err != nil {
+			return err
+		}
+		handlers[name] = handler
+	}
+
+	// Stop inputs that were removed or need to be restarted. We stop them
+	// all first so that a listen address or file that moved from one input
+	// to another is free when the new input starts.
+	// The status entries are removed once the inputs have finished, since
+	// they record their final state on the way out.
+	stopped := make(map[string]*runningInput)
+	for name, r := range s.running {
+		input, ok := inputs[name]
+		if ok && sameSource(r.input, input) {
+			continue
+		}
+		logger.With("input", name).Infof("stopping input")
+		r.cancel()
+		stopped[name] = r
+		delete(s.running, name)
+	}
+	for name, r := range stopped {
+		<-r.done
+		agentStatus.remove(name)
+	}
+
+	// Update and start inputs in a consistent order. We'll wait 250ms
+	// between startups so the initial log messages from each don't
+	// intermingle.
+	var names []string
+	for name := range inputs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		input := inputs[name]
+		handler, changed := handlers[name]
+		if !changed {
+			continue
+		}
+
+		if r, ok := s.running[name]; ok {
+			logger.With("input", name).Infof("will use output [%s] starting "+
+				"with its next job", input.Output)
+			r.handler.replace(handler)
+			agentStatus.register(name, input)
+			r.input = input
+			r.output = outputs[input.Output]
+			continue
+		}
+
+		logger.With("input", name, "output", input.Output).Infof(
+			"starting input/output pair")
+		ctx, cancel := context.WithCancel(context.Background())
+		r := &runningInput{
+			input:   input,
+			output:  outputs[input.Output],
+			handler: newReloadableHandler(handler, name),
+			cancel:  cancel,
+			done:    make(chan struct{}),
+		}
+		s.running[name] = r
+		agentStatus.register(name, input)
+		go func(name string) {
+			defer close(r.done)
+			runPrinter(ctx, name, input, r.handler)
+		}(name)
+		time.Sleep(250 * time.Millisecond)
+	}
+
+	return nil
+}
+
+// sameSource returns true if the two input configurations read from the same
+// place in the same way, ignoring which output they print to.
+func sameSource(a, b InputConfig) bool {
+	a.Output = ""
+	b.Output = ""
+	return reflect.DeepEqual(a, b)
+}
+
+// reloadableHandler is a PrinterHandler that passes everything through to
+// another handler, which can be replaced while the input is running. The
+// replacement only takes effect between jobs so that a job is never split
+// across two outputs.
+type reloadableHandler struct {
+	mu        sync.Mutex
+	current   scanner.PrinterHandler
+	next      scanner.PrinterHandler
+	inJob     bool
+	inputName string
+}
+
+func newReloadableHandler(h scanner.PrinterHandler,
+	inputName string) *reloadableHandler {
+
+	return &reloadableHandler{current: h, inputName: inputName}
+}
+
+// replace arranges for h to receive all jobs after the current one.
+func (r *reloadableHandler) replace(h scanner.PrinterHandler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inJob {
+		r.next = h
+		return
+	}
+	r.current = h
+	r.next = nil
+}
+
+// handler returns the handler for the current job, marking that a job is in
+// progress.
+func (r *reloadableHandler) handler() scanner.PrinterHandler {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inJob = true
+	return r.current
+}
+
+func (r *reloadableHandler) AddLine(line string, linefeed bool) {
+	r.handler().AddLine(line, linefeed)
+}
+
+func (r *reloadableHandler) PageBreak() {
+	r.handler().PageBreak()
+}
+
+func (r *reloadableHandler) SkipToChannel(channel int) {
+	h := r.handler()
+	if ch, ok := h.(scanner.ChannelHandler); ok {
+		ch.SkipToChannel(channel)
+	} else {
+		h.AddLine("", true)
+	}
+}
+
+func (r *reloadableHandler) JobTruncated() {
+	if h, ok := r.handler().(scanner.TruncatedJobHandler); ok {
+		h.JobTruncated()
+	}
+}
+
+func (r *reloadableHandler) EndOfJob(job scanner.JobInfo) {
+	h := r.handler()
+
+	// The job is waiting in the spool until the output handler has finished
+	// writing or uploading it.
+	agentStatus.update(r.inputName, func(s *pairStatus) { s.SpoolDepth++ })
+	h.EndOfJob(job)
+	agentStatus.update(r.inputName, func(s *pairStatus) { s.SpoolDepth-- })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.inJob = false
+	if r.next != nil {
+		r.current = r.next
+		r.next = nil
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeHercules is a Hercules printer socket device for inputs to connect
+// to.
+type fakeHercules struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newFakeHercules(t *testing.T) *fakeHercules {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := &fakeHercules{listener: listener, conns: make(chan net.Conn, 10)}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			h.conns <- conn
+		}
+	}()
+	return h
+}
+
+func (h *fakeHercules) addr() string {
+	return h.listener.Addr().String()
+}
+
+// accept returns the next connection from an input.
+func (h *fakeHercules) accept(t *testing.T) net.Conn {
+	t.Helper()
+	select {
+	case conn := <-h.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no input connected to %s", h.addr())
+		return nil
+	}
+}
+
+// connected returns true if an input has made a connection that we haven't
+// accepted yet.
+func (h *fakeHercules) connected() bool {
+	select {
+	case conn := <-h.conns:
+		h.conns <- conn
+		return true
+	case <-time.After(100 * time.Millisecond):
+		return false
+	}
+}
+
+// hungUp returns true if the input at the other end of conn has closed it.
+func hungUp(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(250 * time.Millisecond))
+	_, err := conn.Read(make([]byte, 1))
+	return errors.Is(err, io.EOF)
+}
+
+// waitForPDF waits for a PDF to be written to dir.
+func waitForPDF(t *testing.T, dir string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(
+		deadline); time.Sleep(50 * time.Millisecond) {
+
+		if files, _ := filepath.Glob(filepath.Join(dir,
+			"*.pdf")); len(files) > 0 {
+			return
+		}
+	}
+	t.Fatalf("no PDF written to %s", dir)
+}
+
+func TestSupervisorApply(t *testing.T) {
+	first, second, third, moved := newFakeHercules(t), newFakeHercules(t),
+		newFakeHercules(t), newFakeHercules(t)
+	firstDir, otherDir := t.TempDir(), t.TempDir()
+	outputs := map[string]OutputConfig{
+		"pdf":   {Mode: "local", OutputDir: firstDir},
+		"other": {Mode: "local", OutputDir: otherDir},
+	}
+	inputs := map[string]InputConfig{
+		"unchanged": {HerculesAddress: first.addr(), Output: "pdf"},
+		"moved":     {HerculesAddress: second.addr(), Output: "pdf"},
+		"rerouted":  {HerculesAddress: third.addr(), Output: "pdf"},
+	}
+
+	sup := newSupervisor()
+	defer sup.shutdown(5 * time.Second)
+	if err := sup.apply(inputs, outputs); err != nil {
+		t.Fatal(err)
+	}
+	unchangedConn := first.accept(t)
+	movedConn := second.accept(t)
+	reroutedConn := third.accept(t)
+
+	// Move one input to another address, and send another to a different
+	// output.
+	inputs = map[string]InputConfig{
+		"unchanged": {HerculesAddress: first.addr(), Output: "pdf"},
+		"moved":     {HerculesAddress: moved.addr(), Output: "pdf"},
+		"rerouted":  {HerculesAddress: third.addr(), Output: "other"},
+	}
+	if err := sup.apply(inputs, outputs); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the moved input is restarted.
+	if !hungUp(movedConn) {
+		t.Errorf("moved input didn't close its old connection")
+	}
+	moved.accept(t)
+	if hungUp(unchangedConn) || first.connected() {
+		t.Errorf("unchanged input was restarted")
+	}
+	if hungUp(reroutedConn) || third.connected() {
+		t.Errorf("input with a new output was restarted")
+	}
+
+	// The rerouted input's next job goes to its new output. The job ends
+	// once Hercules has been quiet for a moment.
+	io.WriteString(reroutedConn, "HELLO\r\n")
+	waitForPDF(t, otherDir)
+	if files, _ := os.ReadDir(firstDir); len(files) != 0 {
+		t.Errorf("rerouted job went to the old output")
+	}
+
+	// Removed inputs are stopped.
+	delete(inputs, "rerouted")
+	if err := sup.apply(inputs, outputs); err != nil {
+		t.Fatal(err)
+	}
+	if !hungUp(reroutedConn) {
+		t.Errorf("removed input is still running")
+	}
+	if hungUp(unchangedConn) {
+		t.Errorf("unchanged input was stopped")
+	}
+	if state := inputState("rerouted"); state != "" {
+		t.Errorf("removed input is still in the status, in state %s", state)
+	}
+	if state := inputState("unchanged"); state != stateConnected {
+		t.Errorf("got state %s for the unchanged input", state)
+	}
+}
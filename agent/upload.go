@@ -0,0 +1,218 @@
+package main
+
+// Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/racingmars/virtual1403/logging"
+)
+
+// uploadChunkSize is how much compressed job data the online output collects
+// before sending it to the server, so that large jobs aren't held in memory.
+// Jobs smaller than this are sent to the print API in a single request.
+const uploadChunkSize = 256 * 1024
+
+// uploadRetries is how many times we try to resume sending a chunk after an
+// error before giving up on the job.
+const uploadRetries = 5
+
+// errUploadsUnsupported is returned by beginUpload for servers that don't
+// have the chunked upload API.
+var errUploadsUnsupported = errors.New(
+	"print API doesn't support chunked uploads")
+
+// uploadStatusError is an unexpected HTTP response from the upload API.
+type uploadStatusError struct {
+	status string
+	code   int
+}
+
+func (e *uploadStatusError) Error() string {
+	return "upload API response status: " + e.status
+}
+
+// temporary is true if trying again might help.
+func (e *uploadStatusError) temporary() bool {
+	return e.code == http.StatusConflict || e.code >= 500
+}
+
+// jobUpload is an upload session on the print API server. The job is sent
+// in chunks with send, and printed with a commit request.
+type jobUpload struct {
+	url    string
+	key    string
+	offset int64
+}
+
+// beginUpload starts an upload session with the print API at api.
+func beginUpload(api, key string) (*jobUpload, error) {
+	u := &jobUpload{url: api + "/jobs", key: key}
+	req, err := u.newRequest(http.MethodPost, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Encoding", "zstd")
+	req.Header.Set("Content-Type", "text/x-print-job")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	// Older servers don't have the upload API at all.
+	switch resp.StatusCode {
+	case http.StatusCreated:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return nil, errUploadsUnsupported
+	default:
+		return nil, &uploadStatusError{resp.Status, resp.StatusCode}
+	}
+
+	location, err := resp.Location()
+	if err != nil {
+		return nil, fmt.Errorf("upload session location: %v", err)
+	}
+	u.url = location.String()
+	return u, nil
+}
+
+// newRequest returns an authenticated request for the upload session's URL
+// followed by suffix.
+func (u *jobUpload) newRequest(method, suffix string,
+	body io.Reader) (*http.Request, error) {
+
+	req, err := http.NewRequest(method, u.url+suffix, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+u.key)
+	return req, nil
+}
+
+// send appends chunk to the job. If the connection drops or the server has a
+// problem, it asks the server how much of the chunk it got and sends the
+// rest, up to uploadRetries times.
+func (u *jobUpload) send(chunk []byte, log *logging.Logger) error {
+	start := u.offset
+	end := start + int64(len(chunk))
+	failures := 0
+	for u.offset < end {
+		err := u.put(chunk[u.offset-start:])
+		if err == nil {
+			continue
+		}
+		var statusErr *uploadStatusError
+		if errors.As(err, &statusErr) && !statusErr.temporary() {
+			return err
+		}
+		failures++
+		if failures > uploadRetries {
+			return err
+		}
+		log.Warnf("problem uploading print job, will resume: %v", err)
+		time.Sleep(time.Duration(failures) * 2 * time.Second)
+		if err := u.resume(); err != nil {
+			log.Warnf("unable to get upload offset: %v", err)
+		}
+		if u.offset < start || u.offset > end {
+			return fmt.Errorf("server's upload offset %d is outside the "+
+				"chunk we're sending (%d-%d)", u.offset, start, end)
+		}
+	}
+	return nil
+}
+
+// put sends data at the current offset, and updates the offset to what the
+// server says it has.
+func (u *jobUpload) put(data []byte) error {
+	req, err := u.newRequest(http.MethodPut, "", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Upload-Offset", strconv.FormatInt(u.offset, 10))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	defer io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusOK {
+		return &uploadStatusError{resp.Status, resp.StatusCode}
+	}
+	return u.setOffset(resp)
+}
+
+// resume asks the server how much of the job it has.
+func (u *jobUpload) resume() error {
+	req, err := u.newRequest(http.MethodHead, "", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent &&
+		resp.StatusCode != http.StatusOK {
+		return &uploadStatusError{resp.Status, resp.StatusCode}
+	}
+	return u.setOffset(resp)
+}
+
+// setOffset updates the offset from the Upload-Offset header of resp.
+func (u *jobUpload) setOffset(resp *http.Response) error {
+	offset, err := strconv.ParseInt(resp.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid upload offset from server: %v", err)
+	}
+	u.offset = offset
+	return nil
+}
+
+// commitRequest returns the request that prints the uploaded job.
+func (u *jobUpload) commitRequest() (*http.Request, error) {
+	return u.newRequest(http.MethodPost, "/commit", nil)
+}
+
+// abort abandons the upload session, so the server can delete what we've
+// sent so far.
+func (u *jobUpload) abort() {
+	req, err := u.newRequest(http.MethodDelete, "", nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	resp.Body.Close()
+}
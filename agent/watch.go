@@ -0,0 +1,193 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// watchPollInterval is how often we look for new files in a watched folder.
+const watchPollInterval = 1 * time.Second
+
+// defaultStableSeconds is how long a file in a watched folder must go
+// without changing before we print it, if the input doesn't configure it.
+const defaultStableSeconds = 5
+
+// Printed files are moved to these subfolders of the watched folder.
+const (
+	watchDoneDir   = "done"
+	watchFailedDir = "failed"
+)
+
+// watchedFile is what we last saw of a file in a watched folder.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	since   time.Time
+	handled bool
+}
+
+// handleWatch prints each file that appears in the watched folder of input,
+// once the file has stopped changing, and then moves it to the done or
+// failed subfolder. Hidden files are ignored, so other systems may write a
+// file under a hidden name and rename it when it's complete. We return if
+// the folder can't be read.
+func handleWatch(ctx context.Context, input InputConfig,
+	handler scanner.PrinterHandler, inputName string) {
+
+	log := logger.With("input", inputName)
+	dir := input.WatchDirectory
+	for _, sub := range []string{watchDoneDir, watchFailedDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			log.Errorf("Couldn't create folder: %v", err)
+			setError(inputName, err)
+			return
+		}
+	}
+
+	stable := time.Duration(input.StableSeconds) * time.Second
+	if input.StableSeconds == 0 {
+		stable = defaultStableSeconds * time.Second
+	}
+	// The carriage control was validated with the configuration.
+	cc, _ := parseCarriageControl(input.CarriageControl)
+
+	log.Infof("Watching folder %s for files to print...", dir)
+	setState(inputName, stateWatching)
+	defer setState(inputName, stateDisconnected)
+
+	seen := make(map[string]*watchedFile)
+	ticker := time.NewTicker(watchPollInterval)
+	defer ticker.Stop()
+	for {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			log.Errorf("Couldn't read folder: %v", err)
+			setError(inputName, err)
+			return
+		}
+
+		present := make(map[string]bool)
+		for _, entry := range entries {
+			name := entry.Name()
+			if !entry.Type().IsRegular() || strings.HasPrefix(name, ".") {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil {
+				// The file was removed since we read the folder.
+				continue
+			}
+			present[name] = true
+
+			w, ok := seen[name]
+			if !ok || w.size != info.Size() ||
+				!w.modTime.Equal(info.ModTime()) {
+				// New or still being written.
+				seen[name] = &watchedFile{
+					size:    info.Size(),
+					modTime: info.ModTime(),
+					since:   time.Now(),
+				}
+				continue
+			}
+			if w.handled || time.Since(w.since) < stable {
+				continue
+			}
+
+			w.handled = true
+			printWatchedFile(dir, name, cc, handler, inputName)
+			if ctx.Err() != nil {
+				return
+			}
+		}
+
+		for name := range seen {
+			if !present[name] {
+				delete(seen, name)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// printWatchedFile prints the file name in the watched folder dir, then moves
+// it to the done or failed subfolder.
+func printWatchedFile(dir, name string, cc carriageControl,
+	handler scanner.PrinterHandler, inputName string) {
+
+	path := filepath.Join(dir, name)
+	jobname := jobNameForFile(name)
+	log := logger.With("input", inputName, "file", path, "job", jobname)
+
+	ok := false
+	if f, err := os.Open(path); err != nil {
+		log.Errorf("Couldn't open file: %v", err)
+		setError(inputName, err)
+	} else {
+		failedBefore := failedJobCount(inputName)
+		err = scanFile(f, name, jobname, cc, handler, log)
+		f.Close()
+		if err != nil {
+			log.Errorf("couldn't read file: %v", err)
+			setError(inputName, err)
+		} else {
+			// If the job wasn't delivered, the output handler has already
+			// logged why.
+			ok = failedJobCount(inputName) == failedBefore
+		}
+	}
+
+	sub := watchDoneDir
+	if !ok {
+		sub = watchFailedDir
+	}
+	dest, err := moveWatchedFile(dir, name, sub)
+	if err != nil {
+		// We won't print the file again unless it changes or the input is
+		// restarted.
+		log.Errorf("Couldn't move file to %s: %v", sub, err)
+		setError(inputName, err)
+		return
+	}
+	log.Infof("Moved file to %s", dest)
+}
+
+// moveWatchedFile moves the file name in dir to the subfolder sub. If there
+// is already a file with that name in sub, the current time is added to the
+// name of the file we're moving.
+func moveWatchedFile(dir, name, sub string) (string, error) {
+	dest := filepath.Join(dir, sub, name)
+	if _, err := os.Lstat(dest); err == nil {
+		dest = filepath.Join(dir, sub, name+"."+
+			time.Now().UTC().Format("20060102T150405.000000000"))
+	}
+	return dest, os.Rename(filepath.Join(dir, name), dest)
+}
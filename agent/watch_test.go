@@ -0,0 +1,164 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// jobRecorder is a printer handler that counts the lines of each job. Jobs
+// whose names start with "bad" aren't delivered.
+type jobRecorder struct {
+	mu        sync.Mutex
+	inputName string
+	lines     int
+	jobs      map[string]int
+}
+
+func (r *jobRecorder) AddLine(string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lines++
+}
+
+func (r *jobRecorder) PageBreak() {}
+
+func (r *jobRecorder) EndOfJob(job scanner.JobInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if strings.HasPrefix(job.Name, "bad") {
+		jobNotDelivered(r.inputName, errors.New("out of paper"))
+	}
+	r.jobs[job.Name] = r.lines
+	r.lines = 0
+}
+
+// job returns the number of lines printed for the job name, and whether it
+// was printed at all.
+func (r *jobRecorder) job(name string) (int, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	lines, ok := r.jobs[name]
+	return lines, ok
+}
+
+// waitForFile waits for a file to exist at path.
+func waitForFile(t *testing.T, path string) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(
+		deadline); time.Sleep(50 * time.Millisecond) {
+
+		if _, err := os.Lstat(path); err == nil {
+			return
+		}
+	}
+	t.Fatalf("%s didn't appear", path)
+}
+
+func TestWatchFolder(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		t.Helper()
+		err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("good.txt", "HELLO\nWORLD\n")
+	write("bad.txt", "HELLO\n")
+	write(".partial.txt", "HELLO\n")
+	if err := os.MkdirAll(filepath.Join(dir, watchDoneDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	// A file printed earlier with the same name is kept.
+	write(filepath.Join(watchDoneDir, "good.txt"), "OLD\n")
+
+	// This file is still being written, so it mustn't be printed yet.
+	growing, err := os.Create(filepath.Join(dir, "growing.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer growing.Close()
+	stopGrowing, grown := make(chan struct{}), make(chan int)
+	go func() {
+		n := 0
+		for {
+			select {
+			case <-stopGrowing:
+				grown <- n
+				return
+			case <-time.After(200 * time.Millisecond):
+				n++
+				fmt.Fprintf(growing, "LINE %d\n", n)
+			}
+		}
+	}()
+
+	recorder := &jobRecorder{inputName: "watch", jobs: make(map[string]int)}
+	agentStatus.register("watch", InputConfig{})
+	defer agentStatus.remove("watch")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		handleWatch(ctx, InputConfig{WatchDirectory: dir, StableSeconds: 1},
+			recorder, "watch")
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitForFile(t, filepath.Join(dir, watchFailedDir, "bad.txt"))
+	if lines, _ := recorder.job("good_txt"); lines != 2 {
+		t.Errorf("got %d lines for good.txt, want 2", lines)
+	}
+	moved, _ := filepath.Glob(filepath.Join(dir, watchDoneDir, "good.txt*"))
+	if len(moved) != 2 {
+		t.Errorf("got %v in the done folder, want both copies of good.txt",
+			moved)
+	}
+	if _, printed := recorder.job("growing_txt"); printed {
+		t.Errorf("file was printed while it was still being written")
+	}
+
+	close(stopGrowing)
+	n := <-grown
+	waitForFile(t, filepath.Join(dir, watchDoneDir, "growing.txt"))
+	if lines, _ := recorder.job("growing_txt"); lines != n {
+		t.Errorf("got %d lines for growing.txt, want %d", lines, n)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, ".partial.txt")); err != nil {
+		t.Errorf("hidden file was moved: %v", err)
+	}
+	if _, printed := recorder.job("_partial_txt"); printed {
+		t.Errorf("hidden file was printed")
+	}
+}
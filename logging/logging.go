@@ -0,0 +1,420 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+/*
+Package logging is the leveled, structured logger shared by the agent and
+the web server.
+
+Each Logger belongs to a component (e.g. "agent", "scanner", "db") and may
+carry key/value fields, such as the input name or the user's email address,
+that are included with every message it logs:
+
+	logger := logging.New("agent").With("input", inputName)
+	logger.Infof("connecting to Hercules on %s", address)
+	logger.Warn("Hercules disconnected", "bytes", n)
+
+Messages are written as text lines in the familiar format
+
+	2022/01/02 15:04:05 INFO:  [agent] connecting to Hercules on 127.0.0.1:1403 input=default
+
+or, after SetFormat(FormatJSON), as one JSON object per line. The minimum
+level is set for all components with Configure, and may be overridden for
+individual components, e.g. "info,scanner=debug".
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelTrace Level = iota - 1
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// String returns the lowercase name of the level.
+func (l Level) String() string {
+	switch l {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level" + strconv.Itoa(int(l))
+}
+
+// ParseLevel converts a level name, as returned by Level.String, to a Level.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "trace":
+		return LevelTrace, nil
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level `%s`", s)
+}
+
+// Format is the output format of the log.
+type Format int
+
+const (
+	FormatText Format = iota
+	FormatJSON
+)
+
+// ParseFormat converts "text" or "json" to a Format. The empty string is
+// text.
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "", "text":
+		return FormatText, nil
+	case "json":
+		return FormatJSON, nil
+	}
+	return FormatText, fmt.Errorf("unknown log format `%s`", s)
+}
+
+// The logging configuration is shared by all loggers.
+var (
+	mu     sync.Mutex
+	out    io.Writer = os.Stderr
+	format Format
+	levels atomic.Value // *levelConfig
+)
+
+// levelConfig holds the minimum levels. It is replaced rather than modified,
+// so that loggers can check whether a message is enabled without locking.
+type levelConfig struct {
+	defaultLevel    Level
+	componentLevels map[string]Level
+}
+
+func init() {
+	levels.Store(&levelConfig{defaultLevel: LevelInfo})
+}
+
+// SetOutput sets where log messages are written. The default is stderr.
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// SetFormat sets the output format for all loggers.
+func SetFormat(f Format) {
+	mu.Lock()
+	defer mu.Unlock()
+	format = f
+}
+
+// SetLevel sets the minimum level logged by components that don't have their
+// own level.
+func SetLevel(level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	current := levels.Load().(*levelConfig)
+	levels.Store(&levelConfig{
+		defaultLevel:    level,
+		componentLevels: current.componentLevels,
+	})
+}
+
+// SetComponentLevel sets the minimum level logged by one component.
+func SetComponentLevel(component string, level Level) {
+	mu.Lock()
+	defer mu.Unlock()
+	current := levels.Load().(*levelConfig)
+	componentLevels := make(map[string]Level, len(current.componentLevels)+1)
+	for name, l := range current.componentLevels {
+		componentLevels[name] = l
+	}
+	componentLevels[component] = level
+	levels.Store(&levelConfig{
+		defaultLevel:    current.defaultLevel,
+		componentLevels: componentLevels,
+	})
+}
+
+// Configure sets the levels from a specification such as "warn" or
+// "info,scanner=debug,db=warn": an optional default level followed by
+// component=level overrides, separated by commas. An empty spec leaves the
+// levels as they are.
+func Configure(spec string) error {
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		component, levelName := "", part
+		if i := strings.Index(part, "="); i >= 0 {
+			component = strings.TrimSpace(part[:i])
+			levelName = part[i+1:]
+			if component == "" {
+				return fmt.Errorf("missing component name in `%s`", part)
+			}
+		}
+		level, err := ParseLevel(levelName)
+		if err != nil {
+			return err
+		}
+		if component == "" {
+			SetLevel(level)
+		} else {
+			SetComponentLevel(component, level)
+		}
+	}
+	return nil
+}
+
+// Logger writes messages for one component. Loggers are immutable and safe
+// for concurrent use; With returns a new Logger with additional fields.
+type Logger struct {
+	component string
+	fields    []interface{}
+}
+
+// New returns a Logger for component.
+func New(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// With returns a Logger that adds the key/value pairs kv to every message.
+// Keys should be strings.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{component: l.component, fields: fields}
+}
+
+// Component returns the logger's component name.
+func (l *Logger) Component() string {
+	return l.component
+}
+
+// Enabled returns true if messages at level will be logged. It may be used
+// to avoid expensive work preparing debug messages.
+func (l *Logger) Enabled(level Level) bool {
+	current := levels.Load().(*levelConfig)
+	min, ok := current.componentLevels[l.component]
+	if !ok {
+		min = current.defaultLevel
+	}
+	return level >= min
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, "", msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, "", msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, "", msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, "", msg, kv)
+}
+
+// Tracef logs below the debug level. It is meant for very chatty messages,
+// such as the scanners' state changes for every byte they read.
+func (l *Logger) Tracef(format string, args ...interface{}) {
+	if l.Enabled(LevelTrace) {
+		l.log(LevelTrace, "", fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	if l.Enabled(LevelDebug) {
+		l.log(LevelDebug, "", fmt.Sprintf(format, args...), nil)
+	}
+}
+
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(LevelInfo, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(LevelWarn, "", fmt.Sprintf(format, args...), nil)
+}
+
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(LevelError, "", fmt.Sprintf(format, args...), nil)
+}
+
+// Fatalf logs the message, which is never filtered out, and exits the
+// program with status 1.
+func (l *Logger) Fatalf(format string, args ...interface{}) {
+	l.log(LevelError, "fatal", fmt.Sprintf(format, args...), nil)
+	os.Exit(1)
+}
+
+// log writes a message. label overrides the name of the level in the output.
+func (l *Logger) log(level Level, label, msg string, kv []interface{}) {
+	if label == "" {
+		if !l.Enabled(level) {
+			return
+		}
+		label = level.String()
+	}
+
+	fields := l.fields
+	if len(kv) > 0 {
+		fields = append(append([]interface{}{}, l.fields...), kv...)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	var line []byte
+	if format == FormatJSON {
+		line = formatJSON(time.Now(), label, l.component, msg, fields)
+	} else {
+		line = formatText(time.Now(), label, l.component, msg, fields)
+	}
+	out.Write(line)
+}
+
+// formatText formats a message like the standard library log package, with
+// our level prefixes and the fields as key=value pairs.
+func formatText(t time.Time, label, component, msg string,
+	fields []interface{}) []byte {
+
+	var b bytes.Buffer
+	b.WriteString(t.Format("2006/01/02 15:04:05 "))
+	b.WriteString(fmt.Sprintf("%-7s", strings.ToUpper(label)+":"))
+	if component != "" {
+		b.WriteString("[" + component + "] ")
+	}
+	b.WriteString(strings.TrimRight(msg, "\n"))
+	for i := 0; i < len(fields); i += 2 {
+		b.WriteByte(' ')
+		b.WriteString(fieldKey(fields, i))
+		b.WriteByte('=')
+		b.WriteString(textValue(fieldValue(fields, i)))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// formatJSON formats a message as a single-line JSON object. The standard
+// keys come first, followed by the fields in the order they were added.
+func formatJSON(t time.Time, label, component, msg string,
+	fields []interface{}) []byte {
+
+	var b bytes.Buffer
+	writePair := func(key string, value interface{}) {
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		k, _ := json.Marshal(key)
+		b.Write(k)
+		b.WriteByte(':')
+		b.Write(jsonValue(value))
+	}
+
+	writePair("time", t.UTC().Format(time.RFC3339Nano))
+	writePair("level", label)
+	if component != "" {
+		writePair("component", component)
+	}
+	writePair("msg", strings.TrimRight(msg, "\n"))
+	for i := 0; i < len(fields); i += 2 {
+		writePair(fieldKey(fields, i), fieldValue(fields, i))
+	}
+	return append(append([]byte{'{'}, b.Bytes()...), '}', '\n')
+}
+
+func fieldKey(fields []interface{}, i int) string {
+	if s, ok := fields[i].(string); ok {
+		return s
+	}
+	return fmt.Sprint(fields[i])
+}
+
+// fieldValue returns the value for the key at i. A key without a value gets
+// a placeholder rather than being dropped.
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i+1 >= len(fields) {
+		return "(missing)"
+	}
+	return fields[i+1]
+}
+
+func textValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case time.Time:
+		s = v.Format(time.RFC3339)
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func jsonValue(v interface{}) []byte {
+	switch val := v.(type) {
+	case error:
+		v = val.Error()
+	case fmt.Stringer:
+		if _, ok := v.(time.Time); !ok {
+			v = val.String()
+		}
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return b
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture runs f with the log written to a buffer and the configuration
+// reset to the defaults, and returns what was logged.
+func capture(f func()) string {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	SetFormat(FormatText)
+	levels.Store(&levelConfig{defaultLevel: LevelInfo})
+	defer func() {
+		SetOutput(os.Stderr)
+		SetFormat(FormatText)
+		levels.Store(&levelConfig{defaultLevel: LevelInfo})
+	}()
+	f()
+	return buf.String()
+}
+
+func TestText(t *testing.T) {
+	got := capture(func() {
+		New("agent").With("input", "default").Info("job done",
+			"pages", 3, "job", "J12 IBMUSER", "err", errors.New("none"))
+	})
+	want := `INFO:  [agent] job done input=default pages=3 ` +
+		`job="J12 IBMUSER" err=none` + "\n"
+	if !strings.HasSuffix(got, want) {
+		t.Errorf("got %q, expected suffix %q", got, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	got := capture(func() {
+		SetFormat(FormatJSON)
+		New("server").With("request_id", "abc").Warnf("quota %d", 5)
+	})
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal([]byte(got), &entry); err != nil {
+		t.Fatalf("invalid JSON %q: %v", got, err)
+	}
+	if entry["level"] != "warn" || entry["component"] != "server" ||
+		entry["msg"] != "quota 5" || entry["request_id"] != "abc" {
+		t.Errorf("unexpected JSON entry: %v", entry)
+	}
+	if !strings.HasPrefix(got, `{"time":`) {
+		t.Errorf("JSON keys out of order: %s", got)
+	}
+}
+
+func TestLevels(t *testing.T) {
+	got := capture(func() {
+		if err := Configure("warn,scanner=debug"); err != nil {
+			t.Fatal(err)
+		}
+		New("agent").Info("hidden")
+		New("agent").Error("shown")
+		New("scanner").Debugf("byte %02x", 0x0c)
+		New("scanner").Tracef("state change")
+	})
+	if strings.Contains(got, "hidden") {
+		t.Error("info message logged at warn level")
+	}
+	if !strings.Contains(got, "ERROR: [agent] shown") {
+		t.Errorf("error message not logged: %q", got)
+	}
+	if !strings.Contains(got, "DEBUG: [scanner] byte 0c") {
+		t.Errorf("component debug message not logged: %q", got)
+	}
+	if strings.Contains(got, "state change") {
+		t.Error("trace message logged at debug level")
+	}
+
+	if err := Configure("info,=debug"); err == nil {
+		t.Error("missing component name was accepted")
+	}
+	if err := Configure("loud"); err == nil {
+		t.Error("unknown level was accepted")
+	}
+}
@@ -21,7 +21,6 @@ package scanner
 import (
 	"bufio"
 	"io"
-	"log"
 	"unicode/utf8"
 )
 
@@ -29,9 +28,10 @@ import (
 // prints the entire contents to the handler. No job separation is attempted.
 // The input file is assumed to be UTF-8 (compatible with US-ASCII) encoded,
 // with the first character of each line being an ASA carriage control
-// instructions (' ', '1', '0', '-', and '+' are supported).
-func ScanASAUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
-	trace bool) error {
+// instructions (' ', '1', '0', '-', '+', and '2'-'9' and 'A'-'C' to skip to
+// channels 2-12 are supported).
+func ScanASAUTF8Single(r io.Reader, jobname string,
+	handler PrinterHandler) error {
 
 	linenum := 0
 	var prevline string
@@ -56,7 +56,7 @@ func ScanASAUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
 			// choices (or at least reconsider their input file), but again,
 			// we'll be generous and just ignore it and try to carry on
 			// assuming this is a regular line.
-			log.Printf("ERROR: invalid UTF-8 byte sequence at beginning "+
+			logger.Errorf("invalid UTF-8 byte sequence at beginning "+
 				"of line %d", linenum)
 			control = rune(' ')
 		}
@@ -81,7 +81,11 @@ func ScanASAUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
 				handler.AddLine("", true)
 				handler.AddLine("", true)
 			default:
-				log.Printf("ERROR: unknown/unimplemented control "+
+				if channel := asaChannel(control); channel != 0 {
+					skipToChannel(handler, channel)
+					break
+				}
+				logger.Errorf("unknown/unimplemented control "+
 					"character '%s' on line %d", string(control), linenum)
 			}
 			prevline = rest
@@ -109,7 +113,11 @@ func ScanASAUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
 			handler.AddLine(prevline, false)
 		default:
 			handler.AddLine(prevline, true)
-			log.Printf("ERROR: unknown/unimplemented control "+
+			if channel := asaChannel(control); channel != 0 {
+				skipToChannel(handler, channel)
+				break
+			}
+			logger.Errorf("unknown/unimplemented control "+
 				"character '%s' on line %d", string(control), linenum)
 		}
 
@@ -125,7 +133,29 @@ func ScanASAUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
 	// We always need to finish by writing the last line in the prevline
 	// buffer
 	handler.AddLine(prevline, true)
-	handler.EndOfJob(jobname)
+	handler.EndOfJob(JobInfo{Name: jobname})
 
 	return nil
 }
+
+// IsASAControl returns true if b is an ASA carriage control character that
+// we know how to handle.
+func IsASAControl(b byte) bool {
+	switch b {
+	case ' ', '1', '0', '-', '+':
+		return true
+	}
+	return asaChannel(rune(b)) != 0
+}
+
+// asaChannel returns the channel (2-12) that an ASA control character skips
+// to before printing, or 0 if it isn't a skip to channel 2-12.
+func asaChannel(control rune) int {
+	switch {
+	case control >= '2' && control <= '9':
+		return int(control - '0')
+	case control >= 'A' && control <= 'C':
+		return int(control-'A') + 10
+	}
+	return 0
+}
@@ -18,11 +18,52 @@
 
 package scanner
 
+import (
+	"io"
+	"time"
+)
+
+// Input is a source of printer data for the scanner. In addition to reading,
+// the scanner needs to set read deadlines so it can detect the end of a job
+// when the printer stops sending data in the middle of a page. net.Conn
+// satisfies this interface; sources that don't support deadlines may be
+// wrapped with NewDeadlineReader.
+type Input interface {
+	io.Reader
+	SetReadDeadline(t time.Time) error
+}
+
 // PrinterHandler interface receives the output of printer output parsing.
+// EndOfJob receives whatever information about the job the scanner found in
+// its separator pages.
 type PrinterHandler interface {
 	AddLine(line string, linefeed bool)
 	PageBreak()
-	EndOfJob(jobinfo string)
+	EndOfJob(job JobInfo)
+}
+
+// TruncatedJobHandler may be implemented by a PrinterHandler that wants to
+// know when a job is ended early because scanning was stopped in the middle
+// of it. JobTruncated is called just before EndOfJob for that job.
+type TruncatedJobHandler interface {
+	JobTruncated()
+}
+
+// ChannelHandler may be implemented by a PrinterHandler that can skip to
+// channels 2 through 12 of a carriage control tape. Skips to channel 1 are
+// always sent as PageBreak. Handlers that don't implement ChannelHandler get
+// a blank line instead.
+type ChannelHandler interface {
+	SkipToChannel(channel int)
+}
+
+// skipToChannel sends a skip to channel (2-12) to handler.
+func skipToChannel(handler PrinterHandler, channel int) {
+	if h, ok := handler.(ChannelHandler); ok {
+		h.SkipToChannel(channel)
+	} else {
+		handler.AddLine("", true)
+	}
 }
 
 const maxLineLen = 132
@@ -0,0 +1,152 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// deadlineReader adds read deadline support to a reader that doesn't have
+// it. A background goroutine does the blocking reads, and Read waits for the
+// goroutine's results until the deadline passes. Data that arrives after a
+// deadline has passed is kept for the next Read. Closing the reader stops the
+// goroutine, even if nothing is reading its results any more.
+type deadlineReader struct {
+	r         io.Reader
+	results   chan readResult
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	deadline  time.Time
+	pending   []byte
+	err       error
+}
+
+// NewDeadlineReader wraps r, which doesn't support read deadlines, into an
+// Input that does. If r already implements Input, it is returned as-is. If
+// r is an io.Closer, the returned Input is too.
+func NewDeadlineReader(r io.Reader) Input {
+	if in, ok := r.(Input); ok {
+		return in
+	}
+
+	d := &deadlineReader{
+		r:       r,
+		results: make(chan readResult),
+		done:    make(chan struct{}),
+	}
+	go d.readLoop()
+	return d
+}
+
+func (d *deadlineReader) readLoop() {
+	defer close(d.results)
+	for {
+		buf := make([]byte, 4096)
+		n, err := d.r.Read(buf)
+		if n > 0 && !d.send(readResult{data: buf[:n]}) {
+			return
+		}
+		if err != nil {
+			d.send(readResult{err: err})
+			return
+		}
+	}
+}
+
+// send passes a result to Read, returning false if the reader was closed
+// instead.
+func (d *deadlineReader) send(result readResult) bool {
+	select {
+	case d.results <- result:
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+func (d *deadlineReader) Read(p []byte) (int, error) {
+	if len(d.pending) == 0 {
+		if d.err != nil {
+			return 0, d.err
+		}
+
+		d.mu.Lock()
+		deadline := d.deadline
+		d.mu.Unlock()
+
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case result, ok := <-d.results:
+			if !ok {
+				d.err = os.ErrClosed
+				return 0, d.err
+			}
+			if result.err != nil {
+				d.err = result.err
+				return 0, d.err
+			}
+			d.pending = result.data
+		case <-timeout:
+			return 0, os.ErrDeadlineExceeded
+		case <-d.done:
+			d.err = os.ErrClosed
+			return 0, d.err
+		}
+	}
+
+	n := copy(p, d.pending)
+	d.pending = d.pending[n:]
+	return n, nil
+}
+
+func (d *deadlineReader) SetReadDeadline(t time.Time) error {
+	d.mu.Lock()
+	d.deadline = t
+	d.mu.Unlock()
+	return nil
+}
+
+// Close stops the background reads and closes the underlying reader if it
+// is an io.Closer.
+func (d *deadlineReader) Close() error {
+	d.closeOnce.Do(func() { close(d.done) })
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// endlessReader always has more data.
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'x'
+	}
+	return len(p), nil
+}
+
+func TestDeadlineReaderClose(t *testing.T) {
+	in := NewDeadlineReader(endlessReader{})
+	d := in.(*deadlineReader)
+
+	buf := make([]byte, 10)
+	if _, err := in.Read(buf); err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// Nobody reads any more. Closing must still stop the goroutine, which
+	// closes the results channel on its way out.
+	d.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case _, ok := <-d.results:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatal("read goroutine still running after Close")
+		}
+	}
+}
+
+// blockingReader blocks until it is closed.
+type blockingReader struct {
+	closed chan struct{}
+}
+
+func (b blockingReader) Read(p []byte) (int, error) {
+	<-b.closed
+	return 0, os.ErrClosed
+}
+
+func (b blockingReader) Close() error {
+	close(b.closed)
+	return nil
+}
+
+func TestDeadlineReaderDeadline(t *testing.T) {
+	in := NewDeadlineReader(blockingReader{make(chan struct{})})
+
+	in.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := in.Read(make([]byte, 10)); err != os.ErrDeadlineExceeded {
+		t.Errorf("got %v, expected deadline exceeded", err)
+	}
+
+	in.(*deadlineReader).Close()
+	in.SetReadDeadline(time.Time{})
+	if _, err := in.Read(make([]byte, 10)); err != os.ErrClosed {
+		t.Errorf("read after close returned %v", err)
+	}
+}
@@ -82,5 +82,10 @@ the single-file-print mode of the agent, which prints a single UTF-8-encoded
 text file. It does not attempt any job separation, and carriage control
 features such as overstrike are not available since the input is an arbitrary
 text file which may have either DOS or Unix line endings.
+
+Files that use carriage control in the first position of each line are
+printed by the scanners in asascanner.go (ASA characters such as '1' and '+')
+and machinescanner.go (1403 machine codes such as 0x09 and 0x8B), which do
+support overstrike and page ejects.
 */
 package scanner
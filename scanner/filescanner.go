@@ -21,7 +21,8 @@ package scanner
 import (
 	"bufio"
 	"io"
-	"log"
+
+	"github.com/racingmars/virtual1403/logging"
 )
 
 type fileStateFunc func(*fileScanner, rune) fileStateFunc
@@ -32,21 +33,28 @@ type fileScanner struct {
 	pos      int
 	curline  [maxLineLen]rune
 	handler  PrinterHandler
-	trace    bool
+	log      *logging.Logger
 }
 
 // ScanUTF8Single reads input from a reader (typically local file) and prints
 // the entire contents to the handler. No job separation is attempted. The
 // input file is assumed to be UTF-8 (compatible with US-ASCII) encoded.
-func ScanUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
-	trace bool) error {
+func ScanUTF8Single(r io.Reader, jobname string,
+	handler PrinterHandler) error {
+	return ScanUTF8SingleWithLogTag(r, jobname, handler, "default")
+}
+
+// ScanUTF8SingleWithLogTag is ScanUTF8Single, but log messages include tag
+// as the input name.
+func ScanUTF8SingleWithLogTag(r io.Reader, jobname string,
+	handler PrinterHandler, tag string) error {
 	b := bufio.NewReader(r)
 
 	var s fileScanner
 	s.buf = b
 	s.handler = handler
-	s.trace = trace
 	s.nextfunc = fileGetNextByte
+	s.log = logger.With("input", tag)
 
 	for {
 		nextRune, _, err := s.buf.ReadRune()
@@ -54,7 +62,7 @@ func ScanUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
 			if s.pos > 0 {
 				s.emitLine()
 			}
-			handler.EndOfJob(jobname)
+			handler.EndOfJob(JobInfo{Name: jobname})
 			return nil
 		}
 		if err != nil {
@@ -65,10 +73,8 @@ func ScanUTF8Single(r io.Reader, jobname string, handler PrinterHandler,
 }
 
 func (s *fileScanner) emitLine() {
-	// Trace output for the raw line
-	if s.trace {
-		log.Printf("TRACE: scanner got line: %U", s.curline[:s.pos])
-	}
+	// Debug output for the raw line
+	s.log.Debugf("scanner got line: %U", s.curline[:s.pos])
 	s.handler.AddLine(string(s.curline[:s.pos]), true)
 	s.pos = 0
 }
@@ -18,31 +18,21 @@
 
 package scanner
 
-import "log"
-
 func fileGetNextByte(s *fileScanner, b rune) fileStateFunc {
 	switch b {
 	case rune(charLF):
-		if s.trace {
-			log.Printf("TRACE: scanner got LF in fileGetNextByte")
-		}
+		s.log.Tracef("scanner got LF in fileGetNextByte")
 		s.emitLine()
 		return fileGetNextByte
 	case rune(charCR):
-		if s.trace {
-			log.Printf("TRACE: scanner got CR in fileGetNextByte")
-		}
+		s.log.Tracef("scanner got CR in fileGetNextByte")
 		return fileHaveCR
 	case rune(charFF):
-		if s.trace {
-			log.Printf("TRACE: scanner got FF in fileGetNextByte")
-		}
+		s.log.Tracef("scanner got FF in fileGetNextByte")
 		s.emitLineAndPage()
 		return fileGetNextByte
 	case rune(charTab):
-		if s.trace {
-			log.Printf("TRACE: scanner for TAB in fileGetNextByte")
-		}
+		s.log.Tracef("scanner for TAB in fileGetNextByte")
 		// we always add at least one space for a tab, then we get to the
 		// next-highest multiple of 8 position
 		s.curline[s.pos] = ' '
@@ -89,21 +79,15 @@ func fileDisposeBytes(s *fileScanner, b rune) fileStateFunc {
 func fileHaveCR(s *fileScanner, b rune) fileStateFunc {
 	switch b {
 	case rune(charCR):
-		if s.trace {
-			log.Printf("TRACE: scanner got CR in fileHaveCR")
-		}
+		s.log.Tracef("scanner got CR in fileHaveCR")
 		s.emitLine()
 		return fileHaveCR
 	case rune(charLF):
-		if s.trace {
-			log.Printf("TRACE: scanner got LF in fileHaveCR")
-		}
+		s.log.Tracef("scanner got LF in fileHaveCR")
 		s.emitLine()
 		return fileGetNextByte
 	case rune(charFF):
-		if s.trace {
-			log.Printf("TRACE: scanner got FF in fileHaveCR")
-		}
+		s.log.Tracef("scanner got FF in fileHaveCR")
 		s.emitLineAndPage()
 		return fileGetNextByte
 	default:
@@ -0,0 +1,191 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// JobInfo is what we know about a print job. For jobs from the mainframe,
+// the fields come from the JES2 separator pages at the start and end of the
+// job; any of them may be empty if the separator pages were missing or in an
+// unexpected format. For local files, only Name is set.
+type JobInfo struct {
+	// Type is JOB, STC or TSU.
+	Type string `json:"type,omitempty"`
+
+	// Number is the JES2 job number.
+	Number string `json:"number,omitempty"`
+
+	// Name is the job name, or the file name for local files.
+	Name string `json:"name,omitempty"`
+
+	// Class is the SYSOUT class.
+	Class string `json:"class,omitempty"`
+
+	// Forms is the forms name. JES2 doesn't print it on the separator pages,
+	// so this is the first forms name in the JCL listing of the job log, if
+	// there is one.
+	Forms string `json:"forms,omitempty"`
+
+	// Programmer is the programmer name from the JOB card.
+	Programmer string `json:"programmer,omitempty"`
+
+	// Room is the room number from the JOB card accounting information.
+	Room string `json:"room,omitempty"`
+
+	// User is the user ID the job ran under, if the job log shows it.
+	User string `json:"user,omitempty"`
+
+	// Printer and System are the JES2 printer and system names.
+	Printer string `json:"printer,omitempty"`
+	System  string `json:"system,omitempty"`
+
+	// Printed is the time JES2 printed the job, if the separator pages show
+	// it. It is in the agent's local time zone, which we assume is the same
+	// as the mainframe's.
+	Printed *time.Time `json:"printed,omitempty"`
+}
+
+// String returns the job in the short form used for filenames and the job
+// info sent to the print server: the first letter of the type, the number,
+// and the name, e.g. J123_IBMUSERA. If we don't know the type and number,
+// it's just the name.
+func (j JobInfo) String() string {
+	if j.Type == "" {
+		return j.Name
+	}
+	return j.Type[:1] + j.Number + "_" + j.Name
+}
+
+// separatorRegexp matches the lines of the JES2 separator pages from the
+// Moseley MVS 3.8J sysgen and TK4-, e.g.
+//
+//	****A  START  JOB   12  IBMUSERA  PROGRAMMER NAME  ROOM 1234
+//	11.25.08 AM 18 JAN 22  PRINTER1  SYS TK4-  JOB   12  START  A****
+//
+// (all on one line). The submatches are the SYSOUT class, START or END, job
+// type, job number, job name, programmer name, room, print time, printer
+// name and system name.
+var separatorRegexp = regexp.MustCompile(
+	`^\*+([A-Z0-9])\s+(START|END)\s+(JOB|STC|TSU)\s*(\d+)\s+(\S+)\s+` +
+		`(.*?)\s*ROOM\s*(\S*?)\s*` +
+		`(\d{1,2}\.\d\d\.\d\d\s+[AP]M\s+\d{1,2}\s+[A-Z]{3}\s+\d\d)\s+` +
+		`(\S+)\s+SYS\s+(\S+)`)
+
+// separatorTimeLayout is the layout of the print time on separator pages,
+// after runs of spaces have been collapsed.
+const separatorTimeLayout = "3.04.05 PM 2 Jan 06"
+
+// userRegexp matches the RACF (or RAKF, on TK4-) message in the job log that
+// shows the user ID the job ran under.
+var userRegexp = regexp.MustCompile(`ICH70001I\s+(\S+)\s+LAST ACCESS`)
+
+// formsRegexp matches a forms name in a JCL or JES2 control statement in the
+// JCL listing, either a FORMS= parameter or the third SYSOUT= subparameter,
+// e.g. SYSOUT=(A,,STD1).
+var formsRegexp = regexp.MustCompile(
+	`(?://|/\*)\S*\s.*?(?:[\s,]FORMS=|[\s,]SYSOUT=\([A-Z0-9*$],[^,()]*,)` +
+		`([A-Z0-9@#$]{1,8})`)
+
+// parseSeparator parses a JES2 separator page line.
+func parseSeparator(line string) (JobInfo, bool) {
+	m := separatorRegexp.FindStringSubmatch(strings.TrimSpace(line))
+	if m == nil {
+		return JobInfo{}, false
+	}
+	j := JobInfo{
+		Class:      m[1],
+		Type:       m[3],
+		Number:     m[4],
+		Name:       m[5],
+		Programmer: strings.TrimSpace(m[6]),
+		Room:       m[7],
+		Printer:    m[9],
+		System:     m[10],
+	}
+	printed, err := time.ParseInLocation(separatorTimeLayout,
+		strings.Join(strings.Fields(m[8]), " "), time.Local)
+	if err == nil {
+		j.Printed = &printed
+	}
+	return j, true
+}
+
+// NoteLine updates j with any job information in a line of the job.
+// Information from earlier lines is kept. The scanners do this for every line
+// they print; handlers only need it to know about a job they end themselves.
+func (j *JobInfo) NoteLine(line string) {
+	if strings.Contains(line, "****") {
+		if sep, ok := parseSeparator(line); ok {
+			j.merge(sep)
+		}
+		return
+	}
+	if j.User == "" && strings.Contains(line, "ICH70001I") {
+		if m := userRegexp.FindStringSubmatch(line); m != nil {
+			j.User = m[1]
+		}
+	}
+	if j.Forms == "" && (strings.Contains(line, "FORMS=") ||
+		strings.Contains(line, "SYSOUT=(")) {
+
+		if m := formsRegexp.FindStringSubmatch(line); m != nil {
+			j.Forms = m[1]
+		}
+	}
+}
+
+// merge fills in the fields of j that are empty from other.
+func (j *JobInfo) merge(other JobInfo) {
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&j.Type, other.Type)
+	fill(&j.Number, other.Number)
+	fill(&j.Name, other.Name)
+	fill(&j.Class, other.Class)
+	fill(&j.Forms, other.Forms)
+	fill(&j.Programmer, other.Programmer)
+	fill(&j.Room, other.Room)
+	fill(&j.User, other.User)
+	fill(&j.Printer, other.Printer)
+	fill(&j.System, other.System)
+	if j.Printed == nil {
+		j.Printed = other.Printed
+	}
+}
+
+// separatorLineRegexp is a looser match than separatorRegexp for the lines of
+// the JES2 start and end separator pages, like eojRegexp but for both ends of
+// the job. It's used to find the separator pages even when we can't parse the
+// details on them.
+var separatorLineRegexp = regexp.MustCompile(
+	`\*+.+(START|END).+(JOB|STC|TSU)\D+\d+\s+\S+\s+.+ROOM.+(START|END).+\*+`)
+
+// IsSeparatorLine returns true if line looks like one of the lines that make
+// up the JES2 separator pages at the start and end of a job.
+func IsSeparatorLine(line string) bool {
+	return strings.Contains(line, "****") &&
+		separatorLineRegexp.MatchString(line)
+}
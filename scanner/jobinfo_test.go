@@ -0,0 +1,114 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+const (
+	testStartSeparator = "****A   START  JOB   12  IBMUSERA  J. PROGRAMMER" +
+		"       ROOM 1234  11.25.08 AM 18 JAN 22  PRINTER1  SYS TK4-  " +
+		"JOB   12  START   A****"
+	testEndSeparator = "****A   END    JOB   12  IBMUSERA  J. PROGRAMMER" +
+		"       ROOM 1234  11.25.09 AM 18 JAN 22  PRINTER1  SYS TK4-  " +
+		"JOB   12  END     A****"
+)
+
+func TestJobInfo(t *testing.T) {
+	var job JobInfo
+	for _, line := range []string{
+		testStartSeparator,
+		"",
+		"ICH70001I IBMUSER  LAST ACCESS AT 11:24:58 ON TUESDAY, " +
+			"JANUARY 18, 2022",
+		"    1 //IBMUSERA JOB (1234),'J. PROGRAMMER',CLASS=A,MSGCLASS=A",
+		"    2 //SYSUT1   DD DSN=SYS1.PARMLIB(FORMS=X),DISP=SHR",
+		"    3 //SYSPRINT DD SYSOUT=(B,,STD1)",
+		"    4 //SYSUT2   DD SYSOUT=A,FORMS=WIDE",
+		"IEF142I IBMUSERA STEP1 - STEP WAS EXECUTED - COND CODE 0000",
+		testEndSeparator,
+	} {
+		job.NoteLine(line)
+	}
+
+	want := JobInfo{
+		Type:       "JOB",
+		Number:     "12",
+		Name:       "IBMUSERA",
+		Class:      "A",
+		Forms:      "STD1",
+		Programmer: "J. PROGRAMMER",
+		Room:       "1234",
+		User:       "IBMUSER",
+		Printer:    "PRINTER1",
+		System:     "TK4-",
+	}
+	printed := job.Printed
+	job.Printed = nil
+	if job != want {
+		t.Errorf("got %+v, want %+v", job, want)
+	}
+	if printed == nil || !printed.Equal(time.Date(2022, 1, 18, 11, 25, 8, 0,
+		time.Local)) {
+
+		t.Errorf("got printed time %v", printed)
+	}
+	if job.String() != "J12_IBMUSERA" {
+		t.Errorf("got job string %s, want J12_IBMUSERA", job.String())
+	}
+	if !eojRegexp.MatchString(testEndSeparator) {
+		t.Errorf("end separator doesn't match the end-of-job pattern")
+	}
+	if !IsSeparatorLine(testStartSeparator) ||
+		!IsSeparatorLine(testEndSeparator) {
+		t.Errorf("separator lines aren't recognized")
+	}
+	if IsSeparatorLine("**** IBMUSERA STARTED JOB 12 ****") {
+		t.Errorf("ordinary line recognized as a separator line")
+	}
+}
+
+func TestJobInfoNoProgrammer(t *testing.T) {
+	job, ok := parseSeparator("****A  START  STC  101  INIT" +
+		"                            ROOM        1.02.03 PM  2 FEB 22  " +
+		"PRINTER1  SYS MVSA  STC  101  START  A****")
+	if !ok {
+		t.Fatal("separator didn't parse")
+	}
+	if job.Programmer != "" || job.Room != "" || job.Name != "INIT" ||
+		job.Printed == nil || job.Printed.Hour() != 13 {
+		t.Errorf("got %+v", job)
+	}
+	if job.String() != "S101_INIT" {
+		t.Errorf("got job string %s, want S101_INIT", job.String())
+	}
+}
+
+func TestJobInfoJSON(t *testing.T) {
+	data, err := json.Marshal(JobInfo{Name: "LISTING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"name":"LISTING"}`; string(data) != want {
+		t.Errorf("got %s, want %s", data, want)
+	}
+}
@@ -0,0 +1,166 @@
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+package scanner
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// Machine carriage control codes for the 1403. "Write" codes print the line
+// and then move the carriage; "immediate" codes move the carriage without
+// printing anything.
+const (
+	machineWriteNoSpace   byte = 0x01
+	machineWriteSpace1    byte = 0x09
+	machineWriteSpace2    byte = 0x11
+	machineWriteSpace3    byte = 0x19
+	machineWriteSkip1     byte = 0x89
+	machineNoOp           byte = 0x03
+	machineImmedSpace1    byte = 0x0B
+	machineImmedSpace2    byte = 0x13
+	machineImmedSpace3    byte = 0x1B
+	machineImmedSkip1     byte = 0x8B
+	machineWriteMask      byte = 0x07
+	machineWriteCommand   byte = 0x01
+	machineImmedCommand   byte = 0x03
+	machineSkipChannelBit byte = 0x80
+)
+
+// IsMachineControl returns true if b is a 1403 machine carriage control code
+// that we know how to handle.
+func IsMachineControl(b byte) bool {
+	switch b {
+	case machineWriteNoSpace, machineWriteSpace1, machineWriteSpace2,
+		machineWriteSpace3, machineWriteSkip1, machineNoOp,
+		machineImmedSpace1, machineImmedSpace2, machineImmedSpace3,
+		machineImmedSkip1:
+		return true
+	}
+	return machineChannel(b) != 0
+}
+
+// ScanMachineUTF8Single reads input from a reader (typically local file) and
+// prints the entire contents to the handler. No job separation is attempted.
+// The first byte of each line is a 1403 machine carriage control code (the
+// raw byte, not a character), and the rest of the line is assumed to be UTF-8
+// (compatible with US-ASCII) encoded. Unlike ASA carriage control, machine
+// codes take effect after the line is printed.
+func ScanMachineUTF8Single(r io.Reader, jobname string,
+	handler PrinterHandler) error {
+
+	linenum := 0
+	// topOfPage is true until something has been printed on the current
+	// page, so we don't emit blank pages for a skip to channel 1 when we're
+	// already there.
+	topOfPage := true
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		linenum++
+		line := bytes.TrimSuffix(scanner.Bytes(), []byte{'\r'})
+		if len(line) == 0 {
+			// A line without even a control code. We'll be lenient and
+			// treat it as a blank line that spaces 1 after printing.
+			line = []byte{machineWriteSpace1}
+		}
+		control := line[0]
+		text := strings.ToValidUTF8(string(line[1:]), string(utf8.RuneError))
+
+		switch control {
+		case machineWriteNoSpace:
+			handler.AddLine(text, false)
+			topOfPage = false
+		case machineWriteSpace1, machineWriteSpace2, machineWriteSpace3:
+			handler.AddLine(text, true)
+			for i := 1; i < machineSpaces(control); i++ {
+				handler.AddLine("", true)
+			}
+			topOfPage = false
+		case machineWriteSkip1:
+			handler.AddLine(text, true)
+			handler.PageBreak()
+			topOfPage = true
+		case machineNoOp:
+			// nothing to do
+		case machineImmedSpace1, machineImmedSpace2, machineImmedSpace3:
+			for i := 0; i < machineSpaces(control); i++ {
+				handler.AddLine("", true)
+			}
+			topOfPage = false
+		case machineImmedSkip1:
+			if !topOfPage {
+				handler.PageBreak()
+				topOfPage = true
+			}
+		default:
+			// Skips to channels 2-12 position to vertical tab stops in the
+			// carriage control tape.
+			if channel := machineChannel(control); channel != 0 {
+				if control&machineWriteMask == machineWriteCommand {
+					handler.AddLine(text, true)
+				}
+				skipToChannel(handler, channel)
+				topOfPage = false
+				break
+			}
+			logger.Errorf("unknown/unimplemented machine control code "+
+				"0x%02X on line %d", control, linenum)
+			if control&machineWriteMask == machineWriteCommand {
+				handler.AddLine(text, true)
+			} else if control&machineSkipChannelBit == 0 {
+				handler.AddLine("", true)
+			}
+			topOfPage = false
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	handler.EndOfJob(JobInfo{Name: jobname})
+	return nil
+}
+
+// machineChannel returns the channel (2-12) that a write-and-skip or
+// immediate skip code skips to, or 0 if it isn't a skip to channel 2-12.
+func machineChannel(control byte) int {
+	if control&machineSkipChannelBit == 0 {
+		return 0
+	}
+	if command := control & machineWriteMask; command != machineWriteCommand &&
+		command != machineImmedCommand {
+		return 0
+	}
+	channel := int(control>>3) & 0x0F
+	if channel < 2 || channel > 12 {
+		return 0
+	}
+	return channel
+}
+
+// machineSpaces returns the number of lines (1-3) that a space command moves
+// the carriage.
+func machineSpaces(control byte) int {
+	return int(control>>3) & 0x03
+}
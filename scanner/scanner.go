@@ -19,45 +19,59 @@
 package scanner
 
 import (
+	"context"
 	"encoding/hex"
 	"errors"
-	"log"
-	"net"
 	"os"
 	"regexp"
 	"time"
+
+	"github.com/racingmars/virtual1403/logging"
 )
 
 type stateFunc func(*scanner, byte) stateFunc
 
 type scanner struct {
-	conn     net.Conn
+	conn     Input
 	nextfunc stateFunc
 	pos      int
 	curline  [maxLineLen]byte
 	prevline string
 	handler  PrinterHandler
 	newjob   bool
-	trace    bool
-	tag      string
+	job      JobInfo
+	log      *logging.Logger
 }
 
-// Scan will read from a net.Conn, conn, which should be sent data from
-// Hercules printer output. It will output lines (trimmed to 132 characters
-// if necessary) and page breaks and identify the end of jobs in the printer
-// data stream.
+// logger is used for messages that aren't about a particular input.
+var logger = logging.New("scanner")
+
+// Scan will read from an Input, conn, such as a net.Conn, which should be
+// sent data from Hercules printer output. It will output lines (trimmed to
+// 132 characters if necessary) and page breaks and identify the end of jobs
+// in the printer data stream.
 //
 // This function exists for backwards-compatibility and just calls
 // ScanWithLogTag with the tag "default"
-func Scan(conn net.Conn, handler PrinterHandler, trace bool) error {
-	return ScanWithLogTag(conn, handler, trace, "default")
+func Scan(conn Input, handler PrinterHandler) error {
+	return ScanWithLogTag(conn, handler, "default")
+}
+
+// ScanWithLogTag will read from an Input, conn, such as a net.Conn, which
+// should be sent data from Hercules printer output. It will output lines
+// (trimmed to 132 characters if necessary) and page breaks and identify the
+// end of jobs in the printer data stream. Log messages include tag as the
+// input name.
+func ScanWithLogTag(conn Input, handler PrinterHandler, tag string) error {
+	return ScanContext(context.Background(), conn, handler, tag)
 }
 
-// Scan will read from a net.Conn, conn, which should be sent data from
-// Hercules printer output. It will output lines (trimmed to 132 characters
-// if necessary) and page breaks and identify the end of jobs in the printer
-// data stream.
-func ScanWithLogTag(conn net.Conn, handler PrinterHandler, trace bool,
+// ScanContext is ScanWithLogTag, but stops reading from conn when ctx is
+// cancelled. If a job is in progress at that point, it is ended right away
+// with whatever data we've received, and the handler is told the job was
+// truncated if it implements TruncatedJobHandler. After cancellation,
+// ScanContext returns ctx.Err().
+func ScanContext(ctx context.Context, conn Input, handler PrinterHandler,
 	tag string) error {
 
 	var s scanner
@@ -65,30 +79,46 @@ func ScanWithLogTag(conn net.Conn, handler PrinterHandler, trace bool,
 	s.handler = handler
 	s.nextfunc = getNextByte
 	s.newjob = true
-	s.trace = trace
-	s.tag = tag
+	s.log = logger.With("input", tag)
+
+	// Wake up any read in progress when we're cancelled.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
 
 	nextByte := make([]byte, 1)
 	for {
+		if ctx.Err() != nil {
+			s.truncateJob()
+			return ctx.Err()
+		}
+
 		// If we are in a job, assume the job is done if we don't receive the
 		// next character within half a second.
 		if !s.newjob {
 			if err := s.conn.SetReadDeadline(time.Now().Add(
 				500 * time.Millisecond)); err != nil {
-				log.Printf("ERROR: [%s] couldn't set read deadline: %v", tag,
-					err)
+				s.log.Errorf("couldn't set read deadline: %v", err)
 			}
 		}
 		n, err := s.conn.Read(nextByte)
-		if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+		if err != nil && ctx.Err() != nil {
+			// the read was interrupted because we were cancelled
+			continue
+		} else if err != nil && errors.Is(err, os.ErrDeadlineExceeded) {
 			s.emitLine(true)
 			s.endJob(true)
 		} else if err != nil {
 			return err
 		} else if n != 1 {
-			log.Printf(
-				"ERROR: [%s] read 0 bytes when expecting 1; continuing read loop",
-				tag)
+			s.log.Errorf(
+				"read 0 bytes when expecting 1; continuing read loop")
 		} else {
 			if nextByte[0] == 0xFF {
 				// This seems to be a control character that VM emits the
@@ -99,10 +129,7 @@ func ScanWithLogTag(conn net.Conn, handler PrinterHandler, trace bool,
 				// as a control character that we don't need since it's
 				// clearly not meant to be a character from any typical
 				// mainframe print job.
-				if s.trace {
-					log.Printf("TRACE: [%s] ignoring 0xFF control character",
-						tag)
-				}
+				s.log.Debugf("ignoring 0xFF control character")
 				continue
 			}
 			s.nextfunc = s.nextfunc(&s, nextByte[0])
@@ -111,10 +138,10 @@ func ScanWithLogTag(conn net.Conn, handler PrinterHandler, trace bool,
 }
 
 func (s *scanner) emitLine(linefeed bool) {
-	// Trace output for the raw line
-	if s.trace {
-		log.Printf("TRACE: [%s] (lf: %v) scanner got line: %s", s.tag,
-			linefeed, hex.EncodeToString(s.curline[:s.pos]))
+	// Debug output for the raw line
+	if s.log.Enabled(logging.LevelDebug) {
+		s.log.Debugf("(lf: %v) scanner got line: %s", linefeed,
+			hex.EncodeToString(s.curline[:s.pos]))
 	}
 
 	// We need to build a valid UTF-8 string. For now we'll handle a couple
@@ -137,15 +164,15 @@ func (s *scanner) emitLine(linefeed bool) {
 			r = '©'
 		default:
 			if s.curline[i] > 0x7F {
-				log.Printf(
-					"WARN:  [%s] got character %02x, need to add mapping\n",
-					s.tag, s.curline[i])
+				s.log.Warnf("got character %02x, need to add mapping",
+					s.curline[i])
 			}
 			r = rune(s.curline[i])
 		}
 		utf8runes = append(utf8runes, r)
 	}
 	s.prevline = string(utf8runes)
+	s.job.NoteLine(s.prevline)
 	s.handler.AddLine(s.prevline, linefeed)
 	s.pos = 0
 
@@ -161,10 +188,7 @@ var eojRegexp = regexp.MustCompile(
 // separator page.
 func (s *scanner) emitLineAndPage() {
 	s.emitLine(true)
-	if s.trace {
-		log.Printf("TRACE: [%s] scanner checking for end of job on line: %s",
-			s.tag, s.prevline)
-	}
+	s.log.Debugf("scanner checking for end of job on line: %s", s.prevline)
 	if eojRegexp.MatchString(s.prevline) {
 		s.endJob(false)
 	} else {
@@ -172,34 +196,53 @@ func (s *scanner) emitLineAndPage() {
 	}
 }
 
+// truncateJob ends the job in progress, if there is one, when we have to stop
+// before the end of the job.
+func (s *scanner) truncateJob() {
+	if s.newjob {
+		return
+	}
+
+	s.log.Warnf("ending print job early; job is truncated")
+	if s.pos > 0 {
+		s.emitLine(true)
+	}
+	if h, ok := s.handler.(TruncatedJobHandler); ok {
+		h.JobTruncated()
+	}
+	s.endJob(true)
+}
+
 func (s *scanner) endJob(wasTimeout bool) {
-	jobinfo := ""
+	job := s.job
 
-	// If end of job was due to end-of-job line, not a read timeout, we'll try
-	// to populate additional job info.
-	if !wasTimeout {
+	// If end of job was due to end-of-job line, not a read timeout, but we
+	// couldn't parse the separator pages, we'll at least get the job type,
+	// number and name from the end-of-job line.
+	if !wasTimeout && job.Type == "" {
 		matches := eojRegexp.FindStringSubmatch(s.prevline)
 		if len(matches) > 1 {
-			// get first letter, e.g. J(ob) or S(tc)
-			jobinfo = string(matches[1][0])
+			// e.g. JOB, STC or TSU
+			job.Type = matches[1]
 		}
 		if len(matches) > 2 {
 			// Should be the job number
-			jobinfo = jobinfo + matches[2]
+			job.Number = matches[2]
 		}
 		if len(matches) > 3 {
 			// Should be the job name
-			jobinfo = jobinfo + "_" + matches[3]
+			job.Name = matches[3]
 		}
 	}
 
-	s.handler.EndOfJob(jobinfo)
+	s.handler.EndOfJob(job)
+	s.job = JobInfo{}
 	s.prevline = ""
 	s.pos = 0
 	s.newjob = true
 
 	// No timeout for the next read awaiting beginning of the next job
 	if err := s.conn.SetReadDeadline(time.Time{}); err != nil {
-		log.Printf("ERROR: [%s] couldn't clear read deadline: %v", s.tag, err)
+		s.log.Errorf("couldn't clear read deadline: %v", err)
 	}
 }
@@ -18,25 +18,19 @@
 
 package scanner
 
-import "log"
-
 // getNextByte represents the "normal" state where we are collecting input
 // characters into the current line until we get a control character or
 // overflow the current line.
 func getNextByte(s *scanner, b byte) stateFunc {
 	wasNewJob := s.newjob
 	if s.newjob {
-		log.Printf(
-			"INFO:  [%s] receiving data from Hercules for new print job",
-			s.tag)
+		s.log.Infof("receiving data from Hercules for new print job")
 		s.newjob = false
 	}
 
 	switch b {
 	case charLF:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got LF in getNextByte", s.tag)
-		}
+		s.log.Tracef("scanner got LF in getNextByte")
 		return haveLF
 	case charCR:
 		if wasNewJob {
@@ -46,28 +40,20 @@ func getNextByte(s *scanner, b byte) stateFunc {
 			// 0, so we'll count this as still being a new job (as we still
 			// want to trigger the special beginning-of-job form feed
 			// handling, since that's probably what's coming next).
-			if s.trace {
-				log.Printf("TRACE: [%s] ignoring CR at beginning of job", s.tag)
-			}
+			s.log.Tracef("ignoring CR at beginning of job")
 			s.newjob = true
 			return getNextByte
 		}
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got CR in getNextByte", s.tag)
-		}
+		s.log.Tracef("scanner got CR in getNextByte")
 		return haveCR
 	case charFF:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got FF in getNextByte", s.tag)
-		}
+		s.log.Tracef("scanner got FF in getNextByte")
 		if wasNewJob {
 			// if the very first byte we receive is a form feed, then it's
 			// probably from VM ejecting the previous job (since, for some
 			// reason, it doesn't eject jobs right after they finish). We're
 			// already starting on a new page, so we'll just suppress it.
-			if s.trace {
-				log.Printf("TRACE: [%s] ignoring FF at beginning of job", s.tag)
-			}
+			s.log.Tracef("ignoring FF at beginning of job")
 			return getNextByte
 		}
 		s.emitLineAndPage()
@@ -107,21 +93,15 @@ func disposeBytes(s *scanner, b byte) stateFunc {
 func haveCR(s *scanner, b byte) stateFunc {
 	switch b {
 	case charCR:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got CR in haveCR", s.tag)
-		}
+		s.log.Tracef("scanner got CR in haveCR")
 		s.emitLine(false)
 		return haveCR
 	case charLF:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got LF in haveCR", s.tag)
-		}
+		s.log.Tracef("scanner got LF in haveCR")
 		s.emitLine(true)
 		return getNextByte
 	case charFF:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got FF in haveCR", s.tag)
-		}
+		s.log.Tracef("scanner got FF in haveCR")
 		s.emitLineAndPage()
 		return getNextByte
 	default:
@@ -137,21 +117,15 @@ func haveCR(s *scanner, b byte) stateFunc {
 func haveLF(s *scanner, b byte) stateFunc {
 	switch b {
 	case charCR:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got CR in haveLF", s.tag)
-		}
+		s.log.Tracef("scanner got CR in haveLF")
 		s.emitLine(true)
 		return getNextByte
 	case charLF:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got LF in haveLF", s.tag)
-		}
+		s.log.Tracef("scanner got LF in haveLF")
 		s.emitLine(true)
 		return haveLF
 	case charFF:
-		if s.trace {
-			log.Printf("TRACE: [%s] scanner got FF in haveLF", s.tag)
-		}
+		s.log.Tracef("scanner got FF in haveLF")
 		s.emitLineAndPage()
 		return getNextByte
 	default:
@@ -29,6 +29,12 @@ import (
 const maxLinesPerPage = 66
 const maxLineCharacters = 132
 
+// carriageTape is the line (counting from 0) of each channel punched in our
+// virtual carriage control tape, other than channel 1, which is the first
+// line after skipLines. Like most 1403 tapes, we only punch channel 12, for
+// the page overflow line.
+var carriageTape = map[int]int{12: 60}
+
 type ColorRGB struct{ R, G, B int }
 
 // our implementation of the Job interface simulating an IBM 1403 printer.
@@ -43,6 +49,9 @@ type virtual1403 struct {
 	leftMargin       float64
 	overstrikeOffset float64
 	background       gofpdf.Template
+	banner           gofpdf.Template
+	bannerPaper      bool
+	pageEmpty        bool
 }
 
 // Page size
@@ -82,6 +91,13 @@ func New1403(font []byte, fontsize float64, skipLines int, forceUpper,
 		drawBackgroundTemplate(tpl, drawBG, dark, light)
 	})
 
+	j.banner = j.pdf.CreateTemplate(func(tpl *gofpdf.Tpl) {
+		tpl.SetXY(0, 0)
+		tpl.SetMargins(0, 0, 0)
+		tpl.SetAutoPageBreak(false, 0)
+		drawBannerTemplate(tpl)
+	})
+
 	// We will dynamically determine how wide 132 characters of the chosen
 	// font is so that we can correctly position (center) the output area on
 	// the page. The left margin of our text output area will be the center
@@ -89,6 +105,12 @@ func New1403(font []byte, fontsize float64, skipLines int, forceUpper,
 	j.pdf.SetFont("userfont", "", j.fontSize)
 	j.leftMargin = v1403W/2 - determineLineWidth(j.pdf)/2
 
+	// gofpdf remembers the first thing that went wrong, such as a font it
+	// can't use, and otherwise wouldn't tell us until the job is written.
+	if err := j.pdf.Error(); err != nil {
+		return nil, err
+	}
+
 	j.NewPage()
 
 	return j, nil
@@ -108,6 +130,7 @@ func (job *virtual1403) AddLine(s string, linefeed bool) int {
 	job.pdf.SetXY(job.leftMargin+job.overstrikeOffset,
 		float64(job.curLine*12)+.25)
 	job.pdf.CellFormat(0, 12, s, "", 0, "LM", false, 0, "")
+	job.pageEmpty = false
 	if linefeed {
 		job.curLine++
 		job.overstrikeOffset = 0
@@ -119,15 +142,56 @@ func (job *virtual1403) AddLine(s string, linefeed bool) int {
 
 func (job *virtual1403) NewPage() int {
 	job.pdf.AddPage()
-	job.pdf.UseTemplate(job.background)
-	job.pdf.SetFont("userfont", "", job.fontSize)
+	job.usePaper()
 	// simulating a 1403 with form control that can skip the first physically
 	// printable lines.
 	job.curLine = job.skipLines
 	job.pages++
+	job.pageEmpty = true
 	return job.pages
 }
 
+// SkipToChannel implements ChannelJob. If the channel isn't punched in the
+// carriage tape, we space one line rather than let the forms run away.
+func (job *virtual1403) SkipToChannel(channel int) int {
+	line, ok := carriageTape[channel]
+	if !ok {
+		return job.AddLine("", true)
+	}
+	if job.curLine >= line {
+		job.NewPage()
+	}
+	job.curLine = line
+	job.overstrikeOffset = 0
+	return job.pages
+}
+
+// SetBanner implements BannerJob.
+func (job *virtual1403) SetBanner(banner bool) {
+	if banner == job.bannerPaper {
+		return
+	}
+	job.bannerPaper = banner
+	if job.pageEmpty {
+		// Nothing has been printed on the current page yet, so we can put
+		// the new paper over the old.
+		job.pdf.SetFillColor(255, 255, 255)
+		job.pdf.Rect(0, 0, v1403W, v1403H, "F")
+		job.usePaper()
+	}
+}
+
+// usePaper draws the background for the current style of paper on the
+// current page.
+func (job *virtual1403) usePaper() {
+	if job.bannerPaper {
+		job.pdf.UseTemplate(job.banner)
+	} else {
+		job.pdf.UseTemplate(job.background)
+	}
+	job.pdf.SetFont("userfont", "", job.fontSize)
+}
+
 func (job *virtual1403) EndJob(w io.Writer) (int, error) {
 	return job.pages, job.pdf.Output(w)
 }
@@ -281,6 +345,14 @@ func drawBackgroundTemplate(pdf *gofpdf.Tpl, drawBG bool, dark,
 	pdf.SetTextColor(0, 0, 0)
 }
 
+// drawBannerTemplate draws the banner paper used to set separator pages apart
+// from the rest of the job: plain colored paper with tractor feed holes.
+func drawBannerTemplate(pdf *gofpdf.Tpl) {
+	pdf.SetFillColor(BannerPaper.R, BannerPaper.G, BannerPaper.B)
+	pdf.Rect(0, 0, v1403W, v1403H, "F")
+	drawBackgroundTemplate(pdf, false, ColorRGB{}, ColorRGB{})
+}
+
 func determineLineWidth(pdf *gofpdf.Fpdf) float64 {
 	const linechars = 132
 	var dummyline [linechars]byte
@@ -29,12 +29,66 @@ var LightGreen = ColorRGB{219, 240, 219}
 var DarkBlue = ColorRGB{65, 182, 255}
 var LightBlue = ColorRGB{214, 239, 255}
 
+// BannerPaper is the color of the paper that separator pages are printed on
+// when they are set apart from the rest of the job.
+var BannerPaper = ColorRGB{255, 243, 189}
+
 //go:embed IBMPlexMono-Regular.ttf
 var defaultFont []byte
 
 //go:embed IBM140310Pitch-Regular-MRW.ttf
 var wornFont []byte
 
+// ProfileNames lists the profiles that NewProfile knows. Any other name gets
+// the default profile.
+var ProfileNames = []string{
+	"default-green", "default-green-noskip",
+	"default-blue", "default-blue-noskip",
+	"default-plain", "default-plain-noskip",
+	"retro-green", "retro-green-noskip",
+	"retro-blue", "retro-blue-noskip",
+	"retro-plain", "retro-plain-noskip",
+	"modern-green", "modern-green-noskip",
+	"modern-blue", "modern-blue-noskip",
+	"modern-plain", "modern-plain-noskip",
+}
+
+// IsProfile returns true if profile is "default" or one of ProfileNames.
+// Profile names aren't case-sensitive.
+func IsProfile(profile string) bool {
+	profile = strings.ToLower(profile)
+	if profile == "default" {
+		return true
+	}
+	for _, name := range ProfileNames {
+		if profile == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CanonicalProfile returns the name of the profile that NewProfile prints
+// with for profile: one of ProfileNames, in lower case. "default" and
+// unknown names are "default-green".
+func CanonicalProfile(profile string) string {
+	profile = strings.ToLower(profile)
+	for _, name := range ProfileNames {
+		if profile == name {
+			return name
+		}
+	}
+	return "default-green"
+}
+
+// ProfileFont returns the font family of profile: "default" for the profiles
+// that use the font the installation provides (if any), "retro" for the
+// worn 1403 font, or "modern" for IBM Plex Mono.
+func ProfileFont(profile string) string {
+	name := CanonicalProfile(profile)
+	return name[:strings.Index(name, "-")]
+}
+
 func NewProfile(profile string, fontOverride []byte,
 	sizeOverride float64) (Job, error) {
 
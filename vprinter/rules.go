@@ -0,0 +1,160 @@
+package vprinter
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// ProfileRule chooses the profile for the jobs it matches, the way an
+// operator would load different paper for different SYSOUT classes or forms.
+// Class, Forms and JobName are patterns: * matches any characters, ? matches
+// one character, and [...] matches a set of characters, as for path.Match.
+// An empty pattern matches any job, but a pattern that isn't empty doesn't
+// match a job where that detail is unknown. Patterns aren't case-sensitive.
+type ProfileRule struct {
+	Class   string `yaml:"class" json:"class,omitempty"`
+	Forms   string `yaml:"forms" json:"forms,omitempty"`
+	JobName string `yaml:"jobname" json:"jobname,omitempty"`
+	Profile string `yaml:"profile" json:"profile"`
+}
+
+// Validate checks that the patterns of the rule are valid and that it
+// chooses a profile we know.
+func (r ProfileRule) Validate() error {
+	for _, pattern := range []string{r.Class, r.Forms, r.JobName} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q", pattern)
+		}
+	}
+	if !IsProfile(r.Profile) {
+		return fmt.Errorf("unknown profile %q", r.Profile)
+	}
+	return nil
+}
+
+// Matches returns true if the class, forms name and job name of a job match
+// the rule.
+func (r ProfileRule) Matches(class, forms, jobname string) bool {
+	return matchPattern(r.Class, class) && matchPattern(r.Forms, forms) &&
+		matchPattern(r.JobName, jobname)
+}
+
+// String returns the rule in the form used to edit rules as text, e.g.
+// "class=A jobname=IBMUSER* profile=default-green".
+func (r ProfileRule) String() string {
+	var parts []string
+	for _, field := range []struct{ name, value string }{
+		{"class", r.Class},
+		{"forms", r.Forms},
+		{"jobname", r.JobName},
+		{"profile", r.Profile},
+	} {
+		if field.value != "" {
+			parts = append(parts, field.name+"="+field.value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ParseProfileRules parses rules written one per line in the form returned
+// by ProfileRule.String. Blank lines are ignored.
+func ParseProfileRules(text string) ([]ProfileRule, error) {
+	var rules []ProfileRule
+	for i, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		var rule ProfileRule
+		for _, field := range fields {
+			name, value, ok := cutField(field)
+			if !ok {
+				return nil, fmt.Errorf("line %d: %q should be name=value",
+					i+1, field)
+			}
+			switch strings.ToLower(name) {
+			case "class":
+				rule.Class = value
+			case "forms":
+				rule.Forms = value
+			case "jobname":
+				rule.JobName = value
+			case "profile":
+				rule.Profile = value
+			default:
+				return nil, fmt.Errorf("line %d: unknown field %q", i+1,
+					name)
+			}
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+1, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// FormatProfileRules returns rules one per line, as parsed by
+// ParseProfileRules.
+func FormatProfileRules(rules []ProfileRule) string {
+	var lines []string
+	for _, rule := range rules {
+		lines = append(lines, rule.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// ChooseProfile returns the profile of the first rule that matches the job,
+// or fallback if none of them do.
+func ChooseProfile(rules []ProfileRule, class, forms, jobname,
+	fallback string) string {
+
+	for _, rule := range rules {
+		if rule.Matches(class, forms, jobname) {
+			return rule.Profile
+		}
+	}
+	return fallback
+}
+
+// matchPattern returns true if value matches pattern, as described for
+// ProfileRule.
+func matchPattern(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	if value == "" {
+		return false
+	}
+	ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(value))
+	return ok
+}
+
+// cutField splits a name=value field.
+func cutField(field string) (name, value string, ok bool) {
+	i := strings.IndexByte(field, '=')
+	if i < 1 {
+		return "", "", false
+	}
+	return field[:i], field[i+1:], true
+}
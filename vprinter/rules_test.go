@@ -0,0 +1,60 @@
+package vprinter
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import "testing"
+
+func TestProfileRules(t *testing.T) {
+	rules, err := ParseProfileRules(`
+class=A profile=default-green
+class=B  forms=STD? profile=modern-plain
+
+jobname=ibm* profile=retro-blue
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 3 || rules[1].String() !=
+		"class=B forms=STD? profile=modern-plain" {
+		t.Fatalf("got %v", rules)
+	}
+
+	tests := []struct {
+		class, forms, jobname, want string
+	}{
+		{"A", "", "IBMUSERA", "default-green"},
+		{"B", "STD1", "IBMUSERA", "modern-plain"},
+		{"B", "", "IBMUSERA", "retro-blue"},
+		{"C", "STD1", "HERC01A", "fallback"},
+	}
+	for _, test := range tests {
+		got := ChooseProfile(rules, test.class, test.forms, test.jobname,
+			"fallback")
+		if got != test.want {
+			t.Errorf("%+v: got %s", test, got)
+		}
+	}
+
+	for _, bad := range []string{"class=A", "class=[ profile=default",
+		"profile", "printer=1 profile=default"} {
+		if _, err := ParseProfileRules(bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
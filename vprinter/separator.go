@@ -0,0 +1,214 @@
+package vprinter
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BannerJob is implemented by virtual printers that can print pages on
+// banner paper, a distinct style of paper used to set the separator pages
+// apart from the rest of the job.
+type BannerJob interface {
+	Job
+
+	// SetBanner selects banner paper (or regular paper, if banner is false)
+	// for the following pages. If nothing has been printed on the current
+	// page yet, it is changed too.
+	SetBanner(banner bool)
+}
+
+// SeparatorMode is what to do with the JES2 separator pages at the start
+// (header) and end (trailer) of a job.
+type SeparatorMode string
+
+const (
+	// SeparatorKeep prints the separator pages like the rest of the job.
+	SeparatorKeep SeparatorMode = "keep"
+
+	// SeparatorDrop leaves out both the header and trailer pages.
+	SeparatorDrop SeparatorMode = "drop"
+
+	// SeparatorHeader keeps the header pages but leaves out the trailer.
+	SeparatorHeader SeparatorMode = "header"
+
+	// SeparatorTrailer keeps the trailer pages but leaves out the header.
+	SeparatorTrailer SeparatorMode = "trailer"
+
+	// SeparatorBanner prints the separator pages on banner paper, if the
+	// printer supports it.
+	SeparatorBanner SeparatorMode = "banner"
+)
+
+// SeparatorModes lists the separator modes, in the order to offer them to
+// users.
+var SeparatorModes = []SeparatorMode{SeparatorKeep, SeparatorDrop,
+	SeparatorHeader, SeparatorTrailer, SeparatorBanner}
+
+// ParseSeparatorMode returns the separator mode named by s. The empty string
+// is SeparatorKeep.
+func ParseSeparatorMode(s string) (SeparatorMode, error) {
+	if s == "" {
+		return SeparatorKeep, nil
+	}
+	for _, mode := range SeparatorModes {
+		if strings.ToLower(s) == string(mode) {
+			return mode, nil
+		}
+	}
+	return SeparatorKeep, fmt.Errorf("unknown separator page mode %q", s)
+}
+
+// separatorLine is a line printed on a page that we're holding on to, or a
+// skip to a channel if channel isn't 0.
+type separatorLine struct {
+	text     string
+	linefeed bool
+	channel  int
+}
+
+// separatorFilter is a Job that passes lines and pages through to another
+// job, holding on to each page until it knows whether it's a separator page.
+type separatorFilter struct {
+	job         Job
+	mode        SeparatorMode
+	isSeparator func(line string) bool
+
+	// page is the lines on the current page.
+	page []separatorLine
+
+	// pages is the number of pages we've been given, and emitted the number
+	// of pages we've passed through to job.
+	pages   int
+	emitted int
+
+	// inBody is true once we've seen a page that isn't a separator page. Any
+	// separator pages after that might be the trailer, so they're held in
+	// trailer until we see another page or the end of the job.
+	inBody  bool
+	trailer [][]separatorLine
+}
+
+// NewSeparatorFilter returns a Job that prints to job, handling the JES2
+// separator pages according to mode. Pages are only recognized as separator
+// pages if they contain a line for which isSeparator returns true. If mode is
+// SeparatorKeep, job is returned unchanged.
+//
+// The page counts returned by AddLine and NewPage include the pages that
+// might be left out; EndJob returns the pages that were actually printed.
+func NewSeparatorFilter(job Job, mode SeparatorMode,
+	isSeparator func(line string) bool) Job {
+
+	if mode == SeparatorKeep || mode == "" {
+		return job
+	}
+	return &separatorFilter{job: job, mode: mode, isSeparator: isSeparator,
+		pages: 1}
+}
+
+func (f *separatorFilter) AddLine(text string, linefeed bool) int {
+	f.page = append(f.page, separatorLine{text: text, linefeed: linefeed})
+	return f.pages
+}
+
+func (f *separatorFilter) SkipToChannel(channel int) int {
+	if channel == 1 {
+		return f.NewPage()
+	}
+	f.page = append(f.page, separatorLine{channel: channel})
+	return f.pages
+}
+
+func (f *separatorFilter) NewPage() int {
+	f.endPage()
+	f.pages++
+	return f.pages
+}
+
+func (f *separatorFilter) EndJob(w io.Writer) (int, error) {
+	f.endPage()
+	for _, page := range f.trailer {
+		f.separatorPage(page, f.mode != SeparatorHeader)
+	}
+	f.trailer = nil
+	// If every page was left out, the job will still have its blank first
+	// page, which is better than a PDF with no pages.
+	return f.job.EndJob(w)
+}
+
+// endPage decides what to do with the page we've been collecting.
+func (f *separatorFilter) endPage() {
+	page := f.page
+	f.page = nil
+
+	separator := false
+	for _, line := range page {
+		if f.isSeparator(line.text) {
+			separator = true
+			break
+		}
+	}
+
+	switch {
+	case separator && !f.inBody:
+		f.separatorPage(page, f.mode != SeparatorTrailer)
+	case separator:
+		f.trailer = append(f.trailer, page)
+	default:
+		// The separator-looking pages we were holding weren't the end of
+		// the job after all.
+		for _, held := range f.trailer {
+			f.emit(held, false)
+		}
+		f.trailer = nil
+		f.inBody = true
+		f.emit(page, false)
+	}
+}
+
+// separatorPage prints a separator page if keep is true and we aren't
+// dropping all separator pages.
+func (f *separatorFilter) separatorPage(page []separatorLine, keep bool) {
+	if f.mode == SeparatorDrop || !keep {
+		return
+	}
+	f.emit(page, f.mode == SeparatorBanner)
+}
+
+// emit prints page to the job, on banner paper if banner is true.
+func (f *separatorFilter) emit(page []separatorLine, banner bool) {
+	bj, ok := f.job.(BannerJob)
+	if ok {
+		bj.SetBanner(banner)
+	}
+	// The job starts out with its first page ready for us.
+	if f.emitted > 0 {
+		f.job.NewPage()
+	}
+	f.emitted++
+	for _, line := range page {
+		if line.channel != 0 {
+			SkipToChannel(f.job, line.channel)
+		} else {
+			f.job.AddLine(line.text, line.linefeed)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package vprinter
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testStartSeparator = "****A   START  JOB   12  IBMUSERA  J. PROGRAMMER" +
+		"       ROOM 1234  11.25.08 AM 18 JAN 22  PRINTER1  SYS TK4-  " +
+		"JOB   12  START   A****"
+	testEndSeparator = "****A   END    JOB   12  IBMUSERA  J. PROGRAMMER" +
+		"       ROOM 1234  11.25.09 AM 18 JAN 22  PRINTER1  SYS TK4-  " +
+		"JOB   12  END     A****"
+)
+
+// recordingJob is a BannerJob that records the first line of each page, with
+// a "*" in front of it if the page is on banner paper.
+type recordingJob struct {
+	pages  []string
+	banner bool
+}
+
+func (j *recordingJob) AddLine(text string, linefeed bool) int {
+	if j.pages[len(j.pages)-1] == "" || j.pages[len(j.pages)-1] == "*" {
+		j.pages[len(j.pages)-1] += text
+	}
+	return len(j.pages)
+}
+
+func (j *recordingJob) NewPage() int {
+	j.pages = append(j.pages, "")
+	j.SetBanner(j.banner)
+	return len(j.pages)
+}
+
+func (j *recordingJob) SetBanner(banner bool) {
+	j.banner = banner
+	if page := &j.pages[len(j.pages)-1]; *page == "" || *page == "*" {
+		*page = ""
+		if banner {
+			*page = "*"
+		}
+	}
+}
+
+func (j *recordingJob) EndJob(w io.Writer) (int, error) {
+	return len(j.pages), nil
+}
+
+func TestSeparatorFilter(t *testing.T) {
+	tests := []struct {
+		mode SeparatorMode
+		want []string
+	}{
+		{SeparatorKeep, []string{"START", "ONE", "TWO", "END"}},
+		{SeparatorDrop, []string{"ONE", "TWO"}},
+		{SeparatorHeader, []string{"START", "ONE", "TWO"}},
+		{SeparatorTrailer, []string{"ONE", "TWO", "END"}},
+		{SeparatorBanner, []string{"*START", "ONE", "TWO", "*END"}},
+	}
+
+	for _, test := range tests {
+		rj := &recordingJob{pages: []string{""}}
+		job := NewSeparatorFilter(rj, test.mode, func(line string) bool {
+			return line == testStartSeparator || line == testEndSeparator
+		})
+		for i, page := range []string{testStartSeparator, "ONE", "TWO",
+			testEndSeparator} {
+
+			if i > 0 {
+				job.NewPage()
+			}
+			job.AddLine(page, true)
+			job.AddLine("more", true)
+		}
+		n, _ := job.EndJob(io.Discard)
+
+		for i := range rj.pages {
+			rj.pages[i] = strings.Replace(rj.pages[i], testStartSeparator,
+				"START", 1)
+			rj.pages[i] = strings.Replace(rj.pages[i], testEndSeparator,
+				"END", 1)
+		}
+		if !reflect.DeepEqual(rj.pages, test.want) || n != len(test.want) {
+			t.Errorf("%s: got %d pages %v, want %v", test.mode, n, rj.pages,
+				test.want)
+		}
+	}
+}
@@ -47,6 +47,31 @@ type Job interface {
 	EndJob(io.Writer) (int, error)
 }
 
+// ChannelJob is implemented by virtual printers that can skip to a channel
+// of a carriage control tape. Channel 1 is always the top of the form, which
+// print jobs ask for with NewPage instead.
+type ChannelJob interface {
+	Job
+
+	// SkipToChannel advances the paper to the next line punched for channel
+	// (2-12) in the carriage control tape. Returns the current number of
+	// pages in the job so far.
+	SkipToChannel(channel int) int
+}
+
+// SkipToChannel skips job to channel if it is a ChannelJob. Channel 1 is the
+// same as NewPage. Printers that can't skip to a channel space one line
+// instead, which is what the agent has always done for them.
+func SkipToChannel(job Job, channel int) int {
+	if channel == 1 {
+		return job.NewPage()
+	}
+	if cj, ok := job.(ChannelJob); ok {
+		return cj.SkipToChannel(channel)
+	}
+	return job.AddLine("", true)
+}
+
 // LoadFont will load a font file from path, verify that it is usable with the
 // gofpdf library, and that it is a fixed-with font. If everything is okay,
 // we will return the font as a byte array and error will be nil.
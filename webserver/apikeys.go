@@ -0,0 +1,223 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+const (
+	// maxAPIKeys is how many API keys each user may have.
+	maxAPIKeys = 20
+
+	// maxAPIKeyNameLen is the longest name an API key may have.
+	maxAPIKeyNameLen = 50
+
+	// apiKeyTouchInterval is how often we record that an API key was used,
+	// so that busy keys, e.g. for chunked uploads, don't write the user's
+	// record on every request.
+	apiKeyTouchInterval = time.Minute
+)
+
+var (
+	errKeyExpired = errors.New("API key has expired")
+	errKeyScope   = errors.New("API key may not be used for this")
+)
+
+// apiKeyExpiries are the choices for how long new API keys last, in days.
+// Zero means never.
+var apiKeyExpiries = []struct {
+	Days        int
+	Description string
+}{
+	{0, "Never expires"},
+	{30, "Expires in 30 days"},
+	{90, "Expires in 90 days"},
+	{365, "Expires in a year"},
+}
+
+// authenticateKey finds the user with the API key key, checking that the key
+// hasn't expired and may be used for scope. The returned user's default
+// profile is the key's, if it has one.
+func (a *application) authenticateKey(key, scope string) (model.User,
+	model.APIKey, error) {
+
+	user, err := a.db.GetUserForAccessKey(key)
+	if err != nil {
+		return user, model.APIKey{}, err
+	}
+	apikey := user.FindAPIKey(key)
+	if apikey == nil {
+		// The index is out of sync with the user record.
+		return user, model.APIKey{}, errors.New("API key not found")
+	}
+	now := time.Now().UTC()
+	if apikey.Expired(now) {
+		return user, *apikey, errKeyExpired
+	}
+	if !apikey.HasScope(scope) {
+		return user, *apikey, errKeyScope
+	}
+
+	if now.Sub(apikey.LastUsed) > apiKeyTouchInterval {
+		if err := a.db.TouchAPIKey(user.Email, apikey.ID, now); err != nil {
+			logger.With("user", user.Email).Errorf(
+				"couldn't record API key use: %v", err)
+		}
+	}
+
+	// The key's default profile takes the place of the user's for jobs sent
+	// with it.
+	if apikey.Profile != "" {
+		user.DefaultProfile = apikey.Profile
+	}
+	return user, *apikey, nil
+}
+
+// createAPIKey adds a new API key for the logged in user.
+func (app *application) createAPIKey(w http.ResponseWriter,
+	r *http.Request) {
+
+	// Verify we have a logged in, valid user
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "couldn't parse API key form", http.StatusBadRequest)
+		return
+	}
+
+	fail := func(message string) {
+		app.session.Put(r, "apiKeyError", "API key not created: "+message)
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+	}
+
+	if !u.Verified {
+		fail("your email address must be verified first.")
+		return
+	}
+	if len(u.APIKeys) >= maxAPIKeys {
+		fail("you may have no more than " + strconv.Itoa(maxAPIKeys) +
+			" API keys.")
+		return
+	}
+
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" || len(name) > maxAPIKeyNameLen {
+		fail("the name is required, and may be no more than " +
+			strconv.Itoa(maxAPIKeyNameLen) + " characters.")
+		return
+	}
+
+	var scopes []string
+	for _, scope := range model.Scopes {
+		for _, s := range r.PostForm["scopes"] {
+			if s == scope {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	if len(scopes) == 0 {
+		fail("choose what the key may be used for.")
+		return
+	}
+
+	var expires time.Time
+	days, err := strconv.Atoi(r.PostForm.Get("expires"))
+	if err != nil || days < 0 {
+		fail("invalid expiry.")
+		return
+	}
+	if days > 0 {
+		expires = time.Now().UTC().AddDate(0, 0, days)
+	}
+
+	profile, _, err := validateProfilePreferences(r.PostForm.Get("profile"),
+		false, nil)
+	if err != nil {
+		fail(err.Error() + ".")
+		return
+	}
+	if profile != "" && len(u.AllowedProfiles) > 0 &&
+		!isAllowedProfile(u.AllowedProfiles, profile) {
+		fail("the default profile must be one of your allowed profiles.")
+		return
+	}
+
+	key, secret := u.AddAPIKey(name, scopes, expires, profile)
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	requestLog(r).With("user", u.Email, "key_id", key.ID).Infof(
+		"created API key")
+	app.session.Put(r, "apiKeySuccess", "API key "+name+" created.")
+	app.session.Put(r, "newAPIKey", secret)
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
+
+// revokeAPIKey deletes one of the logged in user's API keys.
+func (app *application) revokeAPIKey(w http.ResponseWriter,
+	r *http.Request) {
+
+	// Verify we have a logged in, valid user
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id := r.URL.Query().Get("id")
+	if !u.RevokeAPIKey(id) {
+		http.Error(w, "No such API key", http.StatusNotFound)
+		return
+	}
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	requestLog(r).With("user", u.Email, "key_id", id).Infof(
+		"revoked API key")
+	app.session.Put(r, "apiKeySuccess", "API key revoked.")
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
@@ -22,13 +22,15 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"os"
 	"regexp"
+	"time"
 
+	"github.com/racingmars/virtual1403/logging"
 	"github.com/racingmars/virtual1403/webserver/db"
 	"github.com/racingmars/virtual1403/webserver/mailer"
 	"github.com/racingmars/virtual1403/webserver/model"
+	"github.com/racingmars/virtual1403/webserver/oidc"
 	"gopkg.in/yaml.v3"
 )
 
@@ -41,17 +43,30 @@ type ServerConfig struct {
 	TLSDomain               string        `yaml:"tls_domain"`
 	BaseURL                 string        `yaml:"server_base_url"`
 	MailConfig              mailer.Config `yaml:"mail_config"`
+	OIDC                    oidc.Config   `yaml:"oidc"`
 	QuotaJobs               int           `yaml:"quota_jobs"`
 	QuotaPages              int           `yaml:"quota_pages"`
 	QuotaPeriod             int           `yaml:"quota_period"`
 	MaxLinesPerJob          int           `yaml:"max_lines_per_job"`
 	ConcurrentPrintJobs     int           `yaml:"concurrent_print_jobs"`
+	JobWaitSeconds          int           `yaml:"job_wait_seconds"`
+	ProfileSeats            []SeatLimit   `yaml:"profile_seats"`
+	SeatWaitSeconds         int           `yaml:"seat_wait_seconds"`
 	InactiveMonthsCleanup   int           `yaml:"inactive_months_cleanup"`
 	UnverifiedMonthsCleanup int           `yaml:"unverified_months_cleanup"`
 	PDFDaysCleanup          int           `yaml:"pdf_cleanup_days"`
 	NuisanceJobNames        []string      `yaml:"nuisance_job_names"`
 	nuisanceJobRegex        []*regexp.Regexp
 	ServerAdmin             string `yaml:"server_admin_email"`
+	LogLevel                string `yaml:"log_level"`
+	LogFormat               string `yaml:"log_format"`
+	UploadDirectory         string `yaml:"upload_directory"`
+	SockdevPort             int    `yaml:"sockdev_port"`
+	SockdevTLS              bool   `yaml:"sockdev_tls"`
+	SockdevCertFile         string `yaml:"sockdev_tls_cert"`
+	SockdevKeyFile          string `yaml:"sockdev_tls_key"`
+	SockdevInsecure         bool   `yaml:"sockdev_insecure"`
+	RequireAdmin2FA         bool   `yaml:"require_admin_2fa"`
 }
 
 func readConfig(path string) (ServerConfig, []error) {
@@ -89,6 +104,31 @@ func readConfig(path string) (ServerConfig, []error) {
 		errs = append(errs, fmt.Errorf("TLS domain name is required"))
 	}
 
+	// SockdevPort is optional; <= 0 we don't accept sockdev connections
+	if c.SockdevPort > 65535 {
+		errs = append(errs, fmt.Errorf("sockdev port number %d is invalid",
+			c.SockdevPort))
+	}
+
+	// A sockdev TLS certificate needs its key, and vice versa. Without
+	// them, TLS sockdev connections use the TLS HTTP server's certificate.
+	if (c.SockdevCertFile == "") != (c.SockdevKeyFile == "") {
+		errs = append(errs, fmt.Errorf(
+			"sockdev_tls_cert and sockdev_tls_key must be set together"))
+	}
+	if c.SockdevTLS && c.SockdevCertFile == "" && c.TLSListenPort <= 0 {
+		errs = append(errs, fmt.Errorf("sockdev_tls requires "+
+			"sockdev_tls_cert and sockdev_tls_key, or tls_listen_port"))
+	}
+
+	// Sockdev clients send their API key, so it has to be encrypted unless
+	// we're told otherwise.
+	if c.SockdevPort > 0 && !c.SockdevTLS && c.SockdevCertFile == "" &&
+		!c.SockdevInsecure {
+		errs = append(errs, fmt.Errorf("sockdev_port requires sockdev_tls, "+
+			"or sockdev_insecure to accept unencrypted connections"))
+	}
+
 	if c.BaseURL == "" {
 		errs = append(errs, fmt.Errorf("server_base_url is required"))
 	}
@@ -131,6 +171,29 @@ func readConfig(path string) (ServerConfig, []error) {
 			"pdf_cleanup_days is required and must be >0"))
 	}
 
+	// The logging settings take effect immediately so that the rest of the
+	// startup is logged the way the administrator asked.
+	if err := logging.Configure(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log_level: %v", err))
+	}
+	if format, err := logging.ParseFormat(c.LogFormat); err != nil {
+		errs = append(errs, fmt.Errorf("log_format: %v", err))
+	} else {
+		logging.SetFormat(format)
+	}
+
+	for i, limit := range c.ProfileSeats {
+		if err := limit.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("profile_seats entry %d: %v",
+				i+1, err))
+		}
+	}
+
+	// Single sign-on is optional
+	if c.OIDC.Enabled() {
+		errs = append(errs, c.OIDC.Validate()...)
+	}
+
 	// Parse the nuisance regular expressions
 	for i := range c.NuisanceJobNames {
 		r, err := regexp.Compile(c.NuisanceJobNames[i])
@@ -149,7 +212,7 @@ func (a *application) createAdmin(email string) error {
 	// Only proceed if admin user doesn't already exist
 	_, err := a.db.GetUser(email)
 	if err != db.ErrNotFound {
-		log.Printf("INFO:  admin account %s already exists", email)
+		logger.Infof("admin account %s already exists", email)
 		return nil
 	}
 
@@ -167,13 +230,15 @@ func (a *application) createAdmin(email string) error {
 	u.Admin = true
 	u.Verified = true
 	u.Enabled = true
+	u.VerificationToken = ""
+	_, key := u.AddAPIKey("Default", model.Scopes, time.Time{}, "")
 
 	err = a.db.SaveUser(u)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("INFO:  Created new admin account: %s ; %s ; %s", email,
-		pwstring, u.AccessKey)
+	logger.Infof("Created new admin account: %s ; %s ; %s", email,
+		pwstring, key)
 	return nil
 }
@@ -24,15 +24,17 @@ import (
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"log"
 	"strings"
 	"time"
 
 	"github.com/boltdb/bolt"
 
+	"github.com/racingmars/virtual1403/logging"
 	"github.com/racingmars/virtual1403/webserver/model"
 )
 
+var logger = logging.New("db")
+
 type boltimpl struct {
 	bdb *bolt.DB
 }
@@ -40,14 +42,17 @@ type boltimpl struct {
 const (
 	userBucketName             = "users"
 	accessKeyBucketName        = "access_keys"
+	verificationBucketName     = "verification_tokens"
 	jobLogBucketName           = "job_log"
 	jobLogUserIndexName        = "job_log_user_index"
 	configBucketName           = "config"
 	autocertBucketName         = "autocert"
 	deleteLogBucketName        = "delete_log"
 	pdfBucketName              = "pdfs"
+	printQueueBucketName       = "print_queue"
 	sessionSecretKeyConfigName = "session_secret"
 	shareSecretKeyConfigName   = "share_secret"
+	resetSecretKeyConfigName   = "reset_secret"
 )
 
 func NewDB(path string) (DB, error) {
@@ -66,6 +71,10 @@ func NewDB(path string) (DB, error) {
 			[]byte(accessKeyBucketName)); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists(
+			[]byte(verificationBucketName)); err != nil {
+			return err
+		}
 		if _, err := tx.CreateBucketIfNotExists(
 			[]byte(jobLogBucketName)); err != nil {
 			return err
@@ -90,12 +99,60 @@ func NewDB(path string) (DB, error) {
 			[]byte(pdfBucketName)); err != nil {
 			return err
 		}
+		if _, err := tx.CreateBucketIfNotExists(
+			[]byte(printQueueBucketName)); err != nil {
+			return err
+		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 
-	return &boltimpl{bdb: db}, nil
+	impl := &boltimpl{bdb: db}
+	if err := impl.migrateKeys(); err != nil {
+		return nil, err
+	}
+
+	return impl, nil
+}
+
+// migrateKeys moves each user's access key from before users could have
+// several API keys to their APIKeys, or for unverified users, to their
+// verification token, and replaces API keys stored from before keys were
+// hashed with their hashes.
+func (db *boltimpl) migrateKeys() error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		userBucket := tx.Bucket([]byte(userBucketName))
+		var users []model.User
+		if err := userBucket.ForEach(func(k, v []byte) error {
+			var user model.User
+			if err := json.Unmarshal(v, &user); err != nil {
+				return err
+			}
+			if user.MigrateKeys() {
+				users = append(users, user)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		// The old keys are still in the access key index, so they are
+		// unindexed with the user as it was before.
+		for _, user := range users {
+			logger.Infof("migrating API keys of %s", user.Email)
+			if err := putUser(tx, user); err != nil {
+				return err
+			}
+		}
+		if len(users) > 0 {
+			// Bolt doesn't clear the pages it frees.
+			logger.Warnf("API keys are now hashed, but unused pages of the " +
+				"database file and backups of it may still contain " +
+				"the old plaintext keys")
+		}
+		return nil
+	})
 }
 
 func (db *boltimpl) Close() error {
@@ -103,48 +160,82 @@ func (db *boltimpl) Close() error {
 }
 
 // SaveUser will save a new user or update an existing user in the database.
-// We also want an index on the user's access key, so we *always* keep the
-// user bucket and access key bucket in sync here. We delete and recreate the
-// access key each time, even if it hasn't changed. This is simpler logic and
-// user record updates aren't frequent enough that we need to optimize this.
+// We also want indexes on the user's API keys and verification token, so we
+// *always* keep the user bucket and index buckets in sync here. We delete and
+// recreate the index entries each time, even if they haven't changed. This
+// is simpler logic and user record updates aren't frequent enough that we
+// need to optimize this.
 func (db *boltimpl) SaveUser(user model.User) error {
-	// Prepare the user for saving in DB by converting to JSON. If the
-	// creation date isn't already set, set it to now.
+	// If the creation date isn't already set, set it to now.
 	if user.SignupDate == (time.Time{}) {
 		user.SignupDate = time.Now().UTC()
 	}
+
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		return putUser(tx, user)
+	})
+}
+
+// putUser saves the user record and its index entries in tx.
+func putUser(tx *bolt.Tx, user model.User) error {
 	userjson, err := json.Marshal(&user)
 	if err != nil {
 		return err
 	}
-
-	return db.bdb.Update(func(tx *bolt.Tx) error {
-		userBucket := tx.Bucket([]byte(userBucketName))
-		accessBucket := tx.Bucket([]byte(accessKeyBucketName))
-
-		// Does the user already exist?
-		olduserjson := userBucket.Get([]byte(strings.ToLower(user.Email)))
-		if olduserjson != nil {
-			// yes... let's grab the old access key so we can delete it
-			var olduser model.User
-			if err := json.Unmarshal(olduserjson, &olduser); err != nil {
-				return err
-			}
-			accessBucket.Delete([]byte(olduser.AccessKey))
+	userBucket := tx.Bucket([]byte(userBucketName))
+	accessBucket := tx.Bucket([]byte(accessKeyBucketName))
+	verificationBucket := tx.Bucket([]byte(verificationBucketName))
+	email := []byte(strings.ToLower(user.Email))
+
+	// Does the user already exist?
+	olduserjson := userBucket.Get(email)
+	if olduserjson != nil {
+		// yes... let's grab the old keys so we can delete them
+		var olduser model.User
+		if err := json.Unmarshal(olduserjson, &olduser); err != nil {
+			return err
 		}
+		unindexUser(tx, olduser)
+	}
 
-		// Save the new user record and access key linked to the user
-		if err := userBucket.Put([]byte(strings.ToLower(user.Email)),
-			userjson); err != nil {
+	// Save the new user record and keys linked to the user
+	if err := userBucket.Put(email, userjson); err != nil {
+		return err
+	}
+	for _, key := range user.APIKeys {
+		if err := accessBucket.Put([]byte(key.Prefix), email); err != nil {
 			return err
 		}
-		if err := accessBucket.Put([]byte(user.AccessKey),
-			[]byte(strings.ToLower(user.Email))); err != nil {
+	}
+	if user.VerificationToken != "" {
+		if err := verificationBucket.Put([]byte(user.VerificationToken),
+			email); err != nil {
 			return err
 		}
+	}
 
-		return nil
-	})
+	return nil
+}
+
+// unindexUser deletes the index entries for the user's API keys and
+// verification token.
+func unindexUser(tx *bolt.Tx, user model.User) {
+	accessBucket := tx.Bucket([]byte(accessKeyBucketName))
+	for _, key := range user.APIKeys {
+		if key.Prefix != "" {
+			accessBucket.Delete([]byte(key.Prefix))
+		}
+		if key.Key != "" {
+			accessBucket.Delete([]byte(key.Key))
+		}
+	}
+	if user.AccessKey != "" {
+		accessBucket.Delete([]byte(user.AccessKey))
+	}
+	if user.VerificationToken != "" {
+		tx.Bucket([]byte(verificationBucketName)).Delete(
+			[]byte(user.VerificationToken))
+	}
 }
 
 func (db *boltimpl) GetUser(email string) (model.User, error) {
@@ -192,10 +283,32 @@ func (db *boltimpl) GetUsers() ([]model.User, error) {
 	return users, nil
 }
 
+// GetUserForAccessKey looks up the user by the key's prefix, and then checks
+// the key against the hashes of the user's keys.
 func (db *boltimpl) GetUserForAccessKey(key string) (model.User, error) {
+	user, err := db.getUserForIndex(accessKeyBucketName,
+		model.APIKeyPrefix(key))
+	if err != nil {
+		return model.User{}, err
+	}
+	if user.FindAPIKey(key) == nil {
+		return model.User{}, ErrNotFound
+	}
+	return user, nil
+}
+
+func (db *boltimpl) GetUserForVerificationToken(token string) (model.User,
+	error) {
+
+	return db.getUserForIndex(verificationBucketName, token)
+}
+
+// getUserForIndex gets the user whose email is stored under key in one of
+// the user index buckets.
+func (db *boltimpl) getUserForIndex(bucket, key string) (model.User, error) {
 	var email string
 	if err := db.bdb.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(accessKeyBucketName))
+		b := tx.Bucket([]byte(bucket))
 		emailbytes := b.Get([]byte(key))
 		if emailbytes == nil {
 			return ErrNotFound
@@ -209,12 +322,35 @@ func (db *boltimpl) GetUserForAccessKey(key string) (model.User, error) {
 	return db.GetUser(email)
 }
 
+func (db *boltimpl) TouchAPIKey(email, id string, t time.Time) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		userBucket := tx.Bucket([]byte(userBucketName))
+		userjson := userBucket.Get([]byte(strings.ToLower(email)))
+		if userjson == nil {
+			return ErrNotFound
+		}
+		var user model.User
+		if err := json.Unmarshal(userjson, &user); err != nil {
+			return err
+		}
+		for i := range user.APIKeys {
+			if user.APIKeys[i].ID == id {
+				user.APIKeys[i].LastUsed = t
+			}
+		}
+		userjson, err := json.Marshal(&user)
+		if err != nil {
+			return err
+		}
+		return userBucket.Put([]byte(strings.ToLower(email)), userjson)
+	})
+}
+
 // DeleteUser needs to keep user bucket and access key bucket in sync, so
 // will delete from both.
 func (db *boltimpl) DeleteUser(email, who string) error {
 	return db.bdb.Update(func(tx *bolt.Tx) error {
 		userBucket := tx.Bucket([]byte(userBucketName))
-		accessBucket := tx.Bucket([]byte(accessKeyBucketName))
 		deleteLogBucket := tx.Bucket([]byte(deleteLogBucketName))
 
 		olduserjson := userBucket.Get([]byte(strings.ToLower(email)))
@@ -228,8 +364,8 @@ func (db *boltimpl) DeleteUser(email, who string) error {
 			return err
 		}
 
-		// Now we delete access key and user
-		accessBucket.Delete([]byte(olduser.AccessKey))
+		// Now we delete access keys and user
+		unindexUser(tx, olduser)
 		userBucket.Delete([]byte(strings.ToLower(email)))
 
 		// Need to delete job log entries and job log index entries. We will
@@ -243,9 +379,11 @@ func (db *boltimpl) DeleteUser(email, who string) error {
 		// key with the user's email address followed by null byte.
 		id := []byte(strings.ToLower(email))
 		id = append(id, 0)
+		queueBucket := tx.Bucket([]byte(printQueueBucketName))
 		for k, _ := c.Seek(id); bytes.HasPrefix(k, id); k, _ = c.Next() {
 			entryid := bytes.TrimPrefix(k, id)
 			logBucket.Delete(entryid)
+			queueBucket.Delete(entryid)
 			c.Delete()
 		}
 
@@ -330,7 +468,7 @@ func (db *boltimpl) DeleteInactiveUsers(inactive,
 	// transaction or we would deadlock with the transaction in the DeleteUser
 	// function.
 	for i, email := range usersToDelete {
-		log.Printf("INFO:  auto-deleting user %s", email)
+		logger.Infof("auto-deleting user %s", email)
 		if err := db.DeleteUser(email, "db cleanup"); err != nil {
 			return i, err
 		}
@@ -339,12 +477,15 @@ func (db *boltimpl) DeleteInactiveUsers(inactive,
 	return len(usersToDelete), nil
 }
 
-func (db *boltimpl) LogJob(email, jobinfo string, pages int, pdf []byte) error {
+func (db *boltimpl) QueueJob(email, jobinfo string, details *model.JobInfo,
+	profile string, payload []byte) (uint64, error) {
+
+	var id uint64
 	err := db.bdb.Update(func(tx *bolt.Tx) error {
 		userBucket := tx.Bucket([]byte(userBucketName))
 		logBucket := tx.Bucket([]byte(jobLogBucketName))
 		logIdxBucket := tx.Bucket([]byte(jobLogUserIndexName))
-		pdfBucket := tx.Bucket([]byte(pdfBucketName))
+		queueBucket := tx.Bucket([]byte(printQueueBucketName))
 
 		userjson := userBucket.Get([]byte(strings.ToLower(email)))
 		if userjson == nil {
@@ -358,7 +499,6 @@ func (db *boltimpl) LogJob(email, jobinfo string, pages int, pdf []byte) error {
 		}
 
 		user.JobCount++
-		user.PageCount += pages
 		user.LastJob = time.Now().UTC()
 
 		// Save user back to DB
@@ -376,16 +516,15 @@ func (db *boltimpl) LogJob(email, jobinfo string, pages int, pdf []byte) error {
 		if err != nil {
 			return err
 		}
+		id = nextID
 		logentry := model.JobLogEntry{
 			ID:      nextID,
 			Email:   user.Email,
-			Pages:   pages,
 			Time:    user.LastJob,
 			JobInfo: jobinfo,
-		}
-
-		if len(pdf) > 0 {
-			logentry.HasPDF = true
+			Details: details,
+			State:   model.JobQueued,
+			Profile: profile,
 		}
 
 		logentryjson, err := json.Marshal(&logentry)
@@ -408,22 +547,154 @@ func (db *boltimpl) LogJob(email, jobinfo string, pages int, pdf []byte) error {
 			return err
 		}
 
-		// Save the PDF
-		if len(pdf) > 0 {
-			err = pdfBucket.Put(logID, pdf)
-			if err != nil {
+		// Add the job to the print queue, with the print directives that the
+		// print workers will render.
+		return queueBucket.Put(logID, payload)
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+func (db *boltimpl) GetQueuedJobs() ([]model.JobLogEntry, error) {
+	var results []model.JobLogEntry
+	err := db.bdb.View(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket([]byte(jobLogBucketName))
+		queueBucket := tx.Bucket([]byte(printQueueBucketName))
+
+		return queueBucket.ForEach(func(k, v []byte) error {
+			jobJSON := logBucket.Get(k)
+			if len(jobJSON) == 0 {
+				// The job is gone, which the print workers will find out
+				// for themselves.
+				return nil
+			}
+			var job model.JobLogEntry
+			if err := json.Unmarshal(jobJSON, &job); err != nil {
 				return err
 			}
-		}
+			results = append(results, job)
+			return nil
+		})
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (db *boltimpl) GetJobPayload(id uint64) ([]byte, error) {
+	var payload []byte
+	err := db.bdb.View(func(tx *bolt.Tx) error {
+		queueBucket := tx.Bucket([]byte(printQueueBucketName))
 
+		v := queueBucket.Get(uint64ToBytesBE(id))
+		if len(v) == 0 {
+			return ErrNotFound
+		}
+		// Bolt's values are only valid during the transaction.
+		payload = append([]byte(nil), v...)
 		return nil
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return payload, nil
+}
+
+func (db *boltimpl) UpdateJob(job model.JobLogEntry) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		logBucket := tx.Bucket([]byte(jobLogBucketName))
+		queueBucket := tx.Bucket([]byte(printQueueBucketName))
+
+		logID := uint64ToBytesBE(job.ID)
+		if len(logBucket.Get(logID)) == 0 {
+			return ErrNotFound
+		}
+
+		jobJSON, err := json.Marshal(&job)
+		if err != nil {
+			return err
+		}
+		if err := logBucket.Put(logID, jobJSON); err != nil {
+			return err
+		}
+
+		if job.Finished() {
+			return queueBucket.Delete(logID)
+		}
+		return nil
+	})
+}
+
+func (db *boltimpl) SaveJobPDF(id uint64, pages int, pdf []byte) error {
+	return db.bdb.Update(func(tx *bolt.Tx) error {
+		userBucket := tx.Bucket([]byte(userBucketName))
+		logBucket := tx.Bucket([]byte(jobLogBucketName))
+		queueBucket := tx.Bucket([]byte(printQueueBucketName))
+		pdfBucket := tx.Bucket([]byte(pdfBucketName))
+
+		logID := uint64ToBytesBE(id)
+		jobJSON := logBucket.Get(logID)
+		if len(jobJSON) == 0 {
+			return ErrNotFound
+		}
+		var job model.JobLogEntry
+		if err := json.Unmarshal(jobJSON, &job); err != nil {
+			return err
+		}
+
+		userjson := userBucket.Get([]byte(strings.ToLower(job.Email)))
+		if userjson == nil {
+			// no such user
+			return ErrNotFound
+		}
+		var user model.User
+		if err := json.Unmarshal(userjson, &user); err != nil {
+			return err
+		}
+
+		// Now that we know how many pages the job was, it counts toward
+		// the user's total.
+		user.PageCount += pages
+		userjson, err := json.Marshal(&user)
+		if err != nil {
+			return err
+		}
+		if err := userBucket.Put([]byte(strings.ToLower(job.Email)),
+			userjson); err != nil {
+			return err
+		}
+
+		job.Pages = pages
+		job.HasPDF = len(pdf) > 0
+		job.State = model.JobDelivering
+		jobJSON, err = json.Marshal(&job)
+		if err != nil {
+			return err
+		}
+		if err := logBucket.Put(logID, jobJSON); err != nil {
+			return err
+		}
+
+		// Save the PDF
+		if len(pdf) > 0 {
+			if err := pdfBucket.Put(logID, pdf); err != nil {
+				return err
+			}
+		}
+
+		// The job stays in the queue until it's delivered, but we don't
+		// need its print directives any more.
+		return queueBucket.Put(logID, []byte{})
+	})
 }
 
 func (db *boltimpl) GetPDF(id uint64) ([]byte, error) {
@@ -573,6 +844,10 @@ func (db *boltimpl) GetShareSecret() ([]byte, error) {
 	return db.getOrGenKey(shareSecretKeyConfigName, ShareSecretKeyLength)
 }
 
+func (db *boltimpl) GetResetSecret() ([]byte, error) {
+	return db.getOrGenKey(resetSecretKeyConfigName, ResetSecretKeyLength)
+}
+
 func (db *boltimpl) getOrGenKey(name string, size int) ([]byte, error) {
 	result := make([]byte, size)
 	err := db.bdb.Update(func(tx *bolt.Tx) error {
@@ -627,7 +902,7 @@ func (db *boltimpl) CleanPDFs(cutoff time.Time) {
 
 			var job model.JobLogEntry
 			if err := json.Unmarshal(jobJSON, &job); err != nil {
-				log.Printf("ERROR: during PDF cleanup, couldn't read "+
+				logger.Errorf("during PDF cleanup, couldn't read "+
 					"job JSON for %v: %v", k, err)
 				continue
 			}
@@ -637,12 +912,12 @@ func (db *boltimpl) CleanPDFs(cutoff time.Time) {
 				job.HasPDF = false
 				jobJSON, err := json.Marshal(&job)
 				if err != nil {
-					log.Printf("ERROR: during PDF cleanup, couldn't "+
+					logger.Errorf("during PDF cleanup, couldn't "+
 						"re-encode JSON for %v: %v", k, err)
 					continue
 				}
 				if err := jobBucket.Put(k, jobJSON); err != nil {
-					log.Printf("ERROR: during PDF cleanup, couldn't "+
+					logger.Errorf("during PDF cleanup, couldn't "+
 						"save JSON for %v: %v", k, err)
 					continue
 				}
@@ -653,9 +928,9 @@ func (db *boltimpl) CleanPDFs(cutoff time.Time) {
 		return nil
 	})
 	if err != nil {
-		log.Printf("ERROR: during PDF cleanup, transaction returned: %v", err)
+		logger.Errorf("during PDF cleanup, transaction returned: %v", err)
 	} else {
-		log.Printf("INFO:  PDF cleanup deleted %d PDFs", n)
+		logger.Infof("PDF cleanup deleted %d PDFs", n)
 	}
 }
 
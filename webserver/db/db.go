@@ -31,6 +31,7 @@ var ErrNotFound = errors.New("not found")
 
 const SessionSecretKeyLength = 32
 const ShareSecretKeyLength = auth.KeySize
+const ResetSecretKeyLength = auth.KeySize
 
 type DB interface {
 	// Close will close the database.
@@ -43,9 +44,18 @@ type DB interface {
 	// GetUser retrieves a user from the database by email.
 	GetUser(email string) (model.User, error)
 
-	// GetUserForAccessKey returns the user with the provided access key.
+	// GetUserForAccessKey returns the user with the provided API key. Keys
+	// are stored as salted hashes, and looked up by their prefix.
 	GetUserForAccessKey(key string) (model.User, error)
 
+	// GetUserForVerificationToken returns the user with the provided email
+	// verification token.
+	GetUserForVerificationToken(token string) (model.User, error)
+
+	// TouchAPIKey records that the user's API key with the given ID was
+	// used at time t.
+	TouchAPIKey(email, id string, t time.Time) error
+
 	// GetUsers returns all users in the database.
 	GetUsers() ([]model.User, error)
 
@@ -62,11 +72,32 @@ type DB interface {
 	// number of users deleted (which may still be >0 when err != nil).
 	DeleteInactiveUsers(inactive, unverified time.Time) (int, error)
 
-	// LogJob will record that a job was just processed for the user with the
-	// provided email address. This will add to the job log and update the
-	// user's record with the last job time and increase the job count for the
-	// user.
-	LogJob(email, jobinfo string, pages int, pdf []byte) error
+	// QueueJob will record that a job was just received for the user with
+	// the provided email address, and add it to the print queue. This will
+	// add to the job log in the queued state and update the user's record
+	// with the last job time and increase the job count for the user.
+	// details may be nil if the agent didn't send any job details. payload
+	// is the job's print directives, for the print workers. Returns the ID
+	// of the new job log entry.
+	QueueJob(email, jobinfo string, details *model.JobInfo, profile string,
+		payload []byte) (uint64, error)
+
+	// GetQueuedJobs returns the job log entries for the jobs in the print
+	// queue, which haven't finished yet.
+	GetQueuedJobs() ([]model.JobLogEntry, error)
+
+	// GetJobPayload returns the print directives for a queued job that
+	// hasn't been rendered yet.
+	GetJobPayload(id uint64) ([]byte, error)
+
+	// UpdateJob saves a job log entry's changes. Jobs that have finished are
+	// removed from the print queue.
+	UpdateJob(job model.JobLogEntry) error
+
+	// SaveJobPDF records that a queued job has been rendered, saving its PDF
+	// and adding its pages to the user's page count. The job moves to the
+	// delivering state.
+	SaveJobPDF(id uint64, pages int, pdf []byte) error
 
 	// GetUserJobLog returns up to size rows from the job log for the user
 	// with the provided email address. Jobs are returned in descending order
@@ -100,6 +131,11 @@ type DB interface {
 	// the database file.
 	GetShareSecret() ([]byte, error)
 
+	// GetResetSecret will return a 32-byte random value to use as the
+	// password reset link authentication key, generating and saving one the
+	// first time, like GetShareSecret.
+	GetResetSecret() ([]byte, error)
+
 	// We also use our database as an autocert cache
 	autocert.Cache
 }
@@ -0,0 +1,309 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/racingmars/virtual1403/vprinter"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+// protocolVersion is the newest version of the print directive protocol
+// that we understand. Version 1 has no header directive.
+const protocolVersion = 2
+
+// jobInfoRegex matches valid/allowed job info data
+var jobInfoRegex = regexp.MustCompile(`^[a-zA-z0-9_]{0,25}$`)
+
+// printStream reads a print job's print directives. The print operations
+// are handed out one at a time by next, so that a job never has to be held
+// in memory; the job's other directives are recorded in the printStream as
+// they are read.
+type printStream struct {
+	// version is the protocol version of the print directives.
+	version int
+
+	// header is the fields of the version 2 header directive, e.g. agent
+	// and printer.
+	header map[string]string
+
+	// jobinfo is the data of the last J: directive read so far.
+	jobinfo string
+
+	// details is the job details from the version 2 metadata directives
+	// read so far.
+	details model.JobInfo
+
+	// validated is true if the directives were checked when the job was
+	// queued, so only the print operations need to be parsed.
+	validated bool
+
+	scanner  *bufio.Scanner
+	maxlines int
+	lines    int
+}
+
+// printOp is one L:, O:, P: or C: directive of a print job.
+type printOp struct {
+	directive byte
+	text      string
+	channel   int
+}
+
+// parsePrintDirectives returns a printStream reading the print directives
+// of a job from r. Reading will stop after maxlines if maxlines > 0.
+//
+// If the first directive is a V: header, the job uses version 2 of the
+// protocol, which adds M: metadata and C: channel skip directives. Unknown
+// directives are ignored in version 2, so that newer clients can add
+// directives that older servers don't need to understand; in version 1
+// they are an error.
+func parsePrintDirectives(r io.Reader, maxlines int) *printStream {
+	return &printStream{
+		version:  1,
+		scanner:  bufio.NewScanner(r),
+		maxlines: maxlines,
+	}
+}
+
+// parseValidatedDirectives returns a printStream reading print directives
+// that were already checked by reading a printStream from
+// parsePrintDirectives. Only the print operations are parsed; the job info
+// and details are what the earlier printStream found.
+func parseValidatedDirectives(r io.Reader, maxlines int) *printStream {
+	s := parsePrintDirectives(r, maxlines)
+	s.validated = true
+	return s
+}
+
+// next returns the next print operation, or io.EOF once there are no more.
+// An error is returned if the input data is invalid.
+func (s *printStream) next() (printOp, error) {
+	for (s.maxlines <= 0 || s.lines <= s.maxlines) && s.scanner.Scan() {
+		line := strings.TrimSpace(s.scanner.Text())
+		if line == "" {
+			continue
+		}
+		var op printOp
+		var ok bool
+		var err error
+		if s.validated {
+			op, ok = parseOperation(line)
+		} else if op, ok, err = s.parseDirective(line); err != nil {
+			return printOp{}, err
+		}
+		s.lines++
+		if ok {
+			return op, nil
+		}
+	}
+	if err := s.scanner.Err(); err != nil {
+		return printOp{}, err
+	}
+	return printOp{}, io.EOF
+}
+
+// validate reads the rest of the directives, returning an error if the input
+// data is invalid. Afterwards, the printStream has the job's details.
+func (s *printStream) validate() error {
+	for {
+		if _, err := s.next(); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// parseDirective parses one line of the print directives. If it's a print
+// operation, it is returned with ok true.
+func (s *printStream) parseDirective(line string) (op printOp, ok bool,
+	err error) {
+
+	if len(line) < 2 {
+		return op, false, errors.New("line received without directive")
+	}
+	directive := line[0:2]
+	param := line[2:]
+
+	// In all cases, param must be a valid UTF-8 string <= 132 runes, so
+	// we'll take care of that now.
+	if !utf8.ValidString(param) {
+		return op, false, errors.New("invalid UTF-8 string")
+	}
+
+	// Trim to 132 runes
+	param = trimToRuneLen(param, 132)
+
+	switch directive {
+	case "V:":
+		if s.lines > 0 {
+			return op, false, errors.New(
+				"header directive must be the first directive")
+		}
+		if err := s.parseHeader(param); err != nil {
+			return op, false, err
+		}
+	case "L:":
+		return printOp{directive: 'L', text: param}, true, nil
+	case "O:":
+		return printOp{directive: 'O', text: param}, true, nil
+	case "P:":
+		return printOp{directive: 'P'}, true, nil
+	case "J:":
+		if !jobInfoRegex.MatchString(param) {
+			return op, false, errors.New("invalid job data directive")
+		}
+		s.jobinfo = param
+	case "M:":
+		if s.version < 2 {
+			return op, false, errors.New("invalid directive received")
+		}
+		s.parseMetadata(param)
+	case "C:":
+		if s.version < 2 {
+			return op, false, errors.New("invalid directive received")
+		}
+		channel, err := strconv.Atoi(param)
+		if err != nil || channel < 1 || channel > 12 {
+			return op, false, errors.New("invalid channel skip directive")
+		}
+		return printOp{directive: 'C', channel: channel}, true, nil
+	default:
+		if s.version < 2 {
+			return op, false, errors.New("invalid directive received")
+		}
+	}
+	return op, false, nil
+}
+
+// parseOperation parses a line of print directives that are known to be
+// valid. If it's a print operation, it is returned with ok true.
+func parseOperation(line string) (op printOp, ok bool) {
+	if len(line) < 2 {
+		return op, false
+	}
+	param := trimToRuneLen(line[2:], 132)
+	switch line[0:2] {
+	case "L:":
+		return printOp{directive: 'L', text: param}, true
+	case "O:":
+		return printOp{directive: 'O', text: param}, true
+	case "P:":
+		return printOp{directive: 'P'}, true
+	case "C:":
+		channel, _ := strconv.Atoi(param)
+		return printOp{directive: 'C', channel: channel}, true
+	}
+	return op, false
+}
+
+// parseHeader parses the version 2 header directive: the protocol version,
+// followed by name=value fields separated by spaces.
+func (s *printStream) parseHeader(param string) error {
+	fields := strings.Fields(param)
+	if len(fields) == 0 {
+		return errors.New("header directive without a protocol version")
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < 2 {
+		return errors.New("invalid protocol version")
+	}
+	if version > protocolVersion {
+		return fmt.Errorf("unsupported protocol version %d", version)
+	}
+	s.version = version
+	s.header = make(map[string]string)
+	for _, field := range fields[1:] {
+		if i := strings.IndexByte(field, '='); i > 0 {
+			s.header[field[:i]] = field[i+1:]
+		}
+	}
+	return nil
+}
+
+// parseMetadata parses a name=value metadata directive into the job details.
+// Unknown names and invalid values are ignored.
+func (s *printStream) parseMetadata(param string) {
+	i := strings.IndexByte(param, '=')
+	if i < 1 {
+		return
+	}
+	name, value := param[:i], strings.TrimSpace(param[i+1:])
+
+	fields := map[string]*string{
+		"type":       &s.details.Type,
+		"number":     &s.details.Number,
+		"name":       &s.details.Name,
+		"class":      &s.details.Class,
+		"forms":      &s.details.Forms,
+		"programmer": &s.details.Programmer,
+		"room":       &s.details.Room,
+		"user":       &s.details.User,
+		"printer":    &s.details.Printer,
+		"system":     &s.details.System,
+	}
+	if field, ok := fields[name]; ok {
+		*field = value
+	} else if name == "printed" {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			s.details.Printed = t
+		}
+	}
+}
+
+// print reads the rest of the directives and sends the job to the virtual
+// printer. Printing will stop after maxpages if maxpages > 0. If the input
+// data turns out to be invalid, what was read before the problem is printed
+// and the error is returned.
+func (s *printStream) print(job vprinter.Job, maxpages int) error {
+	for {
+		op, err := s.next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var pages int
+		switch op.directive {
+		case 'L':
+			pages = job.AddLine(op.text, true)
+		case 'O':
+			pages = job.AddLine(op.text, false)
+		case 'P':
+			pages = job.NewPage()
+		case 'C':
+			pages = vprinter.SkipToChannel(job, op.channel)
+		}
+
+		if maxpages > 0 && pages > maxpages {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// readOps reads all of the print operations from stream.
+func readOps(stream *printStream) ([]printOp, error) {
+	var ops []printOp
+	for {
+		op, err := stream.next()
+		if err == io.EOF {
+			return ops, nil
+		} else if err != nil {
+			return ops, err
+		}
+		ops = append(ops, op)
+	}
+}
+
+func TestParsePrintDirectives(t *testing.T) {
+	stream := parsePrintDirectives(strings.NewReader(
+		"L:HELLO\nO:OVER\nP:\nJ:J12_IBMUSERA\n"), 0)
+	ops, err := readOps(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.version != 1 || len(ops) != 3 ||
+		stream.jobinfo != "J12_IBMUSERA" {
+		t.Errorf("got %+v: %+v", stream, ops)
+	}
+
+	for _, bad := range []string{"M:class=A\n", "C:12\n", "X:\n",
+		"L:one\nV:2\n", "V:3\n", "V:2\nC:13\n"} {
+		if err := parsePrintDirectives(strings.NewReader(bad),
+			0).validate(); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+
+	// Operations are read as they're needed; the problem on the third line
+	// isn't found until we get there.
+	stream = parsePrintDirectives(strings.NewReader(
+		"L:one\nL:two\nX:\n"), 0)
+	if op, err := stream.next(); err != nil || op.text != "one" {
+		t.Errorf("got %+v, %v", op, err)
+	}
+	if ops, err := readOps(stream); err == nil || len(ops) != 1 {
+		t.Errorf("got %+v, %v after an invalid directive", ops, err)
+	}
+
+	// Reading stops once more than maxlines directives have been read.
+	ops, err = readOps(parsePrintDirectives(strings.NewReader(
+		"L:1\nL:2\nL:3\nL:4\nL:5\n"), 2))
+	if err != nil || len(ops) != 3 {
+		t.Errorf("got %+v, %v with maxlines", ops, err)
+	}
+
+	stream = parsePrintDirectives(strings.NewReader(
+		"V:2 agent=virtual1403-agent/1.0 printer=1403 width=132\n"+
+			"L:HELLO\nC:12\nL:FOOTER\nX:something new\n"+
+			"M:class=A\nM:programmer=J. PROGRAMMER\nM:future=1\n"+
+			"M:printed=2022-01-18T11:25:08Z\nJ:J12_IBMUSERA\n"), 0)
+	ops, err = readOps(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.version != 2 || stream.header["printer"] != "1403" ||
+		len(ops) != 3 || ops[1].channel != 12 {
+		t.Errorf("got %+v: %+v", stream, ops)
+	}
+	if stream.details.Class != "A" ||
+		stream.details.Programmer != "J. PROGRAMMER" ||
+		stream.details.Printed.Day() != 18 {
+		t.Errorf("got details %+v", stream.details)
+	}
+}
+
+func TestParseValidatedDirectives(t *testing.T) {
+	directives := "V:2 agent=virtual1403-agent/1.0\nL:HELLO\nM:class=A\n" +
+		"X:something new\nO:" + strings.Repeat("X", 140) + "\nC:12\nP:\n" +
+		"L:PAGE TWO\nJ:J12_IBMUSERA\n"
+	want, err := readOps(parsePrintDirectives(strings.NewReader(directives),
+		0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := parseValidatedDirectives(strings.NewReader(directives), 0)
+	got, err := readOps(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+	if stream.version != 1 || stream.jobinfo != "" {
+		t.Errorf("directives other than print operations were parsed")
+	}
+
+	// Both streams stop after the same number of directives.
+	want, _ = readOps(parsePrintDirectives(strings.NewReader(directives), 4))
+	got, _ = readOps(parseValidatedDirectives(strings.NewReader(directives),
+		4))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v with maxlines", got, want)
+	}
+}
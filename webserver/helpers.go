@@ -21,9 +21,10 @@ package main
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"net/http"
 	"runtime/debug"
+
+	"github.com/racingmars/virtual1403/logging"
 )
 
 // The functions in this file are based on those in Alex Edwards'
@@ -52,8 +53,14 @@ func (app *application) render(w http.ResponseWriter, r *http.Request,
 
 func (app *application) serverError(w http.ResponseWriter, err string) {
 	trace := fmt.Sprintf("%s\n%s", err, debug.Stack())
-	log.Println(trace)
+	logger.Errorf("%s", trace)
 
 	http.Error(w, http.StatusText(http.StatusInternalServerError),
 		http.StatusInternalServerError)
 }
+
+// requestLog returns the logger for the request, which includes the request
+// ID with every message.
+func requestLog(r *http.Request) *logging.Logger {
+	return logging.FromContext(r.Context(), logger)
+}
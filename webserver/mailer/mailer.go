@@ -106,23 +106,47 @@ func Send(config Config, to, subject, body, filename string,
 }
 
 func SendVerificationCode(config Config, to, verifyURL string) error {
+	return sendText(config, to, "virtual1403 email verification",
+		"You (hopefully) have signed up for a Virtual1403 account. To "+
+			"activate\r\nyour account, please click the link below:\r\n\r\n"+
+			verifyURL+"\r\n\r\n"+
+			"If you were not the one to sign up with this email "+
+			"address, no action is\r\nrequired; the account will remain "+
+			"inactive and unverified.\r\n")
+}
+
+// SendPasswordReset sends the link to reset a user's password.
+func SendPasswordReset(config Config, to, resetURL string,
+	valid time.Duration) error {
+
+	return sendText(config, to, "virtual1403 password reset",
+		"Someone (hopefully you) asked to reset the password of your "+
+			"Virtual1403\r\naccount. To choose a new password, please "+
+			"click the link below:\r\n\r\n"+
+			resetURL+"\r\n\r\n"+
+			fmt.Sprintf("The link can be used once, within the next %d "+
+				"minutes. ", int(valid.Minutes()))+
+			"If you didn't ask to reset\r\nyour password, no action is "+
+			"required; your password hasn't changed.\r\n")
+}
+
+// sendText sends a plain text email.
+func sendText(config Config, to, subject, body string) error {
+	// For testing the web service without generating any actual mail
+	if config.Disable {
+		return nil
+	}
+
 	var buf bytes.Buffer
 
 	fmt.Fprintf(&buf, "To: %s\r\n", to)
 	fmt.Fprintf(&buf, "From: %s\r\n", config.FromAddress)
-	fmt.Fprintf(&buf, "Subject: virtual1403 email verification\r\n")
+	fmt.Fprintf(&buf, "Subject: %s\r\n", subject)
 	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC822Z))
 	fmt.Fprintf(&buf, "MIME-version: 1.0\r\n")
 	fmt.Fprintf(&buf, "Content-Type: text/plain\r\n")
 	fmt.Fprintf(&buf, "\r\n")
-
-	io.WriteString(&buf,
-		"You (hopefully) have signed up for a Virtual1403 account. To "+
-			"activate\r\nyour account, please click the link below:\r\n\r\n")
-	io.WriteString(&buf, verifyURL+"\r\n\r\n")
-	io.WriteString(&buf, "If you were not the one to sign up with this email "+
-		"address, no action is\r\nrequired; the account will remain inactive "+
-		"and unverified.\r\n")
+	io.WriteString(&buf, body)
 
 	// default nil auth will work for SMTP servers that don't require auth
 	var auth smtp.Auth
@@ -19,13 +19,15 @@ package main
 // along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
 
 import (
+	"crypto/rand"
+	"crypto/tls"
 	_ "embed"
 	"encoding/hex"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
@@ -35,10 +37,12 @@ import (
 	"github.com/gorilla/handlers"
 	"golang.org/x/crypto/acme/autocert"
 
+	"github.com/kimrosebush/virtual1403/logging"
 	"github.com/kimrosebush/virtual1403/vprinter"
 	"github.com/kimrosebush/virtual1403/webserver/assets"
 	"github.com/kimrosebush/virtual1403/webserver/db"
 	"github.com/kimrosebush/virtual1403/webserver/mailer"
+	"github.com/kimrosebush/virtual1403/webserver/oidc"
 )
 
 type application struct {
@@ -52,14 +56,24 @@ type application struct {
 	quotaPages            int
 	quotaPeriod           time.Duration
 	maxLinesPerJob        int
-	printerSeats          chan bool
+	jobWait               time.Duration
+	seats                 *seatPools
+	seatWait              time.Duration
 	inactiveMonthsCleanup int
 	pdfCleanupDays        int
 	shareKey              *[db.ShareSecretKeyLength]byte
+	resetKey              *[db.ResetSecretKeyLength]byte
+	resets                resetThrottle
 	nuisanceJobs          []*regexp.Regexp
 	adminEmail            string
+	uploads               *uploadStore
+	queue                 *printQueue
+	requireAdmin2FA       bool
+	sso                   *oidc.Provider
 }
 
+var logger = logging.New("server")
+
 //go:embed favicon.ico
 var favicon []byte
 
@@ -70,21 +84,22 @@ func main() {
 	config, errs := readConfig("config.yaml")
 	if len(errs) > 0 {
 		for _, err := range errs {
-			log.Printf("ERROR: configuration: %v", err)
+			logger.Errorf("configuration: %v", err)
 		}
-		log.Fatal("FATAL: configuration errors")
+		logger.Fatalf("configuration errors")
 	}
 
 	app.nuisanceJobs = config.nuisanceJobRegex
 	app.adminEmail = config.ServerAdmin
+	app.requireAdmin2FA = config.RequireAdmin2FA
 
 	// If the user requested a font file, see if we can load it. Otherwise,
 	// use our standard embedded font.
 	if config.FontFile != "" {
-		log.Printf("INFO:  loading font %s", config.FontFile)
+		logger.Infof("loading font %s", config.FontFile)
 		app.font, err = vprinter.LoadFont(config.FontFile)
 		if err != nil {
-			log.Fatalf("FATAL: unable to load font: %v", err)
+			logger.Fatalf("unable to load font: %v", err)
 		}
 	} else {
 		app.font = nil // no font override for profiles that accept one
@@ -93,48 +108,76 @@ func main() {
 	// Copy the configured quota values to the application state
 	app.maxLinesPerJob = config.MaxLinesPerJob
 	if app.maxLinesPerJob <= 0 {
-		log.Printf("WARN:  no max_lines_per_job, individual job size " +
+		logger.Warnf("no max_lines_per_job, individual job size " +
 			"will be unbounded")
 	} else {
-		log.Printf("INFO:  max_lines_per_job is %d", app.maxLinesPerJob)
+		logger.Infof("max_lines_per_job is %d", app.maxLinesPerJob)
 	}
 
 	app.quotaJobs = config.QuotaJobs
 	app.quotaPages = config.QuotaPages
 	if app.quotaJobs <= 0 && app.quotaPages <= 0 {
-		log.Printf("WARN:  no quotas are set; all users will " +
+		logger.Warnf("no quotas are set; all users will " +
 			"be permitted unlimited use")
 	}
 	if app.quotaJobs > 0 {
-		log.Printf("INFO:  user jobs quota is %d", app.quotaJobs)
+		logger.Infof("user jobs quota is %d", app.quotaJobs)
 	}
 	if app.quotaPages > 0 {
-		log.Printf("INFO:  user pages quota is %d", app.quotaPages)
+		logger.Infof("user pages quota is %d", app.quotaPages)
 	}
 
 	if config.QuotaPeriod <= 0 {
-		log.Printf("WARN:  no valid quota_period; setting to 24 hours")
+		logger.Warnf("no valid quota_period; setting to 24 hours")
 		config.QuotaPeriod = 24
 	}
 
 	app.quotaPeriod = time.Duration(config.QuotaPeriod) * time.Hour
-	log.Printf("INFO:  quota period is %s", app.quotaPeriod.String())
+	logger.Infof("quota period is %s", app.quotaPeriod.String())
 
 	app.pdfCleanupDays = config.PDFDaysCleanup
-	log.Printf("INFO:  PDFs will be deleted after %d days", app.pdfCleanupDays)
-
-	// If there is a limit on concurrent print job, set up the available user
-	// seats
-	if config.ConcurrentPrintJobs > 0 {
-		log.Printf("INFO:  limiting concurrent print jobs to %d",
-			config.ConcurrentPrintJobs)
-		app.printerSeats = make(chan bool, config.ConcurrentPrintJobs)
+	logger.Infof("PDFs will be deleted after %d days", app.pdfCleanupDays)
+
+	// The number of print workers limits the concurrent print jobs
+	printWorkers := config.ConcurrentPrintJobs
+	if printWorkers <= 0 {
+		printWorkers = defaultPrintWorkers
+	}
+	logger.Infof("limiting concurrent print jobs to %d", printWorkers)
+
+	if config.JobWaitSeconds == 0 {
+		config.JobWaitSeconds = 10
+	} else if config.JobWaitSeconds < 0 {
+		config.JobWaitSeconds = 0
+	}
+	app.jobWait = time.Duration(config.JobWaitSeconds) * time.Second
+	logger.Infof("print API will wait %s for jobs to finish", app.jobWait)
+
+	// Profiles may have their own limits on the jobs in the print queue
+	app.seats = newSeatPools(config.ProfileSeats)
+	for _, limit := range config.ProfileSeats {
+		logger.Infof("limiting %v to %d seats", limit, limit.Seats)
+	}
+	if config.SeatWaitSeconds <= 0 {
+		config.SeatWaitSeconds = 30
 	}
+	app.seatWait = time.Duration(config.SeatWaitSeconds) * time.Second
+
+	// Set up the directory for chunked print job uploads
+	uploadDir := config.UploadDirectory
+	if uploadDir == "" {
+		uploadDir = filepath.Join(os.TempDir(), "virtual1403-uploads")
+	}
+	app.uploads, err = newUploadStore(uploadDir)
+	if err != nil {
+		logger.Fatalf("unable to set up upload directory: %v", err)
+	}
+	logger.Infof("print job uploads will be stored in %s", uploadDir)
 
 	// Initialize HTML template cache for UI
 	templateCache, err := newTemplateCache()
 	if err != nil {
-		log.Fatalf("FATAL: unable to load templates: %v", err)
+		logger.Fatalf("unable to load templates: %v", err)
 	}
 	app.templateCache = templateCache
 
@@ -149,31 +192,50 @@ func main() {
 
 	if config.CreateAdmin != "" {
 		if err := app.createAdmin(config.CreateAdmin); err != nil {
-			log.Fatalf("FATAL: unable to create admin user: %v", err)
+			logger.Fatalf("unable to create admin user: %v", err)
 		}
 	}
 
 	app.serverBaseURL = config.BaseURL
 
+	// If configured, users may sign in through an OpenID Connect provider
+	if config.OIDC.Enabled() {
+		app.sso = oidc.NewProvider(config.OIDC,
+			app.serverBaseURL+"/sso/callback")
+		logger.Infof("single sign-on through %s is enabled",
+			config.OIDC.Issuer)
+	}
+
 	// Get session cookie secret key from DB and initialize session manager
 	sessionSecret, err := app.db.GetSessionSecret()
 	if err != nil {
-		log.Fatalf("FATAL: unable to get session secret key: %v", err)
+		logger.Fatalf("unable to get session secret key: %v", err)
 	}
-	log.Printf("INFO:  got session secret: %s",
-		hex.EncodeToString(sessionSecret))
+	logger.Infof("got session secret: %s", hex.EncodeToString(sessionSecret))
 	app.session = sessions.New(sessionSecret)
 	app.session.Lifetime = 3 * time.Hour
 
 	// Set secret key for the PDF download links
 	shareSecret, err := app.db.GetShareSecret()
 	if err != nil {
-		log.Fatalf("FATAL: unable to get share secret key: %v", err)
+		logger.Fatalf("unable to get share secret key: %v", err)
 	}
-	log.Printf("INFO:  got share secret: %s",
-		hex.EncodeToString(shareSecret))
+	logger.Infof("got share secret: %s", hex.EncodeToString(shareSecret))
 	app.shareKey = (*[db.ShareSecretKeyLength]byte)(shareSecret)
 
+	// Set secret key for the password reset links
+	resetSecret, err := app.db.GetResetSecret()
+	if err != nil {
+		logger.Fatalf("unable to get password reset secret key: %v", err)
+	}
+	app.resetKey = (*[db.ResetSecretKeyLength]byte)(resetSecret)
+
+	// Start the print workers
+	app.queue = newPrintQueue(&app)
+	if err := app.queue.start(printWorkers); err != nil {
+		logger.Fatalf("unable to start print queue: %v", err)
+	}
+
 	// Build UI routes
 	mux := http.NewServeMux()
 	mux.Handle("/favicon.ico", http.HandlerFunc(serveFavicon))
@@ -185,16 +247,47 @@ func main() {
 	mux.Handle("/signup", app.session.Enable(http.HandlerFunc(app.signup)))
 	mux.Handle("/changepassword", app.session.Enable(http.HandlerFunc(
 		app.changePassword)))
+	mux.Handle("/forgotpassword", app.session.Enable(http.HandlerFunc(
+		app.forgotPassword)))
+	mux.Handle("/resetpassword", app.session.Enable(http.HandlerFunc(
+		app.resetPassword)))
+	mux.Handle("/sso/login", app.session.Enable(http.HandlerFunc(
+		app.ssoLogin)))
+	mux.Handle("/sso/callback", app.session.Enable(http.HandlerFunc(
+		app.ssoCallback)))
+	mux.Handle("/login2fa", app.session.Enable(http.HandlerFunc(
+		app.login2FA)))
+	mux.Handle("/twofactor", app.session.Enable(http.HandlerFunc(
+		app.twoFactor)))
+	mux.Handle("/begin2fa", app.session.Enable(http.HandlerFunc(
+		app.begin2FA)))
+	mux.Handle("/confirm2fa", app.session.Enable(http.HandlerFunc(
+		app.confirm2FA)))
+	mux.Handle("/recovery2fa", app.session.Enable(http.HandlerFunc(
+		app.recoveryCodes2FA)))
+	mux.Handle("/disable2fa", app.session.Enable(http.HandlerFunc(
+		app.disable2FA)))
 	mux.Handle("/logout", app.session.Enable(http.HandlerFunc(app.logout)))
 	mux.Handle("/user", app.session.Enable(http.HandlerFunc(app.userInfo)))
 	mux.Handle("/userjobs", app.session.Enable(http.HandlerFunc(app.userJobs)))
-	mux.Handle("/regenkey", app.session.Enable(http.HandlerFunc(app.regenkey)))
+	mux.Handle("/createkey", app.session.Enable(http.HandlerFunc(
+		app.createAPIKey)))
+	mux.Handle("/revokekey", app.session.Enable(http.HandlerFunc(
+		app.revokeAPIKey)))
 	mux.Handle("/resend", app.session.Enable(http.HandlerFunc(
 		app.resendVerification)))
 	mux.Handle("/verify", app.session.Enable(http.HandlerFunc(app.verifyUser)))
 	mux.Handle("/pdf", http.HandlerFunc(app.pdf))
 	mux.Handle("/changeDelivery", app.session.Enable(http.HandlerFunc(app.changeDelivery)))
 	mux.Handle("/changeNuisance", app.session.Enable(http.HandlerFunc(app.changeNuisance)))
+	mux.Handle("/changeSeparators", app.session.Enable(http.HandlerFunc(
+		app.changeSeparators)))
+	mux.Handle("/changeProfileRules", app.session.Enable(http.HandlerFunc(
+		app.changeProfileRules)))
+	mux.Handle("/printfile", app.session.Enable(http.HandlerFunc(
+		app.printFile)))
+	mux.Handle("/changePreferences", app.session.Enable(http.HandlerFunc(
+		app.changePreferences)))
 
 	// Admin pages
 	mux.Handle("/admin/users", app.session.Enable(http.HandlerFunc(
@@ -207,16 +300,24 @@ func main() {
 		app.adminEditUserPost)))
 	mux.Handle("/admin/deleteuser", app.session.Enable(http.HandlerFunc(
 		app.adminDeleteUser)))
+	mux.Handle("/admin/reset2fa", app.session.Enable(http.HandlerFunc(
+		app.adminReset2FA)))
 
 	// The print API -- not part of the UI
 	mux.Handle("/print", http.HandlerFunc(app.printjob))
+	mux.Handle("/print/jobs", http.HandlerFunc(app.uploadjob))
+	mux.Handle("/print/jobs/", http.HandlerFunc(app.uploadjob))
+
+	// Every request gets an ID that is included in its log messages and
+	// returned to the client.
+	handler := withRequestID(mux)
 
 	// If configured, run the database cleanup to delete inactive users every
 	// 24 hours. We'll wait until 24 hours passes to run it for the first time
 	// after server startup.
 	if config.InactiveMonthsCleanup > 0 && config.UnverifiedMonthsCleanup > 0 {
 		app.inactiveMonthsCleanup = config.InactiveMonthsCleanup
-		log.Printf("INFO:  Starting background inactive user delete task")
+		logger.Infof("Starting background inactive user delete task")
 		go func() {
 			for {
 				time.Sleep(24 * time.Hour)
@@ -225,61 +326,117 @@ func main() {
 			}
 		}()
 	} else {
-		log.Printf("INFO:  Inactive user deletion is not configured")
+		logger.Infof("Inactive user deletion is not configured")
 	}
 
 	// Run a background job every hour to clean up expired PDFs
-	log.Printf("INFO:  Starting background expired PDF delete task")
+	logger.Infof("Starting background expired PDF delete task")
 	go func() {
 		for {
 			cutoff := time.Now().Add(
 				-time.Duration(app.pdfCleanupDays) * time.Hour * 24)
-			log.Printf("INFO:  Deleting PDFs older than %s",
-				cutoff.UTC().String())
+			logger.Infof("Deleting PDFs older than %s", cutoff.UTC().String())
 			app.db.CleanPDFs(cutoff)
 			time.Sleep(1 * time.Hour)
 		}
 	}()
 
+	// Abandoned upload sessions are cleaned up every few minutes.
+	go func() {
+		for {
+			time.Sleep(5 * time.Minute)
+			cutoff := time.Now().Add(-uploadIdleTimeout)
+			if n := app.uploads.expire(cutoff); n > 0 {
+				logger.Infof("Deleted %d idle upload sessions", n)
+			}
+		}
+	}()
+
+	// The TLS HTTP server gets its certificate from Let's Encrypt.
+	var m *autocert.Manager
+	if config.TLSListenPort > 0 {
+		m = &autocert.Manager{
+			Cache:      app.db,
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(config.TLSDomain),
+		}
+	}
+
+	// If configured, accept printer streams directly from Hercules sockdev
+	// printers.
+	if config.SockdevPort > 0 {
+		var tlsConfig *tls.Config
+		if config.SockdevCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.SockdevCertFile,
+				config.SockdevKeyFile)
+			if err != nil {
+				logger.Fatalf("unable to load sockdev TLS certificate: %v",
+					err)
+			}
+			tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		} else if config.SockdevTLS {
+			tlsConfig = m.TLSConfig()
+		}
+		addr := ":" + strconv.Itoa(config.SockdevPort)
+		if tlsConfig == nil {
+			logger.Warnf("sockdev connections are not encrypted; API keys " +
+				"will be sent in plain text")
+		}
+		if err := app.listenSockdev(addr, tlsConfig,
+			config.SockdevInsecure); err != nil {
+			logger.Fatalf("unable to start sockdev listener: %v", err)
+		}
+		logger.Infof("Accepting sockdev connections on %s (TLS: %t)", addr,
+			tlsConfig != nil)
+	}
+
 	// If running plain HTTP service, we're ready to go
 	if config.TLSListenPort <= 0 {
-		log.Printf("INFO:  Starting plain HTTP server on :%d",
-			config.ListenPort)
+		logger.Infof("Starting plain HTTP server on :%d", config.ListenPort)
 		err = http.ListenAndServe(fmt.Sprintf(":%d", config.ListenPort),
-			handlers.CombinedLoggingHandler(os.Stdout, mux))
-		log.Fatal(err)
+			handlers.CombinedLoggingHandler(os.Stdout, handler))
+		logger.Fatalf("%v", err)
 		return
 	}
 
 	// Otherwise we set up a redirect on plain HTTP port and host w/ TLS and
 	// autocert.
 	go func() {
-		log.Printf("INFO:  Starting plain HTTP redirect server on: %d",
+		logger.Infof("Starting plain HTTP redirect server on: %d",
 			config.ListenPort)
 		err := http.ListenAndServe(fmt.Sprintf(":%d", config.ListenPort),
 			handlers.CombinedLoggingHandler(os.Stdout, http.HandlerFunc(
 				generateRedirectHandler(config.TLSListenPort))))
 		if err != nil {
-			log.Fatal(err)
+			logger.Fatalf("%v", err)
 		}
 	}()
 
-	m := &autocert.Manager{
-		Cache:      app.db,
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(config.TLSDomain),
-	}
 	s := &http.Server{
 		Addr:      ":" + strconv.Itoa(config.TLSListenPort),
 		TLSConfig: m.TLSConfig(),
-		Handler:   handlers.CombinedLoggingHandler(os.Stdout, mux),
+		Handler:   handlers.CombinedLoggingHandler(os.Stdout, handler),
 	}
-	log.Printf("INFO:  Starting TLS HTTP server on %s", s.Addr)
+	logger.Infof("Starting TLS HTTP server on %s", s.Addr)
 	if err := s.ListenAndServeTLS("", ""); err != nil {
-		log.Fatal(err)
+		logger.Fatalf("%v", err)
 	}
 }
 
+// withRequestID assigns each request a random ID, which is sent to the
+// client in the X-Request-ID header and added to the request's logger.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := make([]byte, 8)
+		rand.Read(id)
+		requestID := hex.EncodeToString(id)
+		w.Header().Set("X-Request-ID", requestID)
+		ctx := logging.NewContext(r.Context(),
+			logger.With("request_id", requestID))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func generateRedirectHandler(port int) func(http.ResponseWriter,
 	*http.Request) {
 
@@ -300,13 +457,13 @@ func (app *application) dbCleanupTask(unverifiedMonths, inactiveMonths int) {
 	now := time.Now()
 	unverifiedCutoff := now.AddDate(0, -unverifiedMonths, 0)
 	inactiveCutoff := now.AddDate(0, -inactiveMonths, 0)
-	log.Printf("INFO:  deleting unverified users with cutoff date %s",
+	logger.Infof("deleting unverified users with cutoff date %s",
 		unverifiedCutoff.UTC().Format(time.RFC822))
-	log.Printf("INFO:  deleting inactive users with cutoff date %s",
+	logger.Infof("deleting inactive users with cutoff date %s",
 		inactiveCutoff.UTC().Format(time.RFC822))
 	n, err := app.db.DeleteInactiveUsers(inactiveCutoff, unverifiedCutoff)
-	log.Printf("INFO:  deleted %d users during database cleanup", n)
+	logger.Infof("deleted %d users during database cleanup", n)
 	if err != nil {
-		log.Printf("ERROR: db error during database cleanup: %v", err)
+		logger.Errorf("db error during database cleanup: %v", err)
 	}
 }
@@ -0,0 +1,207 @@
+package model
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+// Scopes say what an API key may be used for.
+const (
+	// ScopePrint keys may send jobs to the print API.
+	ScopePrint = "print"
+
+	// ScopeSockdev keys may connect to the sockdev listener.
+	ScopeSockdev = "sockdev"
+)
+
+// Scopes lists all the scopes an API key may have.
+var Scopes = []string{ScopePrint, ScopeSockdev}
+
+// apiKeyPrefixLen is the length of the start of API keys that is stored
+// as-is, so that keys can be looked up before checking their hash.
+const apiKeyPrefixLen = 12
+
+// APIKey is one of a user's named access keys, e.g. one for each of their
+// Hercules systems, so that they can be revoked individually. Only a salted
+// hash of the key is stored; the key itself is shown to the user once, when
+// it's created.
+type APIKey struct {
+	// ID identifies the key in the UI without showing the key itself.
+	ID   string
+	Name string
+
+	// Prefix is the start of the key, to look it up by. Hash is the SHA-256
+	// hash of Salt followed by the key.
+	Prefix string
+	Salt   string
+	Hash   string
+
+	// Key is the key itself, from before keys were hashed. It is only read
+	// to hash it when the database is opened.
+	Key string `json:",omitempty"`
+
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+
+	// Expires is when the key stops working; the zero time means never.
+	Expires time.Time
+
+	// Profile is the default profile for jobs sent with the key, in place
+	// of the user's default profile.
+	Profile string `json:",omitempty"`
+}
+
+// Expired returns true if the key has expired at time t.
+func (k APIKey) Expired(t time.Time) bool {
+	return !k.Expires.IsZero() && !t.Before(k.Expires)
+}
+
+// HasScope returns true if the key may be used for scope.
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// AddAPIKey generates a new API key for the user. It returns the key's
+// details, and the key itself, which can't be recovered later.
+func (u *User) AddAPIKey(name string, scopes []string, expires time.Time,
+	profile string) (APIKey, string) {
+
+	secret := base64.StdEncoding.EncodeToString(randomBytes(256 / 8))
+	key := APIKey{
+		ID:      hex.EncodeToString(randomBytes(8)),
+		Name:    name,
+		Scopes:  scopes,
+		Created: time.Now().UTC(),
+		Expires: expires,
+		Profile: profile,
+	}
+	key.setKey(secret)
+	u.APIKeys = append(u.APIKeys, key)
+	return key, secret
+}
+
+// setKey sets the prefix and a new salted hash of key.
+func (k *APIKey) setKey(key string) {
+	k.Prefix = APIKeyPrefix(key)
+	k.Salt = base64.StdEncoding.EncodeToString(randomBytes(16))
+	k.Hash = k.hash(key)
+	k.Key = ""
+}
+
+// hash returns the hash of key with the API key's salt.
+func (k APIKey) hash(key string) string {
+	h := sha256.Sum256([]byte(k.Salt + key))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// Matches returns true if key is this API key.
+func (k APIKey) Matches(key string) bool {
+	return k.Hash != "" && k.Prefix == APIKeyPrefix(key) &&
+		subtle.ConstantTimeCompare([]byte(k.hash(key)),
+			[]byte(k.Hash)) == 1
+}
+
+// APIKeyPrefix returns the start of key that API keys are looked up by.
+func APIKeyPrefix(key string) string {
+	if len(key) > apiKeyPrefixLen {
+		return key[:apiKeyPrefixLen]
+	}
+	return key
+}
+
+// FindAPIKey returns the user's API key key, or nil if they don't have it.
+func (u *User) FindAPIKey(key string) *APIKey {
+	for i := range u.APIKeys {
+		if u.APIKeys[i].Matches(key) {
+			return &u.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+// RevokeAPIKey removes the API key with the given ID, returning false if the
+// user doesn't have it.
+func (u *User) RevokeAPIKey(id string) bool {
+	for i := range u.APIKeys {
+		if u.APIKeys[i].ID == id {
+			u.APIKeys = append(u.APIKeys[:i], u.APIKeys[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// GenerateVerificationToken generates and sets a new random token for the
+// link in the user's email verification message.
+func (u *User) GenerateVerificationToken() {
+	u.VerificationToken = base64.RawURLEncoding.EncodeToString(
+		randomBytes(256 / 8))
+}
+
+// randomBytes returns n random bytes.
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Reading info byte buffer from rand should never fail")
+	}
+	return buf
+}
+
+// MigrateKeys moves the access key from before users could have several to
+// APIKeys, and hashes any API keys from before keys were hashed. Unverified
+// users' access keys were also their email verification tokens, so for them
+// it becomes the verification token instead. Returns false if there was
+// nothing to migrate.
+func (u *User) MigrateKeys() bool {
+	migrated := false
+	if u.AccessKey != "" {
+		if u.Verified {
+			u.APIKeys = append(u.APIKeys, APIKey{
+				ID:      hex.EncodeToString(randomBytes(8)),
+				Name:    "Default",
+				Key:     u.AccessKey,
+				Scopes:  Scopes,
+				Created: u.SignupDate,
+			})
+		} else if u.VerificationToken == "" {
+			u.VerificationToken = u.AccessKey
+		}
+		u.AccessKey = ""
+		migrated = true
+	}
+	for i := range u.APIKeys {
+		if u.APIKeys[i].Key != "" {
+			u.APIKeys[i].setKey(u.APIKeys[i].Key)
+			migrated = true
+		}
+	}
+	return migrated
+}
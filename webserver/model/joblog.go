@@ -1,6 +1,10 @@
 package model
 
-import "time"
+import (
+	"fmt"
+	"strings"
+	"time"
+)
 
 // Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
 //
@@ -26,6 +30,103 @@ type JobLogEntry struct {
 	Time     time.Time
 	Pages    int
 	JobInfo  string
+	Details  *JobInfo `json:",omitempty"`
 	HasPDF   bool
 	ShareKey string `json:"-"` // just used by the web UI
+
+	// Jobs are logged when they're queued, and the following fields track
+	// their progress through the print queue. Profile is the profile the
+	// client asked for; Attempts is the number of delivery attempts, and
+	// Error the reason the last attempt (or rendering) failed.
+	State    JobState `json:",omitempty"`
+	Profile  string   `json:",omitempty"`
+	Attempts int      `json:",omitempty"`
+	Error    string   `json:",omitempty"`
+}
+
+// JobState is where a job is in the print queue.
+type JobState string
+
+const (
+	// JobQueued jobs are waiting for a print worker.
+	JobQueued JobState = "queued"
+
+	// JobRendering jobs are being turned into a PDF.
+	JobRendering JobState = "rendering"
+
+	// JobDelivering jobs have a PDF which is being (or will be) emailed.
+	JobDelivering JobState = "delivering"
+
+	// JobDone jobs are finished. Jobs logged before there was a print queue
+	// have no state, and are done too.
+	JobDone JobState = "done"
+
+	// JobFailed jobs couldn't be rendered or delivered.
+	JobFailed JobState = "failed"
+)
+
+// Finished is true if the job is done or has failed.
+func (e JobLogEntry) Finished() bool {
+	return e.State == "" || e.State == JobDone || e.State == JobFailed
+}
+
+// Status describes the job's state for the web UI.
+func (e JobLogEntry) Status() string {
+	switch {
+	case e.State == "":
+		return string(JobDone)
+	case e.State == JobDelivering && e.Attempts > 0:
+		return fmt.Sprintf("%s (attempt %d failed: %s; will retry)",
+			e.State, e.Attempts, e.Error)
+	case e.State == JobFailed && e.Error != "":
+		return string(e.State) + ": " + e.Error
+	default:
+		return string(e.State)
+	}
+}
+
+// JobInfo is what the agent found out about a job from its JES2 separator
+// pages. Any of the fields may be empty. The JSON field names are the same
+// as the agent's scanner.JobInfo, which is how the agent sends it to us.
+type JobInfo struct {
+	Type       string    `json:"type,omitempty"`
+	Number     string    `json:"number,omitempty"`
+	Name       string    `json:"name,omitempty"`
+	Class      string    `json:"class,omitempty"`
+	Forms      string    `json:"forms,omitempty"`
+	Programmer string    `json:"programmer,omitempty"`
+	Room       string    `json:"room,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Printer    string    `json:"printer,omitempty"`
+	System     string    `json:"system,omitempty"`
+	Printed    time.Time `json:"printed"`
+}
+
+// Summary returns the details of the job that aren't already part of the job
+// name, for display in the job log.
+func (j JobInfo) Summary() string {
+	var parts []string
+	if j.Class != "" {
+		parts = append(parts, "class "+j.Class)
+	}
+	if j.Forms != "" {
+		parts = append(parts, "forms "+j.Forms)
+	}
+	if j.Programmer != "" {
+		parts = append(parts, j.Programmer)
+	}
+	if j.Room != "" {
+		parts = append(parts, "room "+j.Room)
+	}
+	if j.User != "" {
+		parts = append(parts, "user "+j.User)
+	}
+	if j.System != "" {
+		parts = append(parts, "system "+j.System)
+	}
+	if !j.Printed.IsZero() {
+		parts = append(parts,
+			"printed "+j.Printed.Format("2006-01-02 15:04:05"))
+	}
+	return strings.Join(parts, ", ")
 }
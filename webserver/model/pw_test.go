@@ -2,6 +2,7 @@ package model
 
 import (
 	"testing"
+	"time"
 )
 
 func TestUserPasswords(t *testing.T) {
@@ -38,19 +39,46 @@ func TestUserPasswords(t *testing.T) {
 	}
 }
 
-func TestUserAccessKey(t *testing.T) {
+func TestUserAPIKeys(t *testing.T) {
 	var u User
 
-	u.GenerateAccessKey()
-	if u.AccessKey == "" {
+	key, secret := u.AddAPIKey("home", Scopes, time.Time{}, "")
+	if secret == "" || key.ID == "" {
 		t.Error("User has a blank access key")
 	}
+	if key.Hash == "" || key.Hash == secret || key.Key != "" ||
+		key.Prefix != APIKeyPrefix(secret) {
+		t.Errorf("key isn't hashed: %+v", key)
+	}
+	other, otherSecret := u.AddAPIKey("work", []string{ScopePrint},
+		time.Now(), "")
+	if otherSecret == secret || other.ID == key.ID {
+		t.Error("Generating new access key didn't change the value")
+	}
+	if u.FindAPIKey(secret).ID != key.ID || u.FindAPIKey("x"+secret) != nil ||
+		!other.Expired(time.Now()) || other.HasScope(ScopeSockdev) {
+		t.Errorf("got keys %+v", u.APIKeys)
+	}
+
+	if !u.RevokeAPIKey(key.ID) || u.FindAPIKey(secret) != nil ||
+		len(u.APIKeys) != 1 {
+		t.Errorf("key wasn't revoked: %+v", u.APIKeys)
+	}
+}
 
-	t.Log(u.AccessKey)
+func TestMigrateKeys(t *testing.T) {
+	u := User{Verified: true, AccessKey: "legacy-access-key"}
+	if !u.MigrateKeys() || u.AccessKey != "" ||
+		u.FindAPIKey("legacy-access-key") == nil || u.APIKeys[0].Key != "" {
+		t.Errorf("access key wasn't migrated: %+v", u)
+	}
+	if u.MigrateKeys() {
+		t.Error("migrated keys twice")
+	}
 
-	oldkey := u.AccessKey
-	u.GenerateAccessKey()
-	if u.AccessKey == oldkey {
-		t.Error("Generating new access key didn't change the value")
+	u = User{AccessKey: "verification-token"}
+	if !u.MigrateKeys() || u.VerificationToken != "verification-token" ||
+		len(u.APIKeys) != 0 {
+		t.Errorf("unverified user wasn't migrated: %+v", u)
 	}
 }
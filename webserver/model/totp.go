@@ -0,0 +1,209 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+// TOTP parameters. These are the defaults of RFC 6238 and the only ones
+// most authenticator apps support.
+const (
+	TOTPPeriod = 30 * time.Second
+	totpDigits = 6
+
+	// totpSkew is the number of time steps either side of the current one
+	// we accept codes from, to allow for clock drift and slow typists.
+	totpSkew = 1
+)
+
+// RecoveryCodeCount is the number of recovery codes users get when they
+// turn on two-factor authentication.
+const RecoveryCodeCount = 10
+
+var base32NoPad = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TwoFactorEnabled reports whether the user must enter an authenticator code
+// to log in.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPSecret != ""
+}
+
+// BeginTOTP generates a new TOTP secret for the user to add to their
+// authenticator app. Two-factor authentication isn't turned on until the
+// user confirms the secret with ConfirmTOTP.
+func (u *User) BeginTOTP() string {
+	u.TOTPPendingSecret = base32NoPad.EncodeToString(randomBytes(20))
+	return u.TOTPPendingSecret
+}
+
+// ConfirmTOTP turns on two-factor authentication if code is valid for the
+// pending secret from BeginTOTP. The user's new recovery codes are
+// returned.
+func (u *User) ConfirmTOTP(code string, t time.Time) ([]string, bool) {
+	if u.TOTPPendingSecret == "" {
+		return nil, false
+	}
+
+	counter, ok := checkTOTP(u.TOTPPendingSecret, code, t, 0)
+	if !ok {
+		return nil, false
+	}
+
+	u.TOTPSecret = u.TOTPPendingSecret
+	u.TOTPPendingSecret = ""
+	u.TOTPLastCounter = counter
+	u.TwoFactorFailures = 0
+	return u.GenerateRecoveryCodes(), true
+}
+
+// CheckTOTP reports whether code is a valid, unused authenticator code for
+// the user at time t.
+func (u *User) CheckTOTP(code string, t time.Time) bool {
+	if u.TOTPSecret == "" {
+		return false
+	}
+
+	counter, ok := checkTOTP(u.TOTPSecret, code, t, u.TOTPLastCounter)
+	if !ok {
+		return false
+	}
+
+	u.TOTPLastCounter = counter
+	return true
+}
+
+// checkTOTP looks for code among the codes for the time steps around t that
+// come after lastCounter, returning the time step it matched.
+func checkTOTP(secret, code string, t time.Time,
+	lastCounter int64) (int64, bool) {
+
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		return 0, false
+	}
+
+	now := t.Unix() / int64(TOTPPeriod/time.Second)
+	for counter := now - totpSkew; counter <= now+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		if hmac.Equal([]byte(totpCode(key, counter)), []byte(code)) {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
+
+// TOTPCode returns the authenticator code for secret at time t.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := base32NoPad.DecodeString(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpCode(key, t.Unix()/int64(TOTPPeriod/time.Second)), nil
+}
+
+// totpCode is the HOTP algorithm from RFC 4226.
+func totpCode(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, value%1000000)
+}
+
+// TOTPURI returns the otpauth URI that authenticator apps read from QR
+// codes to add a secret.
+func TOTPURI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("period", fmt.Sprint(int(TOTPPeriod/time.Second)))
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("algorithm", "SHA1")
+	return "otpauth://totp/" + url.PathEscape(issuer) + ":" +
+		url.PathEscape(account) + "?" + v.Encode()
+}
+
+// GenerateRecoveryCodes replaces the user's recovery codes with new ones,
+// which are returned. Only hashes of the codes are kept.
+func (u *User) GenerateRecoveryCodes() []string {
+	codes := make([]string, RecoveryCodeCount)
+	u.RecoveryCodes = make([]string, RecoveryCodeCount)
+	for i := range codes {
+		code := strings.ToLower(base32NoPad.EncodeToString(randomBytes(5)))
+		codes[i] = code[:4] + "-" + code[4:]
+		u.RecoveryCodes[i] = hashRecoveryCode(code)
+	}
+	return codes
+}
+
+// UseRecoveryCode reports whether code is one of the user's unused
+// recovery codes, and if so, uses it up.
+func (u *User) UseRecoveryCode(code string) bool {
+	hash := hashRecoveryCode(code)
+	for i := range u.RecoveryCodes {
+		if hmac.Equal([]byte(u.RecoveryCodes[i]), []byte(hash)) {
+			u.RecoveryCodes = append(u.RecoveryCodes[:i],
+				u.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// hashRecoveryCode ignores case, spaces, and dashes so codes can be typed
+// however is convenient.
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// ResetTwoFactor turns off two-factor authentication for the user and
+// discards their secret and recovery codes.
+func (u *User) ResetTwoFactor() {
+	u.TOTPSecret = ""
+	u.TOTPPendingSecret = ""
+	u.TOTPLastCounter = 0
+	u.RecoveryCodes = nil
+	u.TwoFactorFailures = 0
+	u.TwoFactorLocked = time.Time{}
+}
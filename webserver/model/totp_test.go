@@ -0,0 +1,102 @@
+package model
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors from RFC 6238 appendix B, truncated to 6 digits.
+func TestTOTPCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString(
+		[]byte("12345678901234567890"))
+
+	cases := []struct {
+		t    int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tc := range cases {
+		code, err := TOTPCode(secret, time.Unix(tc.t, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tc.code {
+			t.Errorf("time %d: got %s, expected %s", tc.t, code, tc.code)
+		}
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	var u User
+	now := time.Unix(1600000000, 0)
+
+	secret := u.BeginTOTP()
+	if u.TwoFactorEnabled() {
+		t.Fatal("two-factor enabled before confirmation")
+	}
+	if _, ok := u.ConfirmTOTP("000000", now); ok {
+		// One in a million chance this is actually the right code.
+		t.Fatal("wrong code confirmed TOTP")
+	}
+
+	code, _ := TOTPCode(secret, now)
+	recovery, ok := u.ConfirmTOTP(code, now)
+	if !ok || !u.TwoFactorEnabled() {
+		t.Fatal("correct code didn't confirm TOTP")
+	}
+	if len(recovery) != RecoveryCodeCount {
+		t.Errorf("got %d recovery codes", len(recovery))
+	}
+
+	// Codes can't be reused, but the next time step's code is fine.
+	if u.CheckTOTP(code, now) {
+		t.Error("code accepted twice")
+	}
+	later := now.Add(TOTPPeriod)
+	code, _ = TOTPCode(secret, later)
+	if !u.CheckTOTP(code, later) {
+		t.Error("next code rejected")
+	}
+
+	// Recovery codes work once, in any case and without the dash.
+	if !u.UseRecoveryCode(" " + recovery[3][:4] + recovery[3][5:] + " ") {
+		t.Error("recovery code rejected")
+	}
+	if u.UseRecoveryCode(recovery[3]) {
+		t.Error("recovery code accepted twice")
+	}
+	if len(u.RecoveryCodes) != RecoveryCodeCount-1 {
+		t.Errorf("got %d recovery codes left", len(u.RecoveryCodes))
+	}
+
+	u.ResetTwoFactor()
+	if u.TwoFactorEnabled() || len(u.RecoveryCodes) != 0 {
+		t.Error("two-factor still enabled after reset")
+	}
+}
@@ -19,17 +19,16 @@ package model
 // along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
 
 import (
-	"crypto/rand"
 	"encoding/base64"
 	"time"
 
+	"github.com/racingmars/virtual1403/vprinter"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
 	Email                 string
 	PasswordHash          string
-	AccessKey             string
 	FullName              string
 	Admin                 bool
 	Verified              bool
@@ -39,9 +38,66 @@ type User struct {
 	PageCount             int
 	LastJob               time.Time
 	LastVerificationEmail time.Time
+	LastPasswordReset     time.Time
 	SignupDate            time.Time
 	DisableEmailDelivery  bool
 	AllowNuisanceJobs     bool
+	SeparatorPages        string
+	ProfileRules          []vprinter.ProfileRule
+
+	// DefaultProfile is the profile for jobs whose client doesn't ask for
+	// one, or for every job if OverrideProfile is set. If AllowedProfiles
+	// isn't empty, jobs may only use those profiles.
+	DefaultProfile  string   `json:",omitempty"`
+	OverrideProfile bool     `json:",omitempty"`
+	AllowedProfiles []string `json:",omitempty"`
+
+	// FilenameTemplate and SubjectTemplate are the user's templates for the
+	// name of the job PDFs and the subject of the emails they're sent in.
+	// Empty templates get the server's usual names.
+	FilenameTemplate string `json:",omitempty"`
+	SubjectTemplate  string `json:",omitempty"`
+
+	// NuisanceJobNames are regular expressions for the user's own nuisance
+	// jobs, in addition to the server's.
+	NuisanceJobNames []string `json:",omitempty"`
+
+	// APIKeys are the user's access keys for the print API.
+	APIKeys []APIKey `json:",omitempty"`
+
+	// VerificationToken is the token in the user's email verification link.
+	// It can only be used once, and is empty after the user is verified.
+	VerificationToken string `json:",omitempty"`
+
+	// TOTPSecret is the base32 secret shared with the user's authenticator
+	// app once two-factor authentication is on. TOTPPendingSecret holds a
+	// new secret until the user confirms it with a code from the app.
+	TOTPSecret        string `json:",omitempty"`
+	TOTPPendingSecret string `json:",omitempty"`
+
+	// TOTPLastCounter is the time step of the last code accepted, so each
+	// code can only be used once.
+	TOTPLastCounter int64 `json:",omitempty"`
+
+	// RecoveryCodes are hashes of the user's unused recovery codes, each of
+	// which can be used once instead of an authenticator code.
+	RecoveryCodes []string `json:",omitempty"`
+
+	// TwoFactorFailures counts the wrong codes entered since the last
+	// correct one, and TwoFactorLocked is when we stopped accepting codes
+	// after too many of them.
+	TwoFactorFailures int `json:",omitempty"`
+	TwoFactorLocked   time.Time
+
+	// SSOSubject is the user's subject identifier at the single sign-on
+	// provider, set the first time they sign in through it. After that,
+	// only that identity can sign in to the account through the provider.
+	SSOSubject string `json:",omitempty"`
+
+	// AccessKey is the user's one access key, from before users could have
+	// several. It is only read to move it to APIKeys when the database is
+	// opened.
+	AccessKey string `json:",omitempty"`
 }
 
 // NewUser is a convenience function to create a new user with the
@@ -52,7 +108,7 @@ func NewUser(email, password string) User {
 	u.Enabled = true
 	u.SetPassword(password)
 	u.SignupDate = time.Now().UTC()
-	u.GenerateAccessKey()
+	u.GenerateVerificationToken()
 	return u
 }
 
@@ -78,14 +134,3 @@ func (u *User) CheckPassword(password string) bool {
 	}
 	return true
 }
-
-// GenerateAccessKey generates and sets a new random access key on the user.
-func (u *User) GenerateAccessKey() {
-	const numBytes = 256 / 8 // 256 bits
-	buf := make([]byte, numBytes)
-	n, err := rand.Read(buf)
-	if err != nil || n != numBytes {
-		panic("Reading info byte buffer from rand should never fail")
-	}
-	u.AccessKey = base64.StdEncoding.EncodeToString(buf)
-}
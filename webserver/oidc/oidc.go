@@ -0,0 +1,566 @@
+// Package oidc is a minimal OpenID Connect relying party for the web UI's
+// single sign-on. It supports the authorization code flow with PKCE and ID
+// tokens signed with RS256 or ES256.
+package oidc
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config is the single sign-on configuration from the server config file.
+type Config struct {
+	// Issuer is the identity provider's issuer URL; its configuration is
+	// discovered from Issuer + "/.well-known/openid-configuration".
+	Issuer       string   `yaml:"issuer"`
+	ClientID     string   `yaml:"client_id"`
+	ClientSecret string   `yaml:"client_secret"`
+	Scopes       []string `yaml:"scopes"`
+
+	// DisplayName is the provider name shown on the login button.
+	DisplayName string `yaml:"display_name"`
+
+	// The names of the ID token claims holding the user's details. Empty
+	// names get the standard OpenID Connect claims.
+	EmailClaim         string `yaml:"email_claim"`
+	EmailVerifiedClaim string `yaml:"email_verified_claim"`
+	NameClaim          string `yaml:"name_claim"`
+	GroupsClaim        string `yaml:"groups_claim"`
+
+	// If AdminGroup is set, users signing in through the provider are made
+	// administrators if they are in this group. With DemoteAdmins, they also
+	// stop being administrators if they aren't.
+	AdminGroup   string `yaml:"admin_group"`
+	DemoteAdmins bool   `yaml:"demote_admins"`
+
+	// SSOOnlySignup turns off the signup form, so new accounts can only be
+	// created by signing in through the provider.
+	SSOOnlySignup bool `yaml:"sso_only_signup"`
+}
+
+// Enabled reports whether single sign-on is configured.
+func (c Config) Enabled() bool {
+	return c.Issuer != ""
+}
+
+// Validate returns any problems with the configuration.
+func (c Config) Validate() []error {
+	var errs []error
+	if _, err := url.ParseRequestURI(c.Issuer); err != nil {
+		errs = append(errs, fmt.Errorf("oidc issuer %q is invalid",
+			c.Issuer))
+	}
+	if c.ClientID == "" {
+		errs = append(errs, fmt.Errorf("oidc client_id is required"))
+	}
+	return errs
+}
+
+// Identity is the user's details from a verified ID token.
+type Identity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+	Groups        []string
+}
+
+// InGroup reports whether the user is a member of group.
+func (id Identity) InGroup(group string) bool {
+	for _, g := range id.Groups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	ErrInvalidToken = errors.New("ID token is invalid")
+	ErrNonce        = errors.New("ID token nonce doesn't match")
+)
+
+// clockSkew is how far we allow the provider's clock to differ from ours
+// when checking token expiry.
+const clockSkew = time.Minute
+
+// jwksRefreshInterval limits how often we fetch the provider's keys when
+// we see a token signed with a key we don't know.
+const jwksRefreshInterval = time.Minute
+
+// Provider is an OpenID Connect identity provider. Its configuration is
+// discovered, and its signing keys fetched, the first time they're needed.
+type Provider struct {
+	config      Config
+	redirectURL string
+	client      *http.Client
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// NewProvider returns the provider described by config, which will send
+// users back to redirectURL after they sign in.
+func NewProvider(config Config, redirectURL string) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if config.EmailClaim == "" {
+		config.EmailClaim = "email"
+	}
+	if config.EmailVerifiedClaim == "" {
+		config.EmailVerifiedClaim = "email_verified"
+	}
+	if config.NameClaim == "" {
+		config.NameClaim = "name"
+	}
+	if config.GroupsClaim == "" {
+		config.GroupsClaim = "groups"
+	}
+	if config.DisplayName == "" {
+		config.DisplayName = "single sign-on"
+	}
+
+	return &Provider{
+		config:      config,
+		redirectURL: redirectURL,
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Config returns the provider's configuration, with defaults filled in.
+func (p *Provider) Config() Config {
+	return p.config
+}
+
+// AuthRequest is the state for one sign in, which must be kept (in the
+// user's session) until the provider sends the user back.
+type AuthRequest struct {
+	State    string
+	Nonce    string
+	Verifier string // PKCE code verifier
+}
+
+// NewAuthRequest returns a new sign in request.
+func NewAuthRequest() AuthRequest {
+	return AuthRequest{
+		State:    randomString(),
+		Nonce:    randomString(),
+		Verifier: randomString(),
+	}
+}
+
+// AuthURL returns the URL to send the user to for the provider's sign in.
+func (p *Provider) AuthURL(ctx context.Context,
+	req AuthRequest) (string, error) {
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(req.Verifier))
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.config.ClientID)
+	v.Set("redirect_uri", p.redirectURL)
+	v.Set("scope", strings.Join(p.config.Scopes, " "))
+	v.Set("state", req.State)
+	v.Set("nonce", req.Nonce)
+	v.Set("code_challenge",
+		base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange trades the authorization code from the provider's redirect for
+// an ID token, and returns the user's identity from the verified token.
+func (p *Provider) Exchange(ctx context.Context, req AuthRequest,
+	code string) (Identity, error) {
+
+	d, err := p.getDiscovery(ctx)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.redirectURL)
+	form.Set("code_verifier", req.Verifier)
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Identity{}, err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	httpReq.Header.Set("Accept", "application/json")
+	httpReq.SetBasicAuth(url.QueryEscape(p.config.ClientID),
+		url.QueryEscape(p.config.ClientSecret))
+
+	resp, err := p.client.Do(httpReq)
+	if err != nil {
+		return Identity{}, err
+	}
+	defer resp.Body.Close()
+
+	var token struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body,
+		1<<20)).Decode(&token); err != nil {
+		return Identity{}, fmt.Errorf("token endpoint returned %s: %v",
+			resp.Status, err)
+	}
+	if token.Error != "" {
+		return Identity{}, fmt.Errorf("token endpoint returned %s: %s",
+			token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return Identity{}, fmt.Errorf(
+			"token endpoint returned %s with no ID token", resp.Status)
+	}
+
+	claims, err := p.verify(ctx, d, token.IDToken, time.Now())
+	if err != nil {
+		return Identity{}, err
+	}
+	if nonce, _ := claims["nonce"].(string); nonce != req.Nonce {
+		return Identity{}, ErrNonce
+	}
+
+	return p.identity(claims)
+}
+
+// identity maps the claims to the user's identity.
+func (p *Provider) identity(claims map[string]interface{}) (Identity,
+	error) {
+
+	var id Identity
+	id.Subject, _ = claims["sub"].(string)
+	if id.Subject == "" {
+		return id, fmt.Errorf("%w: no subject", ErrInvalidToken)
+	}
+
+	id.Email, _ = claims[p.config.EmailClaim].(string)
+	id.Name, _ = claims[p.config.NameClaim].(string)
+
+	// Some providers send email_verified as a string.
+	switch v := claims[p.config.EmailVerifiedClaim].(type) {
+	case bool:
+		id.EmailVerified = v
+	case string:
+		id.EmailVerified = v == "true"
+	}
+
+	switch v := claims[p.config.GroupsClaim].(type) {
+	case string:
+		id.Groups = []string{v}
+	case []interface{}:
+		for _, g := range v {
+			if s, ok := g.(string); ok {
+				id.Groups = append(id.Groups, s)
+			}
+		}
+	}
+
+	return id, nil
+}
+
+// verify checks the ID token's signature, issuer, audience, and expiry, and
+// returns its claims.
+func (p *Provider) verify(ctx context.Context, d *discovery, token string,
+	now time.Time) (map[string]interface{}, error) {
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrInvalidToken)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("%w: header: %v", ErrInvalidToken, err)
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature: %v", ErrInvalidToken, err)
+	}
+
+	key, err := p.key(ctx, d, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], sig) {
+		return nil, fmt.Errorf("%w: bad %s signature", ErrInvalidToken,
+			header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims: %v", ErrInvalidToken, err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != d.Issuer {
+		return nil, fmt.Errorf("%w: issuer is %q", ErrInvalidToken, iss)
+	}
+	if !hasAudience(claims["aud"], p.config.ClientID) {
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+	exp, _ := claims["exp"].(float64)
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+
+	return claims, nil
+}
+
+func hasAudience(aud interface{}, clientID string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == clientID
+	case []interface{}:
+		for _, a := range v {
+			if a == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifySignature checks a signature with the key for the JWS algorithm.
+// Only the asymmetric algorithms providers use for ID tokens are accepted.
+func verifySignature(alg string, key crypto.PublicKey, digest,
+	sig []byte) bool {
+
+	switch alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest,
+			sig) == nil
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || pub.Curve != elliptic.P256() || len(sig) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(pub, digest, r, s)
+	}
+	return false
+}
+
+// getDiscovery returns the provider's configuration, fetching it the first
+// time.
+func (p *Provider) getDiscovery(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d discovery
+	if err := p.getJSON(ctx, strings.TrimSuffix(p.config.Issuer, "/")+
+		"/.well-known/openid-configuration", &d); err != nil {
+		return nil, fmt.Errorf("discovering OIDC provider: %v", err)
+	}
+	if d.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("OIDC provider issuer is %q, expected %q",
+			d.Issuer, p.config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" ||
+		d.JWKSURI == "" {
+		return nil, fmt.Errorf("OIDC provider configuration is incomplete")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+// key returns the provider's signing key with ID kid. The provider's keys
+// are fetched again if we don't know kid, in case they have been rotated.
+func (p *Provider) key(ctx context.Context, d *discovery,
+	kid string) (crypto.PublicKey, error) {
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysFetched) < jwksRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+	}
+
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	p.keysFetched = time.Now()
+	if err := p.getJSON(ctx, d.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("fetching OIDC provider keys: %v", err)
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key, err := k.publicKey(); err == nil {
+			p.keys[k.Kid] = key
+		}
+	}
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, kid)
+}
+
+// jwk is a JSON Web Key from the provider's key set.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+func (p *Provider) getJSON(ctx context.Context, url string,
+	v interface{}) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func randomString() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		panic("Reading info byte buffer from rand should never fail")
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,353 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/auth"
+
+	"github.com/racingmars/virtual1403/logging"
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/mailer"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+const (
+	// resetTokenLifetime is how long a password reset link remains valid.
+	resetTokenLifetime = 1 * time.Hour
+
+	// resetEmailInterval is the minimum time between password reset emails
+	// to the same account.
+	resetEmailInterval = 15 * time.Minute
+
+	// resetClientLimit is the number of password reset requests we take
+	// from one client address in each resetClientWindow.
+	resetClientLimit  = 5
+	resetClientWindow = 1 * time.Hour
+
+	// fingerprintLength is the number of bytes of the password hash digest
+	// included in a reset token.
+	fingerprintLength = 8
+)
+
+var (
+	errResetInvalid = errors.New("password reset link is invalid")
+	errResetExpired = errors.New("password reset link has expired")
+)
+
+// resetThrottle limits how often password resets may be requested. The
+// zero value is ready to use.
+type resetThrottle struct {
+	mu      sync.Mutex
+	clients map[string]*clientRequests
+
+	// accounts serializes the checking and updating of an account's last
+	// reset time, so two quick requests can't both send an email.
+	accounts sync.Mutex
+}
+
+// clientRequests counts the password reset requests from one client address
+// since start.
+type clientRequests struct {
+	start time.Time
+	count int
+}
+
+// allow reports whether the client at addr may request another password
+// reset now, counting the request if so.
+func (t *resetThrottle) allow(addr string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := t.clients[addr]
+	if c == nil || now.Sub(c.start) >= resetClientWindow {
+		if t.clients == nil {
+			t.clients = make(map[string]*clientRequests)
+		}
+		// Forget the clients whose window is over while we're here, so
+		// the map doesn't grow forever.
+		for a, old := range t.clients {
+			if now.Sub(old.start) >= resetClientWindow {
+				delete(t.clients, a)
+			}
+		}
+		c = &clientRequests{start: now}
+		t.clients[addr] = c
+	}
+	if c.count >= resetClientLimit {
+		return false
+	}
+	c.count++
+	return true
+}
+
+// clientAddress returns the IP address of the client that made r.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// A password reset token is the hex encoding of:
+//
+//	expiry time (uint64 Unix seconds, big endian)
+//	password fingerprint (fingerprintLength bytes)
+//	email address
+//	signature of all of the above
+//
+// The signature uses the same nacl auth scheme as the PDF share keys, so we
+// don't need to store outstanding tokens. The fingerprint of the user's
+// current password hash makes each token single-use: once the password is
+// changed, every link issued before the change stops working.
+
+// newResetToken returns a password reset token for u that is valid until
+// expires.
+func newResetToken(key *[db.ResetSecretKeyLength]byte, u model.User,
+	expires time.Time) string {
+
+	msg := uint64ToBytesBE(uint64(expires.Unix()))
+	msg = append(msg, passwordFingerprint(u)...)
+	msg = append(msg, []byte(u.Email)...)
+	sig := auth.Sum(msg, key)
+	msg = append(msg, sig[:]...)
+	return hex.EncodeToString(msg)
+}
+
+// parseResetToken verifies the signature and expiration of a password reset
+// token, returning the email address and password fingerprint it was issued
+// for.
+func parseResetToken(key *[db.ResetSecretKeyLength]byte, token string,
+	now time.Time) (string, []byte, error) {
+
+	raw, err := hex.DecodeString(token)
+	if err != nil || len(raw) <= 64/8+fingerprintLength+auth.Size {
+		return "", nil, errResetInvalid
+	}
+
+	msg := raw[:len(raw)-auth.Size]
+	sig := raw[len(raw)-auth.Size:]
+	if !auth.Verify(sig, msg, key) {
+		return "", nil, errResetInvalid
+	}
+
+	expires, err := bytesToUint64BE(msg[:64/8])
+	if err != nil {
+		return "", nil, errResetInvalid
+	}
+	if now.Unix() > int64(expires) {
+		return "", nil, errResetExpired
+	}
+
+	fingerprint := msg[64/8 : 64/8+fingerprintLength]
+	email := string(msg[64/8+fingerprintLength:])
+	return email, fingerprint, nil
+}
+
+// passwordFingerprint returns the leading bytes of a digest of the user's
+// password hash.
+func passwordFingerprint(u model.User) []byte {
+	sum := sha256.Sum256([]byte(u.PasswordHash))
+	return sum[:fingerprintLength]
+}
+
+// checkResetToken returns the user a password reset token belongs to, as
+// long as the token is genuine, unexpired, and the password hasn't changed
+// since it was issued.
+func (app *application) checkResetToken(token string) (*model.User, error) {
+	email, fingerprint, err := parseResetToken(app.resetKey, token,
+		time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := app.db.GetUser(email)
+	if err == db.ErrNotFound {
+		return nil, errResetInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !u.Enabled || !bytes.Equal(fingerprint, passwordFingerprint(u)) {
+		return nil, errResetInvalid
+	}
+
+	return &u, nil
+}
+
+// forgotPassword is the HTTP handler for /forgotpassword. GET requests show
+// the form to request a password reset email, and POST requests send it.
+// We give the same response whether or not the account exists so the form
+// can't be used to discover registered email addresses. The account is
+// looked up and the email sent in the background, so the response time
+// doesn't give it away either.
+func (app *application) forgotPassword(w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		responseVars := map[string]interface{}{
+			"forgotMessage": app.session.Get(r, "forgotMessage"),
+		}
+		if responseVars["forgotMessage"] != nil {
+			app.session.Remove(r, "forgotMessage")
+		}
+		app.render(w, r, "forgot.page.tmpl", responseVars)
+		return
+	}
+
+	email := strings.TrimSpace(r.PostFormValue("email"))
+	if email == "" {
+		http.Redirect(w, r, "forgotpassword", http.StatusSeeOther)
+		return
+	}
+
+	if !app.resets.allow(clientAddress(r), time.Now()) {
+		requestLog(r).Infof("too many password reset requests from client")
+		app.session.Put(r, "forgotMessage", "There have been too many "+
+			"password reset requests from your address. Please try "+
+			"again later.")
+		http.Redirect(w, r, "forgotpassword", http.StatusSeeOther)
+		return
+	}
+
+	go app.sendPasswordReset(requestLog(r).With("user", email), email)
+
+	app.session.Put(r, "forgotMessage", "If an account exists for "+email+
+		", we have sent it an email with a link to reset the password. "+
+		fmt.Sprintf("The link is valid for %d minutes.",
+			int(resetTokenLifetime.Minutes())))
+	http.Redirect(w, r, "forgotpassword", http.StatusSeeOther)
+}
+
+// sendPasswordReset emails a password reset link to the account with the
+// provided email address, if there is one and it hasn't been sent a link
+// too recently. Nothing is reported back to the requester.
+func (app *application) sendPasswordReset(log *logging.Logger,
+	email string) {
+
+	app.resets.accounts.Lock()
+	defer app.resets.accounts.Unlock()
+
+	u, err := app.db.GetUser(email)
+	if err == db.ErrNotFound {
+		log.Infof("password reset requested for unknown account")
+		return
+	} else if err != nil {
+		log.Errorf("couldn't get user from DB: %v", err)
+		return
+	}
+
+	if !u.Enabled {
+		log.Infof("password reset requested for disabled account")
+		return
+	}
+
+	if time.Since(u.LastPasswordReset) < resetEmailInterval {
+		log.Infof("tried to request another password reset email too " +
+			"quickly")
+		return
+	}
+
+	u.LastPasswordReset = time.Now()
+	if err := app.db.SaveUser(u); err != nil {
+		log.Errorf("couldn't save updated user to DB: %v", err)
+		return
+	}
+
+	token := newResetToken(app.resetKey, u,
+		time.Now().Add(resetTokenLifetime))
+	resetURL := app.serverBaseURL + "/resetpassword?token=" +
+		url.QueryEscape(token)
+	if err := mailer.SendPasswordReset(app.mailconfig, u.Email, resetURL,
+		resetTokenLifetime); err != nil {
+		log.Errorf("couldn't send password reset email: %v", err)
+		return
+	}
+	log.Infof("sent password reset email")
+}
+
+// resetPassword is the HTTP handler for /resetpassword?token=..., the link
+// in the password reset email. GET requests show the form to choose a new
+// password, and POST requests set it.
+func (app *application) resetPassword(w http.ResponseWriter,
+	r *http.Request) {
+
+	token := r.FormValue("token")
+	u, err := app.checkResetToken(token)
+	if err == errResetInvalid || err == errResetExpired {
+		requestLog(r).Infof("rejected password reset link: %v", err)
+		app.render(w, r, "reset.page.tmpl", map[string]interface{}{
+			"tokenError": err.Error(),
+		})
+		return
+	} else if err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	responseVars := map[string]interface{}{
+		"token": token,
+		"email": u.Email,
+	}
+
+	if r.Method != http.MethodPost {
+		app.render(w, r, "reset.page.tmpl", responseVars)
+		return
+	}
+
+	newPassword := r.PostFormValue("new-password")
+	newPassword2 := r.PostFormValue("new-password2")
+
+	if len(newPassword) < 8 {
+		responseVars["resetError"] =
+			"Your new password must be 8 or more characters long."
+		app.render(w, r, "reset.page.tmpl", responseVars)
+		return
+	}
+
+	if newPassword != newPassword2 {
+		responseVars["resetError"] = "New passwords do not match."
+		app.render(w, r, "reset.page.tmpl", responseVars)
+		return
+	}
+
+	u.SetPassword(newPassword)
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, "Sorry, a database error has occurred")
+		return
+	}
+
+	app.session.Put(r, "resetSuccess",
+		"Your password was successfully reset.")
+	requestLog(r).With("user", u.Email).Infof(
+		"successfully reset their password")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
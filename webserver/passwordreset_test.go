@@ -0,0 +1,271 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golangcollege/sessions"
+
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/mailer"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+func TestResetToken(t *testing.T) {
+	var key, otherKey [db.ResetSecretKeyLength]byte
+	key[0] = 1
+	otherKey[0] = 2
+
+	u := model.NewUser("user@example.com", "password1")
+	now := time.Now()
+	token := newResetToken(&key, u, now.Add(resetTokenLifetime))
+
+	email, fingerprint, err := parseResetToken(&key, token, now)
+	if err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if email != u.Email {
+		t.Errorf("got email %q, expected %q", email, u.Email)
+	}
+	if string(fingerprint) != string(passwordFingerprint(u)) {
+		t.Errorf("fingerprint doesn't match the user's password")
+	}
+
+	if _, _, err := parseResetToken(&key, token,
+		now.Add(2*resetTokenLifetime)); err != errResetExpired {
+		t.Errorf("expired token: got %v, expected %v", err, errResetExpired)
+	}
+
+	if _, _, err := parseResetToken(&otherKey, token,
+		now); err != errResetInvalid {
+		t.Errorf("wrong key: got %v, expected %v", err, errResetInvalid)
+	}
+
+	// Flip a bit in the email address
+	tampered := []byte(token)
+	tampered[len(tampered)-65] ^= 1
+	if _, _, err := parseResetToken(&key, string(tampered),
+		now); err != errResetInvalid {
+		t.Errorf("tampered token: got %v, expected %v", err,
+			errResetInvalid)
+	}
+
+	// Once the password changes, the old token no longer matches.
+	u.SetPassword("password2")
+	if string(fingerprint) == string(passwordFingerprint(u)) {
+		t.Errorf("fingerprint unchanged after password change")
+	}
+}
+
+// mailSink is a minimal SMTP server that hands each message it receives to
+// the messages channel.
+type mailSink struct {
+	listener net.Listener
+	messages chan string
+}
+
+func newMailSink(t *testing.T) *mailSink {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	m := &mailSink{listener: listener, messages: make(chan string, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(conn)
+		}
+	}()
+	return m
+}
+
+func (m *mailSink) config() mailer.Config {
+	addr := m.listener.Addr().(*net.TCPAddr)
+	return mailer.Config{
+		FromAddress: "virtual1403@example.com",
+		Server:      addr.IP.String(),
+		Port:        addr.Port,
+	}
+}
+
+func (m *mailSink) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+
+	reply("220 localhost")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+		case strings.HasPrefix(cmd, "DATA"):
+			reply("354 go ahead")
+			var msg strings.Builder
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+				msg.WriteString(line)
+			}
+			m.messages <- msg.String()
+			reply("250 ok")
+		case strings.HasPrefix(cmd, "QUIT"):
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+var resetLinkRegexp = regexp.MustCompile(`/resetpassword\?token=\S+`)
+
+func TestPasswordReset(t *testing.T) {
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	u := model.NewUser("user@example.com", "password1")
+	u.Enabled = true
+	u.Verified = true
+	if err := database.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	templates, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := newMailSink(t)
+	app := &application{
+		db:            database,
+		mailconfig:    sink.config(),
+		templateCache: templates,
+		session:       sessions.New(make([]byte, 32)),
+		resetKey:      new([db.ResetSecretKeyLength]byte),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/forgotpassword", app.session.Enable(http.HandlerFunc(
+		app.forgotPassword)))
+	mux.Handle("/resetpassword", app.session.Enable(http.HandlerFunc(
+		app.resetPassword)))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	app.serverBaseURL = server.URL
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	resp, err := client.PostForm(server.URL+"/forgotpassword",
+		url.Values{"email": {u.Email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	var msg string
+	select {
+	case msg = <-sink.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no password reset email was sent")
+	}
+	link := resetLinkRegexp.FindString(msg)
+	if link == "" {
+		t.Fatalf("no reset link in email:\n%s", msg)
+	}
+
+	resp, err = client.PostForm(server.URL+link, url.Values{
+		"new-password":  {"password2"},
+		"new-password2": {"password2"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("got status %d from reset form", resp.StatusCode)
+	}
+
+	u, err = database.GetUser(u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.CheckPassword("password2") {
+		t.Error("password wasn't changed")
+	}
+
+	// The link can only be used once, since the password has changed.
+	token, _ := url.QueryUnescape(strings.TrimPrefix(link,
+		"/resetpassword?token="))
+	if _, err := app.checkResetToken(token); err != errResetInvalid {
+		t.Errorf("reused reset link got %v, expected errResetInvalid", err)
+	}
+}
+
+func TestResetThrottle(t *testing.T) {
+	var throttle resetThrottle
+	now := time.Now()
+
+	for i := 0; i < resetClientLimit; i++ {
+		if !throttle.allow("192.0.2.1", now) {
+			t.Fatalf("request %d was refused", i+1)
+		}
+	}
+	if throttle.allow("192.0.2.1", now) {
+		t.Errorf("request over the limit was allowed")
+	}
+	if !throttle.allow("192.0.2.2", now) {
+		t.Errorf("request from another client was refused")
+	}
+
+	// Once the window is over the client may ask again, and clients we
+	// haven't heard from are forgotten.
+	if !throttle.allow("192.0.2.1", now.Add(resetClientWindow)) {
+		t.Errorf("request after the window was refused")
+	}
+	if len(throttle.clients) != 1 {
+		t.Errorf("got %d clients, want 1", len(throttle.clients))
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/racingmars/virtual1403/vprinter"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+const (
+	// maxTemplateLen is the longest filename or subject template we allow.
+	maxTemplateLen = 200
+
+	// maxUserNuisanceJobs is how many nuisance job regexps each user may
+	// have.
+	maxUserNuisanceJobs = 20
+)
+
+// templateFields are the placeholders allowed in filename and subject
+// templates, with a description for the user page.
+var templateFields = []struct{ Name, Description string }{
+	{"job", "job identifier, e.g. J12_IBMUSERA"},
+	{"name", "job name"},
+	{"number", "JES2 job number"},
+	{"class", "SYSOUT class"},
+	{"forms", "forms name"},
+	{"programmer", "programmer name"},
+	{"user", "user ID the job ran under"},
+	{"profile", "profile the job was printed with"},
+	{"id", "job log ID"},
+	{"date", "date the job was received, e.g. 2022-01-18 (UTC)"},
+	{"time", "time the job was received, e.g. 112508 (UTC)"},
+}
+
+// templatePlaceholder matches a placeholder in a template.
+var templatePlaceholder = regexp.MustCompile(`\{([a-z]*)\}`)
+
+// filenameInvalidChars matches the characters we don't allow in PDF file
+// names.
+var filenameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// userProfile returns the profile to print a job with for user, from their
+// profile rules for the job's details, or their profile preferences and the
+// profile the client asked for.
+func userProfile(user model.User, requested string,
+	details *model.JobInfo) string {
+
+	profile := requested
+	if user.DefaultProfile != "" &&
+		(user.OverrideProfile || requested == "") {
+		profile = user.DefaultProfile
+	}
+	if details != nil && len(user.ProfileRules) > 0 {
+		profile = vprinter.ChooseProfile(user.ProfileRules, details.Class,
+			details.Forms, details.Name, profile)
+	}
+
+	if len(user.AllowedProfiles) == 0 ||
+		isAllowedProfile(user.AllowedProfiles, profile) {
+		return profile
+	}
+	if user.DefaultProfile != "" {
+		return user.DefaultProfile
+	}
+	return user.AllowedProfiles[0]
+}
+
+// isAllowedProfile returns true if profile is one of allowed. Unknown
+// profiles are the default profile.
+func isAllowedProfile(allowed []string, profile string) bool {
+	profile = vprinter.CanonicalProfile(profile)
+	for _, name := range allowed {
+		if vprinter.CanonicalProfile(name) == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// isNuisanceJob returns true if jobinfo matches one of the user's own
+// nuisance job regexps, or unless they allow them, one of the server's.
+func (a *application) isNuisanceJob(user model.User, jobinfo string) bool {
+	if !user.AllowNuisanceJobs {
+		for i := range a.nuisanceJobs {
+			if a.nuisanceJobs[i].MatchString(jobinfo) {
+				return true
+			}
+		}
+	}
+	for _, expr := range user.NuisanceJobNames {
+		// The regexps were checked when the user saved them.
+		if r, err := regexp.Compile(expr); err == nil &&
+			r.MatchString(jobinfo) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandTemplate replaces the placeholders in a filename or subject
+// template with the job's details.
+func expandTemplate(tmpl string, job model.JobLogEntry) string {
+	var details model.JobInfo
+	if job.Details != nil {
+		details = *job.Details
+	}
+	values := map[string]string{
+		"job":        job.JobInfo,
+		"name":       details.Name,
+		"number":     details.Number,
+		"class":      details.Class,
+		"forms":      details.Forms,
+		"programmer": details.Programmer,
+		"user":       details.User,
+		"profile":    vprinter.CanonicalProfile(job.Profile),
+		"id":         fmt.Sprint(job.ID),
+		"date":       job.Time.UTC().Format("2006-01-02"),
+		"time":       job.Time.UTC().Format("150405"),
+	}
+	return templatePlaceholder.ReplaceAllStringFunc(tmpl,
+		func(placeholder string) string {
+			return values[placeholder[1:len(placeholder)-1]]
+		})
+}
+
+// pdfFileName returns the name of the PDF for job, from the user's filename
+// template. Without a template, the name is the job identifier and the time
+// the job was received, in timeLayout.
+func pdfFileName(user model.User, job model.JobLogEntry,
+	timeLayout string) string {
+
+	if user.FilenameTemplate == "" {
+		jobtag := job.JobInfo
+		if jobtag != "" {
+			jobtag = jobtag + "-"
+		}
+		return fmt.Sprintf("virtual1403_%s%s.pdf", jobtag,
+			job.Time.UTC().Format(timeLayout))
+	}
+
+	name := expandTemplate(user.FilenameTemplate, job)
+	name = strings.Trim(filenameInvalidChars.ReplaceAllString(name, "_"),
+		"._")
+	name = strings.TrimSuffix(name, ".pdf")
+	if name == "" {
+		name = "virtual1403"
+	}
+	return name + ".pdf"
+}
+
+// emailSubject returns the subject of the email job is sent in, from the
+// user's subject template.
+func emailSubject(user model.User, job model.JobLogEntry) string {
+	if user.SubjectTemplate == "" {
+		return "Virtual 1403 printout " + job.JobInfo
+	}
+	// Job details come from the printer output, so we mustn't let them
+	// add email headers.
+	subject := strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, expandTemplate(user.SubjectTemplate, job))
+	return strings.TrimSpace(subject)
+}
+
+// validateTemplate checks that a filename or subject template isn't too long
+// and only uses placeholders we know.
+func validateTemplate(tmpl string) error {
+	if len(tmpl) > maxTemplateLen {
+		return fmt.Errorf("must be no more than %d characters",
+			maxTemplateLen)
+	}
+	for _, m := range templatePlaceholder.FindAllStringSubmatch(tmpl, -1) {
+		known := false
+		for _, field := range templateFields {
+			if m[1] == field.Name {
+				known = true
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown placeholder %s", m[0])
+		}
+	}
+	return nil
+}
+
+// parseNuisanceJobs parses the user's nuisance job regexps, one per line.
+func parseNuisanceJobs(text string) ([]string, error) {
+	var exprs []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, err := regexp.Compile(line); err != nil {
+			return nil, fmt.Errorf("`%s`: %v", line, err)
+		}
+		exprs = append(exprs, line)
+	}
+	if len(exprs) > maxUserNuisanceJobs {
+		return nil, fmt.Errorf("no more than %d nuisance jobs are allowed",
+			maxUserNuisanceJobs)
+	}
+	return exprs, nil
+}
+
+// validateProfilePreferences checks the user's profile preferences, and
+// returns the profile names in lower case.
+func validateProfilePreferences(defaultProfile string, override bool,
+	allowed []string) (string, []string, error) {
+
+	defaultProfile = strings.ToLower(strings.TrimSpace(defaultProfile))
+	if defaultProfile != "" && !vprinter.IsProfile(defaultProfile) {
+		return "", nil, fmt.Errorf("unknown profile %s", defaultProfile)
+	}
+	if override && defaultProfile == "" {
+		return "", nil, errors.New(
+			"choose a default profile to use for every job")
+	}
+	var names []string
+	for _, name := range allowed {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !vprinter.IsProfile(name) {
+			return "", nil, fmt.Errorf("unknown profile %s", name)
+		}
+		names = append(names, name)
+	}
+	if defaultProfile != "" && len(names) > 0 &&
+		!isAllowedProfile(names, defaultProfile) {
+		return "", nil, errors.New(
+			"the default profile must be one of the allowed profiles")
+	}
+	return defaultProfile, names, nil
+}
+
+// allowedProfileSet returns the user's allowed profiles as a set, for the
+// user page to check them off.
+func allowedProfileSet(allowed []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, name := range allowed {
+		set[vprinter.CanonicalProfile(name)] = true
+	}
+	return set
+}
@@ -0,0 +1,83 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"testing"
+	"time"
+
+	"github.com/racingmars/virtual1403/vprinter"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+func TestUserProfile(t *testing.T) {
+	user := model.User{
+		DefaultProfile:  "retro-blue",
+		AllowedProfiles: []string{"retro-blue", "default-plain"},
+		ProfileRules: []vprinter.ProfileRule{
+			{Class: "B", Profile: "default-plain"},
+			{Class: "C", Profile: "modern-green"},
+		},
+	}
+	details := &model.JobInfo{Class: "A"}
+
+	for _, test := range []struct {
+		requested, class string
+		override         bool
+		want             string
+	}{
+		{"", "A", false, "retro-blue"},
+		{"default-plain", "A", false, "default-plain"},
+		{"default-plain", "A", true, "retro-blue"},
+		{"modern-blue", "A", false, "retro-blue"},
+		{"retro-blue", "B", true, "default-plain"},
+		{"retro-blue", "C", false, "retro-blue"},
+	} {
+		user.OverrideProfile = test.override
+		details.Class = test.class
+		if got := userProfile(user, test.requested, details); got !=
+			test.want {
+			t.Errorf("%+v: got %s", test, got)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	job := model.JobLogEntry{
+		ID:      42,
+		JobInfo: "J12_IBMUSERA",
+		Details: &model.JobInfo{Name: "IBMUSERA", Class: "A"},
+		Time:    time.Date(2022, 1, 18, 11, 25, 8, 0, time.UTC),
+	}
+	user := model.User{
+		FilenameTemplate: "{name}/{class} {date}.pdf",
+		SubjectTemplate:  "Job {job}\r\nBcc: x@example.com",
+	}
+	if name := pdfFileName(user, job, time.RFC3339); name !=
+		"IBMUSERA_A_2022-01-18.pdf" {
+		t.Errorf("got file name %q", name)
+	}
+	if subject := emailSubject(user, job); subject !=
+		"Job J12_IBMUSERA  Bcc: x@example.com" {
+		t.Errorf("got subject %q", subject)
+	}
+	if err := validateTemplate("{job} {nope}"); err == nil {
+		t.Errorf("expected an error for an unknown placeholder")
+	}
+}
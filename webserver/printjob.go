@@ -19,45 +19,63 @@ package main
 // along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
 
 import (
-	"bufio"
 	"bytes"
-	"errors"
+	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"mime"
 	"net/http"
-	"regexp"
+	"strconv"
 	"strings"
-	"time"
 	"unicode/utf8"
 
 	"github.com/klauspost/compress/zstd"
 
+	"github.com/racingmars/virtual1403/logging"
 	"github.com/racingmars/virtual1403/vprinter"
-	"github.com/racingmars/virtual1403/webserver/mailer"
+	"github.com/racingmars/virtual1403/webserver/model"
 )
 
 // printjob is the handler for the primary use case of the server: receive
 // the text of a print job and generate a PDF. Clients send the data in the
 // request body as a series of print directives. Print directives must be
 // valid UTF-8 strings separated by CRLF, CR, or LF. Each print directive
-// contains a one-letter prefix (L, O, P), followed by a colon (:), followed
-// by the (optional) data for the directive. Each HTTP POST represents one
-// print job.
+// contains a one-letter prefix (L, O, P, ...), followed by a colon (:),
+// followed by the (optional) data for the directive. Each HTTP POST
+// represents one print job. Large jobs may instead be uploaded in chunks;
+// see uploadjob.
+//
+// There are two versions of the print directive protocol. Version 2 jobs
+// start with a V: header directive, and may also contain M: and C:
+// directives. Jobs without a header are version 1.
 //
 // Request requirements:
 //
 // 1. The HTTP method must be POST.
-// 2. The request must be authenticated with a user's API key as a bearer
-//    token. That is, the request must contain the header:
+// 2. The request must be authenticated with one of the user's API keys, that
+//    may be used to print, as a bearer token. That is, the request must
+//    contain the header:
 //    Authorization: Bearer <api key>
-// 3. The Content-Type header value must be "text/x-print-job".
-// 4. The request body must be compressed using the zstd compression
-//    algorithm.
-// 5. The Content-Encoding header value must be "zstd".
+// 3. The Content-Type header value must be "text/x-print-job", or
+//    "text/plain" or "text/x-asa" for raw text jobs (see below).
+// 4. Print directives must be compressed using the zstd compression
+//    algorithm, and the Content-Encoding header value must be "zstd". Raw
+//    text jobs may be uncompressed, or compressed with gzip and a
+//    Content-Encoding header value of "gzip".
+// 5. For raw text jobs, an optional query parameter named "job" is the
+//    job's name, for the job identifier and generated filename.
 // 6. An optional query parameter named "profile" selects the font and paper
 //    style. No profile parameter, or an unknown value, will result in the
-//    default profile. Profile names are *not* case-sensitive.
+//    default profile. Profile names are *not* case-sensitive. If the user
+//    has profile rules that match the job's class, forms or name, they take
+//    precedence over the profile parameter, as does the user's default
+//    profile if they've chosen to always use it. Profiles the user doesn't
+//    allow are replaced with their default profile.
+// 7. An optional X-Print-Job-Info header may contain a JSON object with the
+//    details of the job that the agent found on the JES2 separator pages
+//    (type, number, name, class, forms, programmer, room, user, printer,
+//    system and printed). Invalid details are ignored. Version 2 jobs send
+//    metadata directives instead, and the header is ignored.
 //
 // Print directives:
 //
@@ -82,263 +100,416 @@ import (
 //                  included in the generated filename. If there are multiple
 //                  J: directives, only the last one is used.
 //
+// Version 2 adds:
+//
+// V:2 [fields]   - Header. Must be the first directive. The protocol version
+//                  is followed by optional name=value fields separated by
+//                  spaces describing the client: agent (name/version),
+//                  printer (model, e.g. 1403), width (line width) and
+//                  codepage (of the line data, always UTF-8).
+// M:name=value   - Job metadata, in place of the X-Print-Job-Info header:
+//                  type, number, name, class, forms, programmer, room, user,
+//                  printer, system, or printed (RFC 3339 time). Unknown
+//                  names are ignored.
+// C:n            - Skip to channel n (1-12) of the carriage control tape.
+//                  C:1 is the same as P:. Channel 12 is punched for the
+//                  overflow line; skips to other channels space one line.
+//
+// Version 2 jobs may contain directives this server doesn't know, which are
+// ignored. In version 1 jobs, they are an error.
+//
+// Raw text jobs:
+//
+// Instead of print directives, the request body may be the UTF-8 text of the
+// job. With text/plain, each line prints on its own line, and form feeds
+// start a new page. With text/x-asa, the first character of each line is an
+// ASA carriage control character (' ', '0', '-', '+', '1', or '2'-'9' and
+// 'A'-'C' to skip to channels 2-12). The server converts the text to print
+// directives, the same way the agent does for its input files.
+//
 // Responses:
 //
+// Jobs are added to the print queue, where print workers render and deliver
+// them. The server waits a little while for the job to finish before
+// responding.
+//
+// The response body is a JSON object. For errors, it has the error message
+// (error) and HTTP status code (status). Otherwise, it has the job log ID
+// (job_id), job identifier (job), number of pages (pages), whether the job
+// was ignored as a nuisance job (nuisance), its state in the print queue
+// (state: queued, rendering, delivering, done or failed), the delivery
+// status (delivery: emailed, stored when the user has turned off email
+// delivery, ignored, pending or failed), the reason for the latest failure
+// (error), what's left of the user's quota (quota: jobs, pages and
+// period_hours; left out for users without a quota) and a link to download
+// the PDF (pdf_url) once there is one.
+//
 // 200 - OK
 //       The request was processed successfully and the PDF of the print job
-//       has been sent to the user.
+//       has been sent to the user, or the job was ignored as a nuisance job.
+// 202 - Accepted
+//       The job is in the print queue, and hasn't finished yet. If email
+//       delivery failed, it will be retried.
 // 400 - Bad Request
 //       The server was unable to process the request body due to invalid
 //       print directives (unknown directive or invalid UTF-8 string) or error
 //       during zstd decompression.
 // 401 - Unauthorized
 //       Either the Authorization header is missing from the request, or the
-//       supplied API key is invalid.
+//       supplied API key is invalid or has expired.
+// 403 - Forbidden
+//       The API key may not be used to print, or the user's account is
+//       disabled or their email address hasn't been verified.
 // 405 - Method Not Allowed
 //       Returned when the HTTP request method is not POST.
 // 415 - Unsupported Media Type
-//       Returned when Content-Type is not text/x-print-job or
-//       Content-Encoding is not zstd.
+//       Returned when Content-Type is not text/x-print-job, text/plain or
+//       text/x-asa, or print directives aren't zstd-compressed.
+// 413 - Request Entity Too Large
+//       The compressed job is too large.
 // 429 - Too Many Requests
 //       The user has exceeded their quota of print jobs in a period of time.
 // 500 - Internal Server Error
 //       The virtual 1403 printer experienced a paper jam and is awaiting
-//       operator intervention.
+//       operator intervention, or the job failed.
+// 503 - Service Unavailable
+//       The profile's printer seats are all taken by other jobs in the print
+//       queue. The Retry-After header says how many seconds to wait before
+//       trying again.
 func (a *application) printjob(w http.ResponseWriter, r *http.Request) {
 	// We only accept POST requests.
 	if r.Method != http.MethodPost {
 		w.Header().Set("Allow", http.MethodPost)
-		w.Header().Set("Accept-Encoding", "zstd")
-		w.Header().Set("Accept", "text/x-print-job")
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		setPrintAccept(w)
+		apiError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, ok := a.authenticatePrintRequest(w, r)
+	if !ok {
+		return
+	}
+
+	mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediatype {
+	case "text/x-print-job":
+		// Print directives must be zstd-compressed.
+		if r.Header.Get("Content-Encoding") != "zstd" {
+			setPrintAccept(w)
+			apiError(w, "Requests must use zstd compression",
+				http.StatusUnsupportedMediaType)
+			return
+		}
+		a.processJob(w, r, user, r.Body)
+	case "text/plain", "text/x-asa":
+		a.processTextJob(w, r, user, mediatype == "text/x-asa")
+	default:
+		setPrintAccept(w)
+		apiError(w, "Requests must be of type text/x-print-job, "+
+			"text/plain or text/x-asa", http.StatusUnsupportedMediaType)
+	}
+}
+
+// setPrintAccept sets the headers telling clients which content types and
+// encodings the print API accepts.
+func setPrintAccept(w http.ResponseWriter) {
+	w.Header().Set("Accept-Encoding", "zstd, gzip")
+	w.Header().Set("Accept", "text/x-print-job, text/plain, text/x-asa")
+}
+
+// processTextJob converts a plain text or ASA carriage control print job in
+// the request body to print directives, and adds it to the print queue.
+func (a *application) processTextJob(w http.ResponseWriter, r *http.Request,
+	user model.User, asa bool) {
+
+	text, err := readTextJob(r.Body, r.Header.Get("Content-Encoding"),
+		jobSizeLimit(user))
+	if err == errTextJobTooLarge {
+		apiError(w, "Print job is too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		requestLog(r).Infof("error reading text print job: %v", err)
+		setPrintAccept(w)
+		apiError(w, fmt.Sprintf("Error reading print job: %v", err),
+			http.StatusBadRequest)
+		return
+	}
+
+	job, err := convertTextJob(text, asa, textJobName(r.URL.Query().Get("job")))
+	if err != nil {
+		requestLog(r).Errorf("error converting text print job: %v", err)
+		apiError(w, "Unable to convert print job",
+			http.StatusInternalServerError)
 		return
 	}
+	a.processJob(w, r, user, bytes.NewReader(job))
+}
+
+// authenticatePrintRequest finds the user whose API key is the bearer token
+// in the request's Authorization header. If there isn't one, the key may not
+// be used to print, or the user may not print, it responds with an error and
+// returns false.
+func (a *application) authenticatePrintRequest(w http.ResponseWriter,
+	r *http.Request) (model.User, bool) {
 
 	// Authenticate
 	authHdr := r.Header.Get("Authorization")
 	authHdr = strings.TrimPrefix(authHdr, "Bearer ")
-	user, err := a.db.GetUserForAccessKey(authHdr)
-	if err != nil {
-		log.Printf("INFO:  unauthorized web service call from %s",
+	user, _, err := a.authenticateKey(authHdr, model.ScopePrint)
+	if err == errKeyExpired {
+		apiError(w, "API key has expired", http.StatusUnauthorized)
+		return user, false
+	} else if err == errKeyScope {
+		apiError(w, "API key may not be used to print",
+			http.StatusForbidden)
+		return user, false
+	} else if err != nil {
+		requestLog(r).Infof("unauthorized web service call from %s",
 			r.RemoteAddr)
-		http.Error(w, "Authentication failure", http.StatusUnauthorized)
-		return
+		apiError(w, "Authentication failure", http.StatusUnauthorized)
+		return user, false
 	}
 	if !user.Enabled {
-		http.Error(w, "User's account is disabled", http.StatusForbidden)
-		return
+		apiError(w, "User's account is disabled", http.StatusForbidden)
+		return user, false
 	}
 	if !user.Verified {
-		http.Error(w, "User's email address has not been verified",
+		apiError(w, "User's email address has not been verified",
 			http.StatusForbidden)
-		return
+		return user, false
 	}
+	return user, true
+}
 
-	// Now that we have confirmed this is a valid user, if we are limiting
-	// concurrency of the print service, we will wait until a seat is
-	// available.
-	// TODO: This feature was added to support a font that had a limited number
-	// of concurrent seats in its license terms. We could restrict this to the
-	// profile(s) that use it, but at the moment, performance isn't a problem
-	// waiting for jobs to complete.
-	if a.printerSeats != nil {
-		// Writing to the channel will block if the queue is full.
-		a.printerSeats <- true
-
-		// when this function ends, we release the user's seat
-		defer func() {
-			<-a.printerSeats
-		}()
+// processJob checks the zstd-compressed print directives in body for user,
+// and adds the job to the print queue. The profile parameter and job details
+// are taken from the request r, which the response is written to.
+func (a *application) processJob(w http.ResponseWriter, r *http.Request,
+	user model.User, body io.Reader) {
+
+	log := requestLog(r).With("user", user.Email)
+	result, status, err := a.queueJob(log, user, body,
+		r.URL.Query().Get("profile"), r.Header.Get("X-Print-Job-Info"))
+	if err != nil {
+		if err.retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(err.retryAfter))
+		}
+		apiError(w, err.message, err.code)
+		return
 	}
+	writePrintResult(w, log, status, result)
+}
+
+// jobError is why a print job wasn't queued, with the HTTP status code for
+// the print API's response and, if the client should try again later, the
+// number of seconds to wait.
+type jobError struct {
+	message    string
+	code       int
+	retryAfter int
+}
+
+func (e *jobError) Error() string {
+	return e.message
+}
+
+// queueJob checks the zstd-compressed print directives in body for user,
+// and adds the job to the print queue, with the profile the client asked for
+// and the job details from version 1 clients. We wait a little while for the
+// print workers to finish the job, so that the result can say how it went;
+// if it's taking too long, the result says the job is still in the queue.
+// The HTTP status code for the result is returned with it.
+func (a *application) queueJob(log *logging.Logger, user model.User,
+	body io.Reader, profileName, detailsHeader string) (printResult, int,
+	*jobError) {
 
 	// Enforce quotas
 	if _, _, err := a.checkQuota(user.Email); err == errQuotaExceeded {
-		log.Printf("INFO:  user %s attempted to print over quota", user.Email)
-		http.Error(w, a.quotaString(), http.StatusTooManyRequests)
-		return
+		log.Infof("user attempted to print over quota")
+		return printResult{}, 0, &jobError{message: a.quotaString(),
+			code: http.StatusTooManyRequests}
 	} else if err != nil {
-		log.Printf("ERROR: db error calculating user quota: %v", err)
-		http.Error(w, "internal db error", http.StatusInternalServerError)
-		return
+		log.Errorf("db error calculating user quota: %v", err)
+		return printResult{}, 0, &jobError{message: "internal db error",
+			code: http.StatusInternalServerError}
 	}
 
-	// Content must be zstd-compressed.
-	if r.Header.Get("Content-Encoding") != "zstd" {
-		w.Header().Set("Accept-Encoding", "zstd")
-		w.Header().Set("Accept", "text/x-print-job")
-		http.Error(w, "Requests must use zstd compression",
-			http.StatusUnsupportedMediaType)
-		return
+	// Keep the compressed job to store in the print queue. Unlimited users
+	// are trusted with much larger jobs, but the whole job goes in the
+	// database, so there's still a limit.
+	limit := jobSizeLimit(user)
+	payload, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		log.Infof("error reading print job: %v", err)
+		return printResult{}, 0, &jobError{message: "Error reading print job",
+			code: http.StatusBadRequest}
 	}
-
-	// Content must be of type text/x-print-job.
-	if r.Header.Get("Content-Type") != "text/x-print-job" {
-		w.Header().Set("Accept-Encoding", "zstd")
-		w.Header().Set("Accept", "text/x-print-job")
-		http.Error(w, "Requests must be of type text/x-print-job",
-			http.StatusUnsupportedMediaType)
-		return
+	if int64(len(payload)) > limit {
+		return printResult{}, 0, &jobError{message: "Print job is too large",
+			code: http.StatusRequestEntityTooLarge}
 	}
 
-	// Set up decompressor on the request body.
-	d, err := zstd.NewReader(r.Body)
+	// Set up decompressor on the job, and check its directives now so that
+	// we can tell the client about any problems. We only keep the job's
+	// details; the print workers will read the directives again to print
+	// the job.
+	d, err := zstd.NewReader(bytes.NewReader(payload))
 	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to begin zstd decoding: %v", err),
-			http.StatusBadRequest)
-		return
+		return printResult{}, 0, &jobError{
+			message: fmt.Sprintf("Unable to begin zstd decoding: %v", err),
+			code:    http.StatusBadRequest}
 	}
 	defer d.Close()
+	stream := parsePrintDirectives(d, a.maxLines(user))
+	if err := stream.validate(); err != nil {
+		log.Infof("invalid print directives: %v", err)
+		return printResult{}, 0, &jobError{
+			message: fmt.Sprintf("Invalid data: %v", err),
+			code:    http.StatusBadRequest}
+	}
+	jobinfo := stream.jobinfo
+	if stream.version >= 2 {
+		log.Debugf("protocol version %d from agent %s", stream.version,
+			stream.header["agent"])
+	}
 
-	// Create our virtual printer.
-	profileName := r.URL.Query().Get("profile")
-	log.Printf("INFO:  requested profile: %s", profileName)
-	job, err := vprinter.NewProfile(profileName, a.font, 11.4)
-	if err != nil {
-		log.Printf("ERROR: couldn't create virtual printer: %v", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	// Ignore nuisance jobs
+	if a.isNuisanceJob(user, jobinfo) {
+		// This is a nuisance job, we'll just ignore it.
+		log.With("job", jobinfo).Infof("ignoring nuisance job")
+		return printResult{
+			Job:      jobinfo,
+			Nuisance: true,
+			State:    string(model.JobDone),
+			Delivery: deliveryIgnored,
+			Quota:    a.quotaRemaining(user),
+		}, http.StatusOK, nil
 	}
 
-	// Process the directives in the request body and send them to the
-	// virtual printer.
-	pageQuota := a.quotaPages
-	maxLines := a.maxLinesPerJob
-	// Unlimited users are trusted and we apply no limits
-	if user.Unlimited {
-		pageQuota = 0
-		maxLines = 0
+	// Version 2 sends the job details as metadata directives, version 1
+	// in a header.
+	var details *model.JobInfo
+	if stream.version >= 2 {
+		details = cleanJobDetails(stream.details)
+	} else {
+		details, err = parseJobDetails(detailsHeader)
+		if err != nil {
+			log.Infof("ignoring invalid job details: %v", err)
+		}
 	}
-	jobinfo, err := processPrintDirectives(d, job, pageQuota,
-		maxLines)
+
+	log.Infof("requested profile: %s", profileName)
+	if chosen := userProfile(user, profileName, details); chosen !=
+		profileName {
+		log.Infof("user's profile preferences chose profile: %s", chosen)
+		profileName = chosen
+	}
+
+	// Some profiles may only have a limited number of jobs in the queue at
+	// once. If the profile's seats are all taken for too long, the client
+	// should try again later.
+	seat, ok := a.seats.acquire(profileName, a.seatWait)
+	if !ok {
+		log.Infof("no printer seat available for profile %s", profileName)
+		return printResult{}, 0, &jobError{
+			message: fmt.Sprintf("The printer for profile %s is busy; "+
+				"please try again later",
+				vprinter.CanonicalProfile(profileName)),
+			code:       http.StatusServiceUnavailable,
+			retryAfter: seatRetryAfter}
+	}
+
+	id, err := a.db.QueueJob(user.Email, jobinfo, details, profileName,
+		payload)
 	if err != nil {
-		log.Printf("INFO:  invalid print directives from %s: %v",
-			user.Email, err)
-		http.Error(w, fmt.Sprintf("Invalid data: %v", err),
-			http.StatusBadRequest)
-		return
+		a.seats.release(seat)
+		log.Errorf("couldn't queue job: %v", err)
+		return printResult{}, 0, &jobError{message: "internal db error",
+			code: http.StatusInternalServerError}
 	}
+	log.With("job", jobinfo, "job_id", id).Infof("queued job")
 
-	// Unless user allows them, ignore nuisance jobs
-	if !user.AllowNuisanceJobs {
-		for i := range a.nuisanceJobs {
-			if a.nuisanceJobs[i].MatchString(jobinfo) {
-				// This is a nuisance job, we'll just ignore it.
-				log.Printf("IFNO:  ignoring job %s from %s",
-					jobinfo, user.Email)
-				return // will just return empty HTTP 200 OK
-			}
+	job, ok := a.queue.submitAndWait(id, seat, a.jobWait)
+	if !ok {
+		// The job will still be in its last state in the database.
+		if job, err = a.db.GetJob(id); err != nil {
+			log.Errorf("couldn't get queued job: %v", err)
+			return printResult{}, 0, &jobError{message: "internal db error",
+				code: http.StatusInternalServerError}
 		}
 	}
 
-	// Create the PDF
-	var pdfBuffer bytes.Buffer
-	var pagecount int
-	if pagecount, err = job.EndJob(&pdfBuffer); err != nil {
-		log.Printf("ERROR: couldn't create PDF: %v", err)
-		http.Error(w, fmt.Sprintf("error creating PDF: %v", err),
-			http.StatusInternalServerError)
-		return
+	result := printResult{
+		JobID:    job.ID,
+		Job:      job.JobInfo,
+		Pages:    job.Pages,
+		State:    string(job.State),
+		Delivery: deliveryPending,
+		Error:    job.Error,
+		Quota:    a.quotaRemaining(user),
 	}
-
-	jobtag := jobinfo
-	if jobtag != "" {
-		jobtag = jobtag + "-"
+	if job.HasPDF {
+		result.PDFURL = a.pdfURL(job.ID)
 	}
-	jobname := fmt.Sprintf("%s%s", jobtag,
-		time.Now().UTC().Format("2006-01-02T15:04:05Z"))
-
-	if !user.DisableEmailDelivery {
-		attachmentName := fmt.Sprintf("virtual1403_%s.pdf", jobname)
-
-		err = mailer.Send(a.mailconfig, user.Email,
-			"Virtual 1403 printout "+jobinfo,
-			"The intern in the machine room has carefully collated your job and "+
-				"prepared it for delivery. Please find it attached to this "+
-				"message.\r\n\r\n"+
-				"The font used in some PDFs is 1403 Vintage Mono from "+
-				"Slanted Hall, used under license.\r\n",
-			attachmentName, pdfBuffer.Bytes())
-		if err != nil {
-			log.Printf("ERROR: error sending email: %v", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	status := http.StatusAccepted
+	switch job.State {
+	case model.JobDone:
+		status = http.StatusOK
+		result.Delivery = deliveryEmailed
+		if user.DisableEmailDelivery {
+			result.Delivery = deliveryStored
 		}
-
-		log.Printf("INFO:  sent %d pages to %s", pagecount, user.Email)
-	} else {
-		log.Printf("INFO:  processed %d pages for %s", pagecount, user.Email)
+	case model.JobFailed:
+		status = http.StatusInternalServerError
+		result.Delivery = deliveryFailed
 	}
+	return result, status, nil
+}
 
-	// Try to log the job to the database
-	if err = a.db.LogJob(user.Email, jobinfo, pagecount,
-		pdfBuffer.Bytes()); err != nil {
-		log.Printf("ERROR: couldn't log job: %v", err)
+// maxLines returns the most print directives allowed in one of user's jobs,
+// or 0 if there's no limit.
+func (a *application) maxLines(user model.User) int {
+	// Unlimited users are trusted and we apply no limits
+	if user.Unlimited {
+		return 0
 	}
-
-	// HTTP 200 will be returned if we make it this far.
+	return a.maxLinesPerJob
 }
 
-// jobInfoRegex matches valid/allowed job info data
-var jobInfoRegex = regexp.MustCompile(`^[a-zA-z0-9_]{0,25}$`)
-
-// processPrintDirectives will apply print directives to the virtual printer
-// job, returning an error if the input data is invalid. Processing will stop
-// after maxpages if maxpages > 0 or after maxlines if maxlines > 0.
-func processPrintDirectives(r io.Reader, job vprinter.Job,
-	maxpages, maxlines int) (string, error) {
-
-	var jobinfo string
-	var lines int
-	scanner := bufio.NewScanner(r)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-		if len(line) < 2 {
-			return "", errors.New("line received without directive")
-		}
-		directive := line[0:2]
-		param := line[2:]
+// maxJobDetailLen is the most runes we keep in each field of the job details.
+const maxJobDetailLen = 40
 
-		// In all cases, param must be a valid UTF-8 string <= 132 runes, so
-		// we'll take care of that now.
-		if !utf8.ValidString(param) {
-			return "", errors.New("invalid UTF-8 string")
-		}
+// parseJobDetails parses the job details that the agent sends in the
+// X-Print-Job-Info header. It returns nil if there aren't any details.
+func parseJobDetails(header string) (*model.JobInfo, error) {
+	if header == "" {
+		return nil, nil
+	}
 
-		// Trim to 132 runes
-		param = trimToRuneLen(param, 132)
-
-		var pages int
-		switch directive {
-		case "L:":
-			pages = job.AddLine(param, true)
-		case "O:":
-			pages = job.AddLine(param, false)
-		case "P:":
-			pages = job.NewPage()
-		case "J:":
-			if !jobInfoRegex.MatchString(param) {
-				return "", errors.New("invalid job data directive")
-			}
-			jobinfo = param
-		default:
-			return "", errors.New("invalid directive received")
-		}
-		lines++
+	var details model.JobInfo
+	if err := json.Unmarshal([]byte(header), &details); err != nil {
+		return nil, err
+	}
+	return cleanJobDetails(details), nil
+}
 
-		if maxpages > 0 && pages > maxpages {
-			break
-		}
-		if maxlines > 0 && lines > maxlines {
-			break
-		}
+// cleanJobDetails trims the fields of job details from a client to a
+// reasonable length of valid UTF-8. It returns nil if there aren't any
+// details.
+func cleanJobDetails(details model.JobInfo) *model.JobInfo {
+	for _, field := range []*string{&details.Type, &details.Number,
+		&details.Name, &details.Class, &details.Forms, &details.Programmer,
+		&details.Room, &details.User, &details.Printer, &details.System} {
+
+		*field = trimToRuneLen(strings.ToValidUTF8(
+			strings.TrimSpace(*field), ""), maxJobDetailLen)
 	}
-	if err := scanner.Err(); err != nil {
-		return "", err
+
+	if details == (model.JobInfo{}) {
+		return nil
 	}
-	return jobinfo, nil
+	return &details
 }
 
 // trimToRuneLen trims the input string, str, to no more than n runes. The
@@ -0,0 +1,143 @@
+package main
+
+// Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"github.com/racingmars/virtual1403/logging"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+// The delivery status of a print job in a printResult.
+const (
+	// deliveryEmailed means the PDF was sent to the user by email.
+	deliveryEmailed = "emailed"
+
+	// deliveryStored means the user has turned off email delivery, so the
+	// PDF is only available from the web site.
+	deliveryStored = "stored"
+
+	// deliveryIgnored means the job was a nuisance job, and wasn't printed.
+	deliveryIgnored = "ignored"
+
+	// deliveryPending means the job is still in the print queue.
+	deliveryPending = "pending"
+
+	// deliveryFailed means the job couldn't be rendered or delivered.
+	deliveryFailed = "failed"
+)
+
+// printResult is the JSON response body of the print API when a job has
+// been processed.
+type printResult struct {
+	// JobID is the job's ID in the job log, if it was logged.
+	JobID uint64 `json:"job_id,omitempty"`
+
+	// Job is the job's identifier from the J: directive.
+	Job string `json:"job,omitempty"`
+
+	Pages    int    `json:"pages"`
+	Nuisance bool   `json:"nuisance"`
+	State    string `json:"state"`
+	Delivery string `json:"delivery"`
+
+	// Error is why the job failed, or why the last delivery attempt failed
+	// if it will be retried.
+	Error string `json:"error,omitempty"`
+
+	// Quota is what the user has left of their quota, or nil if they have
+	// no quota.
+	Quota *quotaRemaining `json:"quota,omitempty"`
+
+	// PDFURL is a link to download the PDF, which works without logging in
+	// until the PDF is cleaned up.
+	PDFURL string `json:"pdf_url,omitempty"`
+}
+
+// quotaRemaining is how many jobs and pages a user may still print in the
+// current quota period. Jobs or pages is nil if there's no quota for it.
+type quotaRemaining struct {
+	Jobs        *int `json:"jobs,omitempty"`
+	Pages       *int `json:"pages,omitempty"`
+	PeriodHours int  `json:"period_hours"`
+}
+
+// apiErrorResponse is the JSON response body of the print API for errors.
+type apiErrorResponse struct {
+	Error  string `json:"error"`
+	Status int    `json:"status"`
+}
+
+// quotaRemaining returns what user has left of their quota, or nil if they
+// don't have one.
+func (a *application) quotaRemaining(user model.User) *quotaRemaining {
+	if user.Unlimited || (a.quotaJobs <= 0 && a.quotaPages <= 0) {
+		return nil
+	}
+	jobs, pages, err := a.checkQuota(user.Email)
+	if err != nil && err != errQuotaExceeded {
+		return nil
+	}
+
+	remaining := func(quota, used int) *int {
+		if quota <= 0 {
+			return nil
+		}
+		left := quota - used
+		if left < 0 {
+			left = 0
+		}
+		return &left
+	}
+	return &quotaRemaining{
+		Jobs:        remaining(a.quotaJobs, jobs),
+		Pages:       remaining(a.quotaPages, pages),
+		PeriodHours: int(a.quotaPeriod.Hours()),
+	}
+}
+
+// pdfURL returns the link to download the PDF of the job log entry id.
+func (a *application) pdfURL(id uint64) string {
+	return a.serverBaseURL + "/pdf?sharekey=" +
+		url.QueryEscape(a.pdfShareKey(id))
+}
+
+// writePrintResult sends result as the response to a print API request,
+// with the HTTP status code.
+func writePrintResult(w http.ResponseWriter, log *logging.Logger, code int,
+	result printResult) {
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(&result); err != nil {
+		log.Warnf("couldn't send print result: %v", err)
+	}
+}
+
+// apiError responds to a print API request with an error in a JSON
+// apiErrorResponse, the print API's equivalent of http.Error.
+func apiError(w http.ResponseWriter, message string, code int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&apiErrorResponse{Error: message, Status: code})
+}
@@ -0,0 +1,553 @@
+// Package qrcode generates QR codes for the short strings, such as otpauth
+// URIs, that the web UI needs to show. It only supports byte mode data at
+// error correction level M in versions 1 through 10.
+package qrcode
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+)
+
+// ErrTooLong is returned when the data doesn't fit in the largest QR code
+// version we support.
+var ErrTooLong = errors.New("data too long for QR code")
+
+// quietZone is the width, in modules, of the light border around the code.
+const quietZone = 4
+
+// version describes the error correction block structure of a QR code
+// version at error correction level M.
+type version struct {
+	ecPerBlock int
+	blocks1    int // number of blocks in group 1
+	data1      int // data codewords per block in group 1
+	blocks2    int // number of blocks in group 2
+	data2      int // data codewords per block in group 2
+	alignment  []int
+}
+
+// versions is indexed by version number - 1.
+var versions = []version{
+	{10, 1, 16, 0, 0, nil},
+	{16, 1, 28, 0, 0, []int{6, 18}},
+	{26, 1, 44, 0, 0, []int{6, 22}},
+	{18, 2, 32, 0, 0, []int{6, 26}},
+	{24, 2, 43, 0, 0, []int{6, 30}},
+	{16, 4, 27, 0, 0, []int{6, 34}},
+	{18, 4, 31, 0, 0, []int{6, 22, 38}},
+	{22, 2, 38, 2, 39, []int{6, 24, 42}},
+	{22, 3, 36, 2, 37, []int{6, 26, 46}},
+	{26, 4, 43, 1, 44, []int{6, 28, 50}},
+}
+
+func (v version) dataCodewords() int {
+	return v.blocks1*v.data1 + v.blocks2*v.data2
+}
+
+// Code is an encoded QR code.
+type Code struct {
+	// Size is the width and height of the code in modules, not including
+	// the quiet zone.
+	Size int
+
+	modules  [][]bool // true is dark; indexed [y][x]
+	function [][]bool // true for modules that aren't data
+}
+
+// Dark reports whether the module at column x, row y is dark.
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Encode returns the smallest QR code holding data.
+func Encode(data []byte) (*Code, error) {
+	for i, v := range versions {
+		number := i + 1
+		countBits := 8
+		if number >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+len(data)*8 > v.dataCodewords()*8 {
+			continue
+		}
+
+		codewords := addErrorCorrection(v,
+			encodeData(v, countBits, data))
+
+		// Try each mask and keep the one with the lowest penalty.
+		var best *Code
+		bestPenalty := -1
+		for mask := 0; mask < 8; mask++ {
+			c := build(number, v, codewords, mask)
+			if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+				best, bestPenalty = c, p
+			}
+		}
+		return best, nil
+	}
+
+	return nil, ErrTooLong
+}
+
+// PNG renders the code, with its quiet zone, as a PNG image with each module
+// scale pixels square.
+func (c *Code) PNG(scale int) ([]byte, error) {
+	width := (c.Size + 2*quietZone) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width),
+		color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetColorIndex((x+quietZone)*scale+px,
+						(y+quietZone)*scale+py, 1)
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeData returns the data codewords for data in byte mode, padded to
+// the capacity of version v.
+func encodeData(v version, countBits int, data []byte) []byte {
+	var bits bitBuffer
+	bits.append(0x4, 4) // byte mode
+	bits.append(uint(len(data)), countBits)
+	for _, b := range data {
+		bits.append(uint(b), 8)
+	}
+
+	capacity := v.dataCodewords() * 8
+	terminator := capacity - len(bits)
+	if terminator > 4 {
+		terminator = 4
+	}
+	bits.append(0, terminator)
+	bits.append(0, (8-len(bits)%8)%8)
+
+	result := bits.bytes()
+	for pad := byte(0xec); len(result) < v.dataCodewords(); pad ^= 0xec ^ 0x11 {
+		result = append(result, pad)
+	}
+	return result
+}
+
+// addErrorCorrection splits the data codewords into blocks, calculates the
+// error correction codewords for each, and returns the final interleaved
+// sequence of codewords.
+func addErrorCorrection(v version, data []byte) []byte {
+	var blocks, ecc [][]byte
+	generator := rsGenerator(v.ecPerBlock)
+	for i := 0; i < v.blocks1+v.blocks2; i++ {
+		size := v.data1
+		if i >= v.blocks1 {
+			size = v.data2
+		}
+		blocks = append(blocks, data[:size])
+		ecc = append(ecc, rsRemainder(data[:size], generator))
+		data = data[size:]
+	}
+
+	var result []byte
+	for i := 0; i < v.data1 || i < v.data2; i++ {
+		for _, block := range blocks {
+			if i < len(block) {
+				result = append(result, block[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, block := range ecc {
+			result = append(result, block[i])
+		}
+	}
+	return result
+}
+
+// build lays out the function patterns and codewords of a code with the
+// given mask applied.
+func build(number int, v version, codewords []byte, mask int) *Code {
+	c := &Code{Size: number*4 + 17}
+	c.modules = make([][]bool, c.Size)
+	c.function = make([][]bool, c.Size)
+	for y := range c.modules {
+		c.modules[y] = make([]bool, c.Size)
+		c.function[y] = make([]bool, c.Size)
+	}
+
+	// Timing patterns
+	for i := 0; i < c.Size; i++ {
+		c.setFunction(6, i, i%2 == 0)
+		c.setFunction(i, 6, i%2 == 0)
+	}
+
+	// Finder patterns, with their separators
+	c.drawFinder(3, 3)
+	c.drawFinder(c.Size-4, 3)
+	c.drawFinder(3, c.Size-4)
+
+	// Alignment patterns, except where they would overlap the finders
+	last := len(v.alignment) - 1
+	for i, x := range v.alignment {
+		for j, y := range v.alignment {
+			if (i == 0 && j == 0) || (i == 0 && j == last) ||
+				(i == last && j == 0) {
+				continue
+			}
+			c.drawAlignment(x, y)
+		}
+	}
+
+	// Reserve the format areas before placing data; drawFormat fills them
+	// in once the data has been masked.
+	c.drawFormat(0)
+	if number >= 7 {
+		c.drawVersion(number)
+	}
+
+	c.drawCodewords(codewords)
+	c.applyMask(mask)
+	c.drawFormat(mask)
+
+	return c
+}
+
+func (c *Code) setFunction(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+// drawFinder draws a finder pattern and its separator centered on x, y.
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			dist := max(abs(dx), abs(dy))
+			c.setFunction(xx, yy, dist != 2 && dist != 4)
+		}
+	}
+}
+
+// drawAlignment draws an alignment pattern centered on x, y.
+func (c *Code) drawAlignment(x, y int) {
+	for dy := -2; dy <= 2; dy++ {
+		for dx := -2; dx <= 2; dx++ {
+			c.setFunction(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for error
+// correction level M and mask.
+func (c *Code) drawFormat(mask int) {
+	data := uint(mask) // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+
+	bit := func(i int) bool { return (bits>>uint(i))&1 != 0 }
+
+	// Around the top left finder
+	for i := 0; i <= 5; i++ {
+		c.setFunction(8, i, bit(i))
+	}
+	c.setFunction(8, 7, bit(6))
+	c.setFunction(8, 8, bit(7))
+	c.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.setFunction(14-i, 8, bit(i))
+	}
+
+	// Split between the other two finders
+	for i := 0; i < 8; i++ {
+		c.setFunction(c.Size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.setFunction(8, c.Size-15+i, bit(i))
+	}
+	c.setFunction(8, c.Size-8, true) // always dark
+}
+
+// drawVersion draws both copies of the version information, which is only
+// present in version 7 and up.
+func (c *Code) drawVersion(number int) {
+	rem := uint(number)
+	for i := 0; i < 12; i++ {
+		rem = (rem << 1) ^ ((rem >> 11) * 0x1f25)
+	}
+	bits := uint(number)<<12 | rem
+
+	for i := 0; i < 18; i++ {
+		dark := (bits>>uint(i))&1 != 0
+		a, b := c.Size-11+i%3, i/3
+		c.setFunction(a, b, dark)
+		c.setFunction(b, a, dark)
+	}
+}
+
+// drawCodewords places the codewords in the zigzag pattern of two-module
+// wide columns, skipping function modules. Any remainder bits are left
+// light.
+func (c *Code) drawCodewords(codewords []byte) {
+	i := 0
+	for right := c.Size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			// Skip the vertical timing pattern
+			right = 5
+		}
+		for vert := 0; vert < c.Size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					// Moving upward
+					y = c.Size - 1 - vert
+				}
+				if c.function[y][x] || i >= len(codewords)*8 {
+					continue
+				}
+				c.modules[y][x] = (codewords[i/8]>>(7-uint(i%8)))&1 != 0
+				i++
+			}
+		}
+	}
+}
+
+// applyMask flips the data modules selected by mask.
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the code using the rules from the QR code specification;
+// the mask producing the lowest score is the one readers cope with best.
+func (c *Code) penalty() int {
+	result := 0
+
+	// Runs of five or more same-colored modules in a row or column, and
+	// patterns that look like finders.
+	for i := 0; i < c.Size; i++ {
+		row := make([]bool, c.Size)
+		col := make([]bool, c.Size)
+		for j := 0; j < c.Size; j++ {
+			row[j] = c.modules[i][j]
+			col[j] = c.modules[j][i]
+		}
+		result += linePenalty(row) + linePenalty(col)
+	}
+
+	// 2x2 blocks of the same color
+	dark := 0
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x < c.Size-1 && y < c.Size-1 &&
+				c.modules[y][x] == c.modules[y][x+1] &&
+				c.modules[y][x] == c.modules[y+1][x] &&
+				c.modules[y][x] == c.modules[y+1][x+1] {
+				result += 3
+			}
+		}
+	}
+
+	// Imbalance between dark and light modules, in 5% steps away from 50%
+	total := c.Size * c.Size
+	result += abs(dark*20-total*10) / total * 10
+
+	return result
+}
+
+// finderLike is the 1:1:3:1:1 dark:light:dark:light:dark pattern of a
+// finder, which is penalized when it appears next to four light modules.
+var finderLike = []bool{true, false, true, true, true, false, true}
+
+func linePenalty(line []bool) int {
+	result := 0
+
+	run := 1
+	for i := 1; i <= len(line); i++ {
+		if i < len(line) && line[i] == line[i-1] {
+			run++
+			continue
+		}
+		if run >= 5 {
+			result += 3 + run - 5
+		}
+		run = 1
+	}
+
+	// Modules beyond the edge of the code count as light.
+	light := func(i int) bool { return i < 0 || i >= len(line) || !line[i] }
+	for i := 0; i+len(finderLike) <= len(line); i++ {
+		match := true
+		for j, dark := range finderLike {
+			if line[i+j] != dark {
+				match = false
+				break
+			}
+		}
+		if !match {
+			continue
+		}
+		before, after := true, true
+		for j := 1; j <= 4; j++ {
+			before = before && light(i-j)
+			after = after && light(i+len(finderLike)-1+j)
+		}
+		if before {
+			result += 40
+		}
+		if after {
+			result += 40
+		}
+	}
+
+	return result
+}
+
+// gfExp and gfLog are exponent and logarithm tables for GF(256) with the
+// QR code polynomial x^8 + x^4 + x^3 + x^2 + 1.
+var gfExp, gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = x
+		gfLog[x] = i
+		x <<= 1
+		if x >= 256 {
+			x ^= 0x11d
+		}
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return byte(gfExp[(gfLog[a]+gfLog[b])%255])
+}
+
+// rsGenerator returns the coefficients, highest degree first, of the
+// Reed-Solomon generator polynomial for n error correction codewords.
+func rsGenerator(n int) []byte {
+	result := []byte{1}
+	for i := 0; i < n; i++ {
+		// Multiply by (x - a^i)
+		next := make([]byte, len(result)+1)
+		for j, coef := range result {
+			next[j] ^= coef
+			next[j+1] ^= gfMul(coef, byte(gfExp[i]))
+		}
+		result = next
+	}
+	return result
+}
+
+// rsRemainder returns the error correction codewords for data.
+func rsRemainder(data, generator []byte) []byte {
+	result := make([]byte, len(generator)-1)
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i := range result {
+			result[i] ^= gfMul(generator[i+1], factor)
+		}
+	}
+	return result
+}
+
+// bitBuffer accumulates a sequence of bits, most significant first.
+type bitBuffer []bool
+
+func (b *bitBuffer) append(value uint, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, (value>>uint(i))&1 != 0)
+	}
+}
+
+func (b bitBuffer) bytes() []byte {
+	result := make([]byte, (len(b)+7)/8)
+	for i, bit := range b {
+		if bit {
+			result[i/8] |= 0x80 >> uint(i%8)
+		}
+	}
+	return result
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,101 @@
+package qrcode
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"image/png"
+	"testing"
+)
+
+func TestEncodeSize(t *testing.T) {
+	// Byte mode capacity at level M is 14 bytes for version 1 and 213 bytes
+	// for version 10.
+	cases := []struct {
+		length int
+		size   int
+	}{
+		{1, 21},
+		{14, 21},
+		{15, 25},
+		{122, 45},
+		{123, 49},
+		{213, 57},
+	}
+
+	for _, tc := range cases {
+		c, err := Encode(bytes.Repeat([]byte("a"), tc.length))
+		if err != nil {
+			t.Errorf("length %d: %v", tc.length, err)
+			continue
+		}
+		if c.Size != tc.size {
+			t.Errorf("length %d: got size %d, expected %d", tc.length,
+				c.Size, tc.size)
+		}
+	}
+
+	if _, err := Encode(bytes.Repeat([]byte("a"), 214)); err != ErrTooLong {
+		t.Errorf("214 bytes: got %v, expected %v", err, ErrTooLong)
+	}
+}
+
+func TestFormatCopies(t *testing.T) {
+	c, err := Encode([]byte("otpauth://totp/Example:user?secret=abcdefgh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The two copies of the format information must agree.
+	var first, second []bool
+	for i := 0; i <= 5; i++ {
+		first = append(first, c.Dark(8, i))
+	}
+	first = append(first, c.Dark(8, 7), c.Dark(8, 8), c.Dark(7, 8))
+	for i := 9; i < 15; i++ {
+		first = append(first, c.Dark(14-i, 8))
+	}
+	for i := 0; i < 8; i++ {
+		second = append(second, c.Dark(c.Size-1-i, 8))
+	}
+	for i := 8; i < 15; i++ {
+		second = append(second, c.Dark(8, c.Size-15+i))
+	}
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("format bit %d differs between copies", i)
+		}
+	}
+
+	if !c.Dark(8, c.Size-8) {
+		t.Errorf("dark module is light")
+	}
+
+	data, err := c.PNG(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := img.Bounds().Dx(); w != (c.Size+2*quietZone)*2 {
+		t.Errorf("got image width %d", w)
+	}
+}
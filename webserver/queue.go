@@ -0,0 +1,376 @@
+package main
+
+// Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/racingmars/virtual1403/logging"
+	"github.com/racingmars/virtual1403/scanner"
+	"github.com/racingmars/virtual1403/vprinter"
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/mailer"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+// defaultPrintWorkers is the number of print workers if the configuration
+// doesn't limit concurrent print jobs.
+const defaultPrintWorkers = 4
+
+// maxDeliveryAttempts is how many times we try to email a job before giving
+// up on it.
+const maxDeliveryAttempts = 5
+
+// printQueue runs the print workers, which render and deliver the jobs in
+// the database's print queue. The queue of job IDs waiting for a worker is
+// kept in memory; the jobs themselves are in the database, so that they
+// survive a server restart.
+type printQueue struct {
+	app     *application
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []uint64
+
+	// waiters are the channels of print API requests waiting for a job to
+	// finish, by job ID.
+	waiters map[uint64][]chan model.JobLogEntry
+
+	// seats are the seats that jobs took from the app's seat pools when
+	// they were queued, by job ID, which are given back once the job is
+	// rendered.
+	seats map[uint64]chan struct{}
+}
+
+func newPrintQueue(app *application) *printQueue {
+	q := &printQueue{
+		app:     app,
+		waiters: make(map[uint64][]chan model.JobLogEntry),
+		seats:   make(map[uint64]chan struct{}),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// start starts the print workers, and queues up the jobs that were still in
+// the print queue when the server last stopped.
+func (q *printQueue) start(workers int) error {
+	jobs, err := q.app.db.GetQueuedJobs()
+	if err != nil {
+		return err
+	}
+	if len(jobs) > 0 {
+		logger.Infof("resuming %d jobs in the print queue", len(jobs))
+	}
+
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	go q.resume(jobs)
+	return nil
+}
+
+// resume submits the jobs that were in the print queue at startup, in order.
+// Jobs that haven't been rendered need a seat from the app's seat pools,
+// like jobs that are queued by the print API. They were accepted before the
+// restart, so rather than giving up on them we wait as long as it takes.
+func (q *printQueue) resume(jobs []model.JobLogEntry) {
+	for _, job := range jobs {
+		if job.State == model.JobQueued || job.State == model.JobRendering {
+			if seat := q.app.seats.wait(job.Profile); seat != nil {
+				q.mu.Lock()
+				q.seats[job.ID] = seat
+				q.mu.Unlock()
+			}
+		}
+		q.submit(job.ID)
+	}
+}
+
+// submit adds the job id to the queue for the next available worker.
+func (q *printQueue) submit(id uint64) {
+	q.mu.Lock()
+	q.pending = append(q.pending, id)
+	q.mu.Unlock()
+	q.cond.Signal()
+}
+
+// submitAndWait submits the job id, which holds seat from the app's seat
+// pools (nil if it didn't need one), and waits up to timeout for a worker to
+// finish it or to fail an attempt to deliver it. If it does, the job is
+// returned with ok true.
+func (q *printQueue) submitAndWait(id uint64, seat chan struct{},
+	timeout time.Duration) (job model.JobLogEntry, ok bool) {
+
+	ch := make(chan model.JobLogEntry, 1)
+	q.mu.Lock()
+	q.waiters[id] = append(q.waiters[id], ch)
+	if seat != nil {
+		q.seats[id] = seat
+	}
+	q.mu.Unlock()
+	q.submit(id)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case job = <-ch:
+		return job, true
+	case <-timer.C:
+	}
+
+	// We've given up waiting.
+	q.mu.Lock()
+	waiters := q.waiters[id]
+	for i := range waiters {
+		if waiters[i] == ch {
+			q.waiters[id] = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(q.waiters[id]) == 0 {
+		delete(q.waiters, id)
+	}
+	q.mu.Unlock()
+	return job, false
+}
+
+// notify tells anyone waiting for job how it went.
+func (q *printQueue) notify(job model.JobLogEntry) {
+	q.mu.Lock()
+	waiters := q.waiters[job.ID]
+	delete(q.waiters, job.ID)
+	q.mu.Unlock()
+	for _, ch := range waiters {
+		ch <- job
+	}
+}
+
+// releaseSeat gives back the seat that job id held while it was waiting to
+// be rendered, if it had one.
+func (q *printQueue) releaseSeat(id uint64) {
+	q.mu.Lock()
+	seat, ok := q.seats[id]
+	delete(q.seats, id)
+	q.mu.Unlock()
+	if ok {
+		q.app.seats.release(seat)
+	}
+}
+
+// next waits for a job in the queue, and returns its ID.
+func (q *printQueue) next() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.pending) == 0 {
+		q.cond.Wait()
+	}
+	id := q.pending[0]
+	q.pending = q.pending[1:]
+	return id
+}
+
+func (q *printQueue) worker() {
+	for {
+		q.process(q.next())
+	}
+}
+
+// process moves the job id along to its next state: a queued job is
+// rendered and then delivered, and a job that is waiting to be delivered
+// again after a failed attempt is delivered.
+func (q *printQueue) process(id uint64) {
+	log := logger.With("job_id", id)
+	// Once we've rendered the job (or found that we can't), its seat is
+	// free for another job. We give it back as soon as the job is rendered,
+	// and make sure it's given back here otherwise.
+	defer q.releaseSeat(id)
+
+	job, err := q.app.db.GetJob(id)
+	if err == db.ErrNotFound {
+		// The user has been deleted.
+		log.Infof("job is no longer in the job log")
+		return
+	} else if err != nil {
+		log.Errorf("couldn't get job, will try again later: %v", err)
+		time.AfterFunc(time.Minute, func() { q.submit(id) })
+		return
+	}
+	log = log.With("user", job.Email, "job", job.JobInfo)
+
+	user, err := q.app.db.GetUser(job.Email)
+	if err != nil {
+		q.fail(job, log, fmt.Errorf("couldn't get user: %v", err))
+		return
+	}
+
+	switch job.State {
+	case model.JobQueued, model.JobRendering:
+		job.State = model.JobRendering
+		q.update(job, log)
+
+		pdf, pages, err := q.app.renderJob(job, user, log)
+		q.releaseSeat(id)
+		if err != nil {
+			q.fail(job, log, err)
+			return
+		}
+		if err := q.app.db.SaveJobPDF(job.ID, pages, pdf); err != nil {
+			q.fail(job, log, fmt.Errorf("couldn't save PDF: %v", err))
+			return
+		}
+		job.Pages = pages
+		job.HasPDF = len(pdf) > 0
+		job.State = model.JobDelivering
+		q.deliver(job, user, pdf, log)
+	case model.JobDelivering:
+		pdf, err := q.app.db.GetPDF(job.ID)
+		if err != nil {
+			q.fail(job, log, fmt.Errorf("couldn't get PDF: %v", err))
+			return
+		}
+		q.deliver(job, user, pdf, log)
+	default:
+		// Already finished; someone submitted it twice.
+		q.notify(job)
+	}
+}
+
+// deliver emails the job's PDF to the user, unless they've turned off email
+// delivery. If sending the email fails, we try again later, waiting longer
+// after each attempt, until we've made maxDeliveryAttempts.
+func (q *printQueue) deliver(job model.JobLogEntry, user model.User,
+	pdf []byte, log *logging.Logger) {
+
+	if user.DisableEmailDelivery {
+		log.Infof("processed %d pages", job.Pages)
+		q.done(job, log)
+		return
+	}
+
+	attachmentName := pdfFileName(user, job, "2006-01-02T15:04:05Z")
+
+	err := mailer.Send(q.app.mailconfig, user.Email, emailSubject(user, job),
+		"The intern in the machine room has carefully collated your job "+
+			"and prepared it for delivery. Please find it attached to this "+
+			"message.\r\n\r\n"+
+			"The font used in some PDFs is 1403 Vintage Mono from "+
+			"Slanted Hall, used under license.\r\n",
+		attachmentName, pdf)
+	if err != nil {
+		job.Attempts++
+		if job.Attempts >= maxDeliveryAttempts {
+			log.Errorf("error sending email, giving up after %d attempts: %v",
+				job.Attempts, err)
+			q.fail(job, log, err)
+			return
+		}
+
+		delay := time.Duration(job.Attempts*job.Attempts) * time.Minute
+		log.Warnf("error sending email, will try again in %s: %v", delay,
+			err)
+		job.Error = err.Error()
+		q.update(job, log)
+		q.notify(job)
+		time.AfterFunc(delay, func() { q.submit(job.ID) })
+		return
+	}
+
+	log.Infof("sent %d pages", job.Pages)
+	q.done(job, log)
+}
+
+// update saves the job's new state.
+func (q *printQueue) update(job model.JobLogEntry, log *logging.Logger) {
+	if err := q.app.db.UpdateJob(job); err != nil {
+		log.Errorf("couldn't update job state: %v", err)
+	}
+}
+
+// done finishes a job that was delivered.
+func (q *printQueue) done(job model.JobLogEntry, log *logging.Logger) {
+	job.State = model.JobDone
+	job.Error = ""
+	q.update(job, log)
+	q.notify(job)
+}
+
+// fail finishes a job that can't be rendered or delivered.
+func (q *printQueue) fail(job model.JobLogEntry, log *logging.Logger,
+	err error) {
+
+	log.Errorf("job failed: %v", err)
+	job.State = model.JobFailed
+	job.Error = err.Error()
+	q.update(job, log)
+	q.notify(job)
+}
+
+// renderJob prints a queued job's print directives for user, and returns
+// the PDF and number of pages.
+func (a *application) renderJob(job model.JobLogEntry, user model.User,
+	log *logging.Logger) ([]byte, int, error) {
+
+	payload, err := a.db.GetJobPayload(job.ID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't get print directives: %v", err)
+	}
+	d, err := zstd.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, 0, fmt.Errorf("unable to begin zstd decoding: %v", err)
+	}
+	defer d.Close()
+	// The directives were checked when the job was queued.
+	stream := parseValidatedDirectives(d, a.maxLines(user))
+
+	// Create our virtual printer.
+	printer, err := vprinter.NewProfile(job.Profile, a.font, 11.4)
+	if err != nil {
+		return nil, 0, fmt.Errorf("couldn't create virtual printer: %v", err)
+	}
+
+	// Leave out or restyle the JES2 separator pages if the user prefers.
+	separators, err := vprinter.ParseSeparatorMode(user.SeparatorPages)
+	if err != nil {
+		log.Warnf("%v; keeping separator pages", err)
+	}
+	printer = vprinter.NewSeparatorFilter(printer, separators,
+		scanner.IsSeparatorLine)
+
+	// Unlimited users are trusted and we apply no limits
+	pageQuota := a.quotaPages
+	if user.Unlimited {
+		pageQuota = 0
+	}
+	if err := stream.print(printer, pageQuota); err != nil {
+		return nil, 0, fmt.Errorf("invalid data: %v", err)
+	}
+
+	// Create the PDF
+	var pdfBuffer bytes.Buffer
+	pages, err := printer.EndJob(&pdfBuffer)
+	if err != nil {
+		return nil, 0, fmt.Errorf("error creating PDF: %v", err)
+	}
+	return pdfBuffer.Bytes(), pages, nil
+}
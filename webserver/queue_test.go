@@ -0,0 +1,166 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/mailer"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+// waitForJob waits for the job id to satisfy done, and returns it.
+func waitForJob(t *testing.T, database db.DB, id uint64,
+	done func(model.JobLogEntry) bool) model.JobLogEntry {
+
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		job, err := database.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if done(job) {
+			return job
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %d stuck in state %s: %+v", id, job.State, job)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// closedPort returns a local port that nothing is listening on.
+func closedPort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port
+}
+
+func TestPrintQueueRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	database, err := db.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := model.NewUser("queue@example.com", "password")
+	u.Verified = true
+	if err := database.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+	payload := compressJob(t, "L:HELLO\nJ:RETRY\n")
+	id, err := database.QueueJob(u.Email, "RETRY", nil, "default", payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The job is rendered, but the mail server is down, so it waits to be
+	// delivered again.
+	app := &application{
+		db:    database,
+		seats: newSeatPools(nil),
+		mailconfig: mailer.Config{
+			FromAddress: "virtual1403@example.com",
+			Server:      "127.0.0.1",
+			Port:        closedPort(t),
+		},
+	}
+	app.queue = newPrintQueue(app)
+	if err := app.queue.start(1); err != nil {
+		t.Fatal(err)
+	}
+	job := waitForJob(t, database, id, func(job model.JobLogEntry) bool {
+		return job.Attempts > 0
+	})
+	if job.State != model.JobDelivering || job.Error == "" ||
+		!job.HasPDF || job.Pages != 1 {
+		t.Errorf("after failed delivery got %+v", job)
+	}
+	database.Close()
+
+	// Restart the server with the mail server back up, and one seat for the
+	// default profile.
+	database, err = db.NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+	sink := newMailSink(t)
+	app = &application{
+		db:         database,
+		mailconfig: sink.config(),
+		seats:      newSeatPools([]SeatLimit{{Font: "default", Seats: 1}}),
+	}
+
+	// Another job was queued before the restart, but the seat is taken.
+	id2, err := database.QueueJob(u.Email, "WAITING", nil, "default",
+		payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seat, ok := app.seats.acquire("default", time.Millisecond)
+	if !ok {
+		t.Fatal("couldn't take the seat")
+	}
+
+	app.queue = newPrintQueue(app)
+	if err := app.queue.start(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rendered job doesn't need a seat, and is delivered.
+	select {
+	case <-sink.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("resumed job wasn't delivered")
+	}
+	job = waitForJob(t, database, id, func(job model.JobLogEntry) bool {
+		return job.State == model.JobDone
+	})
+	if job.Error != "" || job.Attempts != 1 {
+		t.Errorf("after delivery got %+v", job)
+	}
+
+	// The other job waits for the seat.
+	time.Sleep(200 * time.Millisecond)
+	if job, _ := database.GetJob(id2); job.State != model.JobQueued {
+		t.Errorf("job without a seat got to state %s", job.State)
+	}
+	app.seats.release(seat)
+	waitForJob(t, database, id2, func(job model.JobLogEntry) bool {
+		return job.State == model.JobDone
+	})
+	if len(app.seats.pool("default")) != 0 {
+		t.Errorf("resumed job didn't give back its seat")
+	}
+
+	queued, err := database.GetQueuedJobs()
+	if err != nil || len(queued) != 0 {
+		t.Errorf("print queue not empty: %+v, %v", queued, err)
+	}
+}
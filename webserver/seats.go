@@ -0,0 +1,146 @@
+package main
+
+// Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/vprinter"
+)
+
+// seatRetryAfter is the number of seconds we ask clients to wait before
+// trying again when there's no seat for their job.
+const seatRetryAfter = 30
+
+// SeatLimit limits the number of jobs that may be in the print queue at once
+// for some of the profiles: the profiles that match a pattern, or those that
+// use a font. Fonts are "default" (the profiles that use the configured
+// font_file), "retro" or "modern".
+type SeatLimit struct {
+	Profiles string `yaml:"profiles"`
+	Font     string `yaml:"font"`
+	Seats    int    `yaml:"seats"`
+}
+
+// Validate checks that the limit has a valid pattern or font, but not both,
+// and at least one seat.
+func (l SeatLimit) Validate() error {
+	if (l.Profiles == "") == (l.Font == "") {
+		return fmt.Errorf("must have one of profiles or font")
+	}
+	if _, err := path.Match(l.Profiles, ""); err != nil {
+		return fmt.Errorf("profiles pattern `%s`: %v", l.Profiles, err)
+	}
+	switch strings.ToLower(l.Font) {
+	case "", "default", "retro", "modern":
+	default:
+		return fmt.Errorf("font `%s` must be default, retro or modern",
+			l.Font)
+	}
+	if l.Seats <= 0 {
+		return fmt.Errorf("seats must be >0")
+	}
+	return nil
+}
+
+// String describes the profiles the limit applies to.
+func (l SeatLimit) String() string {
+	if l.Font != "" {
+		return "profiles with font " + l.Font
+	}
+	return "profiles " + l.Profiles
+}
+
+// Matches returns true if the limit applies to profile.
+func (l SeatLimit) Matches(profile string) bool {
+	if l.Font != "" {
+		return strings.EqualFold(l.Font, vprinter.ProfileFont(profile))
+	}
+	matched, _ := path.Match(strings.ToLower(l.Profiles),
+		vprinter.CanonicalProfile(profile))
+	return matched
+}
+
+// seatPools has a pool of seats for each of the configured seat limits. A job
+// takes a seat from the pool of the first limit that matches its profile
+// when it's queued, and gives it back once it's rendered. Profiles without a
+// limit don't need a seat.
+type seatPools struct {
+	limits []SeatLimit
+	seats  []chan struct{}
+}
+
+func newSeatPools(limits []SeatLimit) *seatPools {
+	s := &seatPools{limits: limits}
+	for _, limit := range limits {
+		s.seats = append(s.seats, make(chan struct{}, limit.Seats))
+	}
+	return s
+}
+
+// pool returns the pool of seats for profile, or nil if it's unlimited.
+func (s *seatPools) pool(profile string) chan struct{} {
+	for i, limit := range s.limits {
+		if limit.Matches(profile) {
+			return s.seats[i]
+		}
+	}
+	return nil
+}
+
+// acquire takes a seat for profile, waiting up to timeout for one to be
+// free. It returns the pool the seat must be released to, which is nil for
+// unlimited profiles, and false if there wasn't a seat.
+func (s *seatPools) acquire(profile string,
+	timeout time.Duration) (chan struct{}, bool) {
+
+	pool := s.pool(profile)
+	if pool == nil {
+		return nil, true
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case pool <- struct{}{}:
+		return pool, true
+	case <-timer.C:
+		return nil, false
+	}
+}
+
+// wait takes a seat for profile like acquire, but waits as long as it takes
+// for one to be free.
+func (s *seatPools) wait(profile string) chan struct{} {
+	pool := s.pool(profile)
+	if pool != nil {
+		pool <- struct{}{}
+	}
+	return pool
+}
+
+// release gives back a seat from acquire.
+func (s *seatPools) release(pool chan struct{}) {
+	if pool != nil {
+		<-pool
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSeatPools(t *testing.T) {
+	seats := newSeatPools([]SeatLimit{
+		{Font: "default", Seats: 1},
+		{Profiles: "retro-*", Seats: 2},
+	})
+
+	// "default" and unknown profiles are default-green, which uses the
+	// default font.
+	for _, profile := range []string{"default", "DEFAULT-BLUE", "nonsense"} {
+		if seats.pool(profile) != seats.seats[0] {
+			t.Errorf("%s: didn't get the default font's pool", profile)
+		}
+	}
+	if seats.pool("retro-plain-noskip") != seats.seats[1] {
+		t.Errorf("retro-plain-noskip: didn't get the retro-* pool")
+	}
+	if seats.pool("modern-green") != nil {
+		t.Errorf("modern-green: should be unlimited")
+	}
+
+	pool, ok := seats.acquire("default-green", time.Millisecond)
+	if !ok || pool == nil {
+		t.Fatalf("couldn't get the first default seat")
+	}
+	if _, ok := seats.acquire("default-plain", time.Millisecond); ok {
+		t.Errorf("got a second default seat")
+	}
+	if _, ok := seats.acquire("modern-plain", time.Millisecond); !ok {
+		t.Errorf("couldn't get an unlimited seat")
+	}
+	seats.release(pool)
+	if _, ok := seats.acquire("default-plain", time.Millisecond); !ok {
+		t.Errorf("couldn't get the released default seat")
+	}
+}
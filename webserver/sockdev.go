@@ -0,0 +1,361 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/racingmars/virtual1403/logging"
+	"github.com/racingmars/virtual1403/scanner"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+const (
+	// sockdevHandshakeTimeout is how long clients have to send the
+	// handshake line after connecting.
+	sockdevHandshakeTimeout = 30 * time.Second
+
+	// sockdevMaxHandshake is the longest handshake line we accept.
+	sockdevMaxHandshake = 256
+
+	// sockdevSeatRetries is how many times we try to get a printer seat for
+	// a job before giving up on it. The client can't try again, so we hold
+	// on to the job while we wait.
+	sockdevSeatRetries = 10
+
+	// sockdevMaxWaiting is how many finished jobs from a connection may wait
+	// to be added to the print queue. Once that many are waiting, we stop
+	// reading the printer stream until there's room.
+	sockdevMaxWaiting = 4
+)
+
+var errHandshakeTooLong = errors.New("handshake line is too long")
+
+// listenSockdev accepts raw printer streams, like those from a Hercules
+// sockdev printer, on addr, so that users can print without running the
+// agent. Connections must use TLS with tlsConfig; since clients send their
+// API key in the handshake, tlsConfig may only be nil if insecure is true.
+//
+// The first line the client sends is a handshake: one of the user's API keys
+// that may be used for sockdev connections, optionally followed by a space
+// and the profile to print with. If the key isn't valid, the server sends a
+// line starting with "ERR" and closes the connection. After the handshake,
+// the connection is a printer stream, and each job in it is printed as if
+// it came through the print API.
+func (a *application) listenSockdev(addr string, tlsConfig *tls.Config,
+	insecure bool) error {
+
+	if tlsConfig == nil && !insecure {
+		return errors.New("sockdev connections require TLS")
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				logger.Errorf("error accepting sockdev connection: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+			go a.serveSockdev(conn)
+		}
+	}()
+	return nil
+}
+
+// serveSockdev authenticates a sockdev connection with its handshake, and
+// prints the jobs in the printer stream that follows.
+func (a *application) serveSockdev(conn net.Conn) {
+	defer conn.Close()
+	log := logger.With("remote", conn.RemoteAddr().String())
+
+	conn.SetReadDeadline(time.Now().Add(sockdevHandshakeTimeout))
+	line, err := readHandshake(conn)
+	if err != nil {
+		log.Infof("sockdev handshake failed: %v", err)
+		sockdevError(conn, "invalid handshake")
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) < 1 || len(fields) > 2 {
+		log.Infof("sockdev handshake failed: %d fields", len(fields))
+		sockdevError(conn, "invalid handshake")
+		return
+	}
+	key := fields[0]
+	var profile string
+	if len(fields) > 1 {
+		profile = fields[1]
+	}
+
+	user, _, err := a.authenticateKey(key, model.ScopeSockdev)
+	if err == errKeyExpired || err == errKeyScope {
+		log.Infof("sockdev connection refused: %v", err)
+		sockdevError(conn, err.Error())
+		return
+	} else if err != nil {
+		log.Infof("unauthorized sockdev connection")
+		sockdevError(conn, "authentication failure")
+		return
+	}
+	if !user.Enabled {
+		sockdevError(conn, "user's account is disabled")
+		return
+	}
+	if !user.Verified {
+		sockdevError(conn, "user's email address has not been verified")
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	log = log.With("user", user.Email)
+	log.Infof("sockdev connection with profile %q", profile)
+	handler, err := newSockdevHandler(a, conn, user, key, profile, log)
+	if err != nil {
+		log.Errorf("couldn't set up sockdev job: %v", err)
+		return
+	}
+	err = scanner.ScanWithLogTag(conn, handler, "sockdev "+user.Email)
+	if handler.pending && !handler.tooLarge {
+		// The client hung up without waiting for the scanner to see the end
+		// of the job; print what we have.
+		handler.EndOfJob(handler.job)
+	}
+	handler.finish()
+	if err != nil && err != io.EOF {
+		log.Infof("sockdev connection ended: %v", err)
+		return
+	}
+	log.Infof("sockdev connection closed")
+}
+
+// readHandshake reads the handshake line from conn one byte at a time, so
+// that none of the printer stream after it is consumed.
+func readHandshake(conn net.Conn) (string, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return "", err
+		}
+		if b[0] == '\n' {
+			return strings.TrimSpace(string(line)), nil
+		}
+		if len(line) >= sockdevMaxHandshake {
+			return "", errHandshakeTooLong
+		}
+		line = append(line, b[0])
+	}
+}
+
+// sockdevError tells a sockdev client why we're closing the connection.
+func sockdevError(conn net.Conn, message string) {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "ERR "+message+"\n")
+}
+
+// sockdevHandler is a scanner.PrinterHandler that converts each job in a
+// sockdev printer stream to print directives, and adds it to the print
+// queue.
+type sockdevHandler struct {
+	textJobHandler
+	app     *application
+	conn    net.Conn
+	key     string
+	profile string
+	log     *logging.Logger
+	buf     bytes.Buffer
+	enc     *zstd.Encoder
+
+	// The limits on the size of each job, like the print API's. lines is the
+	// number of directives in the current job.
+	maxBytes int64
+	maxLines int
+	lines    int
+
+	// pending is true once the current job has any lines, and job is what
+	// we know about it from those lines.
+	pending bool
+	job     scanner.JobInfo
+
+	// Finished jobs wait in jobs to be added to the print queue, so that we
+	// keep reading the printer stream while a job waits for a printer seat.
+	// printed is closed once they've all been added.
+	jobs    chan sockdevJob
+	printed chan struct{}
+
+	// tooLarge is true once the current job is over the limits, and we've
+	// dropped the connection.
+	tooLarge bool
+}
+
+func newSockdevHandler(a *application, conn net.Conn, user model.User, key,
+	profile string, log *logging.Logger) (*sockdevHandler, error) {
+
+	h := &sockdevHandler{
+		app:      a,
+		conn:     conn,
+		key:      key,
+		profile:  profile,
+		log:      log,
+		maxBytes: jobSizeLimit(user),
+		maxLines: a.maxLines(user),
+	}
+	// Compress in this goroutine, so that buf has everything compressed so
+	// far when we check the job's size.
+	enc, err := zstd.NewWriter(&h.buf, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	h.enc = enc
+	h.w = bufio.NewWriter(enc)
+	writeDirectiveHeader(h.w)
+	h.jobs = make(chan sockdevJob, sockdevMaxWaiting)
+	h.printed = make(chan struct{})
+	go h.printJobs()
+	return h, nil
+}
+
+// sockdevJob is a finished job from a sockdev connection.
+type sockdevJob struct {
+	payload []byte
+	jobinfo string
+}
+
+func (h *sockdevHandler) AddLine(line string, linefeed bool) {
+	if h.checkLimits() {
+		h.pending = true
+		h.job.NoteLine(line)
+		h.textJobHandler.AddLine(line, linefeed)
+	}
+}
+
+func (h *sockdevHandler) PageBreak() {
+	if h.checkLimits() {
+		h.textJobHandler.PageBreak()
+	}
+}
+
+func (h *sockdevHandler) SkipToChannel(channel int) {
+	if h.checkLimits() {
+		h.textJobHandler.SkipToChannel(channel)
+	}
+}
+
+// checkLimits counts another directive in the current job, and returns true
+// if the job is still small enough to add it. Jobs that are too big are
+// rejected like the print API rejects them, but since the printer stream
+// can't be stopped, we drop the connection.
+func (h *sockdevHandler) checkLimits() bool {
+	if h.tooLarge {
+		return false
+	}
+	h.lines++
+	overLines := h.maxLines > 0 && h.lines > h.maxLines
+	overSize := int64(h.buf.Len()) > h.maxBytes
+	if !overLines && !overSize {
+		return true
+	}
+
+	h.tooLarge = true
+	h.log.Infof("dropping sockdev connection: print job is too large")
+	sockdevError(h.conn, "print job is too large")
+	h.conn.Close()
+	return false
+}
+
+func (h *sockdevHandler) EndOfJob(job scanner.JobInfo) {
+	if h.tooLarge {
+		return
+	}
+
+	writeJobDirectives(h.w, job)
+	h.w.Flush()
+	h.enc.Close()
+	payload := append([]byte(nil), h.buf.Bytes()...)
+
+	// Start the next job before printing this one, so that we're always
+	// ready for more lines.
+	h.pending = false
+	h.job = scanner.JobInfo{}
+	h.lines = 0
+	h.buf.Reset()
+	h.enc.Reset(&h.buf)
+	h.w.Reset(h.enc)
+	writeDirectiveHeader(h.w)
+
+	h.jobs <- sockdevJob{payload: payload, jobinfo: job.String()}
+}
+
+// printJobs adds each job from the connection to the print queue, in order.
+func (h *sockdevHandler) printJobs() {
+	defer close(h.printed)
+	for job := range h.jobs {
+		h.print(job.payload, job.jobinfo)
+	}
+}
+
+// finish waits for the connection's jobs to be added to the print queue,
+// once there won't be any more.
+func (h *sockdevHandler) finish() {
+	close(h.jobs)
+	<-h.printed
+}
+
+// print adds a job to the print queue. The user is looked up again, in case
+// they've been disabled or revoked their API key since they connected.
+func (h *sockdevHandler) print(payload []byte, jobinfo string) {
+	log := h.log.With("job", jobinfo)
+	user, _, err := h.app.authenticateKey(h.key, model.ScopeSockdev)
+	if err != nil || !user.Enabled || !user.Verified {
+		log.Infof("dropping sockdev job: user may no longer print")
+		return
+	}
+
+	for tries := 1; ; tries++ {
+		result, _, jobErr := h.app.queueJob(log, user,
+			bytes.NewReader(payload), h.profile, "")
+		if jobErr == nil {
+			log.Infof("sockdev job %d: %d pages, %s", result.JobID,
+				result.Pages, result.State)
+			return
+		}
+		if jobErr.retryAfter == 0 || tries >= sockdevSeatRetries {
+			log.Warnf("dropping sockdev job: %v", jobErr)
+			return
+		}
+		time.Sleep(time.Duration(jobErr.retryAfter) * time.Second)
+	}
+}
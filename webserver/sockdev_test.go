@@ -0,0 +1,188 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sockdevSession runs serveSockdev on one end of a pipe, and sends the
+// handshake and printer stream to the other. It returns what the server sent
+// back once the server has finished with the connection.
+func sockdevSession(t *testing.T, app *application, handshake,
+	stream string) string {
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		app.serveSockdev(server)
+		close(done)
+	}()
+
+	// The server may hang up on us part way through, so we write in the
+	// background and don't mind if it fails.
+	go func() {
+		io.WriteString(client, handshake+"\n"+stream)
+		client.Close()
+	}()
+
+	response := make(chan string, 1)
+	go func() {
+		line, _ := bufio.NewReader(client).ReadString('\n')
+		response <- line
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sockdev connection didn't finish")
+	}
+	client.Close()
+	return <-response
+}
+
+func TestSockdevHandshake(t *testing.T) {
+	app, key := newPrintTestApp(t)
+
+	// The handshake has the user's API key, so it must be encrypted unless
+	// we're told otherwise.
+	if err := app.listenSockdev("127.0.0.1:0", nil, false); err == nil {
+		t.Errorf("sockdev listener started without TLS")
+	}
+
+	for _, handshake := range []string{
+		"not-a-key",
+		key + " default extra",
+		strings.Repeat("x", sockdevMaxHandshake+1),
+	} {
+		if got := sockdevSession(t, app, handshake,
+			"HELLO\r\n"); !strings.HasPrefix(got, "ERR ") {
+			t.Errorf("handshake %.20q got %q", handshake, got)
+		}
+	}
+	if jobs, _ := app.db.GetJobLog(10); len(jobs) != 0 {
+		t.Errorf("rejected connections printed %d jobs", len(jobs))
+	}
+
+	if got := sockdevSession(t, app, key+" default",
+		"HELLO\r\nWORLD\r\n"); got != "" {
+		t.Errorf("valid handshake got %q", got)
+	}
+	jobs, err := app.db.GetJobLog(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].Pages != 1 {
+		t.Errorf("got jobs %+v", jobs)
+	}
+}
+
+func TestSockdevJobLimit(t *testing.T) {
+	app, key := newPrintTestApp(t)
+	app.maxLinesPerJob = 5
+
+	got := sockdevSession(t, app, key, strings.Repeat("LINE\r\n", 10))
+	if got != "ERR print job is too large\n" {
+		t.Errorf("oversized job got %q", got)
+	}
+	if jobs, _ := app.db.GetJobLog(10); len(jobs) != 0 {
+		t.Errorf("oversized job was printed: %+v", jobs)
+	}
+
+	// Jobs within the limit are fine.
+	if got := sockdevSession(t, app, key,
+		strings.Repeat("LINE\r\n", 4)); got != "" {
+		t.Errorf("small job got %q", got)
+	}
+	if jobs, _ := app.db.GetJobLog(10); len(jobs) != 1 {
+		t.Errorf("got %d jobs after small job", len(jobs))
+	}
+}
+
+func TestSockdevHangUp(t *testing.T) {
+	app, key := newPrintTestApp(t)
+
+	// The job's details come from the lines we got before the hang-up.
+	separator := "****A   START  JOB   12  IBMUSERA  J. PROGRAMMER" +
+		"       ROOM 1234  11.25.08 AM 18 JAN 22  PRINTER1  SYS TK4-  " +
+		"JOB   12  START   A****"
+	if got := sockdevSession(t, app, key,
+		separator+"\r\nHELLO\r\n"); got != "" {
+		t.Errorf("got %q", got)
+	}
+	jobs, err := app.db.GetJobLog(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 1 || jobs[0].JobInfo != "J12_IBMUSERA" ||
+		jobs[0].Details == nil || jobs[0].Details.Class != "A" {
+		t.Errorf("got jobs %+v", jobs)
+	}
+}
+
+func TestSockdevSeatWait(t *testing.T) {
+	app, key := newPrintTestApp(t)
+	app.seats = newSeatPools([]SeatLimit{{Font: "default", Seats: 1}})
+	app.seatWait = 5 * time.Second
+	seat, ok := app.seats.acquire("default", time.Millisecond)
+	if !ok {
+		t.Fatal("couldn't take the printer seat")
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	done := make(chan struct{})
+	go func() {
+		app.serveSockdev(server)
+		close(done)
+	}()
+	go io.Copy(io.Discard, client)
+
+	// The first job ends when the stream goes quiet, and waits for the
+	// seat. We keep reading the stream in the meantime.
+	io.WriteString(client, key+"\nFIRST\r\n")
+	time.Sleep(time.Second)
+	written := make(chan struct{})
+	go func() {
+		io.WriteString(client, "SECOND\r\n")
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(2 * time.Second):
+		t.Errorf("printer stream wasn't read while a job waited for a seat")
+	}
+
+	app.seats.release(seat)
+	<-written
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("sockdev connection didn't finish")
+	}
+	if jobs, _ := app.db.GetJobLog(10); len(jobs) != 2 {
+		t.Errorf("got %d jobs, want 2", len(jobs))
+	}
+}
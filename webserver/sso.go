@@ -0,0 +1,232 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/mailer"
+	"github.com/racingmars/virtual1403/webserver/model"
+	"github.com/racingmars/virtual1403/webserver/oidc"
+)
+
+// errSSORejected is for single sign-on identities we won't log in; the
+// error's message is shown to the user.
+type errSSORejected string
+
+func (e errSSORejected) Error() string {
+	return string(e)
+}
+
+// ssoLogin is the HTTP handler for /sso/login, which sends the user to the
+// single sign-on provider. The state for the sign in is kept in the session
+// until the provider sends the user back to ssoCallback.
+func (app *application) ssoLogin(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := oidc.NewAuthRequest()
+	authURL, err := app.sso.AuthURL(r.Context(), req)
+	if err != nil {
+		requestLog(r).Errorf("couldn't start single sign-on: %v", err)
+		app.ssoError(w, r, "Single sign-on is unavailable right now.")
+		return
+	}
+
+	app.session.Put(r, "ssoState", req.State)
+	app.session.Put(r, "ssoNonce", req.Nonce)
+	app.session.Put(r, "ssoVerifier", req.Verifier)
+	http.Redirect(w, r, authURL, http.StatusSeeOther)
+}
+
+// ssoCallback is the HTTP handler for /sso/callback, where the single
+// sign-on provider sends the user back with an authorization code. We log
+// in the account with the user's verified email address, linking it to the
+// provider identity, or create one if there isn't one.
+func (app *application) ssoCallback(w http.ResponseWriter, r *http.Request) {
+	if app.sso == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	req := oidc.AuthRequest{
+		State:    app.session.GetString(r, "ssoState"),
+		Nonce:    app.session.GetString(r, "ssoNonce"),
+		Verifier: app.session.GetString(r, "ssoVerifier"),
+	}
+	app.session.Remove(r, "ssoState")
+	app.session.Remove(r, "ssoNonce")
+	app.session.Remove(r, "ssoVerifier")
+
+	query := r.URL.Query()
+	if req.State == "" || query.Get("state") != req.State {
+		requestLog(r).Infof("single sign-on callback with wrong state")
+		app.ssoError(w, r, "Single sign-on failed. Please try again.")
+		return
+	}
+
+	if e := query.Get("error"); e != "" {
+		requestLog(r).Infof("single sign-on provider returned %s: %s", e,
+			query.Get("error_description"))
+		app.ssoError(w, r, "Single sign-on failed. Please try again.")
+		return
+	}
+
+	identity, err := app.sso.Exchange(r.Context(), req, query.Get("code"))
+	if err != nil {
+		requestLog(r).Errorf("single sign-on failed: %v", err)
+		app.ssoError(w, r, "Single sign-on failed. Please try again.")
+		return
+	}
+
+	u, err := app.ssoUser(r, identity)
+	var rejected errSSORejected
+	if errors.As(err, &rejected) {
+		requestLog(r).With("user", identity.Email).Infof(
+			"rejected single sign-on for subject %s: %v", identity.Subject,
+			err)
+		app.ssoError(w, r, rejected.Error())
+		return
+	} else if err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	requestLog(r).With("user", u.Email).Infof("signed in through single " +
+		"sign-on")
+	app.startSession(w, r, u)
+}
+
+// ssoError sends the user back to the front page with message. We redirect
+// rather than render the page here, since its links are relative to /.
+func (app *application) ssoError(w http.ResponseWriter, r *http.Request,
+	message string) {
+
+	app.session.Put(r, "loginError", message)
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ssoUser finds, or creates, the account for a single sign-on identity, and
+// updates it from the identity.
+func (app *application) ssoUser(r *http.Request,
+	identity oidc.Identity) (model.User, error) {
+
+	config := app.sso.Config()
+	email := strings.TrimSpace(identity.Email)
+	if !identity.EmailVerified ||
+		!mailer.ValidateAddress(strings.ToLower(email)) {
+		return model.User{}, errSSORejected("Your " + config.DisplayName +
+			" account doesn't have a verified email address.")
+	}
+
+	log := requestLog(r).With("user", email)
+
+	u, err := app.db.GetUser(email)
+	created := false
+	if err == db.ErrNotFound {
+		// The new user gets a random password nobody knows. They can always
+		// set one with the forgotten password link.
+		u = model.NewUser(email, randomPassword())
+		u.FullName = identity.Name
+		if u.FullName == "" {
+			u.FullName = email
+		}
+		log.Infof("creating account for single sign-on user")
+		created = true
+	} else if err != nil {
+		return model.User{}, err
+	}
+
+	if u.SSOSubject != "" && u.SSOSubject != identity.Subject {
+		return model.User{}, errSSORejected("That email address's account " +
+			"is linked to a different " + config.DisplayName + " account.")
+	}
+	if !u.Enabled {
+		return model.User{}, errSSORejected("Invalid login credentials.")
+	}
+
+	if u.SSOSubject == "" {
+		// Anyone could have signed up with this email address and not
+		// verified it. Since the provider has now shown who owns the address,
+		// lock out whoever set up the account: they might otherwise still
+		// log in with the password or API keys they chose.
+		if !u.Verified && !created {
+			u.SetPassword(randomPassword())
+			u.APIKeys = nil
+			u.ResetTwoFactor()
+			log.Infof("reset credentials of unverified account before " +
+				"linking it to single sign-on")
+		}
+		u.SSOSubject = identity.Subject
+		log.Infof("linked account to single sign-on subject %s",
+			identity.Subject)
+	}
+
+	// The provider has verified the email address for us.
+	if !u.Verified {
+		u.Verified = true
+		u.VerificationToken = ""
+		u.LastVerificationEmail = time.Time{}
+		if len(u.APIKeys) == 0 {
+			_, secret := u.AddAPIKey("Default", model.Scopes, time.Time{},
+				"")
+			app.session.Put(r, "newAPIKey", secret)
+		}
+	}
+
+	// Group membership only grants admin, unless we're told to also demote
+	// admins who aren't in the group; admins may have been made with the
+	// createadmin command or the admin page instead.
+	if config.AdminGroup != "" {
+		admin := identity.InGroup(config.AdminGroup)
+		if admin && !u.Admin {
+			log.Infof("making user an admin from %s group membership",
+				config.AdminGroup)
+			u.Admin = true
+		} else if !admin && u.Admin && config.DemoteAdmins {
+			log.Infof("removing admin since user isn't in the %s group",
+				config.AdminGroup)
+			u.Admin = false
+		}
+	}
+
+	if err := app.db.SaveUser(u); err != nil {
+		return model.User{}, err
+	}
+	return u, nil
+}
+
+// randomPassword returns a password nobody knows, for accounts that are only
+// used through single sign-on.
+func randomPassword() string {
+	pwbytes := make([]byte, 128/8)
+	if _, err := rand.Read(pwbytes); err != nil {
+		// shouldn't be possible to have an error reading rand
+		panic(err)
+	}
+	return hex.EncodeToString(pwbytes)
+}
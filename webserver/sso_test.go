@@ -0,0 +1,341 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golangcollege/sessions"
+
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/model"
+	"github.com/racingmars/virtual1403/webserver/oidc"
+)
+
+// mockIssuer is a minimal OpenID Connect provider that signs in whoever
+// its claims say, without asking.
+type mockIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu        sync.Mutex
+	claims    map[string]interface{}
+	nonce     string
+	challenge string
+}
+
+func newMockIssuer(t *testing.T) *mockIssuer {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockIssuer{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration",
+		func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]string{
+				"issuer":                 m.URL,
+				"authorization_endpoint": m.URL + "/authorize",
+				"token_endpoint":         m.URL + "/token",
+				"jwks_uri":               m.URL + "/jwks",
+			})
+		})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.E)).Bytes()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "test",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(e),
+			}},
+		})
+	})
+	mux.HandleFunc("/authorize", func(w http.ResponseWriter,
+		r *http.Request) {
+		q := r.URL.Query()
+		m.mu.Lock()
+		m.nonce = q.Get("nonce")
+		m.challenge = q.Get("code_challenge")
+		m.mu.Unlock()
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code=testcode&state="+
+			url.QueryEscape(q.Get("state")), http.StatusFound)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		id, secret, _ := r.BasicAuth()
+		verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+		if id != "client" || secret != "secret" ||
+			r.PostFormValue("code") != "testcode" ||
+			base64.RawURLEncoding.EncodeToString(verifier[:]) !=
+				m.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"error": "invalid_grant",
+			})
+			return
+		}
+
+		claims := map[string]interface{}{
+			"iss":   m.URL,
+			"aud":   "client",
+			"exp":   time.Now().Add(time.Hour).Unix(),
+			"nonce": m.nonce,
+		}
+		for k, v := range m.claims {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"id_token": m.sign(t, claims),
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockIssuer) sign(t *testing.T, claims interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256",
+		"kid": "test"})
+	payload, _ := json.Marshal(claims)
+	msg := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(msg))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256,
+		digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func (m *mockIssuer) signInAs(claims map[string]interface{}) {
+	m.mu.Lock()
+	m.claims = claims
+	m.mu.Unlock()
+}
+
+// newSSOTestApp returns the URL of a server running the single sign-on
+// handlers, and its application.
+func newSSOTestApp(t *testing.T, config oidc.Config) (string,
+	*application) {
+
+	database, err := db.NewDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	templates, err := newTemplateCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		db:            database,
+		templateCache: templates,
+		session:       sessions.New(make([]byte, 32)),
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", app.session.Enable(http.HandlerFunc(app.home)))
+	mux.Handle("/signup", app.session.Enable(http.HandlerFunc(app.signup)))
+	mux.Handle("/sso/login", app.session.Enable(http.HandlerFunc(
+		app.ssoLogin)))
+	mux.Handle("/sso/callback", app.session.Enable(http.HandlerFunc(
+		app.ssoCallback)))
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+
+	app.serverBaseURL = server.URL
+	app.sso = oidc.NewProvider(config, server.URL+"/sso/callback")
+	return server.URL, app
+}
+
+// ssoSignIn follows the single sign-on redirects and returns the path we
+// end up at on the application.
+func ssoSignIn(t *testing.T, appURL string) string {
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if strings.HasPrefix(req.URL.String(), appURL) &&
+				!strings.HasPrefix(req.URL.Path, "/sso/") {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		},
+	}
+
+	resp, err := client.Get(appURL + "/sso/login")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.Header.Get("Location")
+}
+
+func TestSSO(t *testing.T) {
+	issuer := newMockIssuer(t)
+	appURL, app := newSSOTestApp(t, oidc.Config{
+		Issuer:        issuer.URL,
+		ClientID:      "client",
+		ClientSecret:  "secret",
+		GroupsClaim:   "roles",
+		AdminGroup:    "printer-admins",
+		SSOOnlySignup: true,
+	})
+
+	existing := model.NewUser("existing@example.com", "password")
+	existing.AddAPIKey("Squatter", model.Scopes, time.Time{}, "")
+	if err := app.db.SaveUser(existing); err != nil {
+		t.Fatal(err)
+	}
+	admin := model.NewUser("admin@example.com", "password")
+	admin.Verified = true
+	admin.Admin = true
+	if err := app.db.SaveUser(admin); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new user is created, and made an admin by their group.
+	issuer.signInAs(map[string]interface{}{
+		"sub":            "new-subject",
+		"email":          "new@example.com",
+		"email_verified": true,
+		"name":           "New User",
+		"roles":          []string{"staff", "printer-admins"},
+	})
+	if loc := ssoSignIn(t, appURL); loc != "/user" {
+		t.Fatalf("new user ended up at %q", loc)
+	}
+	u, err := app.db.GetUser("new@example.com")
+	if err != nil {
+		t.Fatalf("new user not created: %v", err)
+	}
+	if !u.Verified || !u.Admin || u.FullName != "New User" ||
+		u.SSOSubject != "new-subject" || len(u.APIKeys) != 1 {
+		t.Errorf("new user not set up correctly: %+v", u)
+	}
+
+	// An existing account is linked by its email address, and verified.
+	// Since it was never verified, whoever signed up with the address loses
+	// their password and API keys.
+	issuer.signInAs(map[string]interface{}{
+		"sub":            "existing-subject",
+		"email":          "Existing@example.com",
+		"email_verified": "true",
+	})
+	if loc := ssoSignIn(t, appURL); loc != "/user" {
+		t.Fatalf("existing user ended up at %q", loc)
+	}
+	u, _ = app.db.GetUser("existing@example.com")
+	if !u.Verified || u.Admin || u.SSOSubject != "existing-subject" {
+		t.Errorf("existing user not linked correctly: %+v", u)
+	}
+	if u.CheckPassword("password") {
+		t.Errorf("unverified account kept its password when linked")
+	}
+	if len(u.APIKeys) != 1 || u.APIKeys[0].Name != "Default" {
+		t.Errorf("unverified account kept its API keys when linked: %+v",
+			u.APIKeys)
+	}
+
+	// Admins who aren't in the admin group stay admins.
+	issuer.signInAs(map[string]interface{}{
+		"sub":            "admin-subject",
+		"email":          "admin@example.com",
+		"email_verified": true,
+	})
+	if loc := ssoSignIn(t, appURL); loc != "/user" {
+		t.Fatalf("admin ended up at %q", loc)
+	}
+	u, _ = app.db.GetUser("admin@example.com")
+	if !u.Admin || !u.CheckPassword("password") {
+		t.Errorf("verified admin changed by linking: %+v", u)
+	}
+
+	// Once linked, another identity with the same email can't sign in.
+	issuer.signInAs(map[string]interface{}{
+		"sub":            "impostor",
+		"email":          "existing@example.com",
+		"email_verified": true,
+	})
+	if loc := ssoSignIn(t, appURL); loc != "/" {
+		t.Errorf("impostor ended up at %q", loc)
+	}
+
+	// Unverified email addresses are rejected.
+	issuer.signInAs(map[string]interface{}{
+		"sub":            "unverified-subject",
+		"email":          "unverified@example.com",
+		"email_verified": false,
+	})
+	if loc := ssoSignIn(t, appURL); loc != "/" {
+		t.Errorf("unverified user ended up at %q", loc)
+	}
+	if _, err := app.db.GetUser("unverified@example.com"); err == nil {
+		t.Errorf("unverified user was created")
+	}
+
+	// Tokens for another client are rejected.
+	issuer.signInAs(map[string]interface{}{
+		"sub":            "new-subject",
+		"email":          "new@example.com",
+		"email_verified": true,
+		"aud":            "other-client",
+	})
+	if loc := ssoSignIn(t, appURL); loc != "/" {
+		t.Errorf("token for another client ended up at %q", loc)
+	}
+
+	// Signups must go through the provider.
+	resp, err := http.PostForm(appURL+"/signup", url.Values{
+		"email":            {"password@example.com"},
+		"name":             {"Password User"},
+		"password":         {"password123"},
+		"password-confirm": {"password123"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if _, err := app.db.GetUser("password@example.com"); err == nil {
+		t.Errorf("password signup allowed with sso_only_signup")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/racingmars/virtual1403/scanner"
+)
+
+// textJobAgent identifies the server in the header of the print directives
+// it writes for text jobs.
+const textJobAgent = "virtual1403-server"
+
+var errTextJobTooLarge = errors.New("print job is too large")
+
+// jobNameInvalidChars matches the characters not allowed in J: directives.
+var jobNameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// textJobName makes a job name out of a file name or a name the client gave
+// us.
+func textJobName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	name = strings.TrimSuffix(name, path.Ext(name))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return jobIdentifier(name)
+}
+
+// jobIdentifier makes a job identifier that's allowed in a J: directive,
+// replacing any characters that aren't allowed (e.g. the $ and # of some
+// job names) with underscores.
+func jobIdentifier(name string) string {
+	name = jobNameInvalidChars.ReplaceAllString(name, "_")
+	if len(name) > 25 {
+		name = name[:25]
+	}
+	return name
+}
+
+// readTextJob reads a text print job from r, decompressing it if encoding is
+// gzip. If limit > 0, jobs with more than limit bytes of (uncompressed) text
+// are an error.
+func readTextJob(r io.Reader, encoding string, limit int64) ([]byte,
+	error) {
+
+	switch encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		r = gz
+	default:
+		return nil, errors.New("unsupported content encoding " + encoding)
+	}
+
+	if limit > 0 {
+		r = io.LimitReader(r, limit+1)
+	}
+	text, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(text)) > limit {
+		return nil, errTextJobTooLarge
+	}
+	return text, nil
+}
+
+// convertTextJob converts a plain text print job, or one with ASA carriage
+// control characters at the start of each line, into zstd-compressed print
+// directives, so it can go through the print queue the same way as jobs
+// from the agent.
+func convertTextJob(text []byte, asa bool, jobname string) ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := zstd.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(enc)
+	writeDirectiveHeader(w)
+
+	handler := &textJobHandler{w: w}
+	if asa {
+		err = scanner.ScanASAUTF8Single(bytes.NewReader(text), jobname,
+			handler)
+	} else {
+		err = scanner.ScanUTF8Single(bytes.NewReader(text), jobname,
+			handler)
+	}
+	if err != nil {
+		enc.Close()
+		return nil, err
+	}
+
+	if err := w.Flush(); err != nil {
+		enc.Close()
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// textJobHandler is a scanner.PrinterHandler that writes the lines and pages
+// of a text job as print directives.
+type textJobHandler struct {
+	w *bufio.Writer
+}
+
+func (h *textJobHandler) AddLine(line string, linefeed bool) {
+	command := "L:"
+	if !linefeed {
+		command = "O:"
+	}
+	h.w.WriteString(command + line + "\n")
+}
+
+func (h *textJobHandler) PageBreak() {
+	h.w.WriteString("P:\n")
+}
+
+func (h *textJobHandler) SkipToChannel(channel int) {
+	h.w.WriteString("C:" + strconv.Itoa(channel) + "\n")
+}
+
+func (h *textJobHandler) EndOfJob(job scanner.JobInfo) {
+	writeJobDirectives(h.w, job)
+}
+
+// writeDirectiveHeader writes the version 2 header directive for the jobs
+// the server converts to print directives.
+func writeDirectiveHeader(w *bufio.Writer) {
+	w.WriteString("V:2 agent=" + textJobAgent + " printer=1403 width=132" +
+		" codepage=UTF-8\n")
+}
+
+// writeJobDirectives writes the metadata directives for what we know about
+// job, and its identifier in a J: directive.
+func writeJobDirectives(w *bufio.Writer, job scanner.JobInfo) {
+	for _, m := range []struct{ name, value string }{
+		{"type", job.Type},
+		{"number", job.Number},
+		{"name", job.Name},
+		{"class", job.Class},
+		{"forms", job.Forms},
+		{"programmer", job.Programmer},
+		{"room", job.Room},
+		{"user", job.User},
+		{"printer", job.Printer},
+		{"system", job.System},
+	} {
+		if value := strings.TrimSpace(m.value); value != "" {
+			w.WriteString("M:" + m.name + "=" + value + "\n")
+		}
+	}
+	if job.Printed != nil {
+		w.WriteString("M:printed=" + job.Printed.Format(time.RFC3339) + "\n")
+	}
+	w.WriteString("J:" + jobIdentifier(job.String()) + "\n")
+}
@@ -0,0 +1,59 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestConvertTextJob(t *testing.T) {
+	if name := textJobName(`C:\listings\pay roll.lst`); name != "pay_roll" {
+		t.Errorf("got job name %q", name)
+	}
+
+	job, err := convertTextJob([]byte("1HELLO\n REPORT\n+______\n2TOTAL\n"),
+		true, "payroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := zstd.NewReader(bytes.NewReader(job))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	stream := parsePrintDirectives(d, 0)
+	ops, err := readOps(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stream.version != 2 || stream.jobinfo != "payroll" ||
+		stream.details.Name != "payroll" {
+		t.Errorf("got %+v", stream)
+	}
+	var directives []byte
+	for _, op := range ops {
+		directives = append(directives, op.directive)
+	}
+	if string(directives) != "LOLCL" || ops[3].channel != 2 {
+		t.Errorf("got directives %q: %+v", directives, ops)
+	}
+}
@@ -0,0 +1,445 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/model"
+	"github.com/racingmars/virtual1403/webserver/qrcode"
+)
+
+const (
+	// totpIssuer is the name authenticator apps show for our codes.
+	totpIssuer = "Virtual1403"
+
+	// pendingLoginTimeout is how long a user has to enter their code after
+	// entering their password.
+	pendingLoginTimeout = 5 * time.Minute
+
+	// After maxTwoFactorFailures wrong codes in a row, we don't accept any
+	// more codes for the user for twoFactorLockout.
+	maxTwoFactorFailures = 5
+	twoFactorLockout     = 15 * time.Minute
+)
+
+var (
+	errWrongCode       = errors.New("incorrect code")
+	errTwoFactorLocked = errors.New("too many incorrect codes")
+)
+
+// checkSecondFactor checks code, which may be from the user's authenticator
+// app or one of their recovery codes, and saves the user. Wrong codes count
+// towards locking out further attempts for a while. Returns true if a
+// recovery code was used.
+func (app *application) checkSecondFactor(u *model.User,
+	code string) (bool, error) {
+
+	if time.Now().Before(u.TwoFactorLocked) {
+		return false, errTwoFactorLocked
+	}
+
+	// Authenticator codes are all digits; recovery codes never are.
+	code = strings.TrimSpace(code)
+	recovery := strings.Trim(code, "0123456789") != ""
+
+	var ok bool
+	if recovery {
+		ok = u.UseRecoveryCode(code)
+	} else {
+		ok = u.CheckTOTP(code, time.Now())
+	}
+
+	var result error
+	if ok {
+		u.TwoFactorFailures = 0
+	} else {
+		result = errWrongCode
+		u.TwoFactorFailures++
+		if u.TwoFactorFailures >= maxTwoFactorFailures {
+			u.TwoFactorFailures = 0
+			u.TwoFactorLocked = time.Now().Add(twoFactorLockout)
+			result = errTwoFactorLocked
+		}
+	}
+
+	if err := app.db.SaveUser(*u); err != nil {
+		return false, err
+	}
+	return recovery, result
+}
+
+// secondFactorMessage is the message to show the user for an error from
+// checkSecondFactor.
+func secondFactorMessage(err error) string {
+	if err == errTwoFactorLocked {
+		return "Too many incorrect codes. Please wait a few minutes and " +
+			"try again."
+	}
+	return "Incorrect code."
+}
+
+// login2FA is the second step of logging in for users with two-factor
+// authentication: after login checks their password, they are sent here to
+// enter a code. The session only gets the user once the code is correct.
+func (app *application) login2FA(w http.ResponseWriter, r *http.Request) {
+	email := app.session.GetString(r, "pendingLogin")
+	started, _ := app.session.Get(r, "pendingLoginTime").(int64)
+	if email == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if time.Since(time.Unix(started, 0)) > pendingLoginTimeout {
+		app.session.Remove(r, "pendingLogin")
+		app.session.Remove(r, "pendingLoginTime")
+		app.renderLoginError(w, r, email,
+			"Your login timed out. Please sign in again.")
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		app.render(w, r, "login2fa.page.tmpl", nil)
+		return
+	}
+
+	log := requestLog(r).With("user", email)
+
+	u, err := app.db.GetUser(email)
+	if err != nil || !u.Enabled || !u.TwoFactorEnabled() {
+		app.session.Remove(r, "pendingLogin")
+		app.session.Remove(r, "pendingLoginTime")
+		app.renderLoginError(w, r, email, "Invalid login credentials.")
+		return
+	}
+
+	recovery, err := app.checkSecondFactor(&u, r.PostFormValue("code"))
+	if err == errWrongCode || err == errTwoFactorLocked {
+		log.Infof("unsuccessful two-factor login: %v", err)
+		app.render(w, r, "login2fa.page.tmpl", map[string]string{
+			"loginError": secondFactorMessage(err),
+		})
+		return
+	} else if err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	app.session.Remove(r, "pendingLogin")
+	app.session.Remove(r, "pendingLoginTime")
+	app.session.Put(r, "user", u.Email)
+	if recovery {
+		log.Infof("logged in with a recovery code")
+		app.session.Put(r, "twoFactorError", fmt.Sprintf("You logged in "+
+			"with a recovery code, which can't be used again. You have "+
+			"%d left.", len(u.RecoveryCodes)))
+		http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
+
+// twoFactor shows the user's two-factor authentication settings, including
+// the QR code for their authenticator app while they set it up.
+func (app *application) twoFactor(w http.ResponseWriter, r *http.Request) {
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	responseValues := map[string]interface{}{
+		"isAdmin":            u.Admin,
+		"enabled":            u.TwoFactorEnabled(),
+		"recoveryCodesLeft":  len(u.RecoveryCodes),
+		"adminRequired":      app.adminNeeds2FA(u),
+		"twoFactorError":     app.session.Get(r, "twoFactorError"),
+		"twoFactorSuccess":   app.session.Get(r, "twoFactorSuccess"),
+		"serverAdminContact": app.adminEmail,
+	}
+
+	if !u.TwoFactorEnabled() && u.TOTPPendingSecret != "" {
+		uri := model.TOTPURI(totpIssuer, u.Email, u.TOTPPendingSecret)
+		responseValues["secret"] = u.TOTPPendingSecret
+		responseValues["uri"] = template.URL(uri)
+		if qr, err := qrcode.Encode([]byte(uri)); err == nil {
+			if img, err := qr.PNG(4); err == nil {
+				responseValues["qrcode"] = template.URL(
+					"data:image/png;base64," +
+						base64.StdEncoding.EncodeToString(img))
+			}
+		}
+	}
+
+	if responseValues["twoFactorError"] != nil {
+		app.session.Remove(r, "twoFactorError")
+	}
+	if responseValues["twoFactorSuccess"] != nil {
+		app.session.Remove(r, "twoFactorSuccess")
+	}
+
+	app.render(w, r, "twofactor.page.tmpl", responseValues)
+}
+
+// begin2FA generates a new secret for the user to set up in their
+// authenticator app.
+func (app *application) begin2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if u.TwoFactorEnabled() {
+		http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+		return
+	}
+
+	u.BeginTOTP()
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, "Sorry, a database error has occurred")
+		return
+	}
+
+	http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+}
+
+// confirm2FA turns on two-factor authentication once the user enters a
+// correct code from their authenticator app, and shows them their recovery
+// codes. This is the only time the recovery codes are shown.
+func (app *application) confirm2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	codes, ok := u.ConfirmTOTP(r.PostFormValue("code"), time.Now())
+	if !ok {
+		app.session.Put(r, "twoFactorError", "Incorrect code. Check that "+
+			"your device's clock is correct and try again.")
+		http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, "Sorry, a database error has occurred")
+		return
+	}
+
+	requestLog(r).With("user", u.Email).Infof(
+		"turned on two-factor authentication")
+	app.renderRecoveryCodes(w, r, u, codes)
+}
+
+// recoveryCodes2FA replaces the user's recovery codes after checking a code
+// from their authenticator app.
+func (app *application) recoveryCodes2FA(w http.ResponseWriter,
+	r *http.Request) {
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if !u.TwoFactorEnabled() {
+		http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := app.checkSecondFactor(u,
+		r.PostFormValue("code")); err != nil {
+		if err != errWrongCode && err != errTwoFactorLocked {
+			app.serverError(w, err.Error())
+			return
+		}
+		app.session.Put(r, "twoFactorError", secondFactorMessage(err))
+		http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+		return
+	}
+
+	codes := u.GenerateRecoveryCodes()
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, "Sorry, a database error has occurred")
+		return
+	}
+
+	requestLog(r).With("user", u.Email).Infof(
+		"generated new recovery codes")
+	app.renderRecoveryCodes(w, r, u, codes)
+}
+
+func (app *application) renderRecoveryCodes(w http.ResponseWriter,
+	r *http.Request, u *model.User, codes []string) {
+
+	app.render(w, r, "twofactor.page.tmpl", map[string]interface{}{
+		"isAdmin":            u.Admin,
+		"enabled":            true,
+		"recoveryCodes":      codes,
+		"recoveryCodesLeft":  len(codes),
+		"serverAdminContact": app.adminEmail,
+	})
+}
+
+// disable2FA turns off two-factor authentication after checking the user's
+// password.
+func (app *application) disable2FA(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if !u.CheckPassword(r.PostFormValue("password")) {
+		app.session.Put(r, "twoFactorError",
+			"Your current password was incorrect.")
+		requestLog(r).With("user", u.Email).Infof(
+			"unsuccessfully attempted to turn off two-factor " +
+				"authentication")
+		http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+		return
+	}
+
+	u.ResetTwoFactor()
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, "Sorry, a database error has occurred")
+		return
+	}
+
+	app.session.Put(r, "twoFactorSuccess",
+		"Two-factor authentication is now off.")
+	requestLog(r).With("user", u.Email).Infof(
+		"turned off two-factor authentication")
+	http.Redirect(w, r, "twofactor", http.StatusSeeOther)
+}
+
+// adminNeeds2FA reports whether u is an administrator who must turn on
+// two-factor authentication before using the administrator pages.
+func (app *application) adminNeeds2FA(u *model.User) bool {
+	return app.requireAdmin2FA && u.Admin && !u.TwoFactorEnabled()
+}
+
+// checkAdmin2FA sends administrators who need to turn on two-factor
+// authentication to do so, returning false if it did.
+func (app *application) checkAdmin2FA(w http.ResponseWriter,
+	r *http.Request, u *model.User) bool {
+
+	if !app.adminNeeds2FA(u) {
+		return true
+	}
+
+	app.session.Put(r, "twoFactorError", "Administrators must turn on "+
+		"two-factor authentication to use the administrator pages.")
+	http.Redirect(w, r, "/twofactor", http.StatusSeeOther)
+	return false
+}
+
+// adminReset2FA lets logged-in administrators turn off two-factor
+// authentication for a user who has lost their authenticator and recovery
+// codes.
+func (app *application) adminReset2FA(w http.ResponseWriter,
+	r *http.Request) {
+
+	// Only POST requests to this handler
+	if r.Method != http.MethodPost {
+		http.Error(w, "Bad method", http.StatusMethodNotAllowed)
+		return
+	}
+
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// Only allow this for administrators
+	if !u.Admin {
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, "This action is only available to administrators.")
+		return
+	}
+	if !app.checkAdmin2FA(w, r, u) {
+		return
+	}
+
+	r.ParseForm()
+	email := r.Form.Get("email")
+	user, err := app.db.GetUser(email)
+	if err == db.ErrNotFound {
+		http.Error(w, "user does not exist", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	user.ResetTwoFactor()
+	if err := app.db.SaveUser(user); err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+	requestLog(r).With("user", u.Email).Infof(
+		"reset two-factor authentication for user %s", user.Email)
+
+	http.Redirect(w, r, "edituser?email="+url.QueryEscape(user.Email),
+		http.StatusSeeOther)
+}
@@ -24,19 +24,41 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/racingmars/virtual1403/vprinter"
 	"github.com/racingmars/virtual1403/webserver/db"
 	"github.com/racingmars/virtual1403/webserver/mailer"
 	"github.com/racingmars/virtual1403/webserver/model"
 	"golang.org/x/crypto/nacl/auth"
 )
 
+// separatorChoice is one of the choices for what to do with the JES2
+// separator pages of a user's jobs.
+type separatorChoice struct {
+	Mode        vprinter.SeparatorMode
+	Description string
+}
+
+// separatorChoices are the separator page choices offered to users, in order.
+var separatorChoices = []separatorChoice{
+	{vprinter.SeparatorKeep, "Print them like the rest of the job"},
+	{vprinter.SeparatorDrop, "Leave them out"},
+	{vprinter.SeparatorHeader, "Only print the header page"},
+	{vprinter.SeparatorTrailer, "Only print the trailer page"},
+	{vprinter.SeparatorBanner, "Print them on banner paper"},
+}
+
+// separatorMode returns the user's separator page preference.
+func separatorMode(u *model.User) vprinter.SeparatorMode {
+	mode, _ := vprinter.ParseSeparatorMode(u.SeparatorPages)
+	return mode
+}
+
 // home serves the home page with the login and signup forms. If the user is
 // already logged in, we redirect to the user's personal info page.
 func (app *application) home(w http.ResponseWriter, r *http.Request) {
@@ -56,9 +78,17 @@ func (app *application) home(w http.ResponseWriter, r *http.Request) {
 	if responseVars["verifySuccess"] != nil {
 		app.session.Remove(r, "verifySuccess")
 	}
+	responseVars["resetSuccess"] = app.session.Get(r, "resetSuccess")
+	if responseVars["resetSuccess"] != nil {
+		app.session.Remove(r, "resetSuccess")
+	}
+	responseVars["loginError"] = app.session.Get(r, "loginError")
+	if responseVars["loginError"] != nil {
+		app.session.Remove(r, "loginError")
+	}
 
 	// Otherwise, show the front page.
-	app.render(w, r, "home.page.tmpl", responseVars)
+	app.renderHome(w, r, responseVars)
 }
 
 // docsSetup serves the setup documentation page. This is unauthenticated.
@@ -101,14 +131,43 @@ func (app *application) login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	app.startSession(w, r, u)
+}
+
+// startSession logs in a user who has proven who they are, with their
+// password or through single sign-on. Users with two-factor authentication
+// are sent to enter a code first.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request,
+	u model.User) {
+
+	if u.TwoFactorEnabled() {
+		// The user isn't logged in until they also enter a code.
+		app.session.Put(r, "pendingLogin", u.Email)
+		app.session.Put(r, "pendingLoginTime", time.Now().Unix())
+		http.Redirect(w, r, "/login2fa", http.StatusSeeOther)
+		return
+	}
+
 	app.session.Put(r, "user", u.Email)
-	http.Redirect(w, r, "user", http.StatusSeeOther)
+	http.Redirect(w, r, "/user", http.StatusSeeOther)
+}
+
+// renderHome renders the front page with responseVars, adding the single
+// sign-on settings the page needs.
+func (app *application) renderHome(w http.ResponseWriter, r *http.Request,
+	responseVars map[string]interface{}) {
+
+	if app.sso != nil {
+		responseVars["ssoName"] = app.sso.Config().DisplayName
+		responseVars["ssoOnlySignup"] = app.sso.Config().SSOOnlySignup
+	}
+	app.render(w, r, "home.page.tmpl", responseVars)
 }
 
 func (app *application) renderLoginError(w http.ResponseWriter,
 	r *http.Request, email, message string) {
 
-	app.render(w, r, "home.page.tmpl", map[string]string{
+	app.renderHome(w, r, map[string]interface{}{
 		"loginEmail": email,
 		"loginError": message,
 	})
@@ -117,7 +176,7 @@ func (app *application) renderLoginError(w http.ResponseWriter,
 func (app *application) renderSignupError(w http.ResponseWriter,
 	r *http.Request, email, name, message string) {
 
-	app.render(w, r, "home.page.tmpl", map[string]string{
+	app.renderHome(w, r, map[string]interface{}{
 		"signupEmail": email,
 		"signupName":  name,
 		"signupError": message,
@@ -145,8 +204,8 @@ func (app *application) userInfo(w http.ResponseWriter, r *http.Request) {
 	// Get 10 most recent jobs the user printed
 	joblog, err := app.db.GetUserJobLog(u.Email, 10)
 	if err != nil {
-		log.Printf("ERROR: db error getting user joblog for %s: %v",
-			u.Email, err)
+		requestLog(r).With("user", u.Email).Errorf(
+			"db error getting user joblog: %v", err)
 		// We'll allow the page to render, it'll just have an empty job log
 	}
 	app.addPDFShareKeys(joblog)
@@ -155,8 +214,8 @@ func (app *application) userInfo(w http.ResponseWriter, r *http.Request) {
 	jobCount, pageCount, quotaErr := app.checkQuota(u.Email)
 	if !(quotaErr == nil || quotaErr == errQuotaExceeded) {
 		// database error checking quota... we'll set error back to nil for UI
-		log.Printf("ERROR: db error in quota check for %s: %v",
-			u.Email, quotaErr)
+		requestLog(r).With("user", u.Email).Errorf(
+			"db error in quota check: %v", quotaErr)
 		quotaErr = nil
 	}
 
@@ -170,7 +229,12 @@ func (app *application) userInfo(w http.ResponseWriter, r *http.Request) {
 		"verified":            u.Verified,
 		"name":                u.FullName,
 		"email":               u.Email,
-		"apiKey":              u.AccessKey,
+		"apiKeys":             u.APIKeys,
+		"newAPIKey":           app.session.Get(r, "newAPIKey"),
+		"scopes":              model.Scopes,
+		"apiKeyExpiries":      apiKeyExpiries,
+		"apiKeyError":         app.session.Get(r, "apiKeyError"),
+		"apiKeySuccess":       app.session.Get(r, "apiKeySuccess"),
 		"apiEndpoint":         app.serverBaseURL + "/print",
 		"pageCount":           u.PageCount,
 		"jobCount":            u.JobCount,
@@ -187,7 +251,26 @@ func (app *application) userInfo(w http.ResponseWriter, r *http.Request) {
 		"pdfRetention":        app.pdfCleanupDays,
 		"emailDisabled":       u.DisableEmailDelivery,
 		"nuisanceFilter":      !u.AllowNuisanceJobs,
+		"separatorPages":      separatorMode(u),
+		"separatorChoices":    separatorChoices,
+		"profileRules":        vprinter.FormatProfileRules(u.ProfileRules),
+		"profileRulesError":   app.session.Get(r, "profileRulesError"),
+		"profileRulesSuccess": app.session.Get(r, "profileRulesSuccess"),
+		"printFileError":      app.session.Get(r, "printFileError"),
+		"printFileSuccess":    app.session.Get(r, "printFileSuccess"),
+		"profiles":            vprinter.ProfileNames,
+		"defaultProfile":      u.DefaultProfile,
+		"overrideProfile":     u.OverrideProfile,
+		"allowedProfiles":     allowedProfileSet(u.AllowedProfiles),
+		"filenameTemplate":    u.FilenameTemplate,
+		"subjectTemplate":     u.SubjectTemplate,
+		"templateFields":      templateFields,
+		"userNuisanceJobs":    strings.Join(u.NuisanceJobNames, "\n"),
+		"preferencesError":    app.session.Get(r, "preferencesError"),
+		"preferencesSuccess":  app.session.Get(r, "preferencesSuccess"),
 		"serverAdminContact":  app.adminEmail,
+		"twoFactor":           u.TwoFactorEnabled(),
+		"admin2FARequired":    app.adminNeeds2FA(u),
 	}
 
 	if responseValues["passwordError"] != nil {
@@ -205,6 +288,33 @@ func (app *application) userInfo(w http.ResponseWriter, r *http.Request) {
 	if responseValues["verifyResendSuccess"] != nil {
 		app.session.Remove(r, "verifyResendSuccess")
 	}
+	if responseValues["profileRulesError"] != nil {
+		app.session.Remove(r, "profileRulesError")
+	}
+	if responseValues["profileRulesSuccess"] != nil {
+		app.session.Remove(r, "profileRulesSuccess")
+	}
+	if responseValues["printFileError"] != nil {
+		app.session.Remove(r, "printFileError")
+	}
+	if responseValues["printFileSuccess"] != nil {
+		app.session.Remove(r, "printFileSuccess")
+	}
+	if responseValues["newAPIKey"] != nil {
+		app.session.Remove(r, "newAPIKey")
+	}
+	if responseValues["apiKeyError"] != nil {
+		app.session.Remove(r, "apiKeyError")
+	}
+	if responseValues["apiKeySuccess"] != nil {
+		app.session.Remove(r, "apiKeySuccess")
+	}
+	if responseValues["preferencesError"] != nil {
+		app.session.Remove(r, "preferencesError")
+	}
+	if responseValues["preferencesSuccess"] != nil {
+		app.session.Remove(r, "preferencesSuccess")
+	}
 
 	app.render(w, r, "user.page.tmpl", responseValues)
 }
@@ -223,8 +333,8 @@ func (app *application) userJobs(w http.ResponseWriter, r *http.Request) {
 	// Get 100 most recent jobs the user printed
 	joblog, err := app.db.GetUserJobLog(u.Email, 100)
 	if err != nil {
-		log.Printf("ERROR: db error getting user joblog for %s: %v",
-			u.Email, err)
+		requestLog(r).With("user", u.Email).Errorf(
+			"db error getting user joblog: %v", err)
 		// We'll allow the page to render, it'll just have an empty job log
 	}
 	app.addPDFShareKeys(joblog)
@@ -238,37 +348,6 @@ func (app *application) userJobs(w http.ResponseWriter, r *http.Request) {
 	app.render(w, r, "userjoblist.page.tmpl", responseValues)
 }
 
-// POST hander to regenerate a user's access key
-func (app *application) regenkey(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		// Don't accept anything other than a POST
-		http.Redirect(w, r, "user", http.StatusSeeOther)
-		return
-	}
-
-	// Verify we have a logged in, valid user
-	u := app.checkLoggedInUser(r)
-	if u == nil {
-		// No logged in user
-		app.session.Destroy(r)
-		http.Redirect(w, r, "/", http.StatusSeeOther)
-		return
-	}
-
-	// All checks passed... regenerate the key
-	u.GenerateAccessKey()
-	err := app.db.SaveUser(*u)
-	if err != nil {
-		log.Printf("ERROR couldn't save user `%s` in DB: %v", u.Email,
-			err)
-		app.serverError(w, "Sorry, a database error has occurred")
-		return
-	}
-
-	log.Printf("INFO  %s generated a new access key", u.Email)
-	http.Redirect(w, r, "user", http.StatusSeeOther)
-}
-
 // adminListUsers provides logged-in administrators with a list of all users in the
 // database.
 func (app *application) adminListUsers(w http.ResponseWriter, r *http.Request) {
@@ -286,6 +365,9 @@ func (app *application) adminListUsers(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "This page is only available to administrators.")
 		return
 	}
+	if !app.checkAdmin2FA(w, r, u) {
+		return
+	}
 
 	users, err := app.db.GetUsers()
 	if err != nil {
@@ -298,7 +380,7 @@ func (app *application) adminListUsers(w http.ResponseWriter, r *http.Request) {
 		"users":   users,
 	}
 
-	log.Printf("INFO  %s accessed the users list page", u.Email)
+	requestLog(r).With("user", u.Email).Infof("accessed the users list page")
 
 	app.render(w, r, "users.page.tmpl", responseValues)
 }
@@ -320,6 +402,9 @@ func (app *application) adminListJobs(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "This page is only available to administrators.")
 		return
 	}
+	if !app.checkAdmin2FA(w, r, u) {
+		return
+	}
 
 	jobs, err := app.db.GetJobLog(100)
 	if err != nil {
@@ -332,7 +417,7 @@ func (app *application) adminListJobs(w http.ResponseWriter, r *http.Request) {
 		"jobs":    jobs,
 	}
 
-	log.Printf("INFO  %s accessed the job log page", u.Email)
+	requestLog(r).With("user", u.Email).Infof("accessed the job log page")
 
 	app.render(w, r, "jobs.page.tmpl", responseValues)
 }
@@ -353,6 +438,9 @@ func (app *application) adminEditUser(w http.ResponseWriter, r *http.Request) {
 		io.WriteString(w, "This page is only available to administrators.")
 		return
 	}
+	if !app.checkAdmin2FA(w, r, u) {
+		return
+	}
 
 	// User to edit is email address in query param 'email'
 	email := r.URL.Query().Get("email")
@@ -368,7 +456,7 @@ func (app *application) adminEditUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err != nil {
-		log.Printf("ERROR: error getting user: %v", err)
+		requestLog(r).Errorf("error getting user: %v", err)
 		http.Error(w, "DB error getting user record",
 			http.StatusInternalServerError)
 		return
@@ -377,8 +465,8 @@ func (app *application) adminEditUser(w http.ResponseWriter, r *http.Request) {
 	// Get 100 most recent jobs the user printed
 	joblog, err := app.db.GetUserJobLog(user.Email, 100)
 	if err != nil {
-		log.Printf("ERR  db error getting user joblog for %s: %v",
-			user.Email, err)
+		requestLog(r).With("user", user.Email).Errorf(
+			"db error getting user joblog: %v", err)
 		// We'll allow the page to render, it'll just have an empty job log
 	}
 
@@ -396,9 +484,12 @@ func (app *application) adminEditUser(w http.ResponseWriter, r *http.Request) {
 		"signupDate":           user.SignupDate,
 		"disableEmailDelivery": user.DisableEmailDelivery,
 		"nuisanceFilter":       !u.AllowNuisanceJobs,
+		"separatorPages":       separatorMode(&user),
+		"separatorChoices":     separatorChoices,
+		"twoFactor":            user.TwoFactorEnabled(),
 	}
 
-	log.Printf("INFO  %s accessed user %s", u.Email, user.Email)
+	requestLog(r).With("user", u.Email).Infof("accessed user %s", user.Email)
 
 	app.render(w, r, "useredit.page.tmpl", responseValues)
 }
@@ -428,9 +519,12 @@ func (app *application) adminEditUserPost(w http.ResponseWriter,
 		io.WriteString(w, "This page is only available to administrators.")
 		return
 	}
+	if !app.checkAdmin2FA(w, r, u) {
+		return
+	}
 
 	if err := r.ParseForm(); err != nil {
-		log.Printf("ERROR: couldn't parse update user form: %v", err)
+		requestLog(r).Errorf("couldn't parse update user form: %v", err)
 		http.Error(w, "couldn't parse update form", http.StatusInternalServerError)
 		return
 	}
@@ -443,7 +537,7 @@ func (app *application) adminEditUserPost(w http.ResponseWriter,
 		return
 	}
 	if err != nil {
-		log.Printf("ERROR: error getting user: %v", err)
+		requestLog(r).Errorf("error getting user: %v", err)
 		http.Error(w, "DB error getting user record",
 			http.StatusInternalServerError)
 		return
@@ -454,6 +548,7 @@ func (app *application) adminEditUserPost(w http.ResponseWriter,
 	active := r.Form.Get("active")
 	deliverEmail := r.Form.Get("emailDelivery")
 	nuisanceFilter := r.Form.Get("nuisanceFilter")
+	separators := r.Form.Get("separators")
 	unlimited := r.Form.Get("unlimited")
 	admin := r.Form.Get("admin")
 
@@ -483,6 +578,10 @@ func (app *application) adminEditUserPost(w http.ResponseWriter,
 		user.AllowNuisanceJobs = true
 	}
 
+	if mode, err := vprinter.ParseSeparatorMode(separators); err == nil {
+		user.SeparatorPages = string(mode)
+	}
+
 	if unlimited == "yes" {
 		user.Unlimited = true
 	} else {
@@ -496,12 +595,12 @@ func (app *application) adminEditUserPost(w http.ResponseWriter,
 	}
 
 	if err := app.db.SaveUser(user); err != nil {
-		log.Printf("ERROR: saving user %s: %v", user.Email, err)
+		requestLog(r).Errorf("saving user %s: %v", user.Email, err)
 		http.Error(w, "DB error saving user", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("INFO:  %s updated user %s", u.Email, user.Email)
+	requestLog(r).With("user", u.Email).Infof("updated user %s", user.Email)
 
 	http.Redirect(w, r, "users", http.StatusSeeOther)
 }
@@ -530,6 +629,9 @@ func (app *application) adminDeleteUser(w http.ResponseWriter,
 		io.WriteString(w, "This action is only available to administrators.")
 		return
 	}
+	if !app.checkAdmin2FA(w, r, u) {
+		return
+	}
 
 	r.ParseForm()
 	email := r.Form.Get("email")
@@ -547,7 +649,8 @@ func (app *application) adminDeleteUser(w http.ResponseWriter,
 		app.serverError(w, err.Error())
 		return
 	}
-	log.Printf("INFO:  %s deleted user %s", u.Email, userToDelete.Email)
+	requestLog(r).With("user", u.Email).Infof(
+		"deleted user %s", userToDelete.Email)
 
 	http.Redirect(w, r, "users", http.StatusSeeOther)
 }
@@ -572,6 +675,13 @@ func (app *application) signup(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if app.sso != nil && app.sso.Config().SSOOnlySignup {
+		app.renderSignupError(w, r, email, name, "New accounts can only "+
+			"be created by signing in with "+app.sso.Config().DisplayName+
+			".")
+		return
+	}
+
 	if !mailer.ValidateAddress(strings.ToLower(email)) {
 		app.renderSignupError(w, r, email, name,
 			"Must provide a valid email address.")
@@ -608,7 +718,8 @@ func (app *application) signup(w http.ResponseWriter, r *http.Request) {
 	newuser.LastVerificationEmail = time.Now()
 
 	if err := app.db.SaveUser(newuser); err != nil {
-		log.Printf("ERROR couldn't save new user %s to DB: %v", email, err)
+		requestLog(r).With("user", email).Errorf(
+			"couldn't save new user to DB: %v", err)
 		app.serverError(w, "Unexpected error saving new user to database.")
 		return
 	}
@@ -617,9 +728,9 @@ func (app *application) signup(w http.ResponseWriter, r *http.Request) {
 
 	if err := mailer.SendVerificationCode(app.mailconfig, newuser.Email,
 		app.serverBaseURL+"/verify?token="+
-			url.QueryEscape(newuser.AccessKey)); err != nil {
-		log.Printf("ERROR couldn't send verification email for %s: %v",
-			newuser.Email, err)
+			url.QueryEscape(newuser.VerificationToken)); err != nil {
+		requestLog(r).With("user", newuser.Email).Errorf(
+			"couldn't send verification email: %v", err)
 	}
 
 	http.Redirect(w, r, "user", http.StatusSeeOther)
@@ -648,9 +759,8 @@ func (app *application) resendVerification(w http.ResponseWriter,
 
 	if u.Verified {
 		// User is already verified. Just send them back to user page.
-		log.Printf(
-			"INFO  %s tried to send verification email but is already verified",
-			u.Email)
+		requestLog(r).With("user", u.Email).Infof(
+			"tried to send verification email but is already verified")
 		http.Redirect(w, r, "/user", http.StatusSeeOther)
 		return
 	}
@@ -661,27 +771,29 @@ func (app *application) resendVerification(w http.ResponseWriter,
 			"verification email within the last hour. Please wait for the "+
 			"email to arrive, or request the email again after an hour "+
 			"has passed.")
-		log.Printf(
-			"INFO  %s tried to request another verification email too quickly",
-			u.Email)
+		requestLog(r).With("user", u.Email).Infof(
+			"tried to request another verification email too quickly")
 		http.Redirect(w, r, "/user", http.StatusSeeOther)
 		return
 	}
 
 	// Update the user's last verification send time
 	u.LastVerificationEmail = time.Now()
+	if u.VerificationToken == "" {
+		u.GenerateVerificationToken()
+	}
 	if err := app.db.SaveUser(*u); err != nil {
-		log.Printf("ERROR couldn't save updated user %s to DB: %v",
-			u.Email, err)
+		requestLog(r).With("user", u.Email).Errorf(
+			"couldn't save updated user to DB: %v", err)
 		app.serverError(w, "Unexpected error saving user update to database.")
 		return
 	}
 
 	if err := mailer.SendVerificationCode(app.mailconfig, u.Email,
 		app.serverBaseURL+"/verify?token="+
-			url.QueryEscape(u.AccessKey)); err != nil {
-		log.Printf("ERROR couldn't send verification email for %s: %v",
-			u.Email, err)
+			url.QueryEscape(u.VerificationToken)); err != nil {
+		requestLog(r).With("user", u.Email).Errorf(
+			"couldn't send verification email: %v", err)
 		app.session.Put(r, "verifyResendError",
 			"Error sending verification email.")
 	} else {
@@ -715,7 +827,8 @@ func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
 		// Users existing password does not match
 		app.session.Put(r, "passwordError",
 			"Your current password was incorrect.")
-		log.Printf("INFO  %s unsuccessfully attempted password change", u.Email)
+		requestLog(r).With("user", u.Email).Infof(
+			"unsuccessfully attempted password change")
 		http.Redirect(w, r, "user", http.StatusSeeOther)
 		return
 	}
@@ -726,7 +839,8 @@ func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
 	if len(newPassword) < 8 {
 		app.session.Put(r, "passwordError",
 			"Your new password must be 8 or more characters long.")
-		log.Printf("INFO  %s unsuccessfully attempted password change", u.Email)
+		requestLog(r).With("user", u.Email).Infof(
+			"unsuccessfully attempted password change")
 		http.Redirect(w, r, "user", http.StatusSeeOther)
 		return
 	}
@@ -734,7 +848,8 @@ func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
 	if newPassword != newPassword2 {
 		app.session.Put(r, "passwordError",
 			"New passwords do not match.")
-		log.Printf("INFO  %s unsuccessfully attempted password change", u.Email)
+		requestLog(r).With("user", u.Email).Infof(
+			"unsuccessfully attempted password change")
 		http.Redirect(w, r, "user", http.StatusSeeOther)
 		return
 	}
@@ -747,15 +862,16 @@ func (app *application) changePassword(w http.ResponseWriter, r *http.Request) {
 
 	app.session.Put(r, "passwordSuccess",
 		"Your password was successfully changed.")
-	log.Printf("INFO  %s successfully changed their password", u.Email)
+	requestLog(r).With("user", u.Email).Infof(
+		"successfully changed their password")
 	http.Redirect(w, r, "user", http.StatusSeeOther)
 }
 
 // verifyUser is the HTTP hander for /verify; we expect /verify?token=... to
 // verify a user after sending them the email verification link. If the
 // verification token belongs to an unverified account, we will set the
-// account to verified and generate a new token (which will be used as their
-// print API access token going forward).
+// account to verified, use up the token, and give them their first API key
+// if they don't have one.
 func (app *application) verifyUser(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
 	if token == "" {
@@ -763,7 +879,7 @@ func (app *application) verifyUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	u, err := app.db.GetUserForAccessKey(token)
+	u, err := app.db.GetUserForVerificationToken(token)
 	if err == db.ErrNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		io.WriteString(w, "That token was not found or has already been "+
@@ -782,7 +898,11 @@ func (app *application) verifyUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	u.Verified = true
-	u.GenerateAccessKey()
+	u.VerificationToken = ""
+	var secret string
+	if len(u.APIKeys) == 0 {
+		_, secret = u.AddAPIKey("Default", model.Scopes, time.Time{}, "")
+	}
 
 	if err := app.db.SaveUser(u); err != nil {
 		app.serverError(w, "Error saving user record after verification")
@@ -790,7 +910,10 @@ func (app *application) verifyUser(w http.ResponseWriter, r *http.Request) {
 	}
 
 	app.session.Put(r, "verifySuccess", "Email address successfully verified.")
-	log.Printf("INFO  %s verified their account", u.Email)
+	if secret != "" {
+		app.session.Put(r, "newAPIKey", secret)
+	}
+	requestLog(r).With("user", u.Email).Infof("verified their account")
 	http.Redirect(w, r, "user", http.StatusSeeOther)
 }
 
@@ -807,22 +930,20 @@ func (app *application) checkLoggedInUser(r *http.Request) *model.User {
 
 	user, err := app.db.GetUser(username)
 	if err == db.ErrNotFound {
-		log.Printf(
-			"INFO  user `%s` has a session cookie but the account no "+
-				"longer exists",
-			username)
+		requestLog(r).With("user", username).Infof(
+			"user has a session cookie but the account no " +
+				"longer exists")
 		return nil
 	}
 	if err != nil {
-		log.Printf("ERROR couldn't look up user `%s` in DB: %v", username,
-			err)
+		requestLog(r).With("user", username).Errorf(
+			"couldn't look up user in DB: %v", err)
 		return nil
 	}
 
 	if !user.Enabled {
-		log.Printf(
-			"INFO  user `%s` has a session cookie but the account is disabled",
-			username)
+		requestLog(r).With("user", username).Infof(
+			"user has a session cookie but the account is disabled")
 		return nil
 	}
 
@@ -860,7 +981,7 @@ func (app *application) pdf(w http.ResponseWriter, r *http.Request) {
 		// Invalid message...which shouldn't be possible since we already
 		// verified the signature and our code should only have created
 		// correct messages in the first place.
-		log.Printf("ERROR: valid signature on invalid message: %s", keyStr)
+		requestLog(r).Errorf("valid signature on invalid message: %s", keyStr)
 		http.Error(w, "PDF for job no longer available", http.StatusNotFound)
 		return
 	}
@@ -886,18 +1007,19 @@ func (app *application) pdf(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO:  Retrieved PDF for job %d", id)
+	requestLog(r).Infof("Retrieved PDF for job %d", id)
 
-	jobtag := job.JobInfo
-	if jobtag != "" {
-		jobtag = jobtag + "-"
+	// The PDF is named with the user's filename template. If the user
+	// can't be found, the PDF gets the usual name.
+	user, err := app.db.GetUser(job.Email)
+	if err != nil {
+		requestLog(r).Warnf("couldn't get user for PDF name: %v", err)
 	}
-	jobname := fmt.Sprintf("%s%s", jobtag,
-		job.Time.UTC().Format("2006-01-02T150405Z"))
+	filename := pdfFileName(user, job, "2006-01-02T150405Z")
 
 	w.Header().Add("Content-Type", "application/pdf")
 	w.Header().Add("Content-Disposition",
-		fmt.Sprintf("inline; filename=\"virtual1403_%s.pdf\"", jobname))
+		fmt.Sprintf("inline; filename=\"%s\"", filename))
 	w.Header().Add("Content-Length", strconv.Itoa(len(pdf)))
 	w.WriteHeader(http.StatusOK)
 	w.Write(pdf)
@@ -935,8 +1057,8 @@ func (app *application) changeDelivery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO:  User %s changed email delivery preference: %s", u.Email,
-		action)
+	requestLog(r).With("user", u.Email).Infof(
+		"changed email delivery preference: %s", action)
 	http.Redirect(w, r, "user", http.StatusSeeOther)
 }
 
@@ -972,8 +1094,8 @@ func (app *application) changeNuisance(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("INFO:  User %s changed nuisance job preference: %s", u.Email,
-		action)
+	requestLog(r).With("user", u.Email).Infof(
+		"changed nuisance job preference: %s", action)
 	http.Redirect(w, r, "user", http.StatusSeeOther)
 }
 
@@ -983,14 +1105,20 @@ func (app *application) addPDFShareKeys(jobs []model.JobLogEntry) {
 			continue
 		}
 
-		// Encode the ID and sign it
-		logID := uint64ToBytesBE(jobs[i].ID)
-		sig := auth.Sum(logID, app.shareKey)
-		logID = append(logID, sig[:]...)
-		jobs[i].ShareKey = hex.EncodeToString(logID)
+		jobs[i].ShareKey = app.pdfShareKey(jobs[i].ID)
 	}
 }
 
+// pdfShareKey returns the signed key for the /pdf link to the job log entry
+// id's PDF.
+func (app *application) pdfShareKey(id uint64) string {
+	// Encode the ID and sign it
+	logID := uint64ToBytesBE(id)
+	sig := auth.Sum(logID, app.shareKey)
+	logID = append(logID, sig[:]...)
+	return hex.EncodeToString(logID)
+}
+
 func uint64ToBytesBE(in uint64) []byte {
 	var buf bytes.Buffer
 	binary.Write(&buf, binary.BigEndian, &in)
@@ -1003,3 +1131,236 @@ func bytesToUint64BE(in []byte) (uint64, error) {
 	err := binary.Read(inrdr, binary.BigEndian, &out)
 	return out, err
 }
+
+func (app *application) changeSeparators(w http.ResponseWriter,
+	r *http.Request) {
+
+	// Verify we have a logged in, valid user
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode, err := vprinter.ParseSeparatorMode(r.FormValue("separators"))
+	if err != nil {
+		http.Error(w, "Unknown separator page choice", http.StatusBadRequest)
+		return
+	}
+	u.SeparatorPages = string(mode)
+
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	requestLog(r).With("user", u.Email).Infof(
+		"changed separator page preference: %s", mode)
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
+
+func (app *application) changeProfileRules(w http.ResponseWriter,
+	r *http.Request) {
+
+	// Verify we have a logged in, valid user
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rules, err := vprinter.ParseProfileRules(r.FormValue("rules"))
+	if err != nil {
+		app.session.Put(r, "profileRulesError",
+			fmt.Sprintf("Profile rules not saved: %v", err))
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+		return
+	}
+	u.ProfileRules = rules
+
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	requestLog(r).With("user", u.Email).Infof(
+		"changed profile rules: %d rules", len(rules))
+	app.session.Put(r, "profileRulesSuccess", "Profile rules saved.")
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
+
+// printFile prints a text file the user uploads from the browser, for
+// one-off jobs without setting up the agent.
+func (app *application) printFile(w http.ResponseWriter, r *http.Request) {
+	// Verify we have a logged in, valid user
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !u.Enabled || !u.Verified {
+		app.session.Put(r, "printFileError",
+			"Your account must be enabled and verified to print.")
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+		return
+	}
+
+	log := requestLog(r).With("user", u.Email)
+
+	limit := jobSizeLimit(*u)
+	r.Body = http.MaxBytesReader(w, r.Body, limit+1024*1024)
+	f, header, err := r.FormFile("file")
+	if err != nil {
+		log.Infof("no file in print file upload: %v", err)
+		app.session.Put(r, "printFileError",
+			"Please choose a text file of no more than "+
+				strconv.FormatInt(limit/1024/1024, 10)+" MB to print.")
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+		return
+	}
+	defer f.Close()
+
+	text, err := readTextJob(f, "", limit)
+	if err == errTextJobTooLarge {
+		app.session.Put(r, "printFileError", "The file is too large.")
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	asa := r.FormValue("carriage") == "asa"
+	job, err := convertTextJob(text, asa, textJobName(header.Filename))
+	if err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	result, _, jobErr := app.queueJob(log, *u, bytes.NewReader(job),
+		r.FormValue("profile"), "")
+	if jobErr != nil {
+		app.session.Put(r, "printFileError", fmt.Sprintf(
+			"%s was not printed: %s", header.Filename, jobErr.message))
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+		return
+	}
+
+	var message string
+	switch result.Delivery {
+	case deliveryIgnored:
+		message = fmt.Sprintf("%s was ignored as a nuisance job.",
+			header.Filename)
+	case deliveryFailed:
+		message = fmt.Sprintf("%s could not be printed: %s",
+			header.Filename, result.Error)
+	case deliveryPending:
+		message = fmt.Sprintf("%s is in the print queue.", header.Filename)
+	default:
+		message = fmt.Sprintf("%s was printed (%d page", header.Filename,
+			result.Pages)
+		if result.Pages != 1 {
+			message += "s"
+		}
+		message += ")."
+	}
+	if result.Delivery == deliveryFailed {
+		app.session.Put(r, "printFileError", message)
+	} else {
+		app.session.Put(r, "printFileSuccess", message)
+	}
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
+
+// changePreferences saves the user's profile, delivery and nuisance job
+// preferences.
+func (app *application) changePreferences(w http.ResponseWriter,
+	r *http.Request) {
+
+	// Verify we have a logged in, valid user
+	u := app.checkLoggedInUser(r)
+	if u == nil {
+		// No logged in user
+		app.session.Destroy(r)
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		http.Error(w, "Only POST is allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "couldn't parse preferences form",
+			http.StatusBadRequest)
+		return
+	}
+
+	fail := func(format string, args ...interface{}) {
+		app.session.Put(r, "preferencesError", "Preferences not saved: "+
+			fmt.Sprintf(format, args...))
+		http.Redirect(w, r, "user", http.StatusSeeOther)
+	}
+
+	override := r.PostForm.Get("override") == "on"
+	defaultProfile, allowed, err := validateProfilePreferences(
+		r.PostForm.Get("defaultProfile"), override,
+		r.PostForm["allowedProfiles"])
+	if err != nil {
+		fail("%v", err)
+		return
+	}
+	filenameTemplate := strings.TrimSpace(r.PostForm.Get("filename"))
+	if err := validateTemplate(filenameTemplate); err != nil {
+		fail("PDF file name %v", err)
+		return
+	}
+	subjectTemplate := strings.TrimSpace(r.PostForm.Get("subject"))
+	if err := validateTemplate(subjectTemplate); err != nil {
+		fail("email subject %v", err)
+		return
+	}
+	nuisanceJobs, err := parseNuisanceJobs(r.PostForm.Get("nuisance"))
+	if err != nil {
+		fail("nuisance jobs: %v", err)
+		return
+	}
+
+	u.DefaultProfile = defaultProfile
+	u.OverrideProfile = override
+	u.AllowedProfiles = allowed
+	u.FilenameTemplate = filenameTemplate
+	u.SubjectTemplate = subjectTemplate
+	u.NuisanceJobNames = nuisanceJobs
+
+	if err := app.db.SaveUser(*u); err != nil {
+		app.serverError(w, err.Error())
+		return
+	}
+
+	requestLog(r).With("user", u.Email).Infof("changed preferences")
+	app.session.Put(r, "preferencesSuccess", "Preferences saved.")
+	http.Redirect(w, r, "user", http.StatusSeeOther)
+}
@@ -0,0 +1,413 @@
+package main
+
+// Copyright 2021 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+// maxUploadBytes is the most compressed print job data we accept in an
+// upload session from users who aren't unlimited. max_lines_per_job is
+// checked as usual when the job is committed; this just keeps users from
+// filling the upload directory.
+const maxUploadBytes = 64 * 1024 * 1024
+
+// maxUnlimitedJobBytes is the most print job data we accept in one job from
+// unlimited users. Queued jobs are kept whole in the database until they're
+// printed, so even trusted users need some limit.
+const maxUnlimitedJobBytes = 512 * 1024 * 1024
+
+// jobSizeLimit returns the most print job data user may send in one job.
+func jobSizeLimit(user model.User) int64 {
+	if user.Unlimited {
+		return maxUnlimitedJobBytes
+	}
+	return maxUploadBytes
+}
+
+// maxUploadSessions is how many upload sessions a user who isn't unlimited
+// may have open at once.
+const maxUploadSessions = 10
+
+// uploadIdleTimeout is how long an upload session may go without a request
+// before we delete it.
+const uploadIdleTimeout = time.Hour
+
+var (
+	errUploadNotFound = errors.New("upload session not found")
+	errUploadBusy     = errors.New("upload session is in use")
+	errUploadLimit    = errors.New("too many upload sessions")
+)
+
+// uploadFileRegexp matches the names of the session files in the upload
+// directory, which are the session IDs.
+var uploadFileRegexp = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// uploadSession is a print job that a client is uploading in chunks. The
+// compressed print directives are appended to a file in the upload
+// directory as they arrive.
+type uploadSession struct {
+	id       string
+	email    string
+	path     string
+	size     int64
+	lastUsed time.Time
+	busy     bool
+}
+
+// uploadStore keeps track of the upload sessions in progress. Sessions only
+// live in memory; after a server restart clients have to start their job
+// over.
+type uploadStore struct {
+	dir      string
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+// newUploadStore returns an upload store that keeps the uploaded data in
+// dir. Session files left in dir from a previous run of the server are
+// deleted; nothing else in dir is touched.
+func newUploadStore(dir string) (*uploadStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.Type().IsRegular() &&
+			uploadFileRegexp.MatchString(entry.Name()) {
+			if err := os.Remove(filepath.Join(dir,
+				entry.Name())); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &uploadStore{
+		dir:      dir,
+		sessions: make(map[string]*uploadSession),
+	}, nil
+}
+
+// begin starts a new, empty upload session for the user with email. If
+// limited, the user may only have maxUploadSessions sessions at once.
+func (s *uploadStore) begin(email string, limited bool) (*uploadSession,
+	error) {
+
+	if limited && s.count(email) >= maxUploadSessions {
+		return nil, errUploadLimit
+	}
+
+	idbytes := make([]byte, 16)
+	if _, err := rand.Read(idbytes); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(idbytes)
+
+	path := filepath.Join(s.dir, id)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	sess := &uploadSession{
+		id:       id,
+		email:    email,
+		path:     path,
+		lastUsed: time.Now(),
+	}
+	s.mu.Lock()
+	s.sessions[id] = sess
+	s.mu.Unlock()
+	return sess, nil
+}
+
+// count returns the number of upload sessions the user with email has.
+func (s *uploadStore) count(email string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	count := 0
+	for _, sess := range s.sessions {
+		if sess.email == email {
+			count++
+		}
+	}
+	return count
+}
+
+// acquire returns the user's upload session with the ID id, which the caller
+// has to give back with release or remove when it's done with it. Only one
+// request may use a session at a time.
+func (s *uploadStore) acquire(id, email string) (*uploadSession, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[id]
+	// Other users' sessions don't exist as far as this user is concerned.
+	if !ok || sess.email != email {
+		return nil, errUploadNotFound
+	}
+	if sess.busy {
+		return nil, errUploadBusy
+	}
+	sess.busy = true
+	sess.lastUsed = time.Now()
+	return sess, nil
+}
+
+// release gives back a session from acquire.
+func (s *uploadStore) release(sess *uploadSession) {
+	s.mu.Lock()
+	sess.busy = false
+	sess.lastUsed = time.Now()
+	s.mu.Unlock()
+}
+
+// remove deletes a session from acquire, along with its data.
+func (s *uploadStore) remove(sess *uploadSession) {
+	s.mu.Lock()
+	delete(s.sessions, sess.id)
+	s.mu.Unlock()
+	os.Remove(sess.path)
+}
+
+// expire deletes the sessions that haven't been used since cutoff, and
+// returns how many there were.
+func (s *uploadStore) expire(cutoff time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for id, sess := range s.sessions {
+		if sess.busy || sess.lastUsed.After(cutoff) {
+			continue
+		}
+		delete(s.sessions, id)
+		os.Remove(sess.path)
+		count++
+	}
+	return count
+}
+
+// uploadjob is the handler for chunked print job uploads, for clients that
+// would rather not hold an entire job in memory and send it in a single
+// request to /print. The data is the same zstd-compressed print directives
+// as /print, split into chunks at any byte. Every request must be
+// authenticated with the user's API key like /print.
+//
+// POST /print/jobs begins an upload session. The Content-Type and
+// Content-Encoding headers must be the same as for /print, and the request
+// body is empty. It returns 201 Created with the session's URL in the
+// Location header and a JSON object with the session's id and offset (always
+// 0).
+//
+// PUT /print/jobs/<id> appends the request body to the job. The
+// Upload-Offset header must be the number of bytes uploaded so far. It
+// returns 204 No Content with the new offset in the Upload-Offset header,
+// 409 Conflict with the correct offset in Upload-Offset if the offset doesn't
+// match, or 413 Request Entity Too Large if the job is too big: more than 64
+// MB, or 512 MB for unlimited users. If the connection drops part way through
+// a chunk, the bytes that made it are kept.
+//
+// HEAD /print/jobs/<id> returns the number of bytes uploaded so far in the
+// Upload-Offset header. After a dropped connection, clients resume from this
+// offset.
+//
+// POST /print/jobs/<id>/commit prints the uploaded job. The profile parameter
+// and X-Print-Job-Info header are the same as for /print, as are the
+// responses. The session is finished whatever the outcome.
+//
+// DELETE /print/jobs/<id> abandons the upload.
+//
+// Users who aren't unlimited may have 10 upload sessions at once; beginning
+// another gets 429 Too Many Requests. Sessions that aren't used for an hour
+// are deleted. Requests for sessions that don't exist (or belong to another
+// user) get 404 Not Found, and requests for a session that another request
+// is using get 409 Conflict.
+func (a *application) uploadjob(w http.ResponseWriter, r *http.Request) {
+	user, ok := a.authenticatePrintRequest(w, r)
+	if !ok {
+		return
+	}
+	log := requestLog(r).With("user", user.Email)
+
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/print/jobs"), "/")
+	if rest == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			apiError(w, "Method Not Allowed",
+				http.StatusMethodNotAllowed)
+			return
+		}
+		a.beginUpload(w, r, user)
+		return
+	}
+
+	id := rest
+	commit := false
+	if strings.HasSuffix(rest, "/commit") {
+		id = strings.TrimSuffix(rest, "/commit")
+		commit = true
+	}
+
+	sess, err := a.uploads.acquire(id, user.Email)
+	if err == errUploadNotFound {
+		apiError(w, "Upload session not found", http.StatusNotFound)
+		return
+	} else if err != nil {
+		apiError(w, err.Error(), http.StatusConflict)
+		return
+	}
+	log = log.With("upload", sess.id)
+
+	switch {
+	case commit && r.Method == http.MethodPost:
+		// The session is finished no matter how printing the job goes;
+		// clients that want to try again start a new session.
+		defer a.uploads.remove(sess)
+		f, err := os.Open(sess.path)
+		if err != nil {
+			log.Errorf("couldn't open uploaded job: %v", err)
+			apiError(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		defer f.Close()
+		log.Infof("committing %d byte upload", sess.size)
+		a.processJob(w, r, user, f)
+	case commit:
+		a.uploads.release(sess)
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	case r.Method == http.MethodHead:
+		a.uploads.release(sess)
+		w.Header().Set("Upload-Offset", strconv.FormatInt(sess.size, 10))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		defer a.uploads.release(sess)
+		a.appendUpload(w, r, user, sess)
+	case r.Method == http.MethodDelete:
+		a.uploads.remove(sess)
+		log.Infof("upload abandoned")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		a.uploads.release(sess)
+		w.Header().Set("Allow", "HEAD, PUT, DELETE")
+		apiError(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// beginUpload starts a new upload session for user.
+func (a *application) beginUpload(w http.ResponseWriter, r *http.Request,
+	user model.User) {
+
+	if r.Header.Get("Content-Encoding") != "zstd" ||
+		r.Header.Get("Content-Type") != "text/x-print-job" {
+
+		w.Header().Set("Accept-Encoding", "zstd")
+		w.Header().Set("Accept", "text/x-print-job")
+		apiError(w, "Uploads must be of type text/x-print-job with zstd "+
+			"compression", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	sess, err := a.uploads.begin(user.Email, !user.Unlimited)
+	if err == errUploadLimit {
+		apiError(w, "Too many uploads in progress; finish or delete one "+
+			"first", http.StatusTooManyRequests)
+		return
+	} else if err != nil {
+		requestLog(r).Errorf("couldn't begin upload session: %v", err)
+		apiError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	requestLog(r).With("user", user.Email, "upload", sess.id).
+		Debugf("upload session started")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/print/jobs/"+sess.id)
+	w.Header().Set("Upload-Offset", "0")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		ID     string `json:"id"`
+		Offset int64  `json:"offset"`
+	}{sess.id, 0})
+}
+
+// appendUpload appends the request body to the upload session.
+func (a *application) appendUpload(w http.ResponseWriter, r *http.Request,
+	user model.User, sess *uploadSession) {
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		apiError(w, "Upload-Offset header is required",
+			http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(sess.size, 10))
+	if offset != sess.size {
+		apiError(w, fmt.Sprintf("Upload offset is %d", sess.size),
+			http.StatusConflict)
+		return
+	}
+
+	f, err := os.OpenFile(sess.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		requestLog(r).Errorf("couldn't open upload file: %v", err)
+		apiError(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	limit := jobSizeLimit(user)
+	n, err := io.Copy(f, io.LimitReader(r.Body, limit-sess.size+1))
+	if sess.size+n > limit {
+		f.Truncate(sess.size)
+		apiError(w, "Print job is too large",
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+	// Whatever we managed to write before any error is kept, so the client
+	// can resume after it.
+	sess.size += n
+	w.Header().Set("Upload-Offset", strconv.FormatInt(sess.size, 10))
+	if err != nil {
+		requestLog(r).With("user", user.Email, "upload", sess.id).
+			Infof("upload chunk interrupted after %d bytes: %v", n, err)
+		apiError(w, "Upload interrupted", http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,273 @@
+package main
+
+// Copyright 2022 Matthew R. Wilson <mwilson@mattwilson.org>
+//
+// This file is part of virtual1403
+// <https://github.com/racingmars/virtual1403>.
+//
+// virtual1403 is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// virtual1403 is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with virtual1403. If not, see <https://www.gnu.org/licenses/>.
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/racingmars/virtual1403/webserver/db"
+	"github.com/racingmars/virtual1403/webserver/model"
+)
+
+// newPrintTestApp returns an application with a database, print queue and
+// upload store in temporary directories, and the API key of a user who may
+// print. The user's jobs are stored rather than emailed.
+func newPrintTestApp(t *testing.T) (*application, string) {
+	dir := t.TempDir()
+	database, err := db.NewDB(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { database.Close() })
+
+	u := model.NewUser("printer@example.com", "password")
+	u.Verified = true
+	u.DisableEmailDelivery = true
+	_, key := u.AddAPIKey("Test", model.Scopes, time.Time{}, "")
+	if err := database.SaveUser(u); err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		db:       database,
+		seats:    newSeatPools(nil),
+		seatWait: time.Second,
+		jobWait:  10 * time.Second,
+		shareKey: new([db.ShareSecretKeyLength]byte),
+	}
+	app.mailconfig.Disable = true
+	if app.uploads, err = newUploadStore(filepath.Join(dir,
+		"uploads")); err != nil {
+		t.Fatal(err)
+	}
+	app.queue = newPrintQueue(app)
+	if err := app.queue.start(2); err != nil {
+		t.Fatal(err)
+	}
+	return app, key
+}
+
+// compressJob returns the zstd-compressed print directives.
+func compressJob(t *testing.T, directives string) []byte {
+	var buf bytes.Buffer
+	e, err := zstd.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Write([]byte(directives))
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// uploadRequest makes a request to the upload API, and returns the
+// response with its body read.
+func uploadRequest(t *testing.T, app *application, key, method, path string,
+	offset int, body []byte) (*http.Response, []byte) {
+
+	req := httptest.NewRequest(method, path, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+key)
+	req.Header.Set("Content-Type", "text/x-print-job")
+	req.Header.Set("Content-Encoding", "zstd")
+	if offset >= 0 {
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+	}
+	w := httptest.NewRecorder()
+	app.uploadjob(w, req)
+	return w.Result(), w.Body.Bytes()
+}
+
+func TestUploadStoreCleanup(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "0123456789abcdef0123456789abcdef")
+	other := filepath.Join(dir, "notes.txt")
+	for _, path := range []string{leftover, other} {
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := newUploadStore(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Errorf("leftover upload wasn't deleted: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("unrelated file was deleted: %v", err)
+	}
+}
+
+func TestUploadJob(t *testing.T) {
+	app, key := newPrintTestApp(t)
+	job := compressJob(t, "L:HELLO\nL:WORLD\nJ:J12_IBMUSERA\n")
+	half := len(job) / 2
+
+	resp, body := uploadRequest(t, app, key, http.MethodPost, "/print/jobs",
+		-1, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("begin got %d: %s", resp.StatusCode, body)
+	}
+	var session struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(body, &session); err != nil {
+		t.Fatal(err)
+	}
+	path := "/print/jobs/" + session.ID
+	if resp.Header.Get("Location") != path {
+		t.Errorf("got location %q", resp.Header.Get("Location"))
+	}
+
+	resp, body = uploadRequest(t, app, key, http.MethodPut, path, 0,
+		job[:half])
+	if resp.StatusCode != http.StatusNoContent ||
+		resp.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("first chunk got %d, offset %s: %s", resp.StatusCode,
+			resp.Header.Get("Upload-Offset"), body)
+	}
+
+	// A client that lost track of the upload gets the right offset back,
+	// and resumes from there.
+	resp, _ = uploadRequest(t, app, key, http.MethodPut, path, 0, job)
+	if resp.StatusCode != http.StatusConflict ||
+		resp.Header.Get("Upload-Offset") != strconv.Itoa(half) {
+		t.Fatalf("wrong offset got %d, offset %s", resp.StatusCode,
+			resp.Header.Get("Upload-Offset"))
+	}
+	resp, _ = uploadRequest(t, app, key, http.MethodHead, path, -1, nil)
+	offset, _ := strconv.Atoi(resp.Header.Get("Upload-Offset"))
+	if offset != half {
+		t.Fatalf("HEAD got offset %d, expected %d", offset, half)
+	}
+	resp, body = uploadRequest(t, app, key, http.MethodPut, path, offset,
+		job[offset:])
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("second chunk got %d: %s", resp.StatusCode, body)
+	}
+
+	resp, body = uploadRequest(t, app, key, http.MethodPost, path+"/commit",
+		-1, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("commit got %d: %s", resp.StatusCode, body)
+	}
+	var result printResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.State != string(model.JobDone) || result.Pages != 1 ||
+		result.Job != "J12_IBMUSERA" {
+		t.Errorf("got result %+v", result)
+	}
+
+	// The session is gone once it's committed.
+	resp, _ = uploadRequest(t, app, key, http.MethodHead, path, -1, nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("committed session got %d", resp.StatusCode)
+	}
+}
+
+func TestUploadLimits(t *testing.T) {
+	app, key := newPrintTestApp(t)
+
+	var paths []string
+	for i := 0; i < maxUploadSessions; i++ {
+		resp, body := uploadRequest(t, app, key, http.MethodPost,
+			"/print/jobs", -1, nil)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("begin got %d: %s", resp.StatusCode, body)
+		}
+		paths = append(paths, resp.Header.Get("Location"))
+	}
+	resp, _ := uploadRequest(t, app, key, http.MethodPost, "/print/jobs",
+		-1, nil)
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("session over the limit got %d", resp.StatusCode)
+	}
+
+	// Pretend the first session is nearly full, rather than uploading
+	// the whole thing.
+	sess, err := app.uploads.acquire(filepath.Base(paths[0]),
+		"printer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.size = maxUploadBytes - 10
+	app.uploads.release(sess)
+
+	resp, _ = uploadRequest(t, app, key, http.MethodPut, paths[0],
+		maxUploadBytes-10, make([]byte, 20))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized chunk got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Upload-Offset") != strconv.Itoa(maxUploadBytes-10) {
+		t.Errorf("oversized chunk moved the offset to %s",
+			resp.Header.Get("Upload-Offset"))
+	}
+
+	// Unlimited users may send larger jobs, but not without limit.
+	user, err := app.db.GetUser("printer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user.Unlimited = true
+	if err := app.db.SaveUser(user); err != nil {
+		t.Fatal(err)
+	}
+	resp, _ = uploadRequest(t, app, key, http.MethodPut, paths[0],
+		maxUploadBytes-10, make([]byte, 20))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("unlimited user's chunk got %d", resp.StatusCode)
+	}
+	sess, err = app.uploads.acquire(filepath.Base(paths[0]),
+		"printer@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess.size = maxUnlimitedJobBytes - 10
+	app.uploads.release(sess)
+	resp, _ = uploadRequest(t, app, key, http.MethodPut, paths[0],
+		maxUnlimitedJobBytes-10, make([]byte, 20))
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("unlimited user's oversized chunk got %d", resp.StatusCode)
+	}
+
+	// Deleting a session makes room for another.
+	resp, _ = uploadRequest(t, app, key, http.MethodDelete, paths[1], -1,
+		nil)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("delete got %d", resp.StatusCode)
+	}
+	resp, _ = uploadRequest(t, app, key, http.MethodPost, "/print/jobs",
+		-1, nil)
+	if resp.StatusCode != http.StatusCreated {
+		t.Errorf("session after delete got %d", resp.StatusCode)
+	}
+}